@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/critiqjo/cs733/assignment4/raft"
+	"github.com/steveyen/gkvlite"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+)
+
+// A backup (see SimplePster.Snapshot) is laid out as:
+//
+//	backupMagic
+//	u32 length + fields (length 0 if there are none)
+//	u64 count, and that many of: u32 length + key, u32 length + value (SetMeta)
+//	u64 count, and that many of: u32 length + entry (LogValEnc, uncompressed)
+//	u32 CRC32 (IEEE) of everything before it
+//
+// with the integers in big endian. Machine snapshots are not included; the
+// log is whole, so the machine can be rebuilt by executing it again.
+var backupMagic = []byte("FSBACKUP1")
+
+var errBadBackup = errors.New("Corrupted backup!")
+
+func backupPut(buf *bytes.Buffer, blob []byte) {
+	buf.Write(U32Enc(uint32(len(blob))))
+	buf.Write(blob)
+}
+
+// ---- quack like a BackupPersister {{{1
+func (self *SimplePster) Snapshot() ([]byte, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var buf bytes.Buffer
+	buf.Write(backupMagic)
+	fields, _ := self.rfields.Get([]byte{0})
+	backupPut(&buf, fields)
+
+	var meta [][]byte
+	self.rmeta.VisitItemsAscend([]byte{}, true, func(item *gkvlite.Item) bool {
+		meta = append(meta, item.Key, item.Val)
+		return true
+	})
+	buf.Write(U64Enc(uint64(len(meta) / 2)))
+	for _, blob := range meta {
+		backupPut(&buf, blob)
+	}
+
+	var blobs [][]byte
+	var err error
+	self.rlog.VisitItemsAscend(U64Enc(0), true, func(item *gkvlite.Item) bool {
+		if U64Dec(item.Key) != uint64(len(blobs)) { // sanity check
+			err = errors.New("Corrupted log!")
+			return false
+		}
+		blob := item.Val
+		if self.comp != nil { // a backup does not depend on the options
+			var entry *raft.RaftEntry
+			if entry, err = LogValDecEx(blob, self.comp); err == nil {
+				blob, err = LogValEnc(entry)
+			}
+		}
+		blobs = append(blobs, blob)
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(U64Enc(uint64(len(blobs))))
+	for _, blob := range blobs {
+		backupPut(&buf, blob)
+	}
+	buf.Write(U32Enc(crc32.ChecksumIEEE(buf.Bytes())))
+	return buf.Bytes(), nil
+}
+
+// Reads a backup, checking that it does not run short
+type backupReader struct {
+	data []byte
+	err  error
+}
+
+func (self *backupReader) next(n int) []byte {
+	if self.err != nil || len(self.data) < n {
+		self.err = errBadBackup
+		return nil
+	}
+	blob := self.data[:n]
+	self.data = self.data[n:]
+	return blob
+}
+
+func (self *backupReader) u32() uint32 {
+	if blob := self.next(4); blob != nil {
+		return U32Dec(blob)
+	}
+	return 0
+}
+
+func (self *backupReader) u64() uint64 {
+	if blob := self.next(8); blob != nil {
+		return U64Dec(blob)
+	}
+	return 0
+}
+
+func (self *backupReader) blob() []byte {
+	return self.next(int(self.u32()))
+}
+
+// Create a persister at dbpath (which should not have a log yet) from a
+// backup taken by SimplePster.Snapshot (say, through RaftNode.BackupLog)
+func RestoreBackup(dbpath string, r io.Reader, errlog *log.Logger) (*SimplePster, error) { // {{{1
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(backupMagic)+4 || !bytes.Equal(data[:len(backupMagic)], backupMagic) {
+		return nil, errBadBackup
+	}
+	crc := U32Dec(data[len(data)-4:])
+	data = data[:len(data)-4]
+	if crc32.ChecksumIEEE(data) != crc {
+		return nil, errBadBackup
+	}
+	br := &backupReader{data[len(backupMagic):], nil}
+	fields := br.blob()
+	var meta [][]byte
+	for n := br.u64(); n > 0 && br.err == nil; n -= 1 {
+		meta = append(meta, br.blob(), br.blob())
+	}
+	var entries []raft.RaftEntry
+	for n := br.u64(); n > 0 && br.err == nil; n -= 1 {
+		entry, err := LogValDecEx(br.blob(), nil)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+	}
+	if br.err != nil {
+		return nil, br.err
+	} else if len(br.data) > 0 {
+		return nil, errBadBackup
+	}
+
+	pster, err := NewPster(dbpath, errlog)
+	if err != nil {
+		return nil, err
+	}
+	if idx, entry := pster.LastEntry(); idx != 0 || entry != nil {
+		pster.Close()
+		return nil, errors.New("A log already exists at " + dbpath)
+	}
+	ok := len(entries) == 0 || pster.LogUpdate(0, entries)
+	if ok && len(fields) > 0 {
+		ok = pster.SetFields(*FieldsDec(fields))
+	}
+	for i := 0; ok && i < len(meta); i += 2 {
+		ok = pster.SetMeta(string(meta[i]), meta[i+1])
+	}
+	if !ok {
+		pster.Close()
+		return nil, errors.New("Unable to restore the backup")
+	}
+	return pster, nil
+}
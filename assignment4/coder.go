@@ -18,10 +18,16 @@ func init() {
 	gob.RegisterName("CE", new(raft.ClientEntry))
 	gob.RegisterName("VQ", new(raft.VoteRequest))
 	gob.RegisterName("VP", new(raft.VoteReply))
+	gob.RegisterName("PI", new(raft.Ping))
+	gob.RegisterName("PO", new(raft.Pong))
+	gob.RegisterName("TN", new(raft.TimeoutNow))
 	gob.RegisterName("SR", new(store.ReqRead))
 	gob.RegisterName("SW", new(store.ReqWrite))
 	gob.RegisterName("SC", new(store.ReqCaS))
 	gob.RegisterName("SD", new(store.ReqDelete))
+	gob.RegisterName("XS", new(raft.SnapshotMarker))
+	gob.RegisterName("XC", new(raft.ClockEntry))
+	gob.RegisterName("XB", new(raft.BatchClientEntry))
 }
 
 type happyWrap struct { // make gob happy! Is there an easier way?
@@ -29,16 +35,34 @@ type happyWrap struct { // make gob happy! Is there an easier way?
 }
 
 func MsgEnc(msg raft.Message) ([]byte, error) {
+	return MsgEncEx(msg, nil)
+}
+
+// Encode msg, and compress it if comp is not nil
+func MsgEncEx(msg raft.Message, comp Compressor) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	enc := gob.NewEncoder(buf)
 	err := enc.Encode(&happyWrap{msg})
 	if err != nil {
 		return nil, err
 	}
+	if comp != nil {
+		return comp.Compress(buf.Bytes())
+	}
 	return buf.Bytes(), nil
 }
 
 func MsgDec(blob []byte) (raft.Message, error) {
+	return MsgDecEx(blob, nil)
+}
+
+func MsgDecEx(blob []byte, comp Compressor) (raft.Message, error) {
+	if comp != nil {
+		var err error
+		if blob, err = comp.Decompress(blob); err != nil {
+			return nil, err
+		}
+	}
 	var happy = new(happyWrap)
 	dec := gob.NewDecoder(bytes.NewBuffer(blob))
 	err := dec.Decode(happy)
@@ -48,14 +72,39 @@ func MsgDec(blob []byte) (raft.Message, error) {
 	return happy.Smile, nil
 }
 
+// Tries to parse a client request (ClientEntry, StaleRead or LeaderRead) from stream
+func ParseRequest(rstream *bufio.Reader) (uint64, raft.Message, error) {
+	line, err := ReadLineClean(rstream)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	pat := regexp.MustCompile("^([sl])read (0x[0-9a-f]+) ([^ ]+)$")
+	if matches := pat.FindStringSubmatch(line); len(matches) == 4 {
+		uid, _ := strconv.ParseUint(matches[2], 0, 64)
+		if matches[1] == "s" {
+			return uid, &raft.StaleRead{UID: uid, Key: matches[3]}, nil
+		}
+		return uid, &raft.LeaderRead{UID: uid, Key: matches[3]}, nil
+	}
+	ce, err := parseCEntryLine(line, rstream)
+	if err != nil {
+		return 0, nil, err
+	}
+	return ce.UID, ce, nil
+}
+
 // Tries to parse a ClientEntry from stream
 func ParseCEntry(rstream *bufio.Reader) (*raft.ClientEntry, error) {
-	// FileName is assumed to have no whitespace characters including \r and \n
 	line, err := ReadLineClean(rstream)
 	if err != nil { // if and only if line does not end in '\n'
 		return nil, err
 	}
+	return parseCEntryLine(line, rstream)
+}
 
+func parseCEntryLine(line string, rstream *bufio.Reader) (*raft.ClientEntry, error) {
+	// FileName is assumed to have no whitespace characters including \r and \n
 	pat := regexp.MustCompile("^(read|write|cas|delete) (0x[0-9a-f]+) ([^ ]+)(?: ([0-9]+)(?: ([0-9]+)(?: ([0-9]+))?)?)?$")
 	matches := pat.FindStringSubmatch(line)
 
@@ -159,17 +208,45 @@ func U64Dec(blob []byte) uint64 {
 	return *val
 }
 
+func U32Enc(val uint32) []byte {
+	return binaryMustEnc(val, 4)
+}
+
+func U32Dec(blob []byte) uint32 {
+	val := new(uint32)
+	binaryMustDec(blob, val)
+	return *val
+}
+
 func LogValEnc(entry *raft.RaftEntry) ([]byte, error) {
+	return LogValEncEx(entry, nil)
+}
+
+// Encode entry, and compress it if comp is not nil
+func LogValEncEx(entry *raft.RaftEntry, comp Compressor) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	enc := gob.NewEncoder(buf)
 	err := enc.Encode(entry)
 	if err != nil {
 		return nil, err
 	}
+	if comp != nil {
+		return comp.Compress(buf.Bytes())
+	}
 	return buf.Bytes(), nil
 }
 
 func LogValDec(blob []byte) (*raft.RaftEntry, error) {
+	return LogValDecEx(blob, nil)
+}
+
+func LogValDecEx(blob []byte, comp Compressor) (*raft.RaftEntry, error) {
+	if comp != nil {
+		var err error
+		if blob, err = comp.Decompress(blob); err != nil {
+			return nil, err
+		}
+	}
 	re := new(raft.RaftEntry)
 	dec := gob.NewDecoder(bytes.NewBuffer(blob))
 	err := dec.Decode(re)
@@ -180,11 +257,21 @@ func LogValDec(blob []byte) (*raft.RaftEntry, error) {
 }
 
 func FieldsEnc(fields *raft.RaftFields) []byte {
-	return binaryMustEnc(fields, 12)
+	return binaryMustEnc(fields, 13)
 }
 
+// Fields persisted before RaftFields.HasVoted (12 bytes) are decoded too
 func FieldsDec(blob []byte) *raft.RaftFields {
 	fields := new(raft.RaftFields)
+	if len(blob) == 12 {
+		binaryMustDec(blob[:8], &fields.Term)
+		binaryMustDec(blob[8:], &fields.VotedFor)
+		fields.HasVoted = fields.VotedFor != raft.NilNode
+		if !fields.HasVoted {
+			fields.VotedFor = 0
+		}
+		return fields
+	}
 	binaryMustDec(blob, fields)
 	return fields
 }
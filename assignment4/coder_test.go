@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
 	"github.com/critiqjo/cs733/assignment4/raft"
 	"github.com/critiqjo/cs733/assignment4/store"
 	"reflect"
@@ -27,12 +28,15 @@ func TestCoding(t *testing.T) {
 		4, 2, 0, 0, []raft.RaftEntry{
 			raft.RaftEntry{1, &raft.ClientEntry{1234, &store.ReqRead{"f"}}},
 			raft.RaftEntry{4, nil},
-		}, 3,
+		}, 3, 9,
 	})
-	testMsg(&raft.AppendReply{1, true, 0, 1})
-	testMsg(&raft.VoteRequest{7, 1, 8, 7})
+	testMsg(&raft.AppendReply{1, true, 0, 1, 1, 2, 9})
+	testMsg(&raft.VoteRequest{7, 1, 8, 7, 2})
 	testMsg(&raft.VoteReply{8, false, 0})
 	testMsg(&raft.ClientEntry{3456, nil})
+	testMsg(&raft.Ping{1, 2, 1234567890})
+	testMsg(&raft.Pong{1, 3, 1234567890})
+	testMsg(&raft.TimeoutNow{7, 2})
 }
 
 func TestParseCEntry(t *testing.T) {
@@ -45,6 +49,26 @@ func TestParseCEntry(t *testing.T) {
 	}
 }
 
+func TestParseRequest(t *testing.T) {
+	buf := bytes.NewBuffer([]byte("sread 0x544 f\r\nread 0x545 f\r\nlread 0x546 f\r\n"))
+	rstream := bufio.NewReader(buf)
+	uid, req, _ := ParseRequest(rstream)
+	if uid != 0x544 || !reflect.DeepEqual(req, &raft.StaleRead{0x544, "f"}) {
+		t.Logf("%#v\n", req)
+		t.Fatal("Bad sread parsing!")
+	}
+	uid, req, _ = ParseRequest(rstream)
+	if uid != 0x545 || !reflect.DeepEqual(req, &raft.ClientEntry{0x545, &store.ReqRead{"f"}}) {
+		t.Logf("%#v\n", req)
+		t.Fatal("Bad read parsing!")
+	}
+	uid, req, _ = ParseRequest(rstream)
+	if uid != 0x546 || !reflect.DeepEqual(req, &raft.LeaderRead{0x546, "f"}) {
+		t.Logf("%#v\n", req)
+		t.Fatal("Bad lread parsing!")
+	}
+}
+
 func TestU64Coding(t *testing.T) {
 	blob := U64Enc(7)
 	if len(blob) != 8 {
@@ -81,3 +105,57 @@ func TestLogValCoding(t *testing.T) {
 		},
 	})
 }
+
+func TestCompressedCoding(t *testing.T) {
+	comp := FlateCompressor{flate.BestSpeed}
+	contents := bytes.Repeat([]byte("all work and no play "), 100)
+	msg := &raft.AppendEntries{
+		4, 2, 0, 0, []raft.RaftEntry{
+			raft.RaftEntry{1, &raft.ClientEntry{1234, &store.ReqWrite{"f", 0, contents}}},
+		}, 3, 9,
+	}
+	plain, err := MsgEnc(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := MsgEncEx(msg, comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blob) > len(plain)/4 {
+		t.Fatal("Not compressed enough:", len(blob), len(plain))
+	}
+	msg_dec, err := MsgDecEx(blob, comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msg_dec, msg) {
+		t.Fatal("Bad decoding of compressed msg!")
+	}
+
+	entry := &msg.Entries[0]
+	blob, err = LogValEncEx(entry, comp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry_dec, err := LogValDecEx(blob, comp)
+	if err != nil || !reflect.DeepEqual(entry_dec, entry) {
+		t.Fatal("Bad decoding of compressed entry!", err)
+	}
+}
+
+func TestFieldsCoding(t *testing.T) {
+	for _, fields := range []raft.RaftFields{{20, 9, true}, {21, 0, false}, {22, raft.NilNode, true}} {
+		if dec := FieldsDec(FieldsEnc(&fields)); !reflect.DeepEqual(dec, &fields) {
+			t.Fatal("Bad decoding of fields!", dec)
+		}
+	}
+	legacy := []byte{0, 0, 0, 0, 0, 0, 0, 20, 0xff, 0xff, 0xff, 0xff} // no vote
+	if dec := FieldsDec(legacy); !reflect.DeepEqual(dec, &raft.RaftFields{Term: 20}) {
+		t.Fatal("Bad decoding of legacy fields!", dec)
+	}
+	legacy[11] = 9
+	if dec := FieldsDec(legacy); !reflect.DeepEqual(dec, &raft.RaftFields{20, 0xffffff09, true}) {
+		t.Fatal("Bad decoding of legacy fields!", dec)
+	}
+}
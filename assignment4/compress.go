@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+)
+
+// Compresses encoded messages and log entries (see MsgEncEx, LogValEncEx).
+// Both the encoding and the decoding side must use the same Compressor.
+type Compressor interface {
+	Compress(blob []byte) ([]byte, error)
+	Decompress(blob []byte) ([]byte, error)
+}
+
+// A Compressor using DEFLATE (compress/flate) at the given level
+type FlateCompressor struct {
+	Level int
+}
+
+func (self FlateCompressor) Compress(blob []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w, err := flate.NewWriter(buf, self.Level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(blob); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (self FlateCompressor) Decompress(blob []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(blob))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"github.com/critiqjo/cs733/assignment4/raft"
+	"log"
+	"net/http"
+)
+
+// Serve diagnostics over HTTP at addr (in the background):
+//
+//	/debug/raft/state  JSON dump of the raft node's state
+func ServeDebug(addr string, node *raft.RaftNode, errlog *log.Logger) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/raft/state", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := node.DumpState(w); err != nil {
+			errlog.Print("State dump failed: ", err)
+		}
+	})
+	go func() {
+		errlog.Print("Debug server: ", http.ListenAndServe(addr, mux))
+	}()
+}
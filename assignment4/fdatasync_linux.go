@@ -0,0 +1,12 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Like file.Sync, but skips the metadata that is not needed to read the data
+// back (e.g. modification time)
+func fdatasync(file *os.File) error {
+	return syscall.Fdatasync(int(file.Fd()))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"github.com/critiqjo/cs733/assignment4/gossip"
+	"log"
+)
+
+// Gossip with the other nodes that have a gossip-port, to find nodes missing
+// from the cluster file. Such nodes are only logged for now, since the node
+// set cannot be changed at runtime.
+func startGossip(selfId uint32, cluster map[uint32]Node, errlog *log.Logger) error {
+	self := cluster[selfId]
+	var seeds []string
+	for nodeId, node := range cluster {
+		if nodeId != selfId && node.GPort != 0 {
+			seeds = append(seeds, fmt.Sprintf("%v:%v", node.Host, node.GPort))
+		}
+	}
+	_, err := gossip.New(gossip.Config{
+		Self:       gossip.Peer{Id: selfId, Addr: fmt.Sprintf("%v:%v", self.Host, self.PPort)},
+		ListenAddr: fmt.Sprintf(":%v", self.GPort),
+		Seeds:      seeds,
+	}, func(peer gossip.Peer) {
+		if _, ok := cluster[peer.Id]; !ok {
+			errlog.Printf("warning: discovered node %v at %v, which is not in the cluster", peer.Id, peer.Addr)
+		}
+	}, errlog)
+	return err
+}
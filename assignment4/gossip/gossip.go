@@ -0,0 +1,174 @@
+// Package gossip discovers the peers of a node over UDP. Every node
+// periodically sends the (nodeId, raftAddr) tuples it knows of to the seeds
+// and to every other node it has heard from, so that each node ends up
+// knowing all the nodes reachable from the seeds.
+package gossip
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Peer struct {
+	Id   uint32 `json:"id"`
+	Addr string `json:"addr"` // raft (peer) address of the node
+}
+
+type Config struct {
+	Self       Peer
+	ListenAddr string        // UDP address to listen on (like ":5012")
+	Seeds      []string      // UDP addresses of other gossipers
+	Interval   time.Duration // between announcements (default 1s)
+}
+
+type message struct {
+	Peers []Peer `json:"peers"` // the sender first
+}
+
+const maxMessageSize = 64 * 1024
+
+type Gossiper struct { // {{{1
+	sync.Mutex
+	cfg        Config
+	conn       *net.UDPConn
+	peers      map[uint32]Peer
+	targets    map[string]*net.UDPAddr // seeds, and gossipers heard from
+	onDiscover func(Peer)
+	done       chan struct{}
+	err        *log.Logger
+}
+
+// Start gossiping; onDiscover is called (from a gossip goroutine) once for
+// every new node id learnt, except self. Unresolvable seeds are skipped.
+func New(cfg Config, onDiscover func(Peer), errlog *log.Logger) (*Gossiper, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	laddr, err := net.ResolveUDPAddr("udp", cfg.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	self := &Gossiper{
+		cfg:        cfg,
+		conn:       conn,
+		peers:      map[uint32]Peer{cfg.Self.Id: cfg.Self},
+		targets:    make(map[string]*net.UDPAddr),
+		onDiscover: onDiscover,
+		done:       make(chan struct{}),
+		err:        errlog,
+	}
+	for _, seed := range cfg.Seeds {
+		addr, err := net.ResolveUDPAddr("udp", seed)
+		if err != nil {
+			errlog.Print("gossip: bad seed: ", err)
+			continue
+		}
+		self.targets[addr.String()] = addr
+	}
+	go self.listen()
+	go self.announce()
+	return self, nil
+}
+
+// The address being listened on (useful with port 0)
+func (self *Gossiper) Addr() net.Addr {
+	return self.conn.LocalAddr()
+}
+
+// All the known nodes (including self), ordered by id
+func (self *Gossiper) Peers() []Peer {
+	self.Lock()
+	defer self.Unlock()
+	return self.peerList()
+}
+
+func (self *Gossiper) Close() error {
+	close(self.done)
+	return self.conn.Close()
+}
+
+func (self *Gossiper) peerList() []Peer {
+	peers := make([]Peer, 0, len(self.peers))
+	for _, peer := range self.peers {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Id < peers[j].Id })
+	return peers
+}
+
+func (self *Gossiper) announce() { // {{{1
+	ticker := time.NewTicker(self.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		self.Lock()
+		msg := message{Peers: []Peer{self.cfg.Self}}
+		for _, peer := range self.peerList() {
+			if peer.Id != self.cfg.Self.Id {
+				msg.Peers = append(msg.Peers, peer)
+			}
+		}
+		var targets []*net.UDPAddr
+		for _, addr := range self.targets {
+			targets = append(targets, addr)
+		}
+		self.Unlock()
+
+		if blob, err := json.Marshal(&msg); err == nil {
+			for _, addr := range targets {
+				self.conn.WriteToUDP(blob, addr) // lost packets are resent later
+			}
+		}
+		select {
+		case <-self.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (self *Gossiper) listen() { // {{{1
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, from, err := self.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-self.done:
+				return
+			default:
+			}
+			self.err.Print("gossip: ", err)
+			continue
+		}
+		var msg message
+		if err := json.Unmarshal(buf[:n], &msg); err != nil || len(msg.Peers) == 0 {
+			continue // not for us
+		}
+		self.merge(from, msg.Peers)
+	}
+}
+
+func (self *Gossiper) merge(from *net.UDPAddr, peers []Peer) {
+	var discovered []Peer
+	self.Lock()
+	self.targets[from.String()] = from
+	for _, peer := range peers {
+		if _, ok := self.peers[peer.Id]; !ok {
+			self.peers[peer.Id] = peer
+			discovered = append(discovered, peer)
+		}
+	}
+	self.Unlock()
+	if self.onDiscover != nil {
+		for _, peer := range discovered {
+			self.onDiscover(peer)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package gossip
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGossip(t *testing.T) {
+	errlog := log.New(os.Stderr, "-- ", log.Lshortfile)
+	want := []Peer{{1, "127.0.0.1:5010"}, {2, "127.0.0.1:5020"}, {3, "127.0.0.1:5030"}}
+
+	var mutex sync.Mutex
+	discovered := make(map[uint32][]Peer) // by the discovering node
+	var gossipers []*Gossiper
+	var seeds []string
+	for _, self := range want {
+		self := self
+		g, err := New(Config{
+			Self:       self,
+			ListenAddr: "127.0.0.1:0",
+			Seeds:      seeds, // a chain: each one knows only the previous one
+			Interval:   10 * time.Millisecond,
+		}, func(peer Peer) {
+			mutex.Lock()
+			discovered[self.Id] = append(discovered[self.Id], peer)
+			mutex.Unlock()
+		}, errlog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer g.Close()
+		gossipers = append(gossipers, g)
+		seeds = []string{g.Addr().String()}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for _, g := range gossipers {
+		for !reflect.DeepEqual(g.Peers(), want) {
+			if time.Now().After(deadline) {
+				t.Fatal("Peers not discovered", g.cfg.Self, g.Peers())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	time.Sleep(50 * time.Millisecond) // a few more rounds
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, self := range want {
+		if len(discovered[self.Id]) != 2 {
+			t.Error("Each peer should be reported exactly once", self, discovered[self.Id])
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Group commit of a persister: writers wait for a common flush, which is done
+// at most once in every interval, instead of flushing on every write. All the
+// methods must be called with the mutex of the persister held.
+type groupCommit struct {
+	flushed *sync.Cond   // broadcast after every group flush
+	flush   func() error // makes every write so far durable
+	gen     uint64       // number of group flushes so far
+	waiting int          // number of writers waiting for the next flush
+	err     error        // result of the last group flush
+	done    chan struct{}
+}
+
+func newGroupCommit(mutex *sync.Mutex, interval time.Duration, flush func() error) *groupCommit {
+	group := &groupCommit{
+		flushed: sync.NewCond(mutex),
+		flush:   flush,
+		done:    make(chan struct{}),
+	}
+	go group.flusher(mutex, interval)
+	return group
+}
+
+// Block until the next group flush, and return its result
+func (self *groupCommit) wait() error {
+	gen := self.gen
+	self.waiting += 1
+	for gen == self.gen {
+		self.flushed.Wait() // releases the mutex while waiting
+	}
+	return self.err
+}
+
+func (self *groupCommit) flushWaiting() {
+	if self.waiting > 0 {
+		self.err = self.flush()
+		self.gen += 1
+		self.waiting = 0
+		self.flushed.Broadcast()
+	}
+}
+
+func (self *groupCommit) flusher(mutex *sync.Mutex, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-self.done:
+			return
+		}
+		mutex.Lock()
+		self.flushWaiting()
+		mutex.Unlock()
+	}
+}
+
+// Stop the flusher, after a last flush for the writers waiting
+func (self *groupCommit) stop() {
+	close(self.done)
+	self.flushWaiting()
+}
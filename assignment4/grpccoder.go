@@ -0,0 +1,115 @@
+// +build grpc
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/critiqjo/cs733/assignment4/raft"
+	"github.com/critiqjo/cs733/assignment4/raftpb"
+	"math"
+)
+
+// Convert a peer message to its protobuf form (see GrpcMsger); ClientEntry
+// payloads are encoded with MsgEnc
+func PeerMsgEnc(msg raft.Message) (*raftpb.PeerMessage, error) {
+	switch m := msg.(type) {
+	case *raft.AppendEntries:
+		entries := make([]*raftpb.RaftEntry, len(m.Entries))
+		for i, entry := range m.Entries {
+			entries[i] = &raftpb.RaftEntry{Term: entry.Term}
+			if entry.CEntry == nil {
+				continue
+			}
+			pce := &raftpb.ClientEntry{Uid: entry.CEntry.UID}
+			if entry.CEntry.Data != nil {
+				data, err := MsgEnc(entry.CEntry.Data)
+				if err != nil {
+					return nil, err
+				}
+				pce.Data = data
+			}
+			entries[i].Centry = pce
+		}
+		return &raftpb.PeerMessage{Msg: &raftpb.PeerMessage_AppendEntries{AppendEntries: &raftpb.AppendEntries{
+			Term: m.Term, LeaderId: m.LeaderId, PrevLogIdx: m.PrevLogIdx, PrevLogTerm: m.PrevLogTerm,
+			Entries: entries, CommitIdx: m.CommitIdx, ReqId: m.ReqID,
+		}}}, nil
+	case *raft.AppendReply:
+		return &raftpb.PeerMessage{Msg: &raftpb.PeerMessage_AppendReply{AppendReply: &raftpb.AppendReply{
+			Term: m.Term, Success: m.Success, NodeId: m.NodeId, LastModIdx: m.LastModIdx,
+			CommitIdx: m.CommitIdx, LastLogIdx: m.LastLogIdx, ReqId: m.ReqID,
+		}}}, nil
+	case *raft.VoteRequest:
+		return &raftpb.PeerMessage{Msg: &raftpb.PeerMessage_VoteRequest{VoteRequest: &raftpb.VoteRequest{
+			Term: m.Term, CandidId: m.CandidId, LastLogIdx: m.LastLogIdx, LastLogTerm: m.LastLogTerm,
+			Priority: uint32(m.Priority),
+		}}}, nil
+	case *raft.VoteReply:
+		return &raftpb.PeerMessage{Msg: &raftpb.PeerMessage_VoteReply{VoteReply: &raftpb.VoteReply{
+			Term: m.Term, Granted: m.Granted, NodeId: m.NodeId,
+		}}}, nil
+	case *raft.Ping:
+		return &raftpb.PeerMessage{Msg: &raftpb.PeerMessage_Ping{Ping: &raftpb.Ping{
+			Id: m.Id, NodeId: m.NodeId, SentAt: m.SentAt,
+		}}}, nil
+	case *raft.Pong:
+		return &raftpb.PeerMessage{Msg: &raftpb.PeerMessage_Pong{Pong: &raftpb.Pong{
+			Id: m.Id, NodeId: m.NodeId, SentAt: m.SentAt,
+		}}}, nil
+	case *raft.TimeoutNow:
+		return &raftpb.PeerMessage{Msg: &raftpb.PeerMessage_TimeoutNow{TimeoutNow: &raftpb.TimeoutNow{
+			Term: m.Term, LeaderId: m.LeaderId,
+		}}}, nil
+	}
+	return nil, fmt.Errorf("Not a peer message: %T", msg)
+}
+
+func PeerMsgDec(pmsg *raftpb.PeerMessage) (raft.Message, error) {
+	switch m := pmsg.Msg.(type) {
+	case *raftpb.PeerMessage_AppendEntries:
+		ae := m.AppendEntries
+		var entries []raft.RaftEntry
+		for _, pentry := range ae.Entries {
+			entry := raft.RaftEntry{Term: pentry.Term}
+			if pce := pentry.Centry; pce != nil {
+				entry.CEntry = &raft.ClientEntry{UID: pce.Uid}
+				if len(pce.Data) > 0 {
+					data, err := MsgDec(pce.Data)
+					if err != nil {
+						return nil, err
+					}
+					entry.CEntry.Data = data
+				}
+			}
+			entries = append(entries, entry)
+		}
+		return &raft.AppendEntries{
+			Term: ae.Term, LeaderId: ae.LeaderId, PrevLogIdx: ae.PrevLogIdx, PrevLogTerm: ae.PrevLogTerm,
+			Entries: entries, CommitIdx: ae.CommitIdx, ReqID: ae.ReqId,
+		}, nil
+	case *raftpb.PeerMessage_AppendReply:
+		ap := m.AppendReply
+		return &raft.AppendReply{
+			Term: ap.Term, Success: ap.Success, NodeId: ap.NodeId, LastModIdx: ap.LastModIdx,
+			CommitIdx: ap.CommitIdx, LastLogIdx: ap.LastLogIdx, ReqID: ap.ReqId,
+		}, nil
+	case *raftpb.PeerMessage_VoteRequest:
+		vq := m.VoteRequest
+		if vq.Priority > math.MaxUint8 {
+			return nil, errors.New("Bad VoteRequest priority")
+		}
+		return &raft.VoteRequest{Term: vq.Term, CandidId: vq.CandidId, LastLogIdx: vq.LastLogIdx,
+			LastLogTerm: vq.LastLogTerm, Priority: uint8(vq.Priority)}, nil
+	case *raftpb.PeerMessage_VoteReply:
+		vp := m.VoteReply
+		return &raft.VoteReply{Term: vp.Term, Granted: vp.Granted, NodeId: vp.NodeId}, nil
+	case *raftpb.PeerMessage_Ping:
+		return &raft.Ping{Id: m.Ping.Id, NodeId: m.Ping.NodeId, SentAt: m.Ping.SentAt}, nil
+	case *raftpb.PeerMessage_Pong:
+		return &raft.Pong{Id: m.Pong.Id, NodeId: m.Pong.NodeId, SentAt: m.Pong.SentAt}, nil
+	case *raftpb.PeerMessage_TimeoutNow:
+		return &raft.TimeoutNow{Term: m.TimeoutNow.Term, LeaderId: m.TimeoutNow.LeaderId}, nil
+	}
+	return nil, errors.New("Empty peer message")
+}
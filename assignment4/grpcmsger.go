@@ -0,0 +1,285 @@
+// +build grpc
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/critiqjo/cs733/assignment4/raft"
+	"github.com/critiqjo/cs733/assignment4/raftpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// A Messenger like SimpleMsger, but speaking gRPC on both the peer and the
+// client ports (see raftpb/raft.proto), so that nodes, tools and clients need
+// not be written in Go. Client requests and responses are the same as on the
+// TCP client port; only the framing differs.
+type GrpcMsger struct {
+	nodeId  uint32
+	raftCh  chan<- raft.Message
+	pListen net.Listener
+	pServer *grpc.Server
+	peers   map[uint32]*grpcPeer
+	cAddrs  map[uint32]string // client address of each peer (for ERR301)
+	cListen net.Listener
+	cServer *grpc.Server
+	cRespCh *cRespChanMap
+	cRespTO time.Duration // response timeout
+	discon  *nodeSet      // peers that are (artificially) disconnected
+	rtts    *rttMap
+	err     *log.Logger
+}
+
+// The stream of messages to a peer; as with WtfPush, messages are silently
+// dropped while the peer is unreachable, or while the queue is full
+type grpcPeer struct { // {{{1
+	conn   *grpc.ClientConn
+	pushch chan *raftpb.PeerMessage
+	quit   chan struct{} // closed by Stop
+}
+
+func (self *grpcPeer) push(msg *raftpb.PeerMessage) {
+	select {
+	case self.pushch <- msg:
+	default:
+	}
+}
+
+// the push loop (until quit)
+func (self *grpcPeer) run() {
+	client := raftpb.NewPeerClient(self.conn)
+	var stream raftpb.Peer_StreamClient
+	cancel := func() {}
+	for {
+		var msg *raftpb.PeerMessage
+		select {
+		case msg = <-self.pushch:
+		case <-self.quit:
+			cancel()
+			_ = self.conn.Close()
+			return
+		}
+		if stream == nil {
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			var err error
+			if stream, err = client.Stream(ctx); err != nil {
+				cancel()
+				continue
+			}
+		}
+		if err := stream.Send(msg); err != nil {
+			cancel()
+			stream = nil
+		}
+	}
+}
+
+func NewGrpcMsger(nodeId uint32, cluster map[uint32]Node, errlog *log.Logger) (*GrpcMsger, error) { // {{{1
+	node, ok := cluster[nodeId]
+	if !ok {
+		return nil, errors.New("nodeId not in cluster")
+	}
+	peers := make(map[uint32]*grpcPeer)
+	cAddrs := make(map[uint32]string)
+	for peerId, peerNode := range cluster {
+		if peerId != nodeId {
+			conn, err := grpc.NewClient(fmt.Sprintf("%v:%v", peerNode.Host, peerNode.PPort),
+				grpc.WithTransportCredentials(insecure.NewCredentials()))
+			if err != nil {
+				return nil, err
+			}
+			peers[peerId] = &grpcPeer{
+				conn:   conn,
+				pushch: make(chan *raftpb.PeerMessage, 16),
+				quit:   make(chan struct{}),
+			}
+			cAddrs[peerId] = fmt.Sprintf("%v:%v", peerNode.Host, peerNode.CPort)
+		}
+	}
+
+	pconn, err := net.Listen("tcp", fmt.Sprintf("%v:%v", node.Host, node.PPort))
+	if err != nil {
+		return nil, err
+	}
+	cconn, err := net.Listen("tcp", fmt.Sprintf(":%v", node.CPort))
+	if err != nil {
+		pconn.Close()
+		return nil, err
+	}
+
+	msger := &GrpcMsger{
+		nodeId:  nodeId,
+		raftCh:  nil,
+		pListen: pconn,
+		pServer: grpc.NewServer(),
+		peers:   peers,
+		cAddrs:  cAddrs,
+		cListen: cconn,
+		cServer: grpc.NewServer(),
+		cRespCh: newCRespChanMap(),
+		cRespTO: 30 * time.Second,
+		discon:  newNodeSet(),
+		rtts:    newRttMap(),
+		err:     errlog,
+	}
+	raftpb.RegisterPeerServer(msger.pServer, &grpcPeerServer{msger: msger})
+	raftpb.RegisterClientServer(msger.cServer, &grpcClientServer{msger: msger})
+	return msger, nil
+}
+
+// ---- quack like a Messenger {{{1
+func (self *GrpcMsger) Register(raftCh chan<- raft.Message) {
+	self.raftCh = raftCh
+}
+
+func (self *GrpcMsger) Send(nodeId uint32, msg raft.Message) {
+	if self.discon.has(nodeId) {
+		return
+	} else if nodeId == self.nodeId { // e.g. a Ping to self
+		go func() { self.raftCh <- msg }() // the sender may be the raft loop
+		return
+	}
+	peer, ok := self.peers[nodeId]
+	if !ok {
+		self.err.Print("Bad nodeId")
+		return
+	}
+	pmsg, err := PeerMsgEnc(msg)
+	if err != nil {
+		self.err.Print(err)
+		return
+	}
+	switch msg.(type) {
+	case *raft.AppendEntries, *raft.VoteRequest:
+		self.rtts.sent(nodeId)
+	}
+	peer.push(pmsg)
+}
+
+func (self *GrpcMsger) BroadcastVoteRequest(msg *raft.VoteRequest) {
+	for nodeId := range self.peers {
+		self.Send(nodeId, msg)
+	}
+}
+
+func (self *GrpcMsger) Client301(uid uint64, nodeId uint32) {
+	self.RespondToClient(uid, fmt.Sprintf("ERR301 %v", self.cAddrs[nodeId]))
+}
+
+func (self *GrpcMsger) Client503(uid uint64) {
+	self.RespondToClient(uid, "ERR503 Service unavailable")
+}
+
+func (self *GrpcMsger) ClientReadReply(uid uint64, data []byte, appliedIdx uint64) {
+	self.RespondToClient(uid, fmt.Sprintf("APPLIED %d\r\n%s", appliedIdx, data))
+}
+
+func (self *GrpcMsger) Latency(nodeId uint32) time.Duration {
+	return self.rtts.get(nodeId)
+}
+
+func (self *GrpcMsger) Disconnect(nodeId uint32) {
+	self.discon.set(nodeId, true)
+}
+
+func (self *GrpcMsger) Connect(nodeId uint32) {
+	self.discon.set(nodeId, false)
+}
+
+func (self *GrpcMsger) SpawnListeners() { // {{{1
+	for _, peer := range self.peers {
+		go peer.run()
+	}
+	go self.serve(self.pServer, self.pListen)
+	go self.serve(self.cServer, self.cListen)
+}
+
+func (self *GrpcMsger) serve(server *grpc.Server, listener net.Listener) {
+	if err := server.Serve(listener); err != nil {
+		self.err.Print("Fatal: ", err)
+	}
+}
+
+// Close the listeners and the connections to peers
+func (self *GrpcMsger) Stop() {
+	self.pServer.Stop()
+	self.cServer.Stop()
+	for _, peer := range self.peers {
+		close(peer.quit)
+	}
+}
+
+func (self *GrpcMsger) RespondToClient(uid uint64, msg string) {
+	if respCh, ok := self.cRespCh.remove(uid); ok {
+		respCh <- msg // client timeout could happen in parallel
+	}
+}
+
+type grpcPeerServer struct { // {{{1
+	raftpb.UnimplementedPeerServer
+	msger *GrpcMsger
+}
+
+func (self *grpcPeerServer) Stream(stream raftpb.Peer_StreamServer) error {
+	msger := self.msger
+	for {
+		pmsg, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&raftpb.StreamClose{})
+		} else if err != nil {
+			return err
+		}
+		msg, err := PeerMsgDec(pmsg)
+		if err != nil {
+			msger.err.Print(err)
+			continue
+		}
+		from, ok := senderOf(msg)
+		if ok && msger.discon.has(from) {
+			continue
+		}
+		switch msg.(type) {
+		case *raft.AppendReply, *raft.VoteReply:
+			msger.rtts.received(from)
+		}
+		msger.raftCh <- msg
+	}
+}
+
+type grpcClientServer struct { // {{{1
+	raftpb.UnimplementedClientServer
+	msger *GrpcMsger
+}
+
+func (self *grpcClientServer) Request(ctx context.Context, req *raftpb.ClientRequest) (*raftpb.ClientResponse, error) {
+	msger := self.msger
+	if msger.raftCh == nil {
+		return &raftpb.ClientResponse{Response: "ERR503 Service unavailable"}, nil
+	}
+	uid, msg, err := ParseRequest(bufio.NewReader(bytes.NewReader(req.Request)))
+	if err != nil {
+		return &raftpb.ClientResponse{Response: "ERR400 Bad request"}, nil
+	}
+	respCh := make(chan string, 1)
+	msger.cRespCh.insert(uid, respCh)
+	msger.raftCh <- msg
+	select {
+	case resp := <-respCh:
+		return &raftpb.ClientResponse{Response: resp}, nil
+	case <-time.After(msger.cRespTO):
+		msger.cRespCh.remove(uid)
+		return &raftpb.ClientResponse{Response: "ERR504 Service timed out"}, nil
+	case <-ctx.Done():
+		msger.cRespCh.remove(uid)
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,119 @@
+// +build grpc
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/critiqjo/cs733/assignment4/raft"
+	"github.com/critiqjo/cs733/assignment4/raftpb"
+	"github.com/critiqjo/cs733/assignment4/store"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGrpcMsger(t *testing.T) { // {{{1
+	cluster := map[uint32]Node{
+		1: Node{Host: "127.0.0.1", PPort: 6711, CPort: 6712},
+		2: Node{Host: "127.0.0.1", PPort: 6721, CPort: 6722},
+		3: Node{Host: "127.0.0.1", PPort: 6731, CPort: 6732},
+	}
+	nodeIds := []uint32{1, 2, 3}
+	errlog := log.New(os.Stderr, "-- ", log.Lshortfile)
+	clients := make(map[uint32]raftpb.ClientClient)
+	for _, nodeId := range nodeIds {
+		msger, err := NewGrpcMsger(nodeId, cluster, errlog)
+		if err != nil {
+			t.Fatal("Creating messenger failed:", err)
+		}
+		defer msger.Stop()
+		dir := walTestDir(t)
+		defer os.RemoveAll(dir)
+		node, err := raft.NewNode(nodeId, nodeIds, 16, msger, initWalPster(t, dir, 0),
+			NewMachn(0, msger), errlog)
+		if err != nil {
+			t.Fatal("Creating raft node failed:", err)
+		}
+		msger.SpawnListeners()
+		go node.Run(50 * time.Millisecond)
+		defer node.Exit()
+
+		conn, err := grpc.NewClient(fmt.Sprintf("127.0.0.1:%v", cluster[nodeId].CPort),
+			grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		clients[nodeId] = raftpb.NewClientClient(conn)
+	}
+
+	request := func(nodeId uint32, req string) string {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		resp, err := clients[nodeId].Request(ctx, &raftpb.ClientRequest{Request: []byte(req)})
+		if err != nil {
+			t.Fatal("Request failed:", err)
+		}
+		return resp.Response
+	}
+	assert_eq(t, request(1, "bogus\r\n"), "ERR400 Bad request", "Bad response to a bad request")
+
+	// retried on every node until committed (the ones that are not the leader
+	// redirect, or are yet to elect one)
+	commit := func(req string) string {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			for _, nodeId := range nodeIds {
+				if resp := request(nodeId, req); !strings.HasPrefix(resp, "ERR") {
+					return resp
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatal("Request not committed:", req)
+		return ""
+	}
+	resp := commit("write 0x1 f 3\r\nbar\r\n")
+	assert(t, strings.HasPrefix(resp, "OK "), "Bad response to write", resp)
+	version := strings.TrimPrefix(resp, "OK ")
+	resp = commit("read 0x2 f\r\n")
+	assert_eq(t, resp, "CONTENTS "+version+" 3 0\r\nbar", "Bad response to read")
+}
+
+func TestPeerMsgCoding(t *testing.T) {
+	testMsg := func(msg raft.Message) {
+		pmsg, err := PeerMsgEnc(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg_dec, err := PeerMsgDec(pmsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(msg_dec, msg) {
+			t.Fatal("Bad decoding of msg!", msg_dec)
+		}
+	}
+	testMsg(&raft.AppendEntries{
+		4, 2, 0, 0, []raft.RaftEntry{
+			raft.RaftEntry{1, &raft.ClientEntry{1234, &store.ReqRead{"f"}}},
+			raft.RaftEntry{2, &raft.ClientEntry{2345, nil}},
+			raft.RaftEntry{4, nil},
+		}, 3, 9,
+	})
+	testMsg(&raft.AppendReply{1, true, 0, 1, 1, 2, 9})
+	testMsg(&raft.VoteRequest{7, 1, 8, 7, 2})
+	testMsg(&raft.VoteReply{8, false, 0})
+	testMsg(&raft.Ping{1, 2, 1234567890})
+	testMsg(&raft.Pong{1, 3, 1234567890})
+	testMsg(&raft.TimeoutNow{7, 2})
+	if _, err := PeerMsgEnc(&raft.ClientEntry{3456, nil}); err == nil {
+		t.Fatal("Encoded a client message")
+	}
+}
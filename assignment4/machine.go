@@ -6,38 +6,58 @@ import (
 	"github.com/critiqjo/cs733/assignment4/store"
 )
 
+// Where the responses to clients are sent (SimpleMsger or GrpcMsger)
+type Responder interface {
+	RespondToClient(uid uint64, msg string)
+}
+
 type SimpleMachn struct {
 	storeChan chan<- store.Action
 	respCache map[uint64]string // uid -> response
-	msger     *SimpleMsger
+	msger     Responder
 }
 
 // ---- quack like a Machine {{{1
 func (self *SimpleMachn) Execute(centries []raft.ClientEntry) {
-	resChan := make(chan store.Response)
 	for _, cEntry := range centries {
-		action := store.Action{
-			Req:   cEntry.Data,
-			Reply: resChan,
-		}
-		self.storeChan <- action
-		response := <-resChan
-
-		switch r := response.(type) {
-		case *store.ResOk:
+		if cEntry.Data == nil { // read-only
 			self.respCache[cEntry.UID] = "OK"
-		case *store.ResOkVer:
-			self.respCache[cEntry.UID] = fmt.Sprintf("OK %d", r.Version)
-		case *store.ResContents:
-			self.respCache[cEntry.UID] = fmt.Sprintf("CONTENTS %d %d %d\r\n%s",
-				r.Version, len(r.Contents), r.ExpTime, string(r.Contents))
-		case *store.ResError:
-			self.respCache[cEntry.UID] = fmt.Sprintf("%s", r.Desc)
+			continue
 		}
+		self.respCache[cEntry.UID] = self.query(cEntry.Data)
 		_ = self.TryRespond(cEntry.UID)
 	}
 }
 
+func (self *SimpleMachn) Read(key string) []byte {
+	return []byte(self.query(&store.ReqRead{FileName: key}))
+}
+
+func (self *SimpleMachn) ReadResult(uid uint64) ([]byte, bool) {
+	resp, ok := self.respCache[uid]
+	return []byte(resp), ok
+}
+
+func (self *SimpleMachn) query(req store.Request) string {
+	resChan := make(chan store.Response)
+	self.storeChan <- store.Action{
+		Req:   req,
+		Reply: resChan,
+	}
+	switch r := (<-resChan).(type) {
+	case *store.ResOk:
+		return "OK"
+	case *store.ResOkVer:
+		return fmt.Sprintf("OK %d", r.Version)
+	case *store.ResContents:
+		return fmt.Sprintf("CONTENTS %d %d %d\r\n%s",
+			r.Version, len(r.Contents), r.ExpTime, string(r.Contents))
+	case *store.ResError:
+		return fmt.Sprintf("%s", r.Desc)
+	}
+	panic("Unreachable")
+}
+
 func (self *SimpleMachn) TryRespond(uid uint64) bool {
 	if resp, ok := self.respCache[uid]; ok {
 		self.msger.RespondToClient(uid, resp)
@@ -47,7 +67,7 @@ func (self *SimpleMachn) TryRespond(uid uint64) bool {
 	}
 }
 
-func NewMachn(initState int64, msger *SimpleMsger) *SimpleMachn { // {{{1
+func NewMachn(initState int64, msger Responder) *SimpleMachn { // {{{1
 	storeChan := store.InitStore()
 	return &SimpleMachn{
 		storeChan: storeChan,
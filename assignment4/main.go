@@ -12,8 +12,8 @@ import (
 
 func main() {
 	args := os.Args
-	if len(args) != 4 {
-		fmt.Printf("Usage: %v <cluster-file> <log-file> <node-id>\n", args[0])
+	if len(args) != 4 && len(args) != 5 {
+		fmt.Printf("Usage: %v <cluster-file> <log-file> <node-id> [<debug-addr>]\n", args[0])
 		os.Exit(1)
 	}
 
@@ -70,6 +70,15 @@ func main() {
 		os.Exit(1)
 	}
 
+	if len(args) == 5 {
+		ServeDebug(args[4], node, errlog)
+	}
+	if cluster[uint32(selfId)].GPort != 0 {
+		if err := startGossip(uint32(selfId), cluster, errlog); err != nil {
+			fmt.Printf("Error starting gossip: %v\n", err.Error())
+			os.Exit(1)
+		}
+	}
 	msger.SpawnListeners()
 	node.Run(time.Duration(200) * time.Millisecond)
 }
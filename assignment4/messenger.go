@@ -15,14 +15,156 @@ type SimpleMsger struct {
 	nodeId  uint32
 	raftCh  chan<- raft.Message
 	pListen net.Listener
-	peers   map[uint32]*WtfPush
-	pCAddr  map[uint32]string // peer's client socket address map
+	peers   *peerMap
 	cListen net.Listener
+	cQueue  chan net.Conn // accepted client connections awaiting a worker
+	cWorker int           // number of client connection workers
 	cRespCh *cRespChanMap
 	cRespTO time.Duration // response timeout
+	discon  *nodeSet      // peers that are (artificially) disconnected
+	rtts    *rttMap
+	comp    Compressor // nil unless compression is enabled
 	err     *log.Logger
 }
 
+type MsgerOpts struct {
+	// Maximum number of client connections served concurrently (default 64)
+	ClientWorkers int
+	// Maximum number of accepted client connections waiting for a free
+	// worker (default 64, negative for none); connections beyond that are
+	// refused with ERR503
+	ClientQueue int
+	// If not nil, peer messages are compressed on the wire (all the nodes in
+	// the cluster should use the same Compressor)
+	Compressor Compressor
+}
+
+type rttMap struct { // {{{1
+	sync.Mutex
+	sentAt map[uint32]time.Time     // earliest unanswered request to a peer
+	avg    map[uint32]time.Duration // moving average of round-trip times
+}
+
+func newRttMap() *rttMap {
+	return &rttMap{
+		sentAt: make(map[uint32]time.Time),
+		avg:    make(map[uint32]time.Duration),
+	}
+}
+
+func (self *rttMap) sent(nodeId uint32) {
+	self.Lock()
+	if _, ok := self.sentAt[nodeId]; !ok {
+		self.sentAt[nodeId] = time.Now()
+	}
+	self.Unlock()
+}
+
+func (self *rttMap) received(nodeId uint32) {
+	self.Lock()
+	if sentAt, ok := self.sentAt[nodeId]; ok {
+		sample := time.Since(sentAt)
+		if avg, ok := self.avg[nodeId]; ok {
+			self.avg[nodeId] = avg + (sample-avg)/8 // as in TCP's SRTT
+		} else {
+			self.avg[nodeId] = sample
+		}
+		delete(self.sentAt, nodeId)
+	}
+	self.Unlock()
+}
+
+func (self *rttMap) get(nodeId uint32) time.Duration {
+	self.Lock()
+	defer self.Unlock()
+	if avg, ok := self.avg[nodeId]; ok {
+		return avg
+	}
+	return raft.NoLatencyEstimate
+}
+
+type nodeSet struct { // {{{1
+	sync.Mutex
+	inner map[uint32]bool
+}
+
+func newNodeSet() *nodeSet {
+	return &nodeSet{inner: make(map[uint32]bool)}
+}
+
+func (self *nodeSet) set(key uint32, val bool) {
+	self.Lock()
+	if val {
+		self.inner[key] = true
+	} else {
+		delete(self.inner, key)
+	}
+	self.Unlock()
+}
+
+func (self *nodeSet) has(key uint32) bool {
+	self.Lock()
+	defer self.Unlock()
+	return self.inner[key]
+}
+
+type peerMap struct { // {{{1
+	sync.Mutex
+	pushers map[uint32]*WtfPush
+	cAddrs  map[uint32]string // peer's client socket address map
+	running bool              // whether the pushers have been Run
+}
+
+func (self *peerMap) get(nodeId uint32) (*WtfPush, bool) {
+	self.Lock()
+	defer self.Unlock()
+	wtfc, ok := self.pushers[nodeId]
+	return wtfc, ok
+}
+
+func (self *peerMap) ids() []uint32 {
+	self.Lock()
+	defer self.Unlock()
+	var ids []uint32
+	for nodeId := range self.pushers {
+		ids = append(ids, nodeId)
+	}
+	return ids
+}
+
+func (self *peerMap) cAddr(nodeId uint32) string {
+	self.Lock()
+	defer self.Unlock()
+	return self.cAddrs[nodeId]
+}
+
+// Replace (or add, or remove if wtfc is nil) the pusher of a peer, returning
+// the old one (if any)
+func (self *peerMap) swap(nodeId uint32, wtfc *WtfPush, cAddr string) *WtfPush {
+	self.Lock()
+	defer self.Unlock()
+	old := self.pushers[nodeId]
+	if wtfc == nil {
+		delete(self.pushers, nodeId)
+		delete(self.cAddrs, nodeId)
+		return old
+	}
+	self.pushers[nodeId], self.cAddrs[nodeId] = wtfc, cAddr
+	if self.running {
+		go wtfc.Run()
+	}
+	return old
+}
+
+func (self *peerMap) run() {
+	self.Lock()
+	defer self.Unlock()
+	for _, wtfc := range self.pushers {
+		go wtfc.Run()
+	}
+	self.running = true
+}
+
 type cRespChanMap struct { // {{{1
 	sync.Mutex
 	inner map[uint64]chan<- string // uid -> response channel
@@ -50,9 +192,22 @@ type Node struct { // {{{1
 	Host  string `json:"host-ip"`
 	PPort int    `json:"peer-port"`
 	CPort int    `json:"client-port"`
+	GPort int    `json:"gossip-port,omitempty"` // optional (see startGossip)
 }
 
 func NewMsger(nodeId uint32, cluster map[uint32]Node, errlog *log.Logger) (*SimpleMsger, error) { // {{{1
+	return NewMsgerEx(nodeId, cluster, MsgerOpts{}, errlog)
+}
+
+func NewMsgerEx(nodeId uint32, cluster map[uint32]Node, opts MsgerOpts, errlog *log.Logger) (*SimpleMsger, error) {
+	if opts.ClientWorkers <= 0 {
+		opts.ClientWorkers = 64
+	}
+	if opts.ClientQueue < 0 {
+		opts.ClientQueue = 0
+	} else if opts.ClientQueue == 0 {
+		opts.ClientQueue = 64
+	}
 	node, ok := cluster[nodeId]
 	if !ok {
 		return nil, errors.New("nodeId not in cluster")
@@ -63,17 +218,17 @@ func NewMsger(nodeId uint32, cluster map[uint32]Node, errlog *log.Logger) (*Simp
 		return nil, err
 	}
 
-	var peers = make(map[uint32]*WtfPush)
-	var redirs = make(map[uint32]string)
+	peers := &peerMap{
+		pushers: make(map[uint32]*WtfPush),
+		cAddrs:  make(map[uint32]string),
+	}
 	for peerId, peerNode := range cluster {
 		if peerId != nodeId {
-			peerAddr := fmt.Sprintf("%v:%v", peerNode.Host, peerNode.PPort)
-			wtfpush, err := NewWtfPush(peerAddr)
+			wtfpush, err := NewWtfPush(fmt.Sprintf("%v:%v", peerNode.Host, peerNode.PPort))
 			if err != nil {
 				return nil, err
 			}
-			peers[peerId] = wtfpush
-			redirs[peerId] = fmt.Sprintf("%v:%v", peerNode.Host, peerNode.CPort)
+			peers.swap(peerId, wtfpush, fmt.Sprintf("%v:%v", peerNode.Host, peerNode.CPort))
 		}
 	}
 
@@ -88,10 +243,14 @@ func NewMsger(nodeId uint32, cluster map[uint32]Node, errlog *log.Logger) (*Simp
 		raftCh:  nil,
 		pListen: pconn,
 		peers:   peers,
-		pCAddr:  redirs,
 		cListen: cconn,
+		cQueue:  make(chan net.Conn, opts.ClientQueue),
+		cWorker: opts.ClientWorkers,
 		cRespCh: newCRespChanMap(),
 		cRespTO: 30 * time.Second,
+		discon:  newNodeSet(),
+		rtts:    newRttMap(),
+		comp:    opts.Compressor,
 		err:     errlog,
 	}, nil
 }
@@ -102,9 +261,19 @@ func (self *SimpleMsger) Register(raftCh chan<- raft.Message) {
 }
 
 func (self *SimpleMsger) Send(nodeId uint32, msg raft.Message) {
-	if wtfc, ok := self.peers[nodeId]; ok {
-		data, err := MsgEnc(msg)
+	if self.discon.has(nodeId) {
+		return
+	} else if nodeId == self.nodeId { // e.g. a Ping to self
+		go func() { self.raftCh <- msg }() // the sender may be the raft loop
+		return
+	}
+	if wtfc, ok := self.peers.get(nodeId); ok {
+		data, err := MsgEncEx(msg, self.comp)
 		if err == nil {
+			switch msg.(type) {
+			case *raft.AppendEntries, *raft.VoteRequest:
+				self.rtts.sent(nodeId)
+			}
 			wtfc.Push(data)
 		} else {
 			self.err.Print(err)
@@ -115,24 +284,69 @@ func (self *SimpleMsger) Send(nodeId uint32, msg raft.Message) {
 }
 
 func (self *SimpleMsger) BroadcastVoteRequest(msg *raft.VoteRequest) {
-	for nodeId, _ := range self.peers {
+	for _, nodeId := range self.peers.ids() {
 		self.Send(nodeId, msg)
 	}
 }
 
 func (self *SimpleMsger) Client301(uid uint64, nodeId uint32) {
-	self.RespondToClient(uid, fmt.Sprintf("ERR301 %v", self.pCAddr[nodeId]))
+	self.RespondToClient(uid, fmt.Sprintf("ERR301 %v", self.peers.cAddr(nodeId)))
 }
 
 func (self *SimpleMsger) Client503(uid uint64) {
 	self.RespondToClient(uid, "ERR503 Service unavailable")
 }
 
-func (self *SimpleMsger) SpawnListeners() { // {{{1
-	for _, peer := range self.peers {
-		go peer.Run()
+func (self *SimpleMsger) ClientReadReply(uid uint64, data []byte, appliedIdx uint64) {
+	self.RespondToClient(uid, fmt.Sprintf("APPLIED %d\r\n%s", appliedIdx, data))
+}
+
+func (self *SimpleMsger) Latency(nodeId uint32) time.Duration {
+	return self.rtts.get(nodeId)
+}
+
+func (self *SimpleMsger) Disconnect(nodeId uint32) {
+	self.discon.set(nodeId, true)
+}
+
+func (self *SimpleMsger) Connect(nodeId uint32) {
+	self.discon.set(nodeId, false)
+}
+
+// Point the messages to a peer at a new address (or start sending to a new
+// peer). Messages already handed to the old connection are still sent over
+// it, before it is closed.
+func (self *SimpleMsger) UpdatePeer(nodeId uint32, node Node) error { // {{{1
+	if nodeId == self.nodeId {
+		return errors.New("Cannot update self")
+	}
+	wtfpush, err := NewWtfPush(fmt.Sprintf("%v:%v", node.Host, node.PPort))
+	if err != nil {
+		return err
+	}
+	if old := self.peers.swap(nodeId, wtfpush, fmt.Sprintf("%v:%v", node.Host, node.CPort)); old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Stop sending messages to a peer (as with UpdatePeer, the ones in flight are
+// still sent)
+func (self *SimpleMsger) RemovePeer(nodeId uint32) error {
+	old := self.peers.swap(nodeId, nil, "")
+	if old == nil {
+		return errors.New("Unknown peer")
 	}
+	old.Close()
+	return nil
+}
+
+func (self *SimpleMsger) SpawnListeners() { // {{{1
+	self.peers.run()
 	go self.listenToPeers()
+	for i := 0; i < self.cWorker; i++ {
+		go self.serveClients()
+	}
 	go self.listenToClients()
 }
 
@@ -157,9 +371,17 @@ func (self *SimpleMsger) handlePeer(conn net.Conn) {
 			self.err.Print("Peer error: ", err)
 			break
 		}
-		msg, err := MsgDec(data)
+		msg, err := MsgDecEx(data, self.comp)
 		//self.err.Print("Received ", msg)
 		if err == nil {
+			from, ok := senderOf(msg)
+			if ok && self.discon.has(from) {
+				continue
+			}
+			switch msg.(type) {
+			case *raft.AppendReply, *raft.VoteReply:
+				self.rtts.received(from)
+			}
 			self.raftCh <- msg
 		} else {
 			self.err.Print(err)
@@ -167,6 +389,26 @@ func (self *SimpleMsger) handlePeer(conn net.Conn) {
 	}
 }
 
+func senderOf(msg raft.Message) (uint32, bool) {
+	switch m := msg.(type) {
+	case *raft.AppendEntries:
+		return m.LeaderId, true
+	case *raft.AppendReply:
+		return m.NodeId, true
+	case *raft.VoteRequest:
+		return m.CandidId, true
+	case *raft.VoteReply:
+		return m.NodeId, true
+	case *raft.Ping:
+		return m.NodeId, true
+	case *raft.Pong:
+		return m.NodeId, true
+	case *raft.TimeoutNow:
+		return m.LeaderId, true
+	}
+	return 0, false
+}
+
 func (self *SimpleMsger) listenToClients() {
 	for {
 		conn, err := self.cListen.Accept()
@@ -174,7 +416,18 @@ func (self *SimpleMsger) listenToClients() {
 			self.err.Print("Fatal: ", err)
 			break
 		}
-		go self.handleClient(conn)
+		select {
+		case self.cQueue <- conn:
+		default: // all workers busy and queue full
+			_ = WriteHard(conn, []byte("ERR503 Service unavailable\r\n"))
+			conn.Close()
+		}
+	}
+}
+
+func (self *SimpleMsger) serveClients() {
+	for conn := range self.cQueue {
+		self.handleClient(conn)
 	}
 }
 
@@ -193,16 +446,16 @@ func (self *SimpleMsger) handleClient(conn net.Conn) { // {{{1
 	respCh := make(chan string, 1)
 	for {
 		// FIXME have a read deadline?
-		ce, err := ParseCEntry(rstream)
+		uid, req, err := ParseRequest(rstream)
 		if err == nil {
-			self.cRespCh.insert(ce.UID, respCh)
-			self.raftCh <- ce
+			self.cRespCh.insert(uid, respCh)
+			self.raftCh <- req
 			var resp string
 			select {
 			case resp = <-respCh:
 			case <-time.After(self.cRespTO): // timeout
 				resp = "ERR504 Service timed out"
-				self.cRespCh.remove(ce.UID)
+				self.cRespCh.remove(uid)
 			}
 			if ok := respond(resp); !ok {
 				break
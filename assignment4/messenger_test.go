@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"github.com/critiqjo/cs733/assignment4/raft"
 	"github.com/critiqjo/cs733/assignment4/store"
 	"log"
@@ -53,7 +54,7 @@ func TestSimpleMsger(t *testing.T) { // {{{1
 			raft.RaftEntry{1, nil},
 			raft.RaftEntry{1, nil},
 			raft.RaftEntry{4, nil},
-		}, 3,
+		}, 3, 0,
 	}
 loop:
 	for {
@@ -66,7 +67,7 @@ loop:
 	}
 	assert_eq(t, m, apen, "Message mismatch", m)
 
-	vreq := &raft.VoteRequest{7, 1, 8, 7}
+	vreq := &raft.VoteRequest{7, 1, 8, 7, 0}
 	msger2.BroadcastVoteRequest(vreq)
 	m = <-raftch1
 	assert_eq(t, m, vreq, "VoteReq mismatch", m)
@@ -95,3 +96,129 @@ loop:
 	}
 	assert_eq(t, m, "OK\r\n", "Bad response to client", m)
 }
+
+func TestMsgerUpdatePeer(t *testing.T) { // {{{1
+	node1 := Node{Host: "127.0.0.1", PPort: 5671, CPort: 5672}
+	node2 := Node{Host: "127.0.0.1", PPort: 5681, CPort: 5682}
+	moved2 := Node{Host: "127.0.0.1", PPort: 5691, CPort: 5692}
+	msger1, _ := initMsger(t, map[uint32]Node{1: node1, 2: node2}, 1)
+	_, raftch2 := initMsger(t, map[uint32]Node{1: node1, 2: node2}, 2)
+	_, moved2ch := initMsger(t, map[uint32]Node{1: node1, 2: moved2}, 2)
+
+	sendUntil := func(msg raft.Message, raftch chan raft.Message) {
+		for i := 0; i < 10; i++ {
+			msger1.Send(2, msg) // this might silently fail, so retry!
+			select {
+			case m := <-raftch:
+				assert_eq(t, m, msg, "Message mismatch", m)
+				return
+			case <-time.After(200 * time.Millisecond):
+			}
+		}
+		t.Fatal("Message not received", msg)
+	}
+	sendUntil(&raft.AppendEntries{4, 1, 0, 0, nil, 0, 0}, raftch2)
+
+	if err := msger1.UpdatePeer(2, moved2); err != nil {
+		t.Fatal(err)
+	}
+	sendUntil(&raft.AppendEntries{4, 1, 0, 0, nil, 1, 0}, moved2ch)
+	select {
+	case m := <-raftch2:
+		t.Fatal("Message sent to the old address", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	respCh := make(chan string, 1)
+	msger1.cRespCh.insert(0x1a2b, respCh)
+	msger1.Client301(0x1a2b, 2)
+	assert_eq(t, <-respCh, "ERR301 127.0.0.1:5692", "Redirect to the old address")
+
+	assert(t, msger1.RemovePeer(2) == nil, "RemovePeer failed")
+	assert(t, msger1.RemovePeer(2) != nil, "Removed an unknown peer")
+	assert(t, msger1.UpdatePeer(1, node2) != nil, "Updated self")
+	msger1.Send(2, &raft.AppendEntries{4, 1, 0, 0, nil, 2, 0})
+	select {
+	case m := <-moved2ch:
+		t.Fatal("Message sent to a removed peer", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRttMap(t *testing.T) { // {{{1
+	rtts := newRttMap()
+	assert(t, rtts.get(1) == raft.NoLatencyEstimate, "Estimate without samples")
+	rtts.sent(1)
+	time.Sleep(10 * time.Millisecond)
+	rtts.sent(1) // earliest unanswered request is kept
+	rtts.received(1)
+	assert(t, rtts.get(1) >= 10*time.Millisecond, "Bad estimate", rtts.get(1))
+	rtts.received(1) // unsolicited reply
+	assert(t, rtts.get(1) >= 10*time.Millisecond, "Bad estimate", rtts.get(1))
+	assert(t, rtts.get(2) == raft.NoLatencyEstimate, "Estimate without samples")
+}
+
+func TestClientPool(t *testing.T) { // {{{1
+	cluster := map[uint32]Node{
+		1: Node{Host: "127.0.0.1", PPort: 4567, CPort: 4568},
+	}
+	raftch := make(chan raft.Message)
+	errlog := log.New(os.Stderr, "-- ", log.Lshortfile)
+	msger, err := NewMsgerEx(1, cluster, MsgerOpts{ClientWorkers: 2, ClientQueue: 1}, errlog)
+	if err != nil {
+		t.Fatal("Creating messenger failed:", err)
+	}
+	msger.Register(raftch)
+	msger.SpawnListeners()
+
+	dial := func(uid int) (net.Conn, *bufio.Reader) {
+		client, err := net.Dial("tcp", "127.0.0.1:4568")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = client.Write([]byte(fmt.Sprintf("read 0x%x f\r\n", uid)))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return client, bufio.NewReader(client)
+	}
+	expectReq := func(uid uint64) {
+		select {
+		case m := <-raftch:
+			assert_eq(t, m.(*raft.ClientEntry).UID, uid, "Unexpected request", m)
+		case <-time.After(time.Second):
+			t.Fatal("Request was not served", uid)
+		}
+	}
+
+	// occupy both workers
+	client1, _ := dial(1)
+	defer client1.Close()
+	expectReq(1)
+	client2, _ := dial(2)
+	defer client2.Close()
+	expectReq(2)
+
+	// queued, but not served yet
+	client3, _ := dial(3)
+	defer client3.Close()
+	select {
+	case m := <-raftch:
+		t.Fatal("Pool exceeded its capacity", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// overflow is refused right away
+	client4, cresp4 := dial(4)
+	defer client4.Close()
+	resp, err := cresp4.ReadString('\n')
+	assert(t, err == nil, err)
+	assert_eq(t, resp, "ERR503 Service unavailable\r\n", "Bad response", resp)
+
+	// worker is freed once its client leaves, and picks up the queued one
+	client1.Close()
+	msger.RespondToClient(1, "OK")
+	expectReq(3)
+	msger.RespondToClient(2, "OK")
+	msger.RespondToClient(3, "OK")
+}
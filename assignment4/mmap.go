@@ -0,0 +1,17 @@
+// +build !linux
+
+package main
+
+import "os"
+
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmapFile(data []byte) error {
+	return errMmapUnsupported
+}
+
+func msyncFile(data []byte) error {
+	return errMmapUnsupported
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+)
+
+// A flat, append-only mirror of the log which is mmap-ed for reading, so that
+// random access of entries does not need any syscall. The mirror is a cache:
+// it is kept across a clean close, along with the length and the checksum of
+// the log it mirrors (see reuse), and rebuilt from the persistent log if it is
+// missing or stale.
+//
+// The file starts with a header (see mmapHeaderLen), followed by the entries,
+// each prefixed with its length.
+type mmapLog struct {
+	file *os.File
+	data []byte  // mmap-ed region; len(data) is the current file size
+	size int64   // number of bytes in use
+	offs []int64 // offs[idx] = offset of the entry at log index idx
+}
+
+const mmapMinCap = 1 << 20 // 1 MB
+
+// Header: clean flag (uint32), log length (uint64), log CRC32 (uint32)
+const mmapHeaderLen = 16
+
+const mmapClean = 0x6d6c6f67 // "mlog", set on a clean close only
+
+func newMmapLog(path string) (*mmapLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+	ml := &mmapLog{file: file, size: mmapHeaderLen}
+	capacity := int64(mmapMinCap)
+	if info, err := file.Stat(); err == nil && info.Size() > capacity {
+		capacity = info.Size()
+	}
+	if err = ml.remap(capacity); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return ml, nil
+}
+
+// Take up the entries left by the previous clean close, if they mirror a log
+// of length entries whose checksum is crc; otherwise, start afresh. Either
+// way, the mirror is marked as not clean (until the next close) before any
+// change is made to it.
+func (self *mmapLog) reuse(length uint64, crc uint32) (bool, error) {
+	header := self.data[:mmapHeaderLen]
+	ok := binary.BigEndian.Uint32(header) == mmapClean &&
+		binary.BigEndian.Uint64(header[4:]) == length &&
+		binary.BigEndian.Uint32(header[12:]) == crc
+	for ok && self.length() < length {
+		if self.size+4 > int64(len(self.data)) {
+			ok = false
+			break
+		}
+		blobLen := int64(binary.BigEndian.Uint32(self.data[self.size:]))
+		if self.size+4+blobLen > int64(len(self.data)) {
+			ok = false
+			break
+		}
+		self.offs = append(self.offs, self.size)
+		self.size += 4 + blobLen
+	}
+	if !ok {
+		self.size, self.offs = mmapHeaderLen, nil
+	}
+	binary.BigEndian.PutUint32(header, 0)
+	return ok, msyncFile(self.data[:mmapHeaderLen])
+}
+
+func (self *mmapLog) remap(capacity int64) error {
+	if self.data != nil {
+		if err := munmapFile(self.data); err != nil {
+			return err
+		}
+		self.data = nil
+	}
+	if err := self.file.Truncate(capacity); err != nil {
+		return err
+	}
+	data, err := mmapFile(self.file, int(capacity))
+	if err != nil {
+		return err
+	}
+	self.data = data
+	return nil
+}
+
+func (self *mmapLog) length() uint64 {
+	return uint64(len(self.offs))
+}
+
+// Returns the encoded entry at idx, or nil if out of bounds
+func (self *mmapLog) blob(idx uint64) []byte {
+	if idx >= self.length() {
+		return nil
+	}
+	off := self.offs[idx]
+	blobLen := int64(binary.BigEndian.Uint32(self.data[off:]))
+	return self.data[off+4 : off+4+blobLen]
+}
+
+func (self *mmapLog) truncate(idx uint64) {
+	if idx < self.length() {
+		self.size = self.offs[idx]
+		self.offs = self.offs[:idx]
+	}
+}
+
+func (self *mmapLog) append(blob []byte) error {
+	need := self.size + 4 + int64(len(blob))
+	if need > int64(len(self.data)) {
+		capacity := 2 * int64(len(self.data))
+		for capacity < need {
+			capacity *= 2
+		}
+		if err := self.remap(capacity); err != nil {
+			return err
+		}
+	}
+	binary.BigEndian.PutUint32(self.data[self.size:], uint32(len(blob)))
+	copy(self.data[self.size+4:], blob)
+	self.offs = append(self.offs, self.size)
+	self.size = need
+	return nil
+}
+
+// Sync the mirror and mark it as clean, with the checksum of the log, for the
+// next open to reuse it
+func (self *mmapLog) close(crc uint32) {
+	if self.data != nil {
+		if msyncFile(self.data) == nil {
+			header := self.data[:mmapHeaderLen]
+			binary.BigEndian.PutUint64(header[4:], self.length())
+			binary.BigEndian.PutUint32(header[12:], crc)
+			binary.BigEndian.PutUint32(header, mmapClean)
+			_ = msyncFile(header)
+		}
+		_ = munmapFile(self.data)
+		self.data = nil
+	}
+	self.file.Close()
+}
+
+// Close the mirror and remove its file, e.g. after a failed write
+func (self *mmapLog) discard() {
+	if self.data != nil {
+		_ = munmapFile(self.data)
+		self.data = nil
+	}
+	path := self.file.Name()
+	self.file.Close()
+	os.Remove(path)
+}
+
+var errMmapUnsupported = errors.New("mmap is not supported on this platform")
@@ -1,23 +1,52 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"github.com/critiqjo/cs733/assignment4/raft"
 	"github.com/steveyen/gkvlite"
+	"hash/crc32"
 	"log"
 	"os"
+	"sync"
+	"time"
 )
 
 const NilIdx = ^uint64(0)
 
 type SimplePster struct {
+	mutex   sync.Mutex // writers may be concurrent (see PsterOpts.GroupCommit)
 	file    *os.File
 	store   *gkvlite.Store
 	rlog    *gkvlite.Collection
+	rcrcs   *gkvlite.Collection // idx -> rolling CRC32 of rlog up to idx
 	rfields *gkvlite.Collection
+	rsnaps  *gkvlite.Collection // (term, idx) -> snapshot
+	rmeta   *gkvlite.Collection // application metadata (see SetMeta)
+	ruids   *gkvlite.Collection // ClientEntry.UID -> idx (see FindByUID)
+	mlog    *mmapLog            // nil unless mmap mode is enabled
+	group   *groupCommit
+	comp    Compressor // nil unless compression is enabled
 	err     *log.Logger
 }
 
+type PsterOpts struct {
+	// Mirror the log to an mmap-ed file (at dbpath.mlog) for fast random
+	// reads. If mmap is not available on the platform, this silently falls
+	// back to reading directly from the store.
+	Mmap bool
+	// If non-zero, writes wait for a common flush that is done at most once
+	// in every GroupCommit interval, instead of flushing on every write
+	GroupCommit time.Duration
+	// If not nil, log entries are compressed before writing (a log has to be
+	// always opened with the same Compressor)
+	Compressor Compressor
+}
+
 func (self *SimplePster) lastIdx() uint64 { // {{{1
+	if self.mlog != nil {
+		return self.mlog.length() - 1 // NilIdx if empty
+	}
 	tailItem, _ := self.rlog.MaxItem(false)
 	var tailIdx uint64 = NilIdx
 	if tailItem != nil {
@@ -28,11 +57,18 @@ func (self *SimplePster) lastIdx() uint64 { // {{{1
 
 // ---- quack like a Persister {{{1
 func (self *SimplePster) Entry(idx uint64) *raft.RaftEntry {
-	blob, _ := self.rlog.Get(U64Enc(idx))
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var blob []byte
+	if self.mlog != nil {
+		blob = self.mlog.blob(idx)
+	} else {
+		blob, _ = self.rlog.Get(U64Enc(idx))
+	}
 	if blob == nil {
 		return nil
 	}
-	entry, err := LogValDec(blob)
+	entry, err := LogValDecEx(blob, self.comp)
 	if err != nil {
 		self.err.Print(err.Error())
 		return nil // panic?
@@ -40,13 +76,38 @@ func (self *SimplePster) Entry(idx uint64) *raft.RaftEntry {
 	return entry
 }
 
+// The size of the stored (encoded, and maybe compressed) entry
+func (self *SimplePster) EntrySize(idx uint64) uint64 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.mlog != nil {
+		return uint64(len(self.mlog.blob(idx)))
+	}
+	blob, _ := self.rlog.Get(U64Enc(idx))
+	return uint64(len(blob))
+}
+
 func (self *SimplePster) LastEntry() (uint64, *raft.RaftEntry) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.mlog != nil {
+		lastIdx := self.lastIdx()
+		if lastIdx == NilIdx {
+			return 0, nil
+		}
+		entry, err := LogValDecEx(self.mlog.blob(lastIdx), self.comp)
+		if err != nil {
+			self.err.Print(err.Error())
+			return 0, nil // panic?
+		}
+		return lastIdx, entry
+	}
 	item, _ := self.rlog.MaxItem(true)
 	if item == nil {
 		return 0, nil
 	}
 	idx := U64Dec(item.Key)
-	entry, err := LogValDec(item.Val)
+	entry, err := LogValDecEx(item.Val, self.comp)
 	if err != nil {
 		self.err.Print(err.Error())
 		return 0, nil // panic?
@@ -55,6 +116,8 @@ func (self *SimplePster) LastEntry() (uint64, *raft.RaftEntry) {
 }
 
 func (self *SimplePster) LogSlice(startIdx uint64, endIdx uint64) ([]raft.RaftEntry, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 	lastIdx := self.lastIdx()
 	if lastIdx == NilIdx {
 		if startIdx == 0 && endIdx == 0 {
@@ -62,7 +125,7 @@ func (self *SimplePster) LogSlice(startIdx uint64, endIdx uint64) ([]raft.RaftEn
 		} else {
 			return nil, false
 		}
-	} else if startIdx > endIdx {
+	} else if startIdx > endIdx || startIdx > lastIdx+1 {
 		return nil, false
 	} else if startIdx == lastIdx+1 {
 		return nil, true
@@ -70,6 +133,16 @@ func (self *SimplePster) LogSlice(startIdx uint64, endIdx uint64) ([]raft.RaftEn
 		endIdx = lastIdx + 1
 	}
 	var entries []raft.RaftEntry
+	if self.mlog != nil {
+		for idx := startIdx; idx < endIdx; idx += 1 {
+			entry, err := LogValDecEx(self.mlog.blob(idx), self.comp)
+			if err != nil {
+				panic("Corrupted log entry!")
+			}
+			entries = append(entries, *entry)
+		}
+		return entries, true
+	}
 	var idx = startIdx
 	iter_cb := func(item *gkvlite.Item) bool {
 		if idx >= endIdx {
@@ -79,7 +152,7 @@ func (self *SimplePster) LogSlice(startIdx uint64, endIdx uint64) ([]raft.RaftEn
 			panic("Corrupted log!")
 		}
 
-		entry, err := LogValDec(item.Val)
+		entry, err := LogValDecEx(item.Val, self.comp)
 		if err != nil {
 			panic("Corrupted log entry!")
 		}
@@ -92,39 +165,206 @@ func (self *SimplePster) LogSlice(startIdx uint64, endIdx uint64) ([]raft.RaftEn
 }
 
 func (self *SimplePster) LogUpdate(startIdx uint64, slice []raft.RaftEntry) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.canUpdate(self.lastIdx(), startIdx) {
+		return false
+	} else if len(slice) == 0 {
+		return true // nothing to update
+	}
+	return self.logUpdate(startIdx, slice) && self.sync()
+}
+
+// All the updates are committed together by a single flush
+func (self *SimplePster) LogUpdateBatch(updates []raft.LogUpdateOp) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 	lastIdx := self.lastIdx()
+	for _, op := range updates { // check all of them before changing anything
+		if !self.canUpdate(lastIdx, op.StartIdx) {
+			return false
+		} else if len(op.Entries) > 0 {
+			lastIdx = op.StartIdx + uint64(len(op.Entries)) - 1
+		}
+	}
+	for _, op := range updates {
+		if len(op.Entries) > 0 && !self.logUpdate(op.StartIdx, op.Entries) {
+			return false
+		}
+	}
+	return self.sync()
+}
 
-	if (lastIdx == NilIdx && startIdx == 0) || (lastIdx+1 >= startIdx) {
-		if len(slice) == 0 {
-			return true // nothing to update
-		}
-		if lastIdx != NilIdx { // truncate
-			newTailIdx := startIdx + uint64(len(slice)) - 1
-			for idx := lastIdx; idx > newTailIdx; idx -= 1 {
-				deleted, _ := self.rlog.Delete(U64Enc(idx))
-				if !deleted {
-					panic("Corrupt log!")
-				}
+func (self *SimplePster) canUpdate(lastIdx, startIdx uint64) bool {
+	return (lastIdx == NilIdx && startIdx == 0) || (lastIdx+1 >= startIdx)
+}
+
+// Update the log without flushing it; slice should not be empty
+func (self *SimplePster) logUpdate(startIdx uint64, slice []raft.RaftEntry) bool {
+	lastIdx := self.lastIdx()
+	if lastIdx != NilIdx {
+		for idx := startIdx; idx <= lastIdx; idx += 1 { // deleted or overwritten
+			if !self.unindexUID(idx) {
+				return false
 			}
 		}
-		idx := startIdx
-		for _, entry := range slice { // append/update
-			blob, err := LogValEnc(&entry)
-			if err != nil {
-				panic("Impossible encode error!!")
+	}
+	if lastIdx != NilIdx { // truncate
+		newTailIdx := startIdx + uint64(len(slice)) - 1
+		for idx := lastIdx; idx > newTailIdx; idx -= 1 {
+			deleted, _ := self.rlog.Delete(U64Enc(idx))
+			if !deleted {
+				panic("Corrupt log!")
 			}
-			err = self.rlog.Set(U64Enc(idx), blob)
-			if err != nil {
+			self.rcrcs.Delete(U64Enc(idx))
+		}
+	}
+	idx := startIdx
+	crc := self.crcAt(startIdx - 1)
+	if self.mlog != nil {
+		self.mlog.truncate(startIdx)
+	}
+	for _, entry := range slice { // append/update
+		blob, err := LogValEncEx(&entry, self.comp)
+		if err != nil {
+			panic("Impossible encode error!!")
+		}
+		err = self.rlog.Set(U64Enc(idx), blob)
+		if err != nil {
+			return false
+		} // panic??
+		crc = crc32.Update(crc, crc32.IEEETable, blob)
+		if self.rcrcs.Set(U64Enc(idx), U32Enc(crc)) != nil {
+			return false
+		}
+		if entry.CEntry != nil && entry.CEntry.UID != 0 {
+			if self.ruids.Set(U64Enc(entry.CEntry.UID), U64Enc(idx)) != nil {
 				return false
-			} // panic??
-			idx += 1
+			}
+		}
+		if self.mlog != nil {
+			self.mirror(blob)
 		}
-		return self.Sync()
+		idx += 1
 	}
-	return false
+	return true
+}
+
+// Drop the UID of the entry at idx from the index, unless a later entry took
+// it over
+func (self *SimplePster) unindexUID(idx uint64) bool {
+	blob, _ := self.rlog.Get(U64Enc(idx))
+	if blob == nil {
+		return true
+	}
+	entry, err := LogValDecEx(blob, self.comp)
+	if err != nil {
+		self.err.Print(err.Error())
+		return false
+	}
+	if entry.CEntry == nil || entry.CEntry.UID == 0 {
+		return true
+	}
+	key := U64Enc(entry.CEntry.UID)
+	if val, _ := self.ruids.Get(key); val != nil && U64Dec(val) == idx {
+		_, err = self.ruids.Delete(key)
+	}
+	return err == nil
+}
+
+// Index the UIDs of a log which has none indexed (as those written before the
+// index was added)
+func (self *SimplePster) fillUIDs() error {
+	if item, _ := self.ruids.MinItem(false); item != nil {
+		return nil
+	}
+	var err error
+	filled := false
+	self.rlog.VisitItemsAscend(U64Enc(0), true, func(item *gkvlite.Item) bool {
+		var entry *raft.RaftEntry
+		if entry, err = LogValDecEx(item.Val, self.comp); err != nil {
+			return false
+		}
+		if entry.CEntry != nil && entry.CEntry.UID != 0 {
+			err = self.ruids.Set(U64Enc(entry.CEntry.UID), item.Key)
+			filled = true
+		}
+		return err == nil
+	})
+	if err == nil && filled && !self.sync() {
+		err = errors.New("Failed to store the UID index")
+	}
+	return err
+}
+
+// Checksum up to (and including) the entry at idx; 0 if there is none
+func (self *SimplePster) crcAt(idx uint64) uint32 {
+	if idx == NilIdx {
+		return 0
+	}
+	blob, _ := self.rcrcs.Get(U64Enc(idx))
+	if len(blob) != 4 {
+		return 0
+	}
+	return U32Dec(blob)
+}
+
+// Recompute the checksum of every entry from its blob, and compare it to the
+// stored one. If fill, missing checksums are computed and stored instead
+// (logs written before the checksums were added have none).
+func (self *SimplePster) checkCRCs(fill bool) error {
+	var crc uint32
+	var err error
+	filled := false
+	self.rlog.VisitItemsAscend(U64Enc(0), true, func(item *gkvlite.Item) bool {
+		idx := U64Dec(item.Key)
+		crc = crc32.Update(crc, crc32.IEEETable, item.Val)
+		stored, _ := self.rcrcs.Get(item.Key)
+		if stored == nil && fill {
+			err = self.rcrcs.Set(item.Key, U32Enc(crc))
+			filled = true
+		} else if stored == nil {
+			err = fmt.Errorf("Missing checksum of log entry %v", idx)
+		} else if U32Dec(stored) != crc {
+			err = fmt.Errorf("Checksum mismatch at log entry %v", idx)
+		}
+		return err == nil
+	})
+	if err == nil && filled && !self.sync() {
+		err = errors.New("Failed to store the log checksums")
+	}
+	return err
+}
+
+// Flush the store (even with GroupCommit, without waiting for the next group
+// flush) and sync the file
+func (self *SimplePster) Fsync() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if err := self.store.Flush(); err != nil {
+		return err
+	}
+	return fdatasync(self.file)
+}
+
+// The rolling CRC32 (IEEE) of the stored blobs of all the entries, in order
+func (self *SimplePster) CRC32() uint32 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.crcAt(self.lastIdx())
+}
+
+// Check the log against its checksums, to detect silent corruption (this
+// reads the whole log)
+func (self *SimplePster) VerifyIntegrity() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.checkCRCs(false)
 }
 
 func (self *SimplePster) GetFields() *raft.RaftFields {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 	blob, _ := self.rfields.Get([]byte{0})
 	if blob == nil {
 		return nil
@@ -133,20 +373,159 @@ func (self *SimplePster) GetFields() *raft.RaftFields {
 }
 
 func (self *SimplePster) SetFields(fields raft.RaftFields) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 	err := self.rfields.Set([]byte{0}, FieldsEnc(&fields))
 	if err != nil {
 		return false
 	}
-	return self.Sync()
+	return self.sync()
+}
+
+// ---- quack like a CommitPersister {{{1
+
+// Kept along with the fields, but not flushed by itself: it is made durable by
+// the next write that is (an older index is safe to restart from)
+func (self *SimplePster) GetCommitIdx() uint64 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	blob, _ := self.rfields.Get([]byte{1})
+	if len(blob) != 8 {
+		return 0
+	}
+	return U64Dec(blob)
+}
+
+func (self *SimplePster) SetCommitIdx(idx uint64) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.rfields.Set([]byte{1}, U64Enc(idx)) == nil
+}
+
+// Look up the latest entry of the client request uid in the log; unlike the
+// node's own map, this covers the whole log, across restarts
+func (self *SimplePster) FindByUID(uid uint64) (uint64, *raft.RaftEntry, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	val, _ := self.ruids.Get(U64Enc(uid))
+	if val == nil {
+		return 0, nil, false
+	}
+	idx := U64Dec(val)
+	blob, _ := self.rlog.Get(U64Enc(idx))
+	if blob == nil {
+		return 0, nil, false
+	}
+	entry, err := LogValDecEx(blob, self.comp)
+	if err != nil {
+		self.err.Print(err.Error())
+		return 0, nil, false
+	}
+	return idx, entry, true
+}
+
+// ---- quack like a SnapshotPersister {{{1
+func snapKey(term, idx uint64) []byte {
+	return append(U64Enc(term), U64Enc(idx)...)
+}
+
+func (self *SimplePster) SaveSnapshot(term, idx uint64, data []byte) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if err := self.rsnaps.Set(snapKey(term, idx), data); err != nil {
+		return false
+	}
+	return self.sync()
+}
+
+func (self *SimplePster) LoadSnapshot(term, idx uint64) ([]byte, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	data, err := self.rsnaps.Get(snapKey(term, idx))
+	return data, err == nil && data != nil
+}
+
+func (self *SimplePster) DropSnapshot(term, idx uint64) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	deleted, err := self.rsnaps.Delete(snapKey(term, idx))
+	if err != nil || !deleted {
+		return false
+	}
+	return self.sync()
+}
+
+// Persist a small piece of application metadata (like a schema version) in
+// the same store, with the same durability as SetFields; a nil val deletes key
+func (self *SimplePster) SetMeta(key string, val []byte) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var err error
+	if val == nil {
+		_, err = self.rmeta.Delete([]byte(key))
+	} else {
+		err = self.rmeta.Set([]byte(key), val)
+	}
+	if err != nil {
+		return false
+	}
+	return self.sync()
+}
+
+// Should return nil if no record
+func (self *SimplePster) GetMeta(key string) []byte {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	val, _ := self.rmeta.Get([]byte(key))
+	return val
 }
 
 func (self *SimplePster) Sync() bool {
-	err := self.store.Flush()
-	// No need to file.Sync() due to O_SYNC
-	return err == nil
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.sync()
+}
+
+// Must be called with the mutex held
+func (self *SimplePster) sync() bool {
+	if self.group == nil {
+		err := self.store.Flush()
+		// No need to file.Sync() due to O_SYNC
+		return err == nil
+	}
+	return self.group.wait() == nil
+}
+
+// Keep the mmap-ed mirror in sync with the persisted log, appending the blob
+// just written to it
+func (self *SimplePster) mirror(blob []byte) {
+	if err := self.mlog.append(blob); err != nil {
+		self.mirrorFailed(err)
+	}
+}
+
+func (self *SimplePster) mirrorFailed(err error) {
+	self.err.Print("mmap failed; falling back to direct reads: ", err)
+	self.mlog.discard()
+	self.mlog = nil
+}
+
+// ---- quack like a raft.GroupCommitter {{{1
+
+// Start group commit (see PsterOpts.GroupCommit), unless it is on already
+func (self *SimplePster) SetGroupCommit(interval time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.group == nil && interval > 0 {
+		self.group = newGroupCommit(&self.mutex, interval, self.store.Flush)
+	}
 }
 
 func NewPster(dbpath string, errlog *log.Logger) (*SimplePster, error) { // {{{1
+	return NewPsterEx(dbpath, PsterOpts{}, errlog)
+}
+
+func NewPsterEx(dbpath string, opts PsterOpts, errlog *log.Logger) (*SimplePster, error) {
 	var store *gkvlite.Store
 	file, err := os.OpenFile(dbpath, os.O_RDWR|os.O_CREATE|os.O_SYNC, 0660)
 	if err != nil {
@@ -156,15 +535,70 @@ func NewPster(dbpath string, errlog *log.Logger) (*SimplePster, error) { // {{{1
 	if err != nil {
 		return nil, err
 	}
-	return &SimplePster{
+	pster := &SimplePster{
 		file:    file,
 		store:   store,
 		rlog:    store.SetCollection("rlog", nil),
+		rcrcs:   store.SetCollection("rcrcs", nil),
 		rfields: store.SetCollection("rfields", nil),
+		rsnaps:  store.SetCollection("rsnaps", nil),
+		rmeta:   store.SetCollection("rmeta", nil),
+		ruids:   store.SetCollection("ruids", nil),
+		mlog:    nil,
+		group:   nil,
+		comp:    opts.Compressor,
 		err:     errlog,
-	}, nil
+	}
+	if err = pster.checkCRCs(true); err != nil {
+		store.Close()
+		return nil, err
+	}
+	if err = pster.fillUIDs(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	if opts.Mmap {
+		var mlog *mmapLog
+		mlog, err = newMmapLog(dbpath + ".mlog")
+		if err == nil {
+			pster.openMirror(mlog)
+		} else if err != errMmapUnsupported {
+			return nil, err
+		}
+	}
+	pster.SetGroupCommit(opts.GroupCommit)
+	return pster, nil
+}
+
+// Reuse the mirror left by the previous Close if it matches the log, or else
+// rebuild it, one entry at a time
+func (self *SimplePster) openMirror(mlog *mmapLog) {
+	lastIdx := self.lastIdx() // from the store, as self.mlog is not set yet
+	self.mlog = mlog
+	reused, err := self.mlog.reuse(lastIdx+1, self.crcAt(lastIdx))
+	if err != nil {
+		self.mirrorFailed(err)
+		return
+	} else if reused {
+		return
+	}
+	self.rlog.VisitItemsAscend(U64Enc(0), true, func(item *gkvlite.Item) bool {
+		if U64Dec(item.Key) != self.mlog.length() { // sanity check
+			panic("Corrupted log!")
+		}
+		self.mirror(item.Val)
+		return self.mlog != nil
+	})
 }
 
 func (self *SimplePster) Close() { // {{{1
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.group != nil {
+		self.group.stop()
+	}
+	if self.mlog != nil {
+		self.mlog.close(self.crcAt(self.lastIdx()))
+	}
 	self.store.Close()
 }
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"github.com/critiqjo/cs733/assignment4/raft"
+	"github.com/critiqjo/cs733/assignment4/testutil"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func initPster(t *testing.T, dbpath string) *SimplePster {
@@ -42,7 +48,7 @@ func TestSimplePster(t *testing.T) {
 		t.Fatal("Failed to persist log entry")
 	}
 
-	fields := raft.RaftFields{Term: 20, VotedFor: 9}
+	fields := raft.RaftFields{Term: 20, VotedFor: 9, HasVoted: true}
 	ok = pster.SetFields(fields)
 	if !ok {
 		t.Fatal("Failed to persist fields")
@@ -60,3 +66,332 @@ func TestSimplePster(t *testing.T) {
 	}
 	pster_dup.Close()
 }
+
+func TestSimplePsterContract(t *testing.T) {
+	for _, opts := range []PsterOpts{{}, {Mmap: true}} {
+		testutil.PersisterContractTest(t, func() raft.Persister {
+			dir, err := ioutil.TempDir("", "testpster")
+			if err != nil {
+				t.Fatal(err)
+			}
+			errlog := log.New(os.Stderr, "-- ", log.Lshortfile)
+			pster, err := NewPsterEx(dir+"/testdb.gkv", opts, errlog)
+			if err != nil {
+				t.Fatal("Creating persister failed:", err)
+			}
+			t.Cleanup(func() {
+				pster.Close()
+				os.RemoveAll(dir)
+			})
+			return pster
+		})
+	}
+}
+
+func TestSimplePsterMeta(t *testing.T) {
+	dbpath := "/tmp/testdb-meta.gkv"
+	os.Remove(dbpath)
+	defer os.Remove(dbpath)
+	pster := initPster(t, dbpath)
+
+	if pster.GetMeta("schema") != nil {
+		t.Fatal("Metadata in a new store")
+	}
+	if !pster.SetMeta("schema", []byte("v2")) || !pster.SetMeta("owner", []byte("ops")) {
+		t.Fatal("Failed to persist metadata")
+	}
+	entries := []raft.RaftEntry{{Term: 0, CEntry: nil}, {Term: 1, CEntry: nil}}
+	if !pster.LogUpdate(0, entries) || !pster.SetFields(raft.RaftFields{Term: 1, VotedFor: 2, HasVoted: true}) {
+		t.Fatal("Failed to persist log or fields")
+	}
+	if !pster.SetMeta("owner", nil) {
+		t.Fatal("Failed to delete metadata")
+	}
+
+	pster_dup := initPster(t, dbpath)
+	if val := pster_dup.GetMeta("schema"); string(val) != "v2" {
+		t.Fatal("Metadata was not synced with disk!", val)
+	}
+	if val := pster_dup.GetMeta("owner"); val != nil {
+		t.Fatal("Deleted metadata is still there", val)
+	}
+	if idx, _ := pster_dup.LastEntry(); idx != 1 {
+		t.Fatal("Metadata changed the log", idx)
+	}
+	if fields := pster_dup.GetFields(); fields == nil || fields.Term != 1 {
+		t.Fatal("Metadata changed the fields", fields)
+	}
+	pster_dup.Close()
+	pster.Close()
+}
+
+func TestSimplePsterBatch(t *testing.T) {
+	dbpath := "/tmp/testdb-batch.gkv"
+	os.Remove(dbpath)
+	defer os.Remove(dbpath)
+	pster := initPster(t, dbpath)
+
+	entries := make([]raft.RaftEntry, 6)
+	for i := range entries {
+		entries[i] = raft.RaftEntry{Term: uint64(i / 2), CEntry: &raft.ClientEntry{UID: uint64(1000 + i), Data: "Yo!"}}
+	}
+	ok := pster.LogUpdateBatch([]raft.LogUpdateOp{{0, entries[:4]}, {2, entries[4:]}})
+	if !ok {
+		t.Fatal("Failed to persist batch")
+	}
+	want := append(append([]raft.RaftEntry(nil), entries[:2]...), entries[4:]...)
+	if slice, ok := pster.LogSlice(0, 9); !ok || !reflect.DeepEqual(slice, want) {
+		t.Fatal("Bad log after batch", slice)
+	}
+
+	// a bad update anywhere in the batch leaves the log untouched
+	ok = pster.LogUpdateBatch([]raft.LogUpdateOp{{1, entries[:1]}, {9, entries[:1]}})
+	if ok {
+		t.Fatal("Persisted a batch with a gap")
+	}
+	pster_dup := initPster(t, dbpath)
+	if slice, ok := pster_dup.LogSlice(0, 9); !ok || !reflect.DeepEqual(slice, want) {
+		t.Fatal("Log changed by a failed batch", slice)
+	}
+	pster_dup.Close()
+	pster.Close()
+}
+
+func TestSimplePsterFindByUID(t *testing.T) {
+	dbpath := "/tmp/testdb-uids.gkv"
+	os.Remove(dbpath)
+	defer os.Remove(dbpath)
+	pster := initPster(t, dbpath)
+
+	entries := []raft.RaftEntry{{Term: 0, CEntry: nil}}
+	for i := 1; i <= 5; i += 1 {
+		entries = append(entries, raft.RaftEntry{Term: 1, CEntry: &raft.ClientEntry{UID: uint64(1000 + i), Data: "Yo!"}})
+	}
+	if !pster.LogUpdate(0, entries) {
+		t.Fatal("Failed to persist log entries")
+	}
+	// 1004 and 1005 are overwritten, and 1003 is appended again after them
+	rewrite := []raft.RaftEntry{{Term: 2, CEntry: &raft.ClientEntry{UID: 1006, Data: "Yo!"}}, entries[3]}
+	if !pster.LogUpdate(4, rewrite) {
+		t.Fatal("Failed to persist log entries")
+	}
+	pster.Close()
+
+	pster = initPster(t, dbpath)
+	defer pster.Close()
+	want := map[uint64]uint64{1001: 1, 1002: 2, 1003: 5, 1006: 4}
+	for uid, wantIdx := range want {
+		idx, entry, found := pster.FindByUID(uid)
+		if !found || idx != wantIdx || entry.CEntry.UID != uid {
+			t.Fatal("Bad lookup of", uid, idx, entry, found)
+		}
+	}
+	for _, uid := range []uint64{1004, 1005, 0} {
+		if idx, _, found := pster.FindByUID(uid); found {
+			t.Fatal("Found a dropped uid", uid, idx)
+		}
+	}
+}
+
+func TestSimplePsterMirror(t *testing.T) {
+	dbpath := "/tmp/testdb-mirror.gkv"
+	os.Remove(dbpath)
+	os.Remove(dbpath + ".mlog")
+	defer os.Remove(dbpath)
+	defer os.Remove(dbpath + ".mlog")
+	errlog := log.New(os.Stderr, "-- ", log.Lshortfile)
+	open := func(useMmap bool) *SimplePster {
+		pster, err := NewPsterEx(dbpath, PsterOpts{Mmap: useMmap}, errlog)
+		if err != nil {
+			t.Fatal("Creating persister failed:", err)
+		}
+		return pster
+	}
+	checkLog := func(pster *SimplePster, want []raft.RaftEntry) {
+		if pster.mlog == nil {
+			t.Skip("mmap is not supported on this platform")
+		}
+		entries, ok := pster.LogSlice(0, uint64(len(want)))
+		if !ok || !reflect.DeepEqual(entries, want) {
+			t.Fatal("Bad log through the mirror", entries, want)
+		}
+	}
+
+	entries := []raft.RaftEntry{{Term: 0, CEntry: nil}}
+	for i := 1; i <= 5; i += 1 {
+		entries = append(entries, raft.RaftEntry{Term: 1, CEntry: &raft.ClientEntry{UID: uint64(1000 + i), Data: "Yo!"}})
+	}
+	pster := open(true)
+	if !pster.LogUpdate(0, entries) {
+		t.Fatal("Failed to persist log entries")
+	}
+	crc := pster.CRC32()
+	pster.Close()
+
+	ml, err := newMmapLog(dbpath + ".mlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused, err := ml.reuse(uint64(len(entries)), crc+1); reused || err != nil {
+		t.Fatal("Reused a mirror of another log", err)
+	}
+	ml.close(crc) // now clean and empty
+	ml, _ = newMmapLog(dbpath + ".mlog")
+	if reused, err := ml.reuse(0, crc); !reused || err != nil || ml.length() != 0 {
+		t.Fatal("Clean mirror not reused", err, ml.length())
+	}
+	ml.discard()
+
+	pster = open(true) // rebuilt, as it was discarded
+	checkLog(pster, entries)
+	pster.Close()
+
+	// tamper with the last entry in the clean mirror, which shows through
+	// only if the mirror is reused rather than rebuilt
+	mlog, err := ioutil.ReadFile(dbpath + ".mlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := bytes.LastIndex(mlog, []byte("Yo!"))
+	if at < 0 {
+		t.Fatal("Entry data not found in the mirror")
+	}
+	mlog[at+2] = '?'
+	if err = ioutil.WriteFile(dbpath+".mlog", mlog, 0660); err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]raft.RaftEntry(nil), entries...)
+	tampered[5] = raft.RaftEntry{Term: 1, CEntry: &raft.ClientEntry{UID: 1005, Data: "Yo?"}}
+	pster = open(true) // reused
+	checkLog(pster, tampered)
+	pster.Close()
+
+	// the same length, but other entries, written without the mirror
+	rewrite := []raft.RaftEntry{{Term: 2, CEntry: &raft.ClientEntry{UID: 1006, Data: "Yo!"}}, entries[3]}
+	pster = open(false)
+	if !pster.LogUpdate(4, rewrite) {
+		t.Fatal("Failed to persist log entries")
+	}
+	pster.Close()
+	pster = open(true) // stale, so rebuilt
+	defer pster.Close()
+	checkLog(pster, append(entries[:4], rewrite...))
+}
+
+func TestSimplePsterBackup(t *testing.T) {
+	dbpath, restpath := "/tmp/testdb-backup.gkv", "/tmp/testdb-restored.gkv"
+	os.Remove(dbpath)
+	os.Remove(restpath)
+	defer os.Remove(dbpath)
+	defer os.Remove(restpath)
+	pster := initPster(t, dbpath)
+	defer pster.Close()
+
+	entries := []raft.RaftEntry{{Term: 0, CEntry: nil}}
+	for i := 1; i <= 5; i += 1 {
+		entries = append(entries, raft.RaftEntry{Term: 1, CEntry: &raft.ClientEntry{UID: uint64(1000 + i), Data: "Yo!"}})
+	}
+	fields := raft.RaftFields{Term: 1, VotedFor: 2, HasVoted: true}
+	if !pster.LogUpdate(0, entries) || !pster.SetFields(fields) || !pster.SetMeta("schema", []byte("v2")) {
+		t.Fatal("Failed to persist the log")
+	}
+	backup, err := pster.Snapshot()
+	if err != nil {
+		t.Fatal("Backup failed:", err)
+	}
+
+	errlog := log.New(os.Stderr, "-- ", log.Lshortfile)
+	corrupt := append([]byte(nil), backup...)
+	corrupt[len(corrupt)/2] ^= 1
+	if _, err = RestoreBackup(restpath, bytes.NewReader(corrupt), errlog); err == nil {
+		t.Fatal("Restored a corrupted backup")
+	}
+	restored, err := RestoreBackup(restpath, bytes.NewReader(backup), errlog)
+	if err != nil {
+		t.Fatal("Restore failed:", err)
+	}
+	defer restored.Close()
+	if slice, ok := restored.LogSlice(0, 9); !ok || !reflect.DeepEqual(slice, entries) {
+		t.Fatal("Bad log after restore", slice)
+	}
+	if got := restored.GetFields(); !reflect.DeepEqual(got, &fields) {
+		t.Fatal("Bad fields after restore", got)
+	}
+	if val := restored.GetMeta("schema"); string(val) != "v2" {
+		t.Fatal("Bad metadata after restore", val)
+	}
+	if restored.CRC32() != pster.CRC32() {
+		t.Fatal("Checksum changed by backup and restore")
+	}
+	if _, err = RestoreBackup(restpath, bytes.NewReader(backup), errlog); err == nil {
+		t.Fatal("Restored over an existing log")
+	}
+}
+
+func benchPsterEntry(b *testing.B, useMmap bool) {
+	dbpath := "/tmp/benchdb.gkv"
+	os.Remove(dbpath)
+	defer os.Remove(dbpath)
+	errlog := log.New(os.Stderr, "-- ", log.Lshortfile)
+	pster, err := NewPsterEx(dbpath, PsterOpts{Mmap: useMmap}, errlog)
+	if err != nil {
+		b.Fatal("Creating persister failed:", err)
+	}
+	defer pster.Close()
+
+	const numEntries = 100000
+	entries := make([]raft.RaftEntry, 1000)
+	for i := uint64(0); i < numEntries; i += uint64(len(entries)) {
+		for j := range entries {
+			entries[j] = raft.RaftEntry{Term: i, CEntry: &raft.ClientEntry{UID: i + uint64(j), Data: "Yo!"}}
+		}
+		if !pster.LogUpdate(i, entries) {
+			b.Fatal("Failed to persist log entries")
+		}
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if pster.Entry(uint64(rng.Int63n(numEntries))) == nil {
+			b.Fatal("Missing entry")
+		}
+	}
+}
+
+func BenchmarkPsterEntry(b *testing.B)     { benchPsterEntry(b, false) }
+func BenchmarkPsterEntryMmap(b *testing.B) { benchPsterEntry(b, true) }
+
+func benchPsterConcurrent(b *testing.B, groupCommit time.Duration) {
+	dbpath := "/tmp/benchdb.gkv"
+	os.Remove(dbpath)
+	defer os.Remove(dbpath)
+	errlog := log.New(os.Stderr, "-- ", log.Lshortfile)
+	pster, err := NewPsterEx(dbpath, PsterOpts{GroupCommit: groupCommit}, errlog)
+	if err != nil {
+		b.Fatal("Creating persister failed:", err)
+	}
+	defer pster.Close()
+	entry := raft.RaftEntry{Term: 0, CEntry: nil}
+	if !pster.LogUpdate(0, []raft.RaftEntry{entry}) {
+		b.Fatal("Failed to persist log entry")
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for j := 0; j < 1000; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if !pster.LogUpdate(1, []raft.RaftEntry{entry}) {
+					b.Error("Failed to persist log entry")
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func BenchmarkPsterConcurrent(b *testing.B)            { benchPsterConcurrent(b, 0) }
+func BenchmarkPsterConcurrentGroupCommit(b *testing.B) { benchPsterConcurrent(b, time.Millisecond) }
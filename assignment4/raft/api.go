@@ -1,5 +1,11 @@
 package raft
 
+import (
+    "errors"
+    "math/rand"
+    "time"
+)
+
 type RaftState int
 
 const (
@@ -8,10 +14,106 @@ const (
     Leader
 )
 
-// Reserved node id (internally used to indicate that no vote was cast)
-// If this value is found while calling NewNode(), it returns an error.
+// Not reserved anymore (every uint32 is a valid node id; see
+// RaftFields.HasVoted), but fields persisted before HasVoted have it as
+// VotedFor when no vote was cast
 const NilNode uint32 = ^uint32(0)
 
+type NodeConfig struct {
+    SelfId uint32
+    NodeIds []uint32 // including SelfId
+    NotifBuf int // buffer size of the notification channel
+    MinNodes int // clusters smaller than this are rejected
+    // Max size of unacknowledged entries in flight to each peer (0 = unlimited)
+    LeaderWindowSize uint64
+    // Serialized size of an entry, used for LeaderWindowSize (if nil, every
+    // entry is considered to be of size 1)
+    EntrySize func(*RaftEntry) uint64
+    // If non-zero, Run scales up timeoutBase to the max latency to peers
+    // times this multiplier (see Messenger.Latency)
+    LatencyMultiplier float64
+    // Decides both elections and commits (if nil, a strict majority is used)
+    Quorum QuorumFunc
+    // Store entries without ClientEntry.Data, and never campaign (this node
+    // is then expected to be in Witnesses of every other node)
+    WitnessMode bool
+    // Nodes in witness mode; leaders do not send them ClientEntry.Data
+    Witnesses []uint32
+    // Leadership preference of each node (higher is preferred, missing is 0)
+    Priorities map[uint32]int
+    // Added to the election timeout for every node of a higher priority (if
+    // zero, twice the heartbeat interval is used)
+    PriorityDelay time.Duration
+    // Votes are granted only to candidates of at least this priority (0 is
+    // the lowest), on top of the up-to-date check. Unlike Priorities, this is
+    // a hard rule: a node whose log is the only up-to-date one in a quorum
+    // cannot win unless that quorum has enough nodes of a priority no higher
+    // than its own, and no one else can win either; so with distinct
+    // priorities, a cluster may be left without a leader until the nodes of
+    // higher priority catch up (or are reconfigured).
+    ElectionPriority uint8
+    // Soft cap on the number of entries since the latest snapshot; a leader
+    // reaching it calls SnapshotAt(0) if the Machine is a Snapshotter, or else
+    // logs a warning and raises the cap by half (0 = no cap). The log itself
+    // is never truncated (see SnapshotRestorer), so no follower is ever too
+    // far behind to catch up through AppendEntries.
+    MaxLogEntries uint64
+    // Append a ClockEntry at the start of every term (see RaftNode.Clock)
+    LogicalClock bool
+    // Max number of ClientEntry-s (queued up in the notification channel)
+    // that a leader appends with a single Persister.LogUpdate, and replicates
+    // in a single AppendEntries (if zero, 256 is used; 1 disables coalescing)
+    MaxCoalesce int
+    // Execute committed entries on a goroutine of their own, so that a slow
+    // Machine does not hold up the event loop (LastApplied then lags behind
+    // CommitIndex). The Machine must then be safe for concurrent use, since
+    // TryRespond, Read and ReadResult are still called from the loop.
+    AsyncApply bool
+    // Let the leader assign UIDs (see RaftNode.Propose); the UIDs chosen by
+    // clients must then have the top bit clear, so as not to collide
+    AssignUIDs bool
+    // Consecutive heartbeats left unanswered by a peer, after which the
+    // leader backs off: the interval between the heartbeats to it doubles
+    // every time, up to MaxReplicationBackoff, until it replies (0 = never)
+    ReplicationFailureThreshold int
+    // Cap on the interval between heartbeats to a peer backed off from (0 =
+    // no cap); unless it is below the election timeout, a peer that comes
+    // back may campaign before the next heartbeat reaches it
+    MaxReplicationBackoff time.Duration
+    // Times a failed Persister write (SetFields, LogUpdate(Batch) or Fsync)
+    // is retried, after 10ms and then twice as long every time, holding up
+    // the event loop meanwhile; still failing, it halts the node with a panic
+    // (0 = no retries, and a failed write is logged and ignored)
+    PersistRetries int
+    // Told how long every committed ClientEntry took to apply, from the
+    // commit to the return of the Machine.Execute call that executed it,
+    // under the label of its command (see CommandLabeler); nil = no-op. It is
+    // called from the goroutine which executes the entries (see AsyncApply).
+    ApplyObserver ApplyObserver
+    // Call Persister.Fsync after every change of term or vote
+    SyncOnVote bool
+    // Call Persister.Fsync after every log update, i.e. before a follower
+    // acks the entries (or a leader counts itself in for committing them)
+    SyncBeforeReply bool
+    // Have the Persister flush the log updates written within this interval
+    // together, each LogUpdate blocking until the flush that makes it durable
+    // (0 = every LogUpdate is flushed by itself); NewNodeEx returns
+    // ErrGroupCommitUnsupported unless the Persister is a GroupCommitter
+    GroupCommitInterval time.Duration
+    // Source of the jitter in the timeouts of Run, for reproducible runs; it
+    // is used by the event loop alone, so it must not be shared between nodes
+    // (if nil, a source seeded from crypto/rand is used)
+    Rand *rand.Rand
+}
+
+// Whether acks (the nodes that granted a vote, or have replicated an entry,
+// including self if so) form a quorum of the voting members in nodeIds
+type QuorumFunc func(acks []uint32, nodeIds []uint32) bool
+
+func MajorityQuorum(acks []uint32, nodeIds []uint32) bool {
+    return len(acks) > len(nodeIds) / 2
+}
+
 type RaftEntry struct {
     Term uint64
     CEntry *ClientEntry
@@ -26,6 +128,11 @@ type AppendEntries struct {
     PrevLogTerm uint64
     Entries []RaftEntry
     CommitIdx uint64
+    // Increases with every AppendEntries that a node sends as leader; a
+    // follower answers one that is not newer than the last one it processed
+    // (from the same leader in the same term) with the reply it sent to that
+    // (0 disables this)
+    ReqID uint64
 }
 
 type AppendReply struct {
@@ -33,6 +140,14 @@ type AppendReply struct {
     Success bool
     NodeId uint32
     LastModIdx uint64
+    // The follower's commit index and last log index at the time of the
+    // reply; the leader uses these to fix matchIdx and nextIdx without extra
+    // round trips (0 means not reported)
+    CommitIdx uint64
+    LastLogIdx uint64
+    // AppendEntries.ReqID of the request replied to, so that the leader can
+    // tell replies to requests sent after a point (see RaftNode.Heartbeat)
+    ReqID uint64
 }
 
 type ClientEntry struct {
@@ -40,11 +155,49 @@ type ClientEntry struct {
     Data interface{} // Note: Be careful while deserializing
 }
 
+// A group of client entries that is replicated as a single log entry (as
+// ClientEntry.Data with UID 0), so that either all or none of them are
+// committed. They are passed on to Machine.Execute in a call of their own.
+type BatchClientEntry struct {
+    Entries []ClientEntry
+}
+
+// Request to read key from the local machine without contacting the leader;
+// the result may be stale (see Messenger.ClientReadReply)
+type StaleRead struct {
+    UID uint64
+    Key string
+}
+
+// Request to read key from the leader's machine without appending to the log.
+// It is served only once the leader has committed and applied an entry of its
+// own term (a no-op is appended if needed), so that the machine is up-to-date.
+type LeaderRead struct {
+    UID uint64
+    Key string
+}
+
+// Raft-internal commands are replicated as ClientEntry.Data (with UID 0), and
+// are never passed on to Machine.Execute
+
+// Asks every node to take a snapshot right after applying the entry at Idx
+type SnapshotMarker struct {
+    Idx uint64
+}
+
+// Appended by every new leader at the start of its term; (Term, Idx) of the
+// latest committed one is the logical clock of a node (see RaftNode.Clock)
+type ClockEntry struct {
+    Term uint64
+    Idx uint64 // of the entry itself
+}
+
 type VoteRequest struct {
     Term uint64
     CandidId uint32
     LastLogIdx uint64
     LastLogTerm uint64
+    Priority uint8 // NodeConfig.ElectionPriority of the candidate
 }
 
 type VoteReply struct {
@@ -53,6 +206,26 @@ type VoteReply struct {
     NodeId uint32
 }
 
+// Sent by a leader to a caught-up peer of higher priority, asking it to
+// campaign without waiting for its election timeout
+type TimeoutNow struct {
+    Term uint64
+    LeaderId uint32
+}
+
+// Latency probe (see RaftNode.Ping); SentAt is in nanoseconds since epoch
+type Ping struct {
+    Id uint64
+    NodeId uint32 // sender
+    SentAt int64
+}
+
+type Pong struct {
+    Id uint64 // of the Ping
+    NodeId uint32 // sender
+    SentAt int64 // of the Ping
+}
+
 // Must maintain a map from serverIds to (network) address/socket
 type Messenger interface {
     // the channel through which Raft layer should be notified of new Messages
@@ -66,8 +239,35 @@ type Messenger interface {
 
     // service temporarily unavailable (leader unknown)
     Client503(uid uint64)
+
+    // result of a StaleRead, as of the entry at appliedIdx
+    ClientReadReply(uid uint64, data []byte, appliedIdx uint64)
+
+    // moving average of round-trip times to node, or NoLatencyEstimate
+    Latency(node uint32) time.Duration
+
+    // silently drop all messages to/from node until Connect(node) is called
+    // (for simulating network partitions)
+    Disconnect(node uint32)
+    Connect(node uint32)
 }
 
+// Returned by Messenger.Latency if it does not measure latencies
+const NoLatencyEstimate time.Duration = 0
+
+// A Messenger that does nothing; embed it for no-op defaults
+type NopMessenger struct { }
+
+func (NopMessenger) Register(notifch chan<- Message)       { }
+func (NopMessenger) Send(node uint32, msg Message)         { }
+func (NopMessenger) BroadcastVoteRequest(msg *VoteRequest) { }
+func (NopMessenger) Client301(uid uint64, node uint32)     { }
+func (NopMessenger) Client503(uid uint64)                  { }
+func (NopMessenger) ClientReadReply(uid uint64, data []byte, appliedIdx uint64) { }
+func (NopMessenger) Latency(node uint32) time.Duration     { return NoLatencyEstimate }
+func (NopMessenger) Disconnect(node uint32)                { }
+func (NopMessenger) Connect(node uint32)                   { }
+
 // Caching of log could be done by the implementer
 type Persister interface {
     Entry(idx uint64) *RaftEntry // return nil if out of bounds
@@ -85,16 +285,82 @@ type Persister interface {
     // Append log entries (possibly after truncating the log from startIdx)
     LogUpdate(startIdx uint64, slice []RaftEntry) bool
 
+    // Make everything written so far durable (say, by an fdatasync), in case
+    // the other methods leave it in OS buffers (see NodeConfig.SyncOnVote)
+    Fsync() error
+
+    // Rolling CRC32 checksum of all the log entries in order (0 if the log
+    // is empty), updated incrementally by LogUpdate; the encoding of the
+    // entries that is checksummed is up to the implementation
+    CRC32() uint32
+
     // Should return nil if no record
     GetFields() *RaftFields
 
-    // Return whether it was successfully persisted
+    // Return whether it was successfully persisted. It need not be atomic
+    // with LogUpdate: a new term (or vote) is always persisted before the
+    // log is updated in it, and a crash in between leaves only a term (or
+    // vote) with nothing appended in it, which Raft allows anyway.
     SetFields(RaftFields) bool
 }
 
+// A single LogUpdate (see Persister)
+type LogUpdateOp struct {
+    StartIdx uint64
+    Entries []RaftEntry
+}
+
+// Optional extension of Persister for applying several LogUpdate-s in one
+// transaction: either all of them are persisted in order, or none are (and
+// false is returned). Without it, the updates are done one after the other.
+type BatchPersister interface {
+    LogUpdateBatch(updates []LogUpdateOp) bool
+}
+
+// Optional extension of Persister for storing machine snapshots. Snapshots
+// are keyed by the (term, index) of the last entry they cover, so that a new
+// snapshot does not overwrite an older one which may still be in use (say,
+// while it is being sent to a slow follower); they are kept until dropped.
+type SnapshotPersister interface {
+    SaveSnapshot(term, idx uint64, data []byte) bool
+    LoadSnapshot(term, idx uint64) ([]byte, bool)
+    DropSnapshot(term, idx uint64) bool
+}
+
+// Optional extension of Persister for storing the commit index, which the node
+// saves whenever it advances; NewNodeEx applies the entries up to the stored
+// index (see RaftNode.ApplyEntries), instead of waiting for a leader to commit
+// them again. It need not be synced: an older index (or none) is always safe.
+type CommitPersister interface {
+    GetCommitIdx() uint64 // 0 if no record
+    SetCommitIdx(idx uint64) bool
+}
+
+// Optional extension of Persister for group commit (see
+// NodeConfig.GroupCommitInterval); NewNodeEx calls SetGroupCommit before it
+// writes anything
+type GroupCommitter interface {
+    SetGroupCommit(interval time.Duration)
+}
+
+// Optional extension of Persister for online backups (see RaftNode.BackupLog):
+// Snapshot returns the whole log and the fields (and whatever else the
+// implementation keeps along with them) as one self-contained blob, as of a
+// single point in time, without stopping the node
+type BackupPersister interface {
+    Snapshot() ([]byte, error)
+}
+
+// Optional extension of Persister for reporting the size of an entry as
+// stored, in bytes (0 if there is no entry at idx); see RaftNode.LogStats
+type EntrySizer interface {
+    EntrySize(idx uint64) uint64
+}
+
 type RaftFields struct {
     Term uint64
-    VotedFor uint32
+    VotedFor uint32 // only if HasVoted
+    HasVoted bool
     // configuration details?
 }
 
@@ -107,14 +373,134 @@ type Machine interface {
     // Execute commands (possibly lazily), and respond to clients with results.
     // After this call returns, TryRespond should return true for all of these
     // uids regardless of whether the operation has been applied or is still in
-    // the lazy queue.
+    // the lazy queue. The entries of a BatchClientEntry are passed together,
+    // in a call of their own.
     Execute([]ClientEntry)
 
+    // Read the value of key from the current state (for StaleRead-s)
+    Read(key string) []byte
+
+    // The result of the executed request with uid (for ReadCommitted), or
+    // false if it has not been executed. The Data of a ClientEntry submitted
+    // by ReadCommitted is a read command, and must not change the state.
+    ReadResult(uid uint64) ([]byte, bool)
+
     //TakeSnapshot(*LogState) // should be properly serialized with Execute
     //LoadSnapshot() *LogState
     //SerializeSnapshot() ByteStream?
 }
 
+// Optionally implemented by a Machine to support coordinated snapshots
+type Snapshotter interface {
+    // Called after all the entries up to idx (and none after) are executed
+    Snapshot(idx uint64)
+}
+
+// Optionally implemented by a Machine whose snapshots can be persisted by the
+// node (given a SnapshotPersister), so that it can restart from the latest one
+// (given a SnapshotRestorer too) instead of executing the whole log again
+type SnapshotSerializer interface {
+    // Called after all the entries up to idx (and none after) are executed,
+    // and after Snapshot(idx) if it is a Snapshotter; the data is later passed
+    // on to RestoreSnapshot as it is
+    SerializeSnapshot(idx uint64) ([]byte, error)
+}
+
+// Optionally implemented by a Machine with side effects that must happen only
+// once cluster-wide (like allocating an external resource)
+type LeaderApplier interface {
+    // Called right after Execute, for each of the entries appended by this
+    // node while it was the leader (even if it has stepped down since), so
+    // that no other node calls it for them. It is not called again for the
+    // entries applied again after a restart, and so not at all for entries
+    // that the node did not apply before crashing.
+    LeaderApply(ClientEntry)
+}
+
+// Optionally implemented by a Machine to support RaftNode.Restore
+//
+// Snapshots are never sent between nodes (leaders keep the whole log, so a
+// follower always catches up through AppendEntries), and RestoreSnapshot is
+// only called while the event loop is not running (by Restore, or when a
+// persisted snapshot is loaded in NewNodeEx). So it can take as long as it
+// needs without holding up heartbeats; there is no install to throttle.
+type SnapshotRestorer interface {
+    // Replace the whole state with that of a snapshot taken at idx
+    RestoreSnapshot(idx uint64, data []byte) error
+}
+
+// Optionally implemented by a Machine to tell apart the types of commands for
+// NodeConfig.ApplyObserver; consecutive entries of different labels are then
+// executed by separate Execute calls, so that each is timed on its own
+type CommandLabeler interface {
+    Label(ClientEntry) string
+}
+
+// See NodeConfig.ApplyObserver (and ApplyHistogram)
+type ApplyObserver interface {
+    ObserveApply(label string, latency time.Duration)
+}
+
+// Optionally implemented by a Machine to check its own state before the node
+// runs (see RaftNode.PreflightCheck)
+type MachineValidator interface {
+    Validate() error
+}
+
+// Returned by NewNodeEx (and ValidateConfigChange) if there are fewer than
+// NodeConfig.MinNodes nodes, or none
+var ErrTooFewNodes = errors.New("Not enough nodes!")
+
+// Returned by NewNodeEx if NodeConfig.NodeIds does not contain SelfId
+var ErrSelfNotInSet = errors.New("nodeIds should contain selfId")
+
+// Deprecated: NilNode is a valid node id (see RaftFields.HasVoted), so this is
+// never returned; it is kept only so that callers matching on it still compile.
+var ErrReservedNodeId = errors.New("NilNode is a reserved node id")
+
+// Returned by NewNodeEx (and ValidateConfigChange) if a node id is repeated
+var ErrDuplicateNodeId = errors.New("nodeIds should not have duplicates")
+
+// Returned by NewNodeEx if the Persister fails to log the initial entry of an
+// empty log
+var ErrInitialLogUpdateFailed = errors.New("Initial log update failed")
+
+// Returned by NewNodeEx if NodeConfig.GroupCommitInterval is set, but the
+// Persister is not a GroupCommitter
+var ErrGroupCommitUnsupported = errors.New("Persister does not support group commit")
+
+var ErrNotLeader = errors.New("Not the leader")
+
+var ErrPingTimeout = errors.New("Ping timed out")
+
+// Returned by RaftNode.VerifyLeadership
+var ErrLeadershipLost = errors.New("Leadership could not be confirmed")
+
+// Returned by RaftNode.ReadCommitted if the Machine has no result for the uid
+var ErrNoResult = errors.New("No result for the request")
+
+// Returned by RaftNode.Propose, ProposeBatch and BulkLoad between Quiesce and
+// Unquiesce
+var ErrQuiesced = errors.New("Node is quiesced")
+
+// Returned by RaftNode.CommitHook if a hook is registered already
+var ErrHookAlreadyRegistered = errors.New("A commit hook is registered already")
+
+// Returned by RaftNode.CommitHook if the hook is nil
+var ErrNilHook = errors.New("The commit hook is nil")
+
+// Returned by RaftNode.Restore while the event loop is running
+var ErrRunning = errors.New("Node is running")
+
+// Returned by RaftNode.ValidateConfigChange
+var ErrRemovesLeader = errors.New("Config change removes the leader")
+var ErrNoOverlap = errors.New("Config change shares no node with the current config")
+
+// Returned by RaftNode.Reset if SelfId, NodeIds, NotifBuf, MinNodes,
+// WitnessMode, Witnesses or AsyncApply differ (by GracefulRestart if any but
+// AsyncApply do)
+var ErrImmutableField = errors.New("Field cannot be changed at runtime")
+
 //type LogState struct {
 //    LastInclIdx uint64
 //    LastInclTerm uint64
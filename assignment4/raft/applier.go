@@ -0,0 +1,251 @@
+package raft
+
+import (
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// A call to make on the Machine: Execute(entries) if there are any (followed
+// by LeaderApply of each if leaderApply), or else Snapshot(snapIdx) (followed
+// by SerializeSnapshot, whose results are kept in snapData and snapErr)
+type applyOp struct {
+    entries []ClientEntry
+    idx uint64 // of the log entry of the last one of entries
+    leaderApply bool
+    snapIdx uint64
+    snapTerm uint64 // of the entry at snapIdx
+    snapData []byte
+    snapErr error
+}
+
+// The ops for the committed entries up to (and including) upto, along with
+// what the loop should do once they are done
+type applyTask struct {
+    ops []applyOp
+    upto uint64
+    uids []uint64 // to be removed from idxOfUid
+    clock *ClockEntry // the latest one in the entries, if any
+    observer ApplyObserver // nil unless NodeConfig.ApplyObserver is set
+    hook func(uint64, []ClientEntry) // see CommitHook
+    committed time.Time // when the entries were handed over (if observer)
+}
+
+// Worker executing applyTask-s in order (see NodeConfig.AsyncApply)
+type applier struct {
+    sync.Mutex
+    tasks []*applyTask
+    wake chan struct{} // signalled when a task is pushed
+    stop chan struct{} // closed on exit; the tasks left are still executed
+    done chan struct{} // closed when all the tasks are executed after stop
+}
+
+func newApplier() *applier {
+    return &applier {
+        wake: make(chan struct{}, 1),
+        stop: make(chan struct{}),
+        done: make(chan struct{}),
+    }
+}
+
+func (self *applier) push(task *applyTask) {
+    self.Lock()
+    self.tasks = append(self.tasks, task)
+    self.Unlock()
+    select {
+    case self.wake <- struct{}{}:
+    default: // already signalled
+    }
+}
+
+func (self *applier) pop() (*applyTask, bool) {
+    self.Lock(); defer self.Unlock()
+    if len(self.tasks) == 0 {
+        return nil, false
+    }
+    task := self.tasks[0]
+    self.tasks = self.tasks[1:]
+    return task, true
+}
+
+// Run on a goroutine of its own; every task done is reported to the loop
+func (self *RaftNode) runApplier(a *applier) { // {{{1
+    defer close(a.done)
+    for {
+        task, ok := a.pop()
+        if !ok {
+            select {
+            case <-a.wake:
+                continue
+            case <-a.stop:
+                if task, ok = a.pop(); !ok {
+                    return
+                }
+            }
+        }
+        self.execute(task)
+        select {
+        case self.notifch <- &applied { task }:
+        case <-a.stop: // the loop finishes the rest itself (see stopApplier)
+        }
+    }
+}
+
+func (self *RaftNode) execute(task *applyTask) {
+    ops := task.ops
+    labeler, _ := self.machn.(CommandLabeler)
+    for i := range ops {
+        op := &ops[i]
+        if len(op.entries) > 0 {
+            self.machn.Execute(op.entries)
+            if task.observer != nil {
+                latency := time.Since(task.committed)
+                for _, cEntry := range op.entries {
+                    var label string
+                    if labeler != nil {
+                        label = labeler.Label(cEntry)
+                    }
+                    task.observer.ObserveApply(label, latency)
+                }
+            }
+            if applier, ok := self.machn.(LeaderApplier); ok && op.leaderApply {
+                for _, cEntry := range op.entries {
+                    applier.LeaderApply(cEntry)
+                }
+            }
+            if task.hook != nil {
+                task.hook(op.idx, op.entries)
+            }
+            continue
+        }
+        if snapper, ok := self.machn.(Snapshotter); ok {
+            snapper.Snapshot(op.snapIdx)
+        }
+        if serializer, ok := self.machn.(SnapshotSerializer); ok {
+            op.snapData, op.snapErr = serializer.SerializeSnapshot(op.snapIdx)
+        }
+    }
+}
+
+// Hand the committed entries over to the Machine: right away, or to the
+// applier if there is one
+func (self *RaftNode) applyCommitted() { // {{{1
+    if self.appldQueued >= self.commitIdx {
+        return
+    }
+    task := &applyTask { upto: self.commitIdx, observer: self.cfg.ApplyObserver, hook: self.commitHook }
+    if task.observer != nil {
+        task.committed = time.Now()
+    }
+    labeler, _ := self.machn.(CommandLabeler)
+    var cEntries []ClientEntry
+    var cIdx uint64 // of the last one of cEntries
+    var cLeader bool // leaderApply of cEntries
+    flush := func() {
+        if len(cEntries) > 0 {
+            task.ops = append(task.ops, applyOp { entries: cEntries, idx: cIdx, leaderApply: cLeader })
+            cEntries = nil
+        }
+    }
+    for idx := self.appldQueued + 1; idx <= self.commitIdx; idx += 1 {
+        entry := self.log(idx)
+        cEntry, leader := entry.CEntry, self.ledTerms[entry.Term]
+        if leader != cLeader {
+            flush()
+            cLeader = leader
+        }
+        if cEntry != nil {
+            if marker, ok := cEntry.Data.(*SnapshotMarker); ok {
+                self.snapIdxs[marker.Idx] = true
+                if marker.Idx > self.lastSnapIdx {
+                    self.lastSnapIdx = marker.Idx
+                }
+            } else if clock, ok := cEntry.Data.(*ClockEntry); ok {
+                task.clock = clock
+            } else if batch, ok := cEntry.Data.(*BatchClientEntry); ok {
+                flush()
+                task.ops = append(task.ops, applyOp { entries: batch.Entries, idx: idx, leaderApply: leader })
+                for _, e := range batch.Entries {
+                    task.uids = append(task.uids, e.UID)
+                }
+            } else {
+                if labeler != nil && task.observer != nil && len(cEntries) > 0 &&
+                   labeler.Label(cEntries[0]) != labeler.Label(*cEntry) {
+                    flush()
+                }
+                cEntries, cIdx = append(cEntries, *cEntry), idx
+                task.uids = append(task.uids, cEntry.UID)
+            }
+        }
+        if self.snapIdxs[idx] {
+            flush()
+            task.ops = append(task.ops, applyOp { snapIdx: idx, snapTerm: entry.Term })
+            delete(self.snapIdxs, idx)
+        }
+    }
+    flush()
+    self.appldQueued = self.commitIdx
+    if self.applier != nil {
+        self.applying = append(self.applying, task)
+        self.applier.push(task)
+    } else {
+        self.execute(task)
+        self.finishApply(task)
+    }
+}
+
+// Advance lastAppld past a task executed by the Machine
+func (self *RaftNode) finishApply(task *applyTask) {
+    if self.applier != nil {
+        if len(self.applying) == 0 || self.applying[0] != task {
+            return // reported after stopApplier took care of it
+        }
+        self.applying = self.applying[1:]
+    }
+    for _, uid := range task.uids {
+        delete(self.idxOfUid, uid)
+    }
+    if task.clock != nil {
+        self.clockAtomic.Store(*task.clock)
+    }
+    self.lastAppld = task.upto
+    self.publishApplied()
+    if self.readsReady() {
+        for _, m := range self.pendingReads {
+            self.msger.ClientReadReply(m.UID, self.machn.Read(m.Key), self.lastAppld)
+        }
+        self.pendingReads = nil
+    }
+    self.serveCommitReads()
+    self.saveSnapshots(task.ops)
+}
+
+// Make lastAppld visible to LastApplied, and wake up the ReadBarrier-s
+func (self *RaftNode) publishApplied() {
+    atomic.StoreUint64(&self.lastAppldAtomic, self.lastAppld)
+    self.appldMutex.Lock()
+    close(self.appldCh)
+    self.appldCh = make(chan struct{})
+    self.appldMutex.Unlock()
+}
+
+// Start the applier if NodeConfig.AsyncApply is set
+func (self *RaftNode) startApplier() {
+    if self.cfg.AsyncApply {
+        self.applier = newApplier()
+        go self.runApplier(self.applier)
+    }
+}
+
+// Wait for the applier to execute the tasks left, and finish them
+func (self *RaftNode) stopApplier() {
+    if self.applier == nil {
+        return
+    }
+    close(self.applier.stop)
+    <-self.applier.done
+    for len(self.applying) > 0 {
+        self.finishApply(self.applying[0])
+    }
+    self.applier = nil
+}
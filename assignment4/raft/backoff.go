@@ -0,0 +1,45 @@
+package raft
+
+import "time"
+
+// Tracks the heartbeats to a peer left unanswered (see
+// ReplicationFailureThreshold)
+type replBackoff struct {
+    fails int // heartbeats sent since the last AppendReply
+    delay time.Duration // between heartbeats, once backing off
+    next time.Time // of the next heartbeat, once backing off
+}
+
+// Whether the heartbeat due now should be sent to nodeId; if so, it is
+// counted as a failure until a reply arrives
+func (self *RaftNode) heartbeatDue(nodeId uint32) bool {
+    threshold := self.cfg.ReplicationFailureThreshold
+    if threshold <= 0 {
+        return true
+    }
+    b := self.backoffs[nodeId]
+    now := time.Now()
+    if b.fails >= threshold && now.Before(b.next) {
+        return false
+    }
+    b.fails += 1
+    if b.fails >= threshold {
+        if b.delay == 0 {
+            b.delay = 2 * self.timer.sampler(Leader)
+        } else {
+            b.delay *= 2
+        }
+        if max := self.cfg.MaxReplicationBackoff; max > 0 && b.delay > max {
+            b.delay = max
+        }
+        b.next = now.Add(b.delay)
+    }
+    return true
+}
+
+// The peer is reachable again; back to a heartbeat every interval
+func (self *RaftNode) resetBackoff(nodeId uint32) {
+    if b, ok := self.backoffs[nodeId]; ok {
+        *b = replBackoff { }
+    }
+}
@@ -0,0 +1,39 @@
+package raft
+
+import (
+    "context"
+    "errors"
+    "io"
+)
+
+// Write a backup of the log (see BackupPersister) to w. The snapshot is taken
+// from within the event loop, between two log updates, and written out after
+// the loop has moved on; so a slow w does not hold up the node.
+func (self *RaftNode) BackupLog(ctx context.Context, w io.Writer) error { // {{{1
+    reply := make(chan backupLogReply, 1)
+    select {
+    case self.notifch <- &backupLog { reply }:
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+    var r backupLogReply
+    select {
+    case r = <-reply:
+    case <-ctx.Done():
+        return ctx.Err() // the reply is dropped into the buffer
+    }
+    if r.err != nil {
+        return r.err
+    }
+    _, err := w.Write(r.data)
+    return err
+}
+
+func (self *RaftNode) backupLog() backupLogReply {
+    bpster, ok := self.pster.(BackupPersister)
+    if !ok {
+        return backupLogReply { nil, errors.New("Persister cannot back up the log") }
+    }
+    data, err := bpster.Snapshot()
+    return backupLogReply { data, err }
+}
@@ -0,0 +1,135 @@
+package raft
+
+import (
+    "context"
+    "errors"
+)
+
+// Entries that BulkLoad appends with a single LogUpdate; the loop handles the
+// messages queued up in between chunks, so heartbeats keep flowing
+const bulkLoadChunkSize = 4096
+
+// Append entries (e.g. the initial dataset of a new cluster) to the log in
+// chunks of bulkLoadChunkSize, each with a single LogUpdate and sent to each
+// peer in a single AppendEntries (unless LeaderWindowSize splits it), instead
+// of one ClientEntry at a time; then block until all of them are committed.
+// Only allowed on a leader whose log has no client entries yet, and the UIDs
+// must be unique and non-zero.
+//
+// ErrNotLeader is returned if the node steps down before the load is
+// committed; the entries logged so far may still be committed by the next
+// leader, in which case the load cannot be retried there. Any other entry
+// appended in the middle of the load makes it fail too. On ctx.Err(), the
+// chunks sent so far are left in the log.
+func (self *RaftNode) BulkLoad(ctx context.Context, entries []ClientEntry) error { // {{{1
+    if len(entries) == 0 {
+        return errors.New("Nothing to load")
+    }
+    seen := make(map[uint64]bool, len(entries))
+    for i := range entries {
+        uid := entries[i].UID
+        if uid == 0 || seen[uid] {
+            return errors.New("Duplicate or reserved UID in bulk load")
+        }
+        seen[uid] = true
+    }
+    entries = append([]ClientEntry(nil), entries...) // not shared with the caller
+    reply := make(chan error, 1)
+    for start := 0; start < len(entries); start += bulkLoadChunkSize {
+        end := start + bulkLoadChunkSize
+        if end > len(entries) {
+            end = len(entries)
+        }
+        select {
+        case self.notifch <- &bulkLoad { entries[start:end], start == 0, end == len(entries), reply }:
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+        select {
+        case err := <-reply:
+            if err != nil {
+                return err
+            }
+        case <-ctx.Done():
+            return ctx.Err() // the reply is dropped into the buffer
+        }
+    }
+    return nil
+}
+
+// Append a chunk of a BulkLoad; the last one is answered only once the whole
+// load is committed (see serveBulkLoad)
+func (self *RaftNode) bulkLoadChunk(m *bulkLoad) {
+    lastIdx, _ := self.logTail()
+    var err error
+    if self.quiesced {
+        err = ErrQuiesced
+    } else if self.state != Leader || !m.first && self.loadIdx == 0 {
+        err = ErrNotLeader // or stepped down since the previous chunk
+    } else if m.first && self.hasClientEntries() {
+        err = errors.New("Client entries were processed already")
+    } else if !m.first && lastIdx != self.loadIdx {
+        err = errors.New("Bulk load interrupted by other entries")
+    }
+    if err != nil {
+        if !m.first { // and not some other load that is under way
+            self.loadIdx = 0
+        }
+        m.reply <- err
+        return
+    }
+    rentries := make([]RaftEntry, len(m.entries))
+    for i := range m.entries {
+        rentries[i] = RaftEntry { self.term, &m.entries[i] }
+    }
+    self.loadIdx = lastIdx + uint64(len(rentries))
+    self.leaderLogAppendAll(rentries)
+    if m.last {
+        self.loadWait = m.reply
+        self.serveBulkLoad()
+    } else {
+        m.reply <- nil
+    }
+}
+
+// Answer the BulkLoad call once its entries are committed
+func (self *RaftNode) serveBulkLoad() {
+    if self.loadWait != nil && self.commitIdx >= self.loadIdx {
+        self.loadWait <- nil
+        self.loadIdx, self.loadWait = 0, nil
+    }
+}
+
+func (self *RaftNode) failBulkLoad() {
+    if self.loadWait != nil {
+        self.loadWait <- ErrNotLeader
+    }
+    self.loadIdx, self.loadWait = 0, nil
+}
+
+// Whether any client entry was ever logged (compacted ones included)
+func (self *RaftNode) hasClientEntries() bool {
+    return self.lastSnapIdx > 0 || self.firstClientIdx > 0
+}
+
+// Keep firstClientIdx up to date with a log update from startIdx on
+func (self *RaftNode) trackClientEntries(startIdx uint64, entries []RaftEntry) {
+    if self.firstClientIdx >= startIdx {
+        self.firstClientIdx = 0 // overwritten
+    }
+    for i := 0; self.firstClientIdx == 0 && i < len(entries); i += 1 {
+        if len(entries[i].clientUids()) > 0 {
+            self.firstClientIdx = startIdx + uint64(i)
+        }
+    }
+}
+
+// Find firstClientIdx in the log, which is read up to that entry only
+func (self *RaftNode) scanClientEntries() {
+    lastIdx, _ := self.logTail()
+    for idx := uint64(1); self.firstClientIdx == 0 && idx <= lastIdx; idx += 1 {
+        if len(self.log(idx).clientUids()) > 0 {
+            self.firstClientIdx = idx
+        }
+    }
+}
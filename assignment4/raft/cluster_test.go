@@ -0,0 +1,1655 @@
+package raft
+
+import (
+    "context"
+    "errors"
+    golog "log"
+    "math/rand"
+    "os"
+    "runtime"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// An in-memory network connecting the nodes of a test cluster; messages are
+// silently dropped when the receiver's notifch is full (as in a real network)
+type MemNet struct { // {{{1
+    sync.Mutex
+    notifchs map[uint32]chan<- Message
+    cutLinks map[[2]uint32]bool // (from, to) pairs whose messages are dropped
+    leaders map[uint64]uint32 // term -> leader, as seen from AppendEntries
+    trace []MsgRecord // nil unless tracing (see StartTrace)
+}
+
+// A message sent over a MemNet, in the order of the Send calls (across nodes)
+type MsgRecord struct {
+    From, To uint32
+    Msg Message
+    Dropped bool // by a cut link or a full notifch
+}
+
+func NewMemNet() *MemNet {
+    return &MemNet {
+        notifchs: make(map[uint32]chan<- Message),
+        cutLinks: make(map[[2]uint32]bool),
+        leaders: make(map[uint64]uint32),
+    }
+}
+
+func (self *MemNet) deliver(from, to uint32, msg Message) {
+    self.Lock()
+    notifch, ok := self.notifchs[to]
+    ok = ok && !self.cutLinks[[2]uint32 { from, to }]
+    if ae, isAE := msg.(*AppendEntries); ok && isAE {
+        self.leaders[ae.Term] = ae.LeaderId
+    }
+    if ok {
+        select {
+        case notifch <- msg:
+        default:
+            ok = false
+        }
+    }
+    if self.trace != nil { // recorded in the same critical section as sent
+        self.trace = append(self.trace, MsgRecord { from, to, msg, !ok })
+    }
+    self.Unlock()
+}
+
+// Record every message sent from now on (see Trace)
+func (self *MemNet) StartTrace() {
+    self.Lock()
+    self.trace = []MsgRecord { }
+    self.Unlock()
+}
+
+// The messages sent since StartTrace, in order
+func (self *MemNet) Trace() []MsgRecord {
+    self.Lock(); defer self.Unlock()
+    return append([]MsgRecord(nil), self.trace...)
+}
+
+func (self *MemNet) setLink(a, b uint32, cut bool) {
+    self.Lock()
+    self.cutLinks[[2]uint32 { a, b }] = cut
+    self.cutLinks[[2]uint32 { b, a }] = cut
+    self.Unlock()
+}
+
+// Returns the leader of the latest term (which need not be the current term)
+func (self *MemNet) leader() (uint64, uint32, bool) {
+    self.Lock(); defer self.Unlock()
+    var maxTerm uint64
+    leaderId, found := NilNode, false
+    for term, id := range self.leaders {
+        if !found || term > maxTerm {
+            maxTerm, leaderId, found = term, id, true
+        }
+    }
+    return maxTerm, leaderId, found
+}
+
+type MemMsger struct { // {{{1
+    id uint32
+    peerIds []uint32
+    net *MemNet
+}
+
+func (self *MemMsger) Register(notifch chan<- Message) {
+    self.net.Lock()
+    self.net.notifchs[self.id] = notifch
+    self.net.Unlock()
+}
+
+func (self *MemMsger) Send(node uint32, msg Message) {
+    if ae, ok := msg.(*AppendEntries); ok { // the sender may overwrite its log
+        copy := *ae
+        copy.Entries = append([]RaftEntry(nil), ae.Entries...)
+        msg = &copy
+    }
+    self.net.deliver(self.id, node, msg)
+}
+
+func (self *MemMsger) BroadcastVoteRequest(msg *VoteRequest) {
+    for _, nodeId := range self.peerIds {
+        self.Send(nodeId, msg)
+    }
+}
+
+func (self *MemMsger) Client301(uid uint64, node uint32) { }
+func (self *MemMsger) Client503(uid uint64)              { }
+func (self *MemMsger) ClientReadReply(uid uint64, data []byte, appliedIdx uint64) { }
+func (self *MemMsger) Latency(node uint32) time.Duration  { return NoLatencyEstimate }
+func (self *MemMsger) Disconnect(node uint32)            { self.net.setLink(self.id, node, true) }
+func (self *MemMsger) Connect(node uint32)               { self.net.setLink(self.id, node, false) }
+
+type MemPster struct { // {{{1
+    sync.Mutex // the log is inspected by tests while the node is running
+    DummyPster
+    updates int // number of calls to LogUpdate(Batch)
+    snapData map[[2]uint64][]byte // (term, idx) -> snapshot
+    fields *RaftFields // kept across restarts, like the log
+}
+
+func (self *MemPster) Entry(idx uint64) *RaftEntry {
+    self.Lock(); defer self.Unlock()
+    if idx >= uint64(len(self.log)) { return nil }
+    return self.DummyPster.Entry(idx)
+}
+func (self *MemPster) LastEntry() (uint64, *RaftEntry) {
+    self.Lock(); defer self.Unlock()
+    return self.DummyPster.LastEntry()
+}
+func (self *MemPster) LogSlice(startIdx uint64, endIdx uint64) ([]RaftEntry, bool) {
+    self.Lock(); defer self.Unlock()
+    entries, ok := self.DummyPster.LogSlice(startIdx, endIdx)
+    return append([]RaftEntry(nil), entries...), ok
+}
+func (self *MemPster) LogUpdate(startIdx uint64, slice []RaftEntry) bool {
+    self.Lock(); defer self.Unlock()
+    self.updates += 1
+    slice = append([]RaftEntry(nil), slice...)
+    return self.DummyPster.LogUpdate(startIdx, slice)
+}
+func (self *MemPster) CRC32() uint32 {
+    self.Lock(); defer self.Unlock()
+    return self.DummyPster.CRC32()
+}
+func (self *MemPster) GetFields() *RaftFields {
+    self.Lock(); defer self.Unlock()
+    return self.fields
+}
+func (self *MemPster) SetFields(fields RaftFields) bool {
+    self.Lock(); defer self.Unlock()
+    self.fields = &fields
+    return true
+}
+func (self *MemPster) SaveSnapshot(term, idx uint64, data []byte) bool {
+    self.Lock(); defer self.Unlock()
+    if self.snapData == nil { self.snapData = make(map[[2]uint64][]byte) }
+    self.snapData[[2]uint64 { term, idx }] = data
+    return true
+}
+func (self *MemPster) LoadSnapshot(term, idx uint64) ([]byte, bool) {
+    self.Lock(); defer self.Unlock()
+    data, ok := self.snapData[[2]uint64 { term, idx }]
+    return data, ok
+}
+func (self *MemPster) DropSnapshot(term, idx uint64) bool {
+    self.Lock(); defer self.Unlock()
+    delete(self.snapData, [2]uint64 { term, idx })
+    return true
+}
+func (self *MemPster) LogUpdateBatch(updates []LogUpdateOp) bool {
+    self.Lock(); defer self.Unlock()
+    self.updates += 1
+    lastIdx, _ := self.DummyPster.LastEntry()
+    for _, op := range updates {
+        if op.StartIdx > lastIdx + 1 { return false }
+        lastIdx = op.StartIdx + uint64(len(op.Entries)) - 1
+    }
+    for _, op := range updates {
+        self.DummyPster.LogUpdate(op.StartIdx, append([]RaftEntry(nil), op.Entries...))
+    }
+    return true
+}
+
+type MemMachn struct { // {{{1
+    sync.Mutex
+    uids []uint64 // in the order of execution
+    execs [][]uint64 // uids passed in each call to Execute
+    snaps map[uint64]int // snapshot index -> len(uids) at the time
+    delay time.Duration // of every call to Execute
+    leaderApplied map[uint64]int // uid -> calls to LeaderApply
+}
+
+func NewMemMachn() *MemMachn {
+    return &MemMachn { snaps: make(map[uint64]int), leaderApplied: make(map[uint64]int) }
+}
+
+func (self *MemMachn) Execute(entries []ClientEntry) {
+    self.Lock()
+    delay := self.delay
+    self.Unlock()
+    time.Sleep(delay) // without holding up TryRespond
+    self.Lock(); defer self.Unlock()
+    var uids []uint64
+    for _, cEntry := range entries {
+        uids = append(uids, cEntry.UID)
+    }
+    self.uids = append(self.uids, uids...)
+    self.execs = append(self.execs, uids)
+}
+func (self *MemMachn) LeaderApply(cEntry ClientEntry) {
+    self.Lock(); defer self.Unlock()
+    self.leaderApplied[cEntry.UID] += 1
+}
+func (self *MemMachn) TryRespond(uid uint64) bool {
+    self.Lock(); defer self.Unlock()
+    for _, u := range self.uids {
+        if u == uid { return true }
+    }
+    return false
+}
+func (self *MemMachn) Read(key string) []byte {
+    return nil
+}
+// The result of a request is its position in the order of execution
+func (self *MemMachn) ReadResult(uid uint64) ([]byte, bool) {
+    self.Lock(); defer self.Unlock()
+    for i, u := range self.uids {
+        if u == uid { return []byte(strconv.Itoa(i)), true }
+    }
+    return nil, false
+}
+func (self *MemMachn) Snapshot(idx uint64) {
+    self.Lock(); defer self.Unlock()
+    self.snaps[idx] = len(self.uids)
+}
+// A snapshot is the list of uids executed
+func (self *MemMachn) SerializeSnapshot(idx uint64) ([]byte, error) {
+    self.Lock(); defer self.Unlock()
+    var data []byte
+    for _, uid := range self.uids {
+        data = strconv.AppendUint(data, uid, 10)
+        data = append(data, ' ')
+    }
+    return data, nil
+}
+func (self *MemMachn) RestoreSnapshot(idx uint64, data []byte) error {
+    self.Lock(); defer self.Unlock()
+    self.uids = nil
+    for _, field := range strings.Fields(string(data)) {
+        uid, err := strconv.ParseUint(field, 10, 64)
+        if err != nil { return err }
+        self.uids = append(self.uids, uid)
+    }
+    return nil
+}
+
+// ---- cluster utilities {{{1
+type testCluster struct {
+    net *MemNet
+    nodes map[uint32]*RaftNode
+    msgers map[uint32]*MemMsger
+    psters map[uint32]*MemPster
+    machns map[uint32]*MemMachn
+}
+
+func initCluster(t testing.TB, nodeIds []uint32) *testCluster {
+    return initClusterEx(t, nodeIds, NodeConfig { NotifBuf: 256, MinNodes: 1 })
+}
+
+// SelfId and NodeIds of cfg are overwritten for each node
+func initClusterEx(t testing.TB, nodeIds []uint32, cfg NodeConfig) *testCluster {
+    memnet := NewMemNet()
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    c := &testCluster {
+        memnet, make(map[uint32]*RaftNode), make(map[uint32]*MemMsger),
+        make(map[uint32]*MemPster), make(map[uint32]*MemMachn),
+    }
+    for _, id := range nodeIds {
+        var peerIds []uint32
+        for _, peerId := range nodeIds {
+            if peerId != id { peerIds = append(peerIds, peerId) }
+        }
+        c.msgers[id] = &MemMsger { id, peerIds, memnet }
+        c.psters[id] = &MemPster { }
+        c.machns[id] = NewMemMachn()
+        cfg.SelfId, cfg.NodeIds = id, nodeIds
+        cfg.WitnessMode = false
+        for _, witnessId := range cfg.Witnesses {
+            if witnessId == id { cfg.WitnessMode = true }
+        }
+        node, err := NewNodeEx(cfg, c.msgers[id], c.psters[id], c.machns[id], errlog)
+        if err != nil { t.Fatal(err) }
+        c.nodes[id] = node
+    }
+    for _, node := range c.nodes {
+        go node.RunEx(clusterTimeout)
+    }
+    return c
+}
+
+func clusterTimeout(rs RaftState) time.Duration {
+    if rs == Leader {
+        return 10 * time.Millisecond
+    }
+    return time.Duration(50 + rand.Intn(50)) * time.Millisecond
+}
+
+// Submit a client entry to all the nodes (only the leader would append it)
+func (self *testCluster) submit(uid uint64) {
+    for _, node := range self.nodes {
+        node.notifch <- &ClientEntry { uid, nil }
+    }
+}
+
+func (self *testCluster) exit() {
+    for _, node := range self.nodes {
+        node.Exit()
+    }
+}
+
+// Poll cond every 10ms until it returns true, or fail after 5s
+func waitFor(t testing.TB, cond func() bool, args ...interface{}) {
+    deadline := time.Now().Add(5 * time.Second)
+    for !cond() {
+        if time.Now().After(deadline) { t.Fatal(args...) }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func TestSnapshotAt(t *testing.T) { // {{{1
+    c := initCluster(t, []uint32 { 1, 2, 3 })
+    defer c.exit()
+
+    var snapIdx uint64
+    waitFor(t, func() bool {
+        for _, node := range c.nodes {
+            if idx, err := node.SnapshotAt(0); err == nil {
+                snapIdx = idx
+                return true
+            }
+        }
+        return false
+    }, "No leader elected")
+
+    c.submit(1001)
+    c.submit(1002)
+
+    var leaderId uint32
+    waitFor(t, func() bool {
+        for id, node := range c.nodes {
+            if idx, err := node.SnapshotAt(snapIdx + 8); err == nil {
+                leaderId = id
+                assert(t, idx == snapIdx + 8, "Bad snapshot index", idx)
+                return true
+            }
+        }
+        return false
+    }, "Leader lost")
+    for uid := uint64(1003); uid < 1020; uid += 1 { // to reach snapIdx + 8
+        c.nodes[leaderId].notifch <- &ClientEntry { uid, nil }
+    }
+
+    for _, idx := range []uint64 { snapIdx, snapIdx + 8 } {
+        var count = -1
+        for id, machn := range c.machns {
+            waitFor(t, func() bool {
+                machn.Lock(); defer machn.Unlock()
+                _, ok := machn.snaps[idx]
+                return ok
+            }, "No snapshot at", idx, "on node", id)
+            machn.Lock()
+            if count < 0 { count = machn.snaps[idx] }
+            assert(t, machn.snaps[idx] == count, "Misaligned snapshot", idx, id)
+            machn.Unlock()
+        }
+    }
+}
+
+func TestSnapshotNow(t *testing.T) { // {{{1
+    c := initCluster(t, []uint32 { 1, 2, 3 })
+    defer c.exit()
+
+    submit := func(uid uint64) {
+        waitFor(t, func() bool {
+            c.submit(uid) // retry, in case there was no leader yet
+            time.Sleep(5 * time.Millisecond)
+            for _, machn := range c.machns {
+                if !machn.TryRespond(uid) { return false }
+            }
+            return true
+        }, "Entry not applied on all nodes", uid)
+    }
+    for uid := uint64(1001); uid <= 1005; uid += 1 {
+        submit(uid)
+    }
+    var leaderId uint32
+    var snapIdx uint64
+    waitFor(t, func() bool {
+        for id, node := range c.nodes {
+            ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+            idx, err := node.SnapshotNow(ctx)
+            cancel()
+            if err == nil {
+                leaderId, snapIdx = id, idx
+                return true
+            }
+        }
+        return false
+    }, "No leader elected")
+    submit(1006)
+    submit(1007)
+
+    var followerId uint32
+    for id := range c.nodes {
+        if id != leaderId { followerId = id }
+    }
+    pster, machn := c.psters[followerId], c.machns[followerId]
+    waitFor(t, func() bool {
+        _, ok := pster.LoadSnapshot(pster.Entry(snapIdx).Term, snapIdx)
+        return ok
+    }, "Snapshot not persisted on", followerId)
+
+    // the restarted node executes only the entries after the snapshot
+    c.nodes[followerId].Exit()
+    c.machns[followerId] = NewMemMachn()
+    node, err := NewNodeEx(NodeConfig { SelfId: followerId, NodeIds: []uint32 { 1, 2, 3 },
+                                        NotifBuf: 256, MinNodes: 1 },
+                           c.msgers[followerId], pster, c.machns[followerId],
+                           golog.New(os.Stderr, "-- ", golog.Lshortfile))
+    if err != nil { t.Fatal(err) }
+    assert(t, node.LastApplied() == snapIdx && node.CommitIndex() == snapIdx,
+           "Snapshot not loaded", node.LastApplied(), node.CommitIndex(), snapIdx)
+    machn.Lock()
+    snapped := machn.uids[:machn.snaps[snapIdx]]
+    machn.Unlock()
+    restored := c.machns[followerId].uids // not running yet
+    assert_eq(t, restored, snapped, "Restored state differs from the snapshot", restored, snapped)
+    c.nodes[followerId] = node
+    go node.RunEx(clusterTimeout)
+    machn = c.machns[followerId]
+    waitFor(t, func() bool { return machn.TryRespond(1007) }, "Restarted node did not catch up")
+    machn.Lock(); defer machn.Unlock()
+    for _, uids := range machn.execs {
+        for _, uid := range uids {
+            assert(t, uid > 1005, "Entry before the snapshot executed again", uid)
+        }
+    }
+    assert(t, len(machn.uids) == 7, "Unexpected state after restart", machn.uids)
+}
+
+func TestMaxLogEntries(t *testing.T) { // {{{1
+    c := initClusterEx(t, []uint32 { 1, 2, 3 }, NodeConfig {
+        NotifBuf: 256,
+        MinNodes: 1,
+        MaxLogEntries: 8,
+    })
+    defer c.exit()
+
+    // node 3 falls behind every snapshot; the log is never truncated, so it
+    // still catches up through AppendEntries alone
+    c.msgers[3].Disconnect(1)
+    c.msgers[3].Disconnect(2)
+    for uid := uint64(1001); uid <= 1020; uid += 1 {
+        waitFor(t, func() bool {
+            c.submit(uid) // retry, in case there was no leader yet
+            time.Sleep(5 * time.Millisecond)
+            return c.machns[1].TryRespond(uid) && c.machns[2].TryRespond(uid)
+        }, "Entry not applied on the connected nodes", uid)
+    }
+    c.msgers[3].Connect(1)
+    c.msgers[3].Connect(2)
+    waitFor(t, func() bool {
+        return c.machns[3].TryRespond(1020)
+    }, "Lagging node did not catch up")
+    for id, machn := range c.machns {
+        waitFor(t, func() bool {
+            machn.Lock(); defer machn.Unlock()
+            return len(machn.snaps) >= 2
+        }, "Too few automatic snapshots on node", id)
+    }
+    for id, node := range c.nodes {
+        if status := node.Status(); status.LogEntryCount >= 8 {
+            t.Error("Log grew past the cap on node", id, status)
+        }
+    }
+}
+
+func TestElectionTrace(t *testing.T) { // {{{1
+    // only node 1 campaigns, so that there is a single election
+    c := initClusterEx(t, []uint32 { 1, 2, 3 }, NodeConfig {
+        NotifBuf: 256,
+        MinNodes: 1,
+        Witnesses: []uint32 { 2, 3 },
+    })
+    defer c.exit()
+    c.net.StartTrace() // well within the first election timeout
+
+    waitFor(t, func() bool {
+        _, leader, ok := c.net.leader()
+        return ok && leader == 1
+    }, "No leader elected")
+    trace := c.net.Trace()
+    assert(t, len(trace) >= 4, "Trace too short", trace)
+    assert_eq(t, trace[:2], []MsgRecord {
+        { 1, 2, &VoteRequest { 1, 1, 0, 0, 0 }, false },
+        { 1, 3, &VoteRequest { 1, 1, 0, 0, 0 }, false },
+    }, "Bad vote requests", trace)
+    // then only votes, until the leader takes over (on the first vote)
+    voters := make(map[uint32]bool)
+    for _, r := range trace[2:] {
+        if _, ok := r.Msg.(*AppendEntries); ok {
+            assert(t, r.From == 1, "AppendEntries from a witness", r)
+            break
+        }
+        reply, ok := r.Msg.(*VoteReply)
+        assert(t, ok && r.To == 1 && reply.Term == 1 && reply.Granted && !voters[r.From],
+               "Unexpected message during election", r, r.Msg)
+        voters[r.From] = true
+    }
+    assert(t, len(voters) > 0, "Leader took over without votes", trace)
+}
+
+func TestMonitorCommitLag(t *testing.T) { // {{{1
+    c := initCluster(t, []uint32 { 1, 2, 3 })
+    var leader uint32
+    leaderExited := false
+    defer func() {
+        for id, node := range c.nodes {
+            if id != leader || !leaderExited { node.Exit() }
+        }
+    }()
+
+    waitFor(t, func() bool {
+        var ok bool
+        _, leader, ok = c.net.leader()
+        return ok
+    }, "No leader elected")
+    lags := make(chan uint64, 1024)
+    interval := 50 * time.Millisecond
+    c.nodes[leader].MonitorCommitLag(interval, func(lag uint64) { lags <- lag })
+
+    // the followers stop acking, so nothing more can be committed
+    for id := range c.nodes {
+        if id != leader { c.msgers[leader].Disconnect(id) }
+    }
+    for uid := uint64(1001); uid <= 1010; uid += 1 {
+        c.nodes[leader].notifch <- &ClientEntry { uid, nil }
+    }
+    c.nodes[leader].Status() // appended by now
+    deadline := time.After(2 * interval + 10 * time.Millisecond)
+    for lag := uint64(0); lag < 10; {
+        select {
+        case lag = <-lags:
+        case <-deadline:
+            t.Fatal("Commit lag not reported within two intervals")
+        }
+    }
+
+    c.nodes[leader].Exit()
+    leaderExited = true
+    time.Sleep(interval) // a callback may have been under way
+    for len(lags) > 0 { <-lags }
+    time.Sleep(2 * interval)
+    assert(t, len(lags) == 0, "Reported after exit", len(lags))
+}
+
+func TestPartition(t *testing.T) { // {{{1
+    c := initCluster(t, []uint32 { 1, 2, 3 })
+    defer c.exit()
+
+    var oldTerm uint64
+    var oldLeader uint32
+    waitFor(t, func() bool {
+        var ok bool
+        oldTerm, oldLeader, ok = c.net.leader()
+        return ok
+    }, "No leader elected")
+
+    for id := range c.nodes {
+        if id != oldLeader { c.msgers[oldLeader].Disconnect(id) }
+    }
+    time.Sleep(200 * time.Millisecond) // two election timeouts
+    waitFor(t, func() bool {
+        term, leader, _ := c.net.leader()
+        return term > oldTerm && leader != oldLeader
+    }, "No re-election")
+
+    for id := range c.nodes {
+        if id != oldLeader { c.msgers[oldLeader].Connect(id) }
+    }
+    c.submit(1001)
+    for id, machn := range c.machns {
+        waitFor(t, func() bool {
+            return machn.TryRespond(1001)
+        }, "Entry not applied on node", id)
+    }
+}
+
+func TestStaleLeaderWrites(t *testing.T) { // {{{1
+    c := initCluster(t, []uint32 { 1, 2, 3 })
+    defer c.exit()
+
+    var oldTerm uint64
+    var oldLeader uint32
+    waitFor(t, func() bool {
+        var ok bool
+        oldTerm, oldLeader, ok = c.net.leader()
+        return ok
+    }, "No leader elected")
+    var mutex sync.Mutex
+    var dropped []*StaleEntriesDropped
+    stop := make(chan struct{})
+    defer close(stop)
+    go func() {
+        for {
+            select {
+            case e := <-c.nodes[oldLeader].Events():
+                if d, ok := e.(*StaleEntriesDropped); ok {
+                    mutex.Lock()
+                    dropped = append(dropped, d)
+                    mutex.Unlock()
+                }
+            case <-stop:
+                return
+            }
+        }
+    }()
+
+    for id := range c.nodes {
+        if id != oldLeader { c.msgers[oldLeader].Disconnect(id) }
+    }
+    c.nodes[oldLeader].notifch <- &ClientEntry { 3001, nil } // never committed
+    var newLeader uint32
+    waitFor(t, func() bool {
+        var term uint64
+        term, newLeader, _ = c.net.leader()
+        return term > oldTerm && newLeader != oldLeader
+    }, "No re-election")
+    waitFor(t, func() bool {
+        c.nodes[newLeader].notifch <- &ClientEntry { 3002, nil }
+        time.Sleep(10 * time.Millisecond)
+        return c.machns[newLeader].TryRespond(3002)
+    }, "Entry not committed by the new leader")
+
+    for id := range c.nodes {
+        if id != oldLeader { c.msgers[oldLeader].Connect(id) }
+    }
+    waitFor(t, func() bool {
+        return c.machns[oldLeader].TryRespond(3002)
+    }, "Entry not applied on the old leader")
+    for id, machn := range c.machns {
+        if machn.TryRespond(3001) { t.Error("Stale leader write applied on node", id) }
+    }
+    waitFor(t, func() bool {
+        mutex.Lock(); defer mutex.Unlock()
+        return len(dropped) > 0
+    }, "No StaleEntriesDropped event")
+    mutex.Lock()
+    assert_eq(t, dropped[0].UIDs, []uint64 { 3001 }, "Bad dropped UIDs", dropped[0])
+    mutex.Unlock()
+}
+
+func TestAtomicAccessors(t *testing.T) { // {{{1
+    c := initCluster(t, []uint32 { 1, 2, 3 })
+    defer c.exit()
+
+    var done int32
+    var wg sync.WaitGroup
+    for _, node := range c.nodes {
+        for i := 0; i < 4; i += 1 {
+            wg.Add(1)
+            go func(node *RaftNode) {
+                defer wg.Done()
+                var lastAppld, commitIdx uint64
+                for atomic.LoadInt32(&done) == 0 {
+                    la, ci := node.LastApplied(), node.CommitIndex()
+                    if la < lastAppld || ci < commitIdx {
+                        t.Error("Index decreased", la, lastAppld, ci, commitIdx)
+                        return
+                    }
+                    lastAppld, commitIdx = la, ci
+                    time.Sleep(100 * time.Microsecond)
+                }
+            }(node)
+        }
+    }
+
+    for uid := uint64(1001); uid <= 1020; uid += 1 {
+        c.submit(uid)
+        time.Sleep(5 * time.Millisecond)
+    }
+    waitFor(t, func() bool {
+        for _, node := range c.nodes {
+            if node.LastApplied() == 0 { return false }
+        }
+        return true
+    }, "Nothing applied")
+    atomic.StoreInt32(&done, 1)
+    wg.Wait()
+}
+
+func TestReadBarrier(t *testing.T) { // {{{1
+    c := initCluster(t, []uint32 { 1, 2, 3 })
+    defer c.exit()
+
+    var leaderId uint32
+    waitFor(t, func() bool {
+        var ok bool
+        _, leaderId, ok = c.net.leader()
+        return ok
+    }, "No leader elected")
+    var laggard uint32
+    for id := range c.nodes {
+        if id != leaderId { laggard = id; break }
+    }
+    c.msgers[leaderId].Disconnect(laggard)
+
+    c.submit(1001)
+    leader := c.nodes[leaderId]
+    waitFor(t, func() bool {
+        return leader.LastApplied() > 0
+    }, "Entry not applied on leader")
+    commitIdx := leader.CommitIndex()
+
+    ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+    err := c.nodes[laggard].ReadBarrier(ctx, commitIdx)
+    cancel()
+    if err != context.DeadlineExceeded {
+        t.Fatal("Barrier passed on a lagging node", err)
+    }
+
+    c.msgers[leaderId].Connect(laggard)
+    for id, node := range c.nodes {
+        ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+        err := node.ReadBarrier(ctx, commitIdx)
+        cancel()
+        if err != nil || node.LastApplied() < commitIdx {
+            t.Fatal("Barrier failed on node", id, err)
+        }
+    }
+}
+
+func TestReadCommitted(t *testing.T) { // {{{1
+    c := initCluster(t, []uint32 { 1, 2, 3 })
+    defer c.exit()
+
+    var leaderId uint32
+    waitFor(t, func() bool {
+        var ok bool
+        _, leaderId, ok = c.net.leader()
+        return ok
+    }, "No leader elected")
+    leader := c.nodes[leaderId]
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+
+    leader.notifch <- &ClientEntry { 5001, "write" }
+    data, err := leader.ReadCommitted(ctx, 5001, "read") // the write may not be applied yet
+    if err != nil || string(data) != "0" {
+        t.Fatal("Bad result of a write", string(data), err)
+    }
+    data, err = leader.ReadCommitted(ctx, 5002, "read") // appended as a read-only entry
+    if err != nil || string(data) != "1" {
+        t.Fatal("Bad result of a read", string(data), err)
+    }
+    waitFor(t, func() bool {
+        for _, machn := range c.machns {
+            if !machn.TryRespond(5002) { return false }
+        }
+        return true
+    }, "Read-only entry not replicated")
+
+    for id, node := range c.nodes {
+        if id == leaderId { continue }
+        if _, err := node.ReadCommitted(ctx, 5003, "read"); err != ErrNotLeader {
+            t.Fatal("ReadCommitted on a follower", err)
+        }
+    }
+}
+
+// A key-value store, whose commands are kvSet-s and kvGet-s
+type kvMachn struct {
+    DummyMachn
+    kv map[string]string
+    results map[uint64][]byte
+}
+type kvSet struct { Key, Val string }
+type kvGet struct { Key string }
+
+func (self *kvMachn) Execute(entries []ClientEntry) {
+    for _, cEntry := range entries {
+        switch cmd := cEntry.Data.(type) {
+        case kvSet:
+            self.kv[cmd.Key] = cmd.Val
+            self.results[cEntry.UID] = []byte("OK")
+        case kvGet:
+            self.results[cEntry.UID] = []byte(self.kv[cmd.Key])
+        }
+    }
+}
+func (self *kvMachn) ReadResult(uid uint64) ([]byte, bool) {
+    data, ok := self.results[uid]
+    return data, ok
+}
+
+func TestReadCommittedValue(t *testing.T) { // {{{1
+    machn := &kvMachn { DummyMachn { }, make(map[string]string), make(map[uint64][]byte) }
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    cfg := NodeConfig { SelfId: 0, NodeIds: []uint32 { 0 }, MinNodes: 1 }
+    node, err := NewNodeEx(cfg, &NopMessenger { }, &MemPster { }, machn, errlog)
+    if err != nil { t.Fatal(err) }
+    go node.Run(10 * time.Millisecond)
+    defer node.Exit()
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+
+    waitFor(t, func() bool {
+        _, err := node.ProposeBatch([]ClientEntry { { 6001, kvSet { "k", "v1" } } })
+        return err == nil
+    }, "Write not accepted")
+    data, err := node.ReadCommitted(ctx, 6002, kvGet { "k" })
+    if err != nil || string(data) != "v1" {
+        t.Fatal("Bad result of a read", string(data), err)
+    }
+    data, err = node.ReadCommitted(ctx, 6003, kvGet { "nokey" })
+    if err != nil || string(data) != "" {
+        t.Fatal("Bad result of a read of a missing key", string(data), err)
+    }
+}
+
+func TestBulkLoad(t *testing.T) { // {{{1
+    c := initCluster(t, []uint32 { 1, 2, 3 })
+    defer c.exit()
+
+    // replicating this many entries takes long (under -race, in particular),
+    // so wait on the load and the apply rather than poll with a fixed deadline
+    ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+    defer cancel()
+    const n = 100000
+    entries := make([]ClientEntry, n)
+    for i := range entries {
+        entries[i] = ClientEntry { uint64(10000 + i), nil }
+    }
+    var leaderId uint32
+    waitFor(t, func() bool {
+        // a leader of a term some node is past may accept the load only to
+        // have it overwritten; wait until all agree on the term
+        var term uint64
+        leaders := 0
+        for id, node := range c.nodes {
+            status := node.Status()
+            if term != 0 && status.Term != term { return false }
+            term = status.Term
+            if status.State == Leader { leaders, leaderId = leaders + 1, id }
+        }
+        if leaders != 1 { return false }
+        err := c.nodes[leaderId].BulkLoad(ctx, entries)
+        if err != nil && err != ErrNotLeader {
+            t.Fatal("Bulk load rejected", err)
+        }
+        return err == nil
+    }, "Bulk load not accepted by any node")
+    status := c.nodes[leaderId].Status()
+    loadIdx := status.LastLogIdx
+    assert(t, status.CommitIdx >= loadIdx, "Bulk load not committed", status)
+    entries[0].UID = 1 // the log has a copy
+    if err := c.nodes[leaderId].BulkLoad(ctx, []ClientEntry { { 1, nil } }); err == nil {
+        t.Fatal("Bulk load accepted after client entries")
+    }
+
+    for id, machn := range c.machns {
+        if err := c.nodes[id].ReadBarrier(ctx, loadIdx); err != nil {
+            t.Fatal("Bulk load not applied on node", id, err)
+        }
+        machn.Lock()
+        if len(machn.uids) != n {
+            t.Fatal("Bad number of applied entries on node", id, len(machn.uids))
+        }
+        for i, uid := range machn.uids {
+            if uid != uint64(10000 + i) {
+                t.Fatal("Bad order of applied entries on node", id, i, uid)
+            }
+        }
+        machn.Unlock()
+    }
+}
+
+func TestGracefulRestart(t *testing.T) { // {{{1
+    ids := []uint32 { 1, 2, 3 }
+    c := initCluster(t, ids)
+    defer c.exit()
+
+    waitFor(t, func() bool {
+        c.submit(2000) // retry, in case there was no leader yet
+        time.Sleep(5 * time.Millisecond)
+        for _, machn := range c.machns {
+            if !machn.TryRespond(2000) { return false }
+        }
+        return true
+    }, "Entry not applied on all nodes", 2000)
+
+    restart := func(asyncApply bool) {
+        for _, id := range ids {
+            cfg := NodeConfig { SelfId: id, NodeIds: ids, NotifBuf: 256, MinNodes: 1, AsyncApply: asyncApply }
+            if err := c.nodes[id].GracefulRestart(cfg); err != nil {
+                t.Fatal("Restart failed on node", id, err)
+            }
+        }
+    }
+    for uid := uint64(2001); uid <= 2100; uid += 1 {
+        c.submit(uid) // once; none should be lost
+        switch uid {
+        case 2030:
+            restart(true)
+        case 2070:
+            restart(false)
+        }
+    }
+    cfg := NodeConfig { SelfId: 4, NodeIds: ids, NotifBuf: 256, MinNodes: 1 }
+    if err := c.nodes[1].GracefulRestart(cfg); err != ErrImmutableField {
+        t.Fatal("SelfId changed on restart", err)
+    }
+
+    for id, machn := range c.machns {
+        waitFor(t, func() bool {
+            return machn.TryRespond(2100)
+        }, "Entries not applied on node", id)
+        for uid := uint64(2001); uid <= 2100; uid += 1 {
+            if !machn.TryRespond(uid) { t.Fatal("Entry lost on node", id, uid) }
+        }
+    }
+}
+
+func TestProposeBatch(t *testing.T) { // {{{1
+    c := initCluster(t, []uint32 { 1, 2, 3 })
+    defer c.exit()
+
+    batch := []ClientEntry { { 2001, nil }, { 2002, nil }, { 2003, nil } }
+    var leaderId uint32
+    waitFor(t, func() bool {
+        for id, node := range c.nodes {
+            _, err := node.ProposeBatch(batch)
+            if err == nil {
+                leaderId = id
+                return true
+            } else if err != ErrNotLeader {
+                t.Fatal("Batch rejected", err)
+            }
+        }
+        time.Sleep(10 * time.Millisecond)
+        return false
+    }, "Batch not accepted by any node")
+
+    leader := c.nodes[leaderId]
+    if _, err := leader.ProposeBatch(batch[1:]); err == nil {
+        t.Fatal("Duplicate batch accepted")
+    }
+    if _, err := leader.ProposeBatch([]ClientEntry { { 2004, nil }, { 2004, nil } }); err == nil {
+        t.Fatal("Batch with repeated UIDs accepted")
+    }
+    c.submit(2002) // duplicate of a batched entry; should be ignored
+
+    for id, machn := range c.machns {
+        waitFor(t, func() bool {
+            return machn.TryRespond(2003)
+        }, "Batch not applied on node", id)
+        machn.Lock()
+        var found bool
+        for _, uids := range machn.execs {
+            if len(uids) == 3 && uids[0] == 2001 && uids[1] == 2002 && uids[2] == 2003 {
+                found = true
+            } else {
+                for _, uid := range uids {
+                    if uid >= 2001 && uid <= 2003 { t.Error("Batch was split on node", id, uids) }
+                }
+            }
+        }
+        machn.Unlock()
+        if !found { t.Fatal("Batch not executed as a unit on node", id) }
+    }
+}
+
+func TestAsyncApply(t *testing.T) { // {{{1
+    c := initClusterEx(t, []uint32 { 1, 2, 3 }, NodeConfig { NotifBuf: 256, MinNodes: 1, AsyncApply: true })
+    defer c.exit()
+
+    var term uint64
+    var leaderId uint32
+    waitFor(t, func() bool {
+        var ok bool
+        term, leaderId, ok = c.net.leader()
+        return ok
+    }, "No leader elected")
+    leader := c.nodes[leaderId]
+    for _, machn := range c.machns {
+        machn.Lock()
+        machn.delay = 200 * time.Millisecond // at least twice the election timeout
+        machn.Unlock()
+    }
+
+    for uid := uint64(7001); uid <= 7004; uid += 1 {
+        leader.notifch <- &ClientEntry { uid, nil }
+        commitIdx := leader.CommitIndex()
+        waitFor(t, func() bool { return leader.CommitIndex() > commitIdx }, "Entry not committed", uid)
+        ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+        res, err := leader.Heartbeat(ctx) // while the machines are busy
+        cancel()
+        if err != nil || res.Replies != 2 {
+            t.Fatal("Heartbeat round while applying", uid, res, err)
+        }
+    }
+    assert(t, leader.LastApplied() < leader.CommitIndex(), "Entries applied too soon")
+    if lterm, lid, _ := c.net.leader(); lterm != term || lid != leaderId {
+        t.Fatal("Leader changed while applying", term, leaderId, lterm, lid)
+    }
+
+    // the entries left are executed on exit
+    commitIdx := leader.CommitIndex()
+    leader.Exit()
+    assert(t, leader.LastApplied() == commitIdx, "Entries not drained", leader.LastApplied(), commitIdx)
+    assert(t, c.machns[leaderId].TryRespond(7004), "Last entry not executed")
+    go leader.RunEx(clusterTimeout) // for c.exit
+}
+
+func TestLeaderApply(t *testing.T) { // {{{1
+    c := initCluster(t, []uint32 { 1, 2, 3 })
+    defer c.exit()
+
+    applied := func(uid uint64) bool {
+        for _, machn := range c.machns {
+            if !machn.TryRespond(uid) { return false }
+        }
+        return true
+    }
+    submit := func(uid uint64) {
+        waitFor(t, func() bool {
+            c.submit(uid) // retry, in case there was no leader yet
+            time.Sleep(10 * time.Millisecond)
+            return applied(uid)
+        }, "Entry not applied on all nodes", uid)
+    }
+    var oldTerm uint64
+    var oldLeader uint32
+    waitFor(t, func() bool {
+        var ok bool
+        oldTerm, oldLeader, ok = c.net.leader()
+        return ok
+    }, "No leader elected")
+    for uid := uint64(8001); uid <= 8004; uid += 1 {
+        submit(uid)
+    }
+    for id := range c.nodes {
+        if id != oldLeader { c.msgers[oldLeader].Disconnect(id) }
+    }
+    waitFor(t, func() bool {
+        term, leaderId, _ := c.net.leader()
+        return term > oldTerm && leaderId != oldLeader
+    }, "No re-election")
+    for uid := uint64(8005); uid <= 8007; uid += 1 { // committed without the old leader
+        for id := range c.nodes {
+            if id != oldLeader { c.nodes[id].notifch <- &ClientEntry { uid, nil } }
+        }
+    }
+    for id := range c.nodes {
+        if id != oldLeader { c.msgers[oldLeader].Connect(id) }
+    }
+    for uid := uint64(8005); uid <= 8007; uid += 1 {
+        submit(uid) // the old leader applies the entries of both terms as a follower
+    }
+
+    for uid := uint64(8001); uid <= 8007; uid += 1 {
+        count := 0
+        for _, machn := range c.machns {
+            machn.Lock()
+            count += machn.leaderApplied[uid]
+            machn.Unlock()
+        }
+        assert(t, count == 1, "LeaderApply not called exactly once", uid, count)
+    }
+}
+
+func TestCoalesce(t *testing.T) { // {{{1
+    c := initClusterEx(t, []uint32 { 1, 2, 3 }, NodeConfig { NotifBuf: 256, MinNodes: 1, MaxCoalesce: 40 })
+    defer c.exit()
+
+    var leaderId uint32
+    waitFor(t, func() bool {
+        var ok bool
+        _, leaderId, ok = c.net.leader()
+        return ok
+    }, "No leader elected")
+    leader, pster := c.nodes[leaderId], c.psters[leaderId]
+
+    // hold the loop up while the entries are queued
+    entered, release := make(chan struct{}), make(chan struct{})
+    go leader.Inspect(func(*RaftNodeSnapshot) { close(entered); <-release })
+    <-entered
+    for uid := uint64(6001); uid <= 6050; uid += 1 {
+        leader.notifch <- &ClientEntry { uid, nil }
+    }
+    leader.notifch <- &ClientEntry { 6001, nil } // duplicate
+    pster.Lock()
+    updates, lastIdx := pster.updates, uint64(len(pster.log) - 1)
+    pster.Unlock()
+    close(release)
+
+    waitFor(t, func() bool {
+        for _, machn := range c.machns {
+            if !machn.TryRespond(6050) { return false }
+        }
+        return true
+    }, "Entries not applied on all nodes")
+    pster.Lock()
+    defer pster.Unlock()
+    // others (say, the replies of peers) may have been queued in between
+    assert(t, pster.updates - updates <= 3, "Entries not coalesced", pster.updates - updates)
+    assert(t, uint64(len(pster.log) - 1) == lastIdx + 50, "Bad number of entries", len(pster.log))
+    for i, entry := range pster.log[lastIdx + 1:] {
+        assert(t, entry.CEntry.UID == 6001 + uint64(i), "Entries out of order", i, entry.CEntry)
+    }
+}
+
+func TestReplay(t *testing.T) { // {{{1
+    c := initCluster(t, []uint32 { 1, 2, 3 })
+    defer c.exit()
+
+    var leaderId uint32
+    waitFor(t, func() bool {
+        for id, node := range c.nodes {
+            if _, err := node.ProposeBatch([]ClientEntry { { 2001, nil }, { 2002, nil } }); err == nil {
+                leaderId = id
+                return true
+            }
+        }
+        time.Sleep(10 * time.Millisecond)
+        return false
+    }, "Batch not accepted by any node")
+    leader := c.nodes[leaderId]
+    for uid := uint64(1001); uid <= 1005; uid += 1 {
+        leader.notifch <- &ClientEntry { uid, nil }
+    }
+    leader.SnapshotAt(0)
+    leader.notifch <- &ClientEntry { 1006, nil }
+    for id, machn := range c.machns {
+        waitFor(t, func() bool { return machn.TryRespond(1006) }, "Entries not applied on node", id)
+    }
+
+    for id, node := range c.nodes {
+        machn := c.machns[id]
+        replayed := make(map[uint64]int) // uid -> position of execution
+        err := node.Replay(node.LastApplied(), func(e ClientEntry) error {
+            replayed[e.UID] = len(replayed)
+            return nil
+        })
+        if err != nil { t.Fatal("Replay failed on node", id, err) }
+        machn.Lock()
+        live := make(map[uint64]int)
+        for i, uid := range machn.uids {
+            live[uid] = i
+        }
+        machn.Unlock()
+        assert_eq(t, replayed, live, "Replayed state differs on node", id)
+    }
+
+    if err := leader.Replay(leader.CommitIndex() + 1, func(ClientEntry) error { return nil }); err == nil {
+        t.Fatal("Replayed beyond the commit index")
+    }
+    stop := errors.New("stop")
+    var count int
+    err := leader.Replay(leader.LastApplied(), func(ClientEntry) error {
+        count += 1
+        return stop
+    })
+    if err != stop || count != 1 {
+        t.Fatal("Replay did not stop at the first error", err, count)
+    }
+}
+
+func TestWitness(t *testing.T) { // {{{1
+    c := initClusterEx(t, []uint32 { 1, 2, 3 }, NodeConfig {
+        NotifBuf: 256,
+        MinNodes: 1,
+        Witnesses: []uint32 { 3 },
+    })
+    defer c.exit()
+
+    for uid := uint64(1001); uid <= 1005; uid += 1 {
+        waitFor(t, func() bool {
+            for _, node := range c.nodes { // retry, in case there was no leader yet
+                node.notifch <- &ClientEntry { uid, "payload" }
+            }
+            time.Sleep(10 * time.Millisecond)
+            for _, machn := range c.machns {
+                if !machn.TryRespond(uid) { return false }
+            }
+            return true
+        }, "Entry not applied on all nodes", uid)
+    }
+
+    for id, pster := range c.psters {
+        pster.Lock()
+        for idx, entry := range pster.log {
+            if entry.CEntry == nil { continue }
+            if id == 3 && entry.CEntry.Data != nil {
+                t.Error("Witness stored a payload", idx, entry.CEntry)
+            } else if id != 3 && entry.CEntry.Data == nil {
+                t.Error("Payload missing on node", id, idx)
+            }
+        }
+        pster.Unlock()
+    }
+    c.net.Lock()
+    for term, leaderId := range c.net.leaders {
+        if leaderId == 3 { t.Error("Witness became leader in term", term) }
+    }
+    c.net.Unlock()
+}
+
+func TestLogicalClock(t *testing.T) { // {{{1
+    cfg := NodeConfig { NotifBuf: 256, MinNodes: 1, LogicalClock: true }
+    c := initClusterEx(t, []uint32 { 1, 2, 3 }, cfg)
+    defer c.exit()
+
+    // every node but skipId should reach the clock of the leader of term
+    clockOf := func(term uint64, skipId uint32) (uint64, uint64) {
+        var idx uint64
+        waitFor(t, func() bool {
+            lterm, leaderId, _ := c.net.leader()
+            if lterm < term { return false }
+            cterm, cidx := c.nodes[leaderId].Clock()
+            if cterm < lterm { return false }
+            for id, node := range c.nodes {
+                if id == skipId { continue }
+                if nterm, nidx := node.Clock(); nterm != cterm || nidx != cidx { return false }
+            }
+            term, idx = cterm, cidx
+            return true
+        }, "Clocks did not converge")
+        return term, idx
+    }
+    term1, idx1 := clockOf(1, NilNode)
+    _, leaderId, _ := c.net.leader()
+    entry := c.psters[leaderId].Entry(idx1)
+    assert_eq(t, entry.CEntry.Data, &ClockEntry { term1, idx1 }, "Bad ClockEntry", entry)
+
+    for id := range c.nodes { // force a new term
+        if id != leaderId { c.msgers[leaderId].Disconnect(id) }
+    }
+    term2, idx2 := clockOf(term1 + 1, leaderId)
+    assert(t, term2 > term1 && idx2 > idx1, "Clock did not advance", term1, idx1, term2, idx2)
+    for id := range c.nodes {
+        if id != leaderId { c.msgers[leaderId].Connect(id) }
+    }
+    term2, idx2 = clockOf(term2, NilNode) // including the old leader
+
+    // a restarted node gets its clock back from its own log
+    c.nodes[leaderId].Exit()
+    cfg.SelfId, cfg.NodeIds = leaderId, []uint32 { 1, 2, 3 }
+    c.machns[leaderId] = NewMemMachn()
+    node, err := NewNodeEx(cfg, c.msgers[leaderId], c.psters[leaderId], c.machns[leaderId],
+                           golog.New(os.Stderr, "-- ", golog.Lshortfile))
+    if err != nil { t.Fatal(err) }
+    c.nodes[leaderId] = node
+    go node.RunEx(clusterTimeout)
+    waitFor(t, func() bool {
+        term, idx := node.Clock()
+        return term >= term2 && idx >= idx2
+    }, "Clock not restored after restart", term2, idx2)
+}
+
+func TestPriority(t *testing.T) { // {{{1
+    cfg := NodeConfig {
+        NotifBuf: 256,
+        MinNodes: 1,
+        Priorities: map[uint32]int { 1: 0, 2: 1, 3: 2 },
+        PriorityDelay: 50 * time.Millisecond,
+    }
+    leaderOf := func(c *testCluster) uint32 {
+        _, leaderId, _ := c.net.leader()
+        return leaderId
+    }
+    wins := 0
+    for trial := 0; trial < 10; trial += 1 {
+        c := initClusterEx(t, []uint32 { 1, 2, 3 }, cfg)
+        waitFor(t, func() bool { return leaderOf(c) == 3 }, "Leadership not transferred", trial)
+        c.net.Lock()
+        var firstTerm uint64
+        for term := range c.net.leaders {
+            if firstTerm == 0 || term < firstTerm { firstTerm = term }
+        }
+        if c.net.leaders[firstTerm] == 3 { wins += 1 }
+        c.net.Unlock()
+        c.exit()
+    }
+    if wins < 7 {
+        t.Error("Preferred node won too few first elections", wins)
+    }
+
+    // the others take over while the preferred node is down
+    c := initClusterEx(t, []uint32 { 1, 2, 3 }, cfg)
+    defer c.exit()
+    c.msgers[3].Disconnect(1)
+    c.msgers[3].Disconnect(2)
+    waitFor(t, func() bool {
+        c.submit(1001) // retry, in case there was no leader yet
+        time.Sleep(10 * time.Millisecond)
+        return c.machns[1].TryRespond(1001) && c.machns[2].TryRespond(1001)
+    }, "Entry not applied without the preferred node")
+    if leaderId := leaderOf(c); leaderId == 3 {
+        t.Fatal("Partitioned node is the leader")
+    }
+    c.msgers[3].Connect(1)
+    c.msgers[3].Connect(2)
+    waitFor(t, func() bool {
+        return leaderOf(c) == 3 && c.machns[3].TryRespond(1001)
+    }, "Leadership not regained by the preferred node")
+}
+
+func TestPing(t *testing.T) { // {{{1
+    c := initCluster(t, []uint32 { 1, 2, 3 })
+    defer c.exit()
+
+    for _, peerId := range []uint32 { 1, 2 } {
+        rtt, err := c.nodes[1].Ping(peerId)
+        if err != nil || rtt <= 0 { t.Fatal("Bad round-trip to", peerId, rtt, err) }
+    }
+    if _, err := c.nodes[1].Ping(4); err == nil {
+        t.Fatal("Pinged an unknown node")
+    }
+    c.msgers[2].Disconnect(1)
+    if _, err := c.nodes[1].Ping(2); err != ErrPingTimeout {
+        t.Fatal("Ping across a partition", err)
+    }
+}
+
+func TestHeartbeat(t *testing.T) { // {{{1
+    c := initCluster(t, []uint32 { 1, 2, 3 })
+    defer c.exit()
+
+    var leaderId uint32
+    waitFor(t, func() bool {
+        var ok bool
+        _, leaderId, ok = c.net.leader()
+        return ok
+    }, "No leader elected")
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    res, err := c.nodes[leaderId].Heartbeat(ctx)
+    cancel()
+    if err != nil || res != (HeartbeatResult { 2, 2 }) {
+        t.Fatal("Bad heartbeat round", res, err)
+    }
+
+    var follower uint32
+    for id := range c.nodes {
+        if id != leaderId { follower = id; break }
+    }
+    if _, err := c.nodes[follower].Heartbeat(context.Background()); err != ErrNotLeader {
+        t.Fatal("Heartbeat from a follower", err)
+    }
+
+    // well within the election timeout of the cut-off follower
+    c.msgers[leaderId].Disconnect(follower)
+    ctx, cancel = context.WithTimeout(context.Background(), 20 * time.Millisecond)
+    res, err = c.nodes[leaderId].Heartbeat(ctx)
+    cancel()
+    if err != context.DeadlineExceeded || res != (HeartbeatResult { 1, 2 }) {
+        t.Fatal("Heartbeat round across a partition", res, err)
+    }
+}
+
+func TestVerifyLeadership(t *testing.T) { // {{{1
+    c := initCluster(t, []uint32 { 1, 2, 3 })
+    defer c.exit()
+
+    var leaderId uint32
+    waitFor(t, func() bool {
+        var ok bool
+        _, leaderId, ok = c.net.leader()
+        return ok
+    }, "No leader elected")
+    verify := func(id uint32) error {
+        ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+        defer cancel()
+        return c.nodes[id].VerifyLeadership(ctx)
+    }
+    if err := verify(leaderId); err != nil {
+        t.Fatal("Leadership not confirmed", err)
+    }
+    var followers []uint32
+    for id := range c.nodes {
+        if id != leaderId { followers = append(followers, id) }
+    }
+    if err := verify(followers[0]); err != ErrNotLeader {
+        t.Fatal("Leadership of a follower", err)
+    }
+
+    // well within the election timeouts of the cut-off followers
+    c.msgers[leaderId].Disconnect(followers[0])
+    if err := verify(leaderId); err != nil {
+        t.Fatal("Leadership not confirmed by a quorum", err)
+    }
+    c.msgers[leaderId].Disconnect(followers[1])
+    if err := verify(leaderId); err != ErrLeadershipLost {
+        t.Fatal("Leadership confirmed without a quorum", err)
+    }
+}
+
+func TestCheckInvariants(t *testing.T) { // {{{1
+    c := initCluster(t, []uint32 { 1, 2, 3 })
+    defer c.exit()
+    waitFor(t, func() bool {
+        _, _, ok := c.net.leader()
+        return ok
+    }, "No leader elected")
+    for uid := uint64(1); uid <= 5; uid += 1 {
+        c.submit(uid)
+    }
+    var nodes []*RaftNode
+    for _, node := range c.nodes {
+        nodes = append(nodes, node)
+    }
+    if err := CheckInvariants(nodes); err != nil {
+        t.Fatal("Violation in a healthy cluster:", err)
+    }
+
+    entry := func(term, uid uint64) RaftEntry {
+        return RaftEntry { term, &ClientEntry { uid, nil } }
+    }
+    healthy := func() []*RaftNodeSnapshot {
+        log := []RaftEntry { { 0, nil }, entry(1, 11), entry(2, 21) }
+        return []*RaftNodeSnapshot {
+            { Id: 1, State: Leader, Term: 2, CommitIdx: 2, LastApplied: 2,
+                Log: append([]RaftEntry(nil), log...) },
+            { Id: 2, State: Follower, Term: 2, CommitIdx: 2, LastApplied: 1,
+                Log: append([]RaftEntry(nil), log...) },
+            { Id: 3, State: Follower, Term: 2, CommitIdx: 1,
+                Log: append([]RaftEntry(nil), log[:2]...) },
+        }
+    }
+    if err := checkInvariants(healthy()); err != nil {
+        t.Fatal("Violation in a healthy state:", err)
+    }
+    violations := map[string]func(snaps []*RaftNodeSnapshot) {
+        "commit past the log": func(snaps []*RaftNodeSnapshot) {
+            snaps[2].CommitIdx = 2
+        },
+        "applied past the commit": func(snaps []*RaftNodeSnapshot) {
+            snaps[2].LastApplied = 2
+        },
+        "decreasing terms": func(snaps []*RaftNodeSnapshot) {
+            snaps[2].Log = append(snaps[2].Log, entry(0, 31))
+        },
+        "term from the future": func(snaps []*RaftNodeSnapshot) {
+            snaps[2].Log = append(snaps[2].Log, entry(3, 31))
+        },
+        "two leaders": func(snaps []*RaftNodeSnapshot) {
+            snaps[1].State = Leader
+        },
+        "committed entries differ": func(snaps []*RaftNodeSnapshot) {
+            snaps[1].Log[2] = entry(2, 22)
+            snaps[0].State = Follower // not caught as leader incompleteness
+        },
+        "leader incomplete": func(snaps []*RaftNodeSnapshot) {
+            snaps[0].Log, snaps[0].CommitIdx, snaps[0].LastApplied = snaps[0].Log[:2], 1, 1
+        },
+    }
+    for name, violate := range violations {
+        snaps := healthy()
+        violate(snaps)
+        if err := checkInvariants(snaps); err == nil {
+            t.Fatal("Violation not detected:", name)
+        }
+    }
+}
+
+func TestValidateConfigChange(t *testing.T) { // {{{1
+    c := initCluster(t, []uint32 { 1, 2, 3 })
+    defer c.exit()
+
+    var leaderId uint32
+    waitFor(t, func() bool {
+        var ok bool
+        _, leaderId, ok = c.net.leader()
+        return ok
+    }, "No leader elected")
+    var others []uint32
+    for _, id := range []uint32 { 1, 2, 3 } {
+        if id != leaderId { others = append(others, id) }
+    }
+    leader, follower := c.nodes[leaderId], c.nodes[others[0]]
+
+    if err := leader.ValidateConfigChange([]uint32 { 1, 2, 3 }); err != nil {
+        t.Fatal("Rejected the current config", err)
+    }
+    if err := follower.ValidateConfigChange(others[1:]); err != nil {
+        t.Fatal("Rejected removal of a follower by itself", err)
+    }
+    if err := leader.ValidateConfigChange(others); err != ErrRemovesLeader {
+        t.Fatal("Accepted removal of the leader", err)
+    }
+    if err := leader.ValidateConfigChange([]uint32 { 5, 6, 7 }); err != ErrNoOverlap {
+        t.Fatal("Accepted a disjoint config", err)
+    }
+    for _, ids := range [][]uint32 { { }, { 1, 2, 2 } } {
+        if err := leader.ValidateConfigChange(ids); err == nil {
+            t.Fatal("Accepted an invalid node set", ids)
+        }
+    }
+    if err := leader.ValidateConfigChange([]uint32 { 1, 2, 3, 4 }); !errors.Is(err, ErrPingTimeout) {
+        t.Fatal("Accepted a node that does not exist", err)
+    }
+    c.msgers[leaderId].Disconnect(others[1])
+    if err := leader.ValidateConfigChange([]uint32 { 1, 2, 3 }); !errors.Is(err, ErrPingTimeout) {
+        t.Fatal("Accepted an unreachable node", err)
+    }
+}
+
+func TestSmallClusters(t *testing.T) { // {{{1
+    for _, nodeIds := range [][]uint32 { { 1 }, { 1, 2 } } {
+        c := initCluster(t, nodeIds)
+        for _, uid := range []uint64 { 1001, 1002 } {
+            waitFor(t, func() bool {
+                c.submit(uid) // retry, in case there was no leader yet
+                time.Sleep(10 * time.Millisecond)
+                for _, machn := range c.machns {
+                    if !machn.TryRespond(uid) { return false }
+                }
+                return true
+            }, "Entry not applied on all nodes", nodeIds, uid)
+        }
+        c.exit()
+    }
+
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    _, err := NewNode(1, []uint32 { 1, 2 }, 0, &MemMsger { }, &MemPster { }, NewMemMachn(), errlog)
+    assert(t, err != nil, "NewNode should require at least 3 nodes")
+}
+
+func TestExitStopsTimer(t *testing.T) { // {{{1
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    before := runtime.NumGoroutine()
+    for i := 0; i < 300; i += 1 {
+        node, err := NewNodeEx(NodeConfig {
+            SelfId: 1, NodeIds: []uint32 { 1 }, NotifBuf: 0, MinNodes: 1,
+        }, &MemMsger { 1, nil, NewMemNet() }, &MemPster { }, NewMemMachn(), errlog)
+        if err != nil { t.Fatal(err) }
+        exited := make(chan struct{})
+        go func() {
+            node.RunEx(func(RaftState) time.Duration { return time.Millisecond })
+            close(exited)
+        }()
+        time.Sleep(time.Duration(i % 3) * time.Millisecond) // let some timers fire
+        node.Exit()
+        <-exited
+    }
+    time.Sleep(10 * time.Millisecond) // for stopped timers to drain
+    waitFor(t, func() bool {
+        return runtime.NumGoroutine() <= before
+    }, "Leaked goroutines", runtime.NumGoroutine() - before)
+}
+
+func benchReplication(b *testing.B, windowSize uint64, maxCoalesce int) { // {{{1
+    c := initClusterEx(b, []uint32 { 1, 2, 3 }, NodeConfig {
+        NotifBuf: 4096,
+        MinNodes: 1,
+        LeaderWindowSize: windowSize,
+        MaxCoalesce: maxCoalesce,
+    })
+    defer c.exit()
+    var leader uint32
+    waitFor(b, func() bool {
+        var ok bool
+        _, leader, ok = c.net.leader()
+        return ok
+    }, "No leader elected")
+
+    b.ResetTimer()
+    for i := 0; i < b.N; i += 1 {
+        c.nodes[leader].notifch <- &ClientEntry { uint64(i + 1), nil }
+    }
+    for _, node := range c.nodes {
+        waitFor(b, func() bool {
+            return node.LastApplied() >= uint64(b.N)
+        }, "Replication stalled")
+    }
+}
+
+func BenchmarkReplication(b *testing.B)         { benchReplication(b, 0, 0) }
+func BenchmarkReplicationWindow(b *testing.B)   { benchReplication(b, 64, 0) }
+func BenchmarkReplicationPerEntry(b *testing.B) { benchReplication(b, 0, 1) } // no coalescing
+
+func TestAssignedUIDs(t *testing.T) { // {{{1
+    c := initClusterEx(t, []uint32 { 1, 2, 3 }, NodeConfig { NotifBuf: 256, MinNodes: 1, AssignUIDs: true })
+    defer c.exit()
+
+    // propose on whichever node (but skip) is the leader
+    propose := func(data string, skip uint32) (uint32, uint64) {
+        var leaderId uint32
+        var uid uint64
+        waitFor(t, func() bool {
+            for id, node := range c.nodes {
+                if id == skip { continue }
+                var err error
+                if uid, _, err = node.Propose(data); err == nil {
+                    leaderId = id
+                    return true
+                }
+            }
+            return false
+        }, "No leader to propose to")
+        return leaderId, uid
+    }
+    uids := make(map[uint64]bool)
+    oldLeader, uidA := propose("a", 0)
+    uids[uidA] = true
+    _, uid := propose("b", 0)
+    uids[uid] = true
+
+    for id := range c.nodes {
+        if id != oldLeader { c.msgers[oldLeader].Disconnect(id) }
+    }
+    _, uid = propose("c", oldLeader) // the old one is still leader of its term
+    uids[uid] = true
+    assert(t, (uid &^ assignedUidBit) >> 32 > (uidA &^ assignedUidBit) >> 32, "Not assigned in a later term", uidA, uid)
+    for id := range c.nodes {
+        if id != oldLeader { c.msgers[oldLeader].Connect(id) }
+    }
+    assert(t, len(uids) == 3, "Assigned UIDs are not unique", uids)
+
+    for uid := range uids {
+        assert(t, uid & assignedUidBit != 0, "UID not in the assigned range", uid)
+        for id, machn := range c.machns {
+            waitFor(t, func() bool {
+                return machn.TryRespond(uid)
+            }, "Entry not applied on node", id, uid)
+        }
+    }
+}
@@ -0,0 +1,84 @@
+package raft
+
+import (
+    "fmt"
+    "sort"
+)
+
+// A configuration of the cluster, and the log position from which it is in
+// effect
+type ConfigEntry struct {
+    Idx uint64
+    Term uint64
+    NodeIds []uint32 // sorted
+}
+
+// The committed configurations of the cluster, oldest first (safe to call
+// from anywhere). Membership cannot change yet (NodeIds is immutable, see
+// Reset), and no configuration is replicated through the log, so this is only
+// the one the node was created with, in effect from the start of the log.
+func (self *RaftNode) ConfigHistory() []ConfigEntry { // {{{1
+    nodeIds := append([]uint32 { self.id }, self.peerIds...)
+    sort.Slice(nodeIds, func(i, j int) bool { return nodeIds[i] < nodeIds[j] })
+    return []ConfigEntry { { 0, 0, nodeIds } }
+}
+
+// Check (without changing anything) whether the cluster could switch to the
+// nodes in newIds right now: newIds must be a valid node set sharing a node
+// with the current one, must not drop this node while it is the leader (there
+// is no one to hand off to), and every node in it must answer a Ping.
+//
+// There is no Resize to make the switch, since that would take joint
+// consensus (a configuration replicated through the log, and quorums over both
+// the old and the new set until it commits). Until then, the whole cluster has
+// to be stopped, and started again with newIds as NodeIds once every node of
+// the old set has the whole committed log (or else a quorum of the new set may
+// elect a leader without some committed entries).
+func (self *RaftNode) ValidateConfigChange(newIds []uint32) error { // {{{1
+    reply := make(chan error, 1)
+    self.notifch <- &validateConfig { newIds, reply }
+    if err := <-reply; err != nil {
+        return err
+    }
+    // outside the loop, since pings are served by it
+    errs := make(chan error, len(newIds))
+    for _, nodeId := range newIds {
+        go func(nodeId uint32) {
+            if _, err := self.ping(nodeId); err != nil {
+                errs <- fmt.Errorf("Node %d is unreachable: %w", nodeId, err)
+            } else {
+                errs <- nil
+            }
+        }(nodeId)
+    }
+    var firstErr error
+    for range newIds {
+        if err := <-errs; err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+    return firstErr
+}
+
+func (self *RaftNode) validateConfig(newIds []uint32) error {
+    nodeSet := make(map[uint32]bool)
+    for _, nodeId := range newIds {
+        if nodeSet[nodeId] {
+            return ErrDuplicateNodeId
+        }
+        nodeSet[nodeId] = true
+    }
+    if len(newIds) < self.cfg.MinNodes || len(newIds) == 0 {
+        return ErrTooFewNodes
+    }
+    overlap := false
+    for _, nodeId := range self.cfg.NodeIds {
+        overlap = overlap || nodeSet[nodeId]
+    }
+    if !overlap {
+        return ErrNoOverlap
+    } else if self.state == Leader && !nodeSet[self.id] {
+        return ErrRemovesLeader
+    }
+    return nil
+}
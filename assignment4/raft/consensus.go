@@ -1,10 +1,16 @@
 package raft
 
 import (
+    "context"
+    crand "crypto/rand"
+    "encoding/binary"
     "errors"
+    "fmt"
     golog "log" // avoid confusion
     "math/rand"
     "sort"
+    "sync"
+    "sync/atomic"
     "time"
 )
 
@@ -12,24 +18,67 @@ import (
 //       All events including timeouts are received on a single channel
 
 type RaftNode struct { // FIXME organize differently?
+    // copies for reading from outside the loop (kept first for 64-bit alignment)
+    lastAppldAtomic uint64
+    commitIdxAtomic uint64
+    termAtomic uint64
+    caughtUpAtomic uint32 // 1 if the log is known to match the leader's
+    running int32 // 1 while the event loop is running (see Restore)
+    clockAtomic atomic.Value // ClockEntry, the latest one applied
+    appldMutex sync.Mutex
+    appldCh chan struct{} // closed (and replaced) whenever lastAppld advances
+    pings pingTracker
     id uint32 // node id
     peerIds []uint32
+    cfg NodeConfig
     // persistent fields
     term uint64
-    votedFor uint32
+    votedFor uint32 // only if hasVoted
+    hasVoted bool
     // volatile fields
     state RaftState
     commitIdx uint64
     lastAppld uint64
+    appldQueued uint64 // entries up to this are handed to the Machine (or applier)
     // state-specific fields
     voteSet map[uint32]bool // candidate: used as a set -- bool values are not used
     nextIdx map[uint32]uint64 // leader
     matchIdx map[uint32]uint64 // leader
+    windows map[uint32]*sendWindow // leader
+    backoffs map[uint32]*replBackoff // leader
+    leaderReady bool // leader: an entry of the current term has been committed
+    readyIdx uint64 // leader: the first entry of the current term committed
+    pendingReads []*LeaderRead // leader: deferred until readsReady
+    heartbeats []*heartbeatRound // leader: forced rounds (see Heartbeat)
+    commitReads []*commitRead // leader: waiting to be applied (see ReadCommitted)
+    snapWaits []*snapWait // leader: waiting to be persisted (see SnapshotNow)
+    loadIdx uint64 // leader: last index of the BulkLoad under way (0 if none)
+    loadWait chan<- error // leader: the BulkLoad waiting for loadIdx to commit
+    transferTerm uint64 // leader: term in which TimeoutNow was last sent
+    lastReqId uint64 // leader: AppendEntries.ReqID of the last one sent
+    uidTerm, uidCount uint64 // leader: UIDs assigned so far in uidTerm (see Propose)
+    appendSeen map[uint32]appendSeen // follower: per leader (see seenAppend)
     // extras
     idxOfUid map[uint64]uint64 // uid -> idx map for entries not yet applied
+    firstClientIdx uint64 // index of the first client entry in the log (0 if none)
+    ledTerms map[uint64]bool // terms in which this node was the leader (see LeaderApplier)
+    snapIdxs map[uint64]bool // pending snapshot indices (see SnapshotMarker)
+    lastSnapIdx uint64 // index of the latest snapshot, taken or scheduled
+    rng *rand.Rand // jitter of the timeouts of Run (see NodeConfig.Rand)
+    commitHook func(uint64, []ClientEntry) // see CommitHook
+    paused map[uint32]bool // peers not sent AppendEntries (see PauseReplication)
+    stats ElectionStats
+    quiesced bool // see Quiesce
+    maxLogEntries uint64 // NodeConfig.MaxLogEntries, or as raised since
     timer *RaftTimer
+    pushback Message // taken out of notifch, but not handled yet
+    halted bool // see Pause
+    held []Message // taken out of notifch while halted
+    applier *applier // if NodeConfig.AsyncApply
+    applying []*applyTask // handed to the applier, in order
     // links
     notifch chan Message
+    events chan RaftEvent
     msger Messenger
     pster Persister
     machn Machine
@@ -42,121 +91,594 @@ func NewNode( // {{{1
     msger Messenger, pster Persister, machn Machine,
     errlog *golog.Logger,
 ) (*RaftNode, error) {
+    return NewNodeEx(NodeConfig {
+        SelfId: selfId,
+        NodeIds: nodeIds,
+        NotifBuf: notifbuf,
+        MinNodes: 3,
+    }, msger, pster, machn, errlog)
+}
+
+func NewNodeEx( // {{{1
+    cfg NodeConfig,
+    msger Messenger, pster Persister, machn Machine,
+    errlog *golog.Logger,
+) (*RaftNode, error) {
+    selfId, nodeIds := cfg.SelfId, cfg.NodeIds
     rf := pster.GetFields()
     var peerIds []uint32
-    if len(nodeIds) < 3 {
-        return nil, errors.New("Not enough nodes!")
+    if len(nodeIds) < cfg.MinNodes || len(nodeIds) == 0 {
+        return nil, ErrTooFewNodes
     } else {
         var pSet = make(map[uint32]bool)
         var selfFound bool = false
         for _, peerId := range nodeIds {
-            if peerId == NilNode {
-                return nil, errors.New("NilNode = ^uint32(0) is a reserved nodeId")
-            } else if peerId == selfId {
+            if peerId == selfId {
                 selfFound = true
             } else {
                 pSet[peerId] = true
             }
         }
         if !selfFound {
-            return nil, errors.New("nodeIds should contain selfId")
+            return nil, ErrSelfNotInSet
         }
         for peerId := range pSet {
             peerIds = append(peerIds, peerId)
         }
         if len(peerIds) + 1 != len(nodeIds) {
-            return nil, errors.New("nodeIds should not have duplicates")
+            return nil, ErrDuplicateNodeId
+        }
+        if len(nodeIds) == 2 {
+            errlog.Print("warning: a 2-node cluster cannot tolerate any failure")
         }
     }
     if rf == nil {
-        rf = &RaftFields { 0, NilNode }
+        rf = &RaftFields { 0, 0, false }
+    }
+    if cfg.GroupCommitInterval > 0 {
+        gpster, ok := pster.(GroupCommitter)
+        if !ok { return nil, ErrGroupCommitUnsupported }
+        gpster.SetGroupCommit(cfg.GroupCommitInterval)
     }
     if idx, entry := pster.LastEntry(); idx == 0 && entry == nil {
         ok := pster.LogUpdate(0, []RaftEntry { RaftEntry { 0, nil } })
-        if !ok { return nil, errors.New("Initial log update failed") }
+        if !ok { return nil, ErrInitialLogUpdateFailed }
     }
-    notifch := make(chan Message, notifbuf)
+    notifch := make(chan Message, cfg.NotifBuf)
     msger.Register(notifch)
-    return &RaftNode {
+    node := &RaftNode {
         id: selfId,
         peerIds: peerIds,
+        cfg: cfg,
         term: rf.Term,
+        termAtomic: rf.Term,
         votedFor: rf.VotedFor,
+        hasVoted: rf.HasVoted,
         state: Follower,
         commitIdx: 0,
         lastAppld: 0,
         voteSet: nil,
         nextIdx: nil,
         matchIdx: nil,
+        windows: nil,
         idxOfUid: nil,
+        ledTerms: make(map[uint64]bool),
+        snapIdxs: make(map[uint64]bool),
+        paused: make(map[uint32]bool),
+        maxLogEntries: cfg.MaxLogEntries,
+        rng: cfg.Rand,
+        appldCh: make(chan struct{}),
         timer: nil,
         notifch: notifch,
+        events: make(chan RaftEvent, eventBuf),
         msger: msger,
         pster: pster,
         machn: machn,
         err: errlog,
-    }, nil
+    }
+    if node.rng == nil {
+        node.rng = newSeededRand()
+    }
+    node.scanClientEntries()
+    if err := node.loadSnapshot(); err != nil {
+        return nil, err
+    } else if err := node.replayCommitted(); err != nil {
+        return nil, err
+    }
+    return node, nil
 }
 
 // Run the event loop with default timeout logic
 func (self *RaftNode) Run(timeoutBase time.Duration) { // {{{1
+    self.RunEx(func(state RaftState) time.Duration {
+        return self.sampleTimeout(timeoutBase, state)
+    })
+}
+
+// The timeout of Run in state; the jitter is drawn from NodeConfig.Rand
+func (self *RaftNode) sampleTimeout(timeoutBase time.Duration, state RaftState) time.Duration {
+    timeoutBase = self.scaleTimeout(timeoutBase)
     followMinTO := 2 * timeoutBase
     candidMinTO := 3 * timeoutBase
     fuzz := int64(2 * timeoutBase)
-    self.RunEx(func(state RaftState) time.Duration {
-        switch state {
-        case Follower:
-            return followMinTO + time.Duration(rand.Int63n(fuzz))
-        case Candidate:
-            return candidMinTO + time.Duration(rand.Int63n(fuzz))
-        case Leader:
-            return timeoutBase
-        }
-        panic("Unreachable")
-    })
+    switch state {
+    case Follower:
+        return followMinTO + time.Duration(self.rng.Int63n(fuzz))
+    case Candidate:
+        return candidMinTO + time.Duration(self.rng.Int63n(fuzz))
+    case Leader:
+        return timeoutBase
+    }
+    panic("Unreachable")
 }
 
-// Run the event loop with custom timout sampling
+// A source of its own for every node, so that nodes started together do not
+// draw the same timeouts
+func newSeededRand() *rand.Rand {
+    var seed [8]byte
+    if _, err := crand.Read(seed[:]); err != nil {
+        binary.LittleEndian.PutUint64(seed[:], uint64(time.Now().UnixNano()))
+    }
+    return rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(seed[:]))))
+}
+
+// Scale up timeoutBase based on the latencies to peers (if configured)
+func (self *RaftNode) scaleTimeout(timeoutBase time.Duration) time.Duration {
+    if self.cfg.LatencyMultiplier <= 0 {
+        return timeoutBase
+    }
+    var maxLatency time.Duration = NoLatencyEstimate
+    for _, peerId := range self.peerIds {
+        if latency := self.msger.Latency(peerId); latency > maxLatency {
+            maxLatency = latency
+        }
+    }
+    scaled := time.Duration(float64(maxLatency) * self.cfg.LatencyMultiplier)
+    if scaled > timeoutBase {
+        return scaled
+    }
+    return timeoutBase
+}
+
+// Run the event loop with custom timout sampling (election timeouts are
+// further delayed based on NodeConfig.Priorities); panics if PreflightCheck
+// fails
 func (self *RaftNode) RunEx(timeoutSampler func(RaftState) time.Duration) { // {{{1
-    self.timer = NewRaftTimer(func(v uint64) func() {
+    if err := self.PreflightCheck(); err != nil {
+        self.halt("fatal", "preflight check failed: " + err.Error())
+    }
+    var timer *RaftTimer
+    timer = NewRaftTimer(func(v uint64) func() {
         return func() {
-            self.notifch <- &timeout { v }
+            select {
+            case self.notifch <- &timeout { v }:
+            case <-timer.Done(): // nobody would read it
+            }
         }
-    }, timeoutSampler)
+    }, self.prioritySampler(timeoutSampler))
+    self.timer = timer
+    self.startApplier()
+    atomic.StoreInt32(&self.running, 1)
 
     self.timerReset()
+    if len(self.peerIds) == 0 && !self.cfg.WitnessMode { // no one else to wait for
+        self.state = Candidate
+        self.candidateHandler(&timeout { 0 })
+    }
 
     loop:
     for {
-        msg := <-self.notifch
+        var msg Message
+        if self.pushback != nil {
+            msg, self.pushback = self.pushback, nil
+        } else if len(self.held) > 0 && !self.halted {
+            msg, self.held = self.held[0], self.held[1:]
+        } else {
+            msg = <-self.notifch
+        }
+        if self.halted {
+            switch msg.(type) {
+            case *pauseLoop, *exitLoop, *inspectState:
+            default:
+                self.held = append(self.held, msg)
+                continue loop
+            }
+        }
 
         switch m := msg.(type) {
         case *timeout:
             if !self.timer.Match(m.version) { continue loop }
+            if self.state != Leader && self.timer.Overslept() {
+                // do not start an election (or another one) before seeing
+                // whether there is still a leader around
+                self.err.Print("timeout fired late; waiting another timeout")
+                self.timerReset()
+                continue loop
+            }
+        case *pauseLoop:
+            self.pause(m.on)
+            close(m.done)
+            continue loop
         case *exitLoop:
+            self.halted, self.held = false, nil
+            self.timer.Stop()
+            self.stopApplier()
+            self.fsync() // whatever SyncOnVote or SyncBeforeReply left unsynced
+            atomic.StoreInt32(&self.running, 0)
+            close(m.done)
             break loop
         case *testEcho:
             self.msger.Send(self.id, m)
             continue loop
+        case *applied:
+            if self.applier != nil { // not a leftover of an earlier run
+                self.finishApply(m.task)
+            }
+            continue loop
+        case *pingPeer, *Ping, *Pong: // can be served in any state
+            self.handlePing(msg)
+            continue loop
+        case *StaleRead: // can be served in any state
+            self.msger.ClientReadReply(m.UID, self.machn.Read(m.Key), self.lastAppld)
+            continue loop
+        case *snapshotAt:
+            idx, err := self.snapshotAt(m.idx)
+            m.reply <- snapshotAtReply { idx, err }
+            continue loop
+        case *snapshotNow:
+            self.startSnapshotNow(m.reply)
+            continue loop
+        case *proposeBatch:
+            idx, err := self.proposeBatch(m.entries)
+            m.reply <- proposeBatchReply { idx, err }
+            continue loop
+        case *bulkLoad:
+            self.bulkLoadChunk(m)
+            continue loop
+        case *propose:
+            uid, idx, err := self.propose(m.data)
+            m.reply <- proposeReply { uid, idx, err }
+            continue loop
+        case *resetConfig:
+            m.reply <- self.reset(m.cfg)
+            continue loop
+        case *restartLoop:
+            m.reply <- self.restart(m.cfg)
+            continue loop
+        case *dumpState:
+            m.reply <- self.dump()
+            continue loop
+        case *inspectState:
+            m.fn(self.inspect())
+            close(m.done)
+            continue loop
+        case *nodeStatus:
+            m.reply <- self.status()
+            continue loop
+        case *replaySlice:
+            entries, ok := self.pster.LogSlice(m.startIdx, m.endIdx)
+            m.reply <- replaySliceReply { append([]RaftEntry(nil), entries...), ok }
+            continue loop
+        case *commitHook:
+            m.reply <- self.setCommitHook(m.fn)
+            continue loop
+        case *setLogger:
+            self.err = m.errlog
+            close(m.done)
+            continue loop
+        case *runDone:
+            m.reply <- self.timer.Done()
+            continue loop
+        case *backupLog:
+            m.reply <- self.backupLog()
+            continue loop
+        case *logStats:
+            m.reply <- self.logStats()
+            continue loop
+        case *electionStats:
+            if m.reset {
+                self.stats = ElectionStats { }
+            }
+            m.reply <- self.stats
+            continue loop
+        case *validateConfig:
+            m.reply <- self.validateConfig(m.nodeIds)
+            continue loop
+        case *heartbeat:
+            self.startHeartbeat(m.round)
+            continue loop
+        case *readCommitted:
+            self.startCommitRead(m.uid, m.cmd, m.reply)
+            continue loop
+        case *pauseReplication:
+            m.reply <- self.pauseReplication(m.nodeId, m.pause)
+            continue loop
+        case *quiesce:
+            self.quiesce(m.on)
+            close(m.done)
+            continue loop
+        case *rpcCall:
+            m.reply <- self.rpc(m.msg)
+            continue loop
         }
 
-        switch self.state {
-        case Follower:
-            self.followerHandler(msg)
-        case Candidate:
-            self.candidateHandler(msg)
-        case Leader:
-            self.leaderHandler(msg)
-        }
+        self.dispatch(msg)
+    }
+}
+
+// Hand msg to the handler of the current state
+func (self *RaftNode) dispatch(msg Message) {
+    if self.fromStranger(msg) {
+        return
+    }
+    switch self.state {
+    case Follower:
+        self.followerHandler(msg)
+    case Candidate:
+        self.candidateHandler(msg)
+    case Leader:
+        self.leaderHandler(msg)
+    }
+}
+
+func (self *RaftNode) isPeer(nodeId uint32) bool {
+    for _, peerId := range self.peerIds {
+        if peerId == nodeId { return true }
     }
+    return false
 }
 
-// Exit the event loop
+// Whether msg is from a stray (misconfigured) node, and so is to be ignored:
+// it must not touch the log, nor the term, nor count toward a quorum (NodeIds
+// cannot change, so no new node is left out)
+func (self *RaftNode) fromStranger(msg Message) bool {
+    var sender uint32
+    switch m := msg.(type) {
+    case *AppendEntries:
+        sender = m.LeaderId
+    case *AppendReply:
+        sender = m.NodeId
+    case *VoteRequest:
+        sender = m.CandidId
+    case *VoteReply:
+        sender = m.NodeId
+    case *TimeoutNow:
+        sender = m.LeaderId
+    case *Ping:
+        if m.NodeId == self.id { return false } // a node may ping itself
+        sender = m.NodeId
+    case *Pong:
+        if m.NodeId == self.id { return false }
+        sender = m.NodeId
+    default:
+        return false
+    }
+    if self.isPeer(sender) {
+        return false
+    }
+    self.err.Printf("%T from unknown node %v ignored", msg, sender)
+    return true
+}
+
+// Exit the event loop (returns after it has stopped), syncing the Persister
+// on the way out; so without SyncOnVote and SyncBeforeReply, only a crash can
+// lose what was written (and acknowledged) since the last sync
 func (self *RaftNode) Exit() { // {{{1
-    self.notifch <- &exitLoop { }
+    done := make(chan struct{})
+    self.notifch <- &exitLoop { done }
+    <-done
+}
+
+// Index of the last entry applied to the machine (safe to call from anywhere)
+func (self *RaftNode) LastApplied() uint64 { // {{{1
+    return atomic.LoadUint64(&self.lastAppldAtomic)
+}
+
+// Index of the last entry known to be committed (safe to call from anywhere)
+func (self *RaftNode) CommitIndex() uint64 {
+    return atomic.LoadUint64(&self.commitIdxAtomic)
+}
+
+// The current term (safe to call from anywhere)
+func (self *RaftNode) Term() uint64 {
+    return atomic.LoadUint64(&self.termAtomic)
+}
+
+// Whether the log of this node is known to match the leader's, up to the end
+// of the latest AppendEntries and at least up to the leader's commit index;
+// always true on a leader (safe to call from anywhere)
+func (self *RaftNode) IsCaughtUp() bool {
+    return atomic.LoadUint32(&self.caughtUpAtomic) == 1
+}
+
+// The logical clock of this node: (Term, Idx) of the latest ClockEntry
+// applied, or zeros if none is yet. With NodeConfig.LogicalClock, a new leader
+// appends one at the start of its term, so the clock only advances, and is the
+// same on every node once they apply the same entries. After a restart, it is
+// restored as the log is applied again (safe to call from anywhere)
+func (self *RaftNode) Clock() (term uint64, idx uint64) {
+    clock, _ := self.clockAtomic.Load().(ClockEntry)
+    return clock.Term, clock.Idx
+}
+
+// Block until LastApplied() >= minApplied (however it is reached, even by
+// ApplyEntries or Restore while the loop is stopped), or ctx is done; returns
+// ctx.Err() in the latter case. To read from this node without seeing stale
+// state, fetch CommitIndex() from any up-to-date node (say, the leader) and
+// pass it as minApplied.
+func (self *RaftNode) ReadBarrier(ctx context.Context, minApplied uint64) error {
+    for {
+        self.appldMutex.Lock()
+        appldCh := self.appldCh
+        self.appldMutex.Unlock()
+        if self.LastApplied() >= minApplied {
+            return nil
+        }
+        select {
+        case <-appldCh:
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+    }
+}
+
+// Make all the nodes take a snapshot (see Snapshotter) at the same log index,
+// by replicating a SnapshotMarker. If idx is zero, the index of the marker
+// itself is used. Returns the index at which the snapshots will be taken.
+// Nodes that are behind will take the snapshot once they catch up to it.
+func (self *RaftNode) SnapshotAt(idx uint64) (uint64, error) { // {{{1
+    reply := make(chan snapshotAtReply, 1)
+    self.notifch <- &snapshotAt { idx, reply }
+    r := <-reply
+    return r.idx, r.err
+}
+
+func (self *RaftNode) snapshotAt(idx uint64) (uint64, error) {
+    if self.state != Leader {
+        return 0, ErrNotLeader
+    }
+    lastIdx, _ := self.logTail()
+    markIdx := lastIdx + 1
+    if idx == 0 {
+        idx = markIdx
+    } else if idx < markIdx { // the entries in between may not be applied after the marker
+        return 0, errors.New("Snapshot index is behind the log tail")
+    }
+    if idx > self.lastSnapIdx {
+        self.lastSnapIdx = idx
+    }
+    self.leaderLogAppend(RaftEntry { self.term, &ClientEntry { 0, &SnapshotMarker { idx } } })
+    return idx, nil
+}
+
+// Schedule a snapshot if the log has grown by maxLogEntries since the latest
+func (self *RaftNode) maybeCompact(lastIdx uint64) {
+    if self.maxLogEntries == 0 || lastIdx < self.lastSnapIdx + self.maxLogEntries {
+        return
+    }
+    if _, ok := self.machn.(Snapshotter); ok {
+        self.snapshotAt(0)
+    } else {
+        self.err.Printf("warning: %v log entries since the latest snapshot, but the machine cannot snapshot",
+                        lastIdx - self.lastSnapIdx)
+        self.maxLogEntries += self.maxLogEntries / 2 + 1
+    }
+}
+
+// Append the entries to the log as a single BatchClientEntry, so that either
+// all or none of them are committed. Returns the log index of the batch.
+// UIDs that are already known (pending or applied) make the whole batch fail.
+func (self *RaftNode) ProposeBatch(entries []ClientEntry) (uint64, error) { // {{{1
+    reply := make(chan proposeBatchReply, 1)
+    self.notifch <- &proposeBatch { entries, reply }
+    r := <-reply
+    return r.idx, r.err
+}
+
+func (self *RaftNode) proposeBatch(entries []ClientEntry) (uint64, error) {
+    if self.quiesced {
+        return 0, ErrQuiesced
+    } else if self.state != Leader {
+        return 0, ErrNotLeader
+    } else if len(entries) == 0 {
+        return 0, errors.New("Empty batch")
+    }
+    seen := make(map[uint64]bool)
+    for _, e := range entries {
+        _, pending := self.idxOfUid[e.UID]
+        if e.UID == 0 || seen[e.UID] || pending || self.machn.TryRespond(e.UID) {
+            return 0, errors.New("Duplicate or reserved UID in batch")
+        }
+        seen[e.UID] = true
+    }
+    self.leaderLogAppend(RaftEntry { self.term, &ClientEntry { 0, &BatchClientEntry { entries } } })
+    idx, _ := self.logTail()
+    return idx, nil
+}
+
+// Append a ClientEntry with a UID assigned by the leader (which needs
+// NodeConfig.AssignUIDs), so that clients need not come up with unique ones.
+// Returns the UID and the log index of the entry; the response is sent for
+// that UID, as for any other ClientEntry. Assigned UIDs have the top bit set,
+// the term in the next 31 bits and a per-term counter in the low 32 bits, so
+// no two leaders assign the same UID.
+func (self *RaftNode) Propose(data interface{}) (uint64, uint64, error) { // {{{1
+    reply := make(chan proposeReply, 1)
+    self.notifch <- &propose { data, reply }
+    r := <-reply
+    return r.uid, r.idx, r.err
+}
+
+func (self *RaftNode) propose(data interface{}) (uint64, uint64, error) {
+    if !self.cfg.AssignUIDs {
+        return 0, 0, errors.New("UIDs are not assigned by the leader")
+    } else if self.quiesced {
+        return 0, 0, ErrQuiesced
+    } else if self.state != Leader {
+        return 0, 0, ErrNotLeader
+    } else if self.term >= 1 << 31 {
+        return 0, 0, errors.New("Term too large for assigned UIDs")
+    }
+    if self.uidTerm != self.term {
+        self.uidTerm, self.uidCount = self.term, 0
+    } else if self.uidCount == 1 << 32 - 1 {
+        return 0, 0, errors.New("Assigned UIDs exhausted for the term")
+    }
+    self.uidCount += 1
+    uid := assignedUidBit | self.term << 32 | self.uidCount
+    self.leaderLogAppend(RaftEntry { self.term, &ClientEntry { uid, data } })
+    idx, _ := self.logTail()
+    return uid, idx, nil
+}
+
+const assignedUidBit uint64 = 1 << 63
+
+// Replace the tunables of the node (LeaderWindowSize, EntrySize,
+// LatencyMultiplier, Priorities, PriorityDelay and MaxLogEntries) at runtime;
+// the rest of cfg should be left as it is.
+func (self *RaftNode) Reset(cfg NodeConfig) error { // {{{1
+    reply := make(chan error, 1)
+    self.notifch <- &resetConfig { cfg, reply }
+    return <-reply
+}
+
+func (self *RaftNode) reset(cfg NodeConfig) error {
+    old := self.cfg
+    if cfg.SelfId != old.SelfId || cfg.NotifBuf != old.NotifBuf || cfg.MinNodes != old.MinNodes ||
+       cfg.WitnessMode != old.WitnessMode || cfg.AsyncApply != old.AsyncApply {
+        return ErrImmutableField
+    }
+    if !sameNodeSet(cfg.NodeIds, old.NodeIds) || !sameNodeSet(cfg.Witnesses, old.Witnesses) {
+        return ErrImmutableField
+    }
+    if cfg.MaxLogEntries != old.MaxLogEntries {
+        self.maxLogEntries = cfg.MaxLogEntries
+    }
+    self.cfg = cfg
+    if self.state == Leader { // the window may have opened up
+        lastIdx, _ := self.logTail()
+        for _, nodeId := range self.peerIds {
+            if self.nextIdx[nodeId] <= lastIdx {
+                self.sendAppendEntries(nodeId, 8)
+            }
+        }
+    }
+    return nil
 }
 
 // ---- private utility methods {{{1
+func sameNodeSet(xs, ys []uint32) bool {
+    nodeSet := make(map[uint32]bool)
+    for _, nodeId := range xs {
+        nodeSet[nodeId] = true
+    }
+    for _, nodeId := range ys {
+        if !nodeSet[nodeId] { return false }
+        delete(nodeSet, nodeId)
+    }
+    return len(nodeSet) == 0
+}
+
 func (self *RaftNode) log(idx uint64) *RaftEntry {
     return self.pster.Entry(idx)
 }
@@ -165,21 +687,29 @@ func (self *RaftNode) logTail() (uint64, *RaftEntry) {
     return self.pster.LastEntry()
 }
 
-func (self *RaftNode) applyCommitted() {
-    if self.lastAppld < self.commitIdx {
-        var cEntries []ClientEntry
-        for idx := self.lastAppld + 1; idx <= self.commitIdx; idx += 1 {
-            cEntry := self.log(idx).CEntry
-            if cEntry != nil {
-                cEntries = append(cEntries, *cEntry)
-                delete(self.idxOfUid, cEntry.UID)
-            }
-        }
-        if len(cEntries) > 0 {
-            self.machn.Execute(cEntries)
+// UIDs of the client requests in the entry (none for raft-internal ones)
+func (self *RaftEntry) clientUids() []uint64 {
+    if self.CEntry == nil {
+        return nil
+    }
+    switch data := self.CEntry.Data.(type) {
+    case *SnapshotMarker, *ClockEntry:
+        return nil
+    case *BatchClientEntry:
+        uids := make([]uint64, len(data.Entries))
+        for i, e := range data.Entries {
+            uids[i] = e.UID
         }
-        self.lastAppld = self.commitIdx
+        return uids
     }
+    return []uint64 { self.CEntry.UID }
+}
+
+func (self *RaftEntry) hasClientUid(uid uint64) bool {
+    for _, u := range self.clientUids() {
+        if u == uid { return true }
+    }
+    return false
 }
 
 func (self *RaftNode) isUpToDate(r *VoteRequest) bool {
@@ -188,33 +718,133 @@ func (self *RaftNode) isUpToDate(r *VoteRequest) bool {
 }
 
 func (self *RaftNode) logUpdate(startIdx uint64, entries []RaftEntry) {
-    if ok := self.pster.LogUpdate(startIdx, entries); !ok {
-        self.err.Print("fatal: unable to update log; ignoring!!!")
+    self.logUpdateBatch([]LogUpdateOp { LogUpdateOp { startIdx, entries } })
+}
+
+func (self *RaftNode) logUpdateBatch(updates []LogUpdateOp) {
+    if self.cfg.WitnessMode { // in case the leader did not strip them
+        stripped := make([]LogUpdateOp, len(updates))
+        for i, op := range updates {
+            stripped[i] = LogUpdateOp { op.StartIdx, witnessEntries(op.Entries) }
+        }
+        updates = stripped
+    }
+    if bpster, ok := self.pster.(BatchPersister); ok {
+        self.persist("unable to update log", func() bool {
+            return bpster.LogUpdateBatch(updates)
+        })
+    } else {
+        for _, op := range updates {
+            self.persist("unable to update log", func() bool {
+                return self.pster.LogUpdate(op.StartIdx, op.Entries)
+            })
+        }
+    }
+    for _, op := range updates {
+        self.trackClientEntries(op.StartIdx, op.Entries)
+    }
+    if self.cfg.SyncBeforeReply {
+        self.fsync()
     }
 }
 
 func (self *RaftNode) leaderLogAppend(entry RaftEntry) {
+    self.leaderLogAppendAll([]RaftEntry { entry })
+}
+
+func (self *RaftNode) leaderLogAppendAll(entries []RaftEntry) {
     lastIdx, _ := self.logTail()
     newIdx := lastIdx + 1
-    self.logUpdate(newIdx, []RaftEntry { entry })
-    if entry.CEntry != nil {
-        self.idxOfUid[entry.CEntry.UID] = newIdx
+    self.logUpdate(newIdx, entries)
+    for i := range entries {
+        for _, uid := range entries[i].clientUids() {
+            self.idxOfUid[uid] = newIdx + uint64(i)
+        }
     }
     for nodeId := range self.nextIdx {
         nextIdx := self.nextIdx[nodeId]
         if nextIdx == newIdx {
-            self.sendAppendEntries(nodeId, 1)
+            self.sendAppendEntries(nodeId, len(entries))
+        }
+    }
+    if len(self.peerIds) == 0 { // no replies would trigger this
+        self.updateCommitIdx()
+        self.applyCommitted()
+    }
+    self.maybeCompact(newIdx + uint64(len(entries)) - 1)
+}
+
+const defaultMaxCoalesce = 256
+
+// Append msg along with the ClientEntry-s queued up right behind it (see
+// NodeConfig.MaxCoalesce); the first other message found is kept aside in
+// pushback, to be handled next
+func (self *RaftNode) leaderAppendCoalesced(msg *ClientEntry) {
+    maxCoalesce := self.cfg.MaxCoalesce
+    if maxCoalesce <= 0 {
+        maxCoalesce = defaultMaxCoalesce
+    }
+    var entries []RaftEntry
+    seen := make(map[uint64]bool)
+    for {
+        if !seen[msg.UID] && self.isNewEntry(msg) {
+            seen[msg.UID] = true
+            entries = append(entries, RaftEntry { self.term, msg })
+        }
+        if len(entries) >= maxCoalesce || self.pushback != nil {
+            break
+        }
+        var next Message
+        select {
+        case next = <-self.notifch:
+        default:
+        }
+        var ok bool
+        if msg, ok = next.(*ClientEntry); !ok {
+            self.pushback = next // nil if nothing was queued
+            break
+        }
+    }
+    if len(entries) > 0 {
+        self.leaderLogAppendAll(entries)
+    }
+}
+
+// Whether a ClientEntry received by the leader is neither executed nor in the
+// log already
+func (self *RaftNode) isNewEntry(msg *ClientEntry) bool {
+    if self.machn.TryRespond(msg.UID) {
+        return false
+    } else if logIdx, ok := self.idxOfUid[msg.UID]; ok {
+        if !self.log(logIdx).hasClientUid(msg.UID) {
+            // this can only happen if a log entry was rewritten,
+            // but idxOfUid is rebuilt when a candidate becomes leader
+            self.fatal("idxOfUid mismatch")
         }
+        return false
     }
+    return true
 }
 
 func (self *RaftNode) sendAppendEntries(nodeId uint32, num_entries int) {
+    if self.paused[nodeId] {
+        return
+    }
     nextIdx := self.nextIdx[nodeId]
     entries, ok := self.pster.LogSlice(nextIdx, nextIdx + uint64(num_entries))
     if !ok {
-        self.err.Print("fatal: log index out of bounds; ignoring!!!")
+        self.fatal("log index out of bounds")
         return
     }
+    if len(entries) > 0 && self.cfg.LeaderWindowSize > 0 {
+        entries = self.fitWindow(nodeId, nextIdx, entries)
+        if len(entries) == 0 { // window is full
+            return
+        }
+    }
+    if len(entries) > 0 && self.isWitness(nodeId) {
+        entries = witnessEntries(entries)
+    }
     self.msger.Send(nodeId, &AppendEntries {
         Term: self.term,
         LeaderId: self.id,
@@ -222,19 +852,66 @@ func (self *RaftNode) sendAppendEntries(nodeId uint32, num_entries int) {
         PrevLogTerm: self.log(nextIdx - 1).Term,
         Entries: entries,
         CommitIdx: self.commitIdx,
+        ReqID: self.nextReqId(),
     })
     self.nextIdx[nodeId] += uint64(len(entries))
 }
 
 func (self *RaftNode) setTermAndVote(term uint64, vote uint32) {
-    self.term = term
-    self.votedFor = vote
-    ok := self.pster.SetFields(RaftFields { Term: term, VotedFor: vote })
-    if !ok {
-        self.err.Print("fatal: could not persist fields; ignoring!!!")
+    self.setFields(RaftFields { Term: term, VotedFor: vote, HasVoted: true })
+}
+
+// Move on to term without a vote
+func (self *RaftNode) setTerm(term uint64) {
+    self.setFields(RaftFields { Term: term })
+}
+
+func (self *RaftNode) setFields(fields RaftFields) {
+    self.term, self.votedFor, self.hasVoted = fields.Term, fields.VotedFor, fields.HasVoted
+    atomic.StoreUint64(&self.termAtomic, fields.Term)
+    ok := self.persist("could not persist fields", func() bool {
+        return self.pster.SetFields(fields)
+    })
+    if ok && self.cfg.SyncOnVote {
+        self.fsync()
     }
 }
 
+func (self *RaftNode) fsync() {
+    self.persist("could not sync persister", func() bool {
+        err := self.pster.Fsync()
+        if err != nil {
+            self.err.Print("fsync: ", err)
+        }
+        return err == nil
+    })
+}
+
+const persistRetryDelay = 10 * time.Millisecond
+
+// Run write (of the Persister) until it succeeds, retrying up to
+// NodeConfig.PersistRetries times, after a delay that doubles every time.
+// A write still failing then halts the node; without retries, it is only
+// logged (see fatal). Returns whether the write succeeded.
+func (self *RaftNode) persist(what string, write func() bool) bool {
+    delay := persistRetryDelay
+    for i := 0; i < self.cfg.PersistRetries; i += 1 {
+        if write() {
+            return true
+        }
+        self.err.Printf("%v; retrying in %v", what, delay)
+        time.Sleep(delay)
+        delay *= 2
+    }
+    if write() {
+        return true
+    } else if self.cfg.PersistRetries > 0 {
+        self.halt("fatal", what)
+    }
+    self.fatal(what)
+    return false
+}
+
 func (self *RaftNode) setVote(vote uint32) {
     self.setTermAndVote(self.term, vote)
 }
@@ -248,15 +925,196 @@ func (l idxSlice) Len() int           { return len(l) }
 func (l idxSlice) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
 func (l idxSlice) Less(i, j int) bool { return l[i] < l[j] }
 
+func (self *RaftNode) isQuorum(acks []uint32) bool {
+    nodeIds := append([]uint32 { self.id }, self.peerIds...)
+    if self.cfg.Quorum == nil {
+        return MajorityQuorum(acks, nodeIds)
+    }
+    return self.cfg.Quorum(acks, nodeIds)
+}
+
 func (self *RaftNode) updateCommitIdx() {
-    var matchIdx []uint64
+    lastIdx, _ := self.logTail()
+    var matchIdx = []uint64 { lastIdx } // self
     for _, idx := range self.matchIdx {
         matchIdx = append(matchIdx, idx)
     }
-    sort.Sort(idxSlice(matchIdx))
-    offset := len(self.peerIds) / 2
-    if self.log(matchIdx[offset]).Term == self.term {
-        self.commitIdx = matchIdx[offset] // assert monotonicity?
+    sort.Sort(sort.Reverse(idxSlice(matchIdx)))
+    for _, idx := range matchIdx { // find the highest index held by a quorum
+        if idx <= self.commitIdx {
+            break
+        }
+        acks := []uint32 { self.id }
+        for nodeId, mIdx := range self.matchIdx {
+            if mIdx >= idx { acks = append(acks, nodeId) }
+        }
+        if self.isQuorum(acks) {
+            if self.log(idx).Term == self.term {
+                self.setCommitIdx(idx)
+                if !self.leaderReady {
+                    self.leaderReady, self.readyIdx = true, idx
+                }
+                self.serveBulkLoad()
+            }
+            break
+        }
+    }
+}
+
+// Whether the machine has every write acknowledged before this node became
+// leader: an entry of the current term is committed, and applied too (with
+// AsyncApply, the former does not imply the latter)
+func (self *RaftNode) readsReady() bool {
+    return self.leaderReady && self.lastAppld >= self.readyIdx
+}
+
+// The applied entries stay committed, so idx is never taken below lastAppld
+func (self *RaftNode) setCommitIdx(idx uint64) {
+    if idx < self.lastAppld {
+        self.fatal(fmt.Sprintf("commitIdx set to %v, below lastApplied %v", idx, self.lastAppld))
+        idx = self.lastAppld
+    }
+    if idx > self.commitIdx {
+        self.emit(&CommitAdvanced { idx })
+        if cpster, ok := self.pster.(CommitPersister); ok && !cpster.SetCommitIdx(idx) {
+            self.err.Printf("Unable to persist commit index %v (an older one is safe)", idx)
+        }
+    }
+    self.commitIdx = idx
+    atomic.StoreUint64(&self.commitIdxAtomic, idx)
+}
+
+// Answer a ClientEntry received by a non-leader. A request still pending in
+// the log (from when this node was leader) gets no 503 here, since it may yet
+// commit; it is answered when applied, or with a 503 as soon as its entry is
+// overwritten (see reportStaleEntries), so that it gets a single final
+// response.
+func (self *RaftNode) redirectEntry(uid uint64) {
+    _, pending := self.idxOfUid[uid]
+    if self.machn.TryRespond(uid) {
+        return
+    } else if self.state == Follower && self.hasVoted {
+        self.msger.Client301(uid, self.votedFor)
+    } else if !pending {
+        self.msger.Client503(uid)
+    }
+}
+
+func (self *RaftNode) setCaughtUp(caughtUp bool) {
+    var v uint32 = 0
+    if caughtUp { v = 1 }
+    atomic.StoreUint32(&self.caughtUpAtomic, v)
+}
+
+func (self *RaftNode) becomeFollower(term uint64) {
+    wasLeader := self.state == Leader
+    if wasLeader {
+        self.stats.SteppedDown += 1
+    } else if self.state == Candidate {
+        self.stats.Lost += 1
+    }
+    self.state = Follower
+    self.voteSet = nil
+    if wasLeader {
+        // drop leader-only state; it is rebuilt by tryBecomeLeader
+        // (idxOfUid is kept to tell which requests are still in flight,
+        // until they are applied or overwritten)
+        self.nextIdx, self.matchIdx, self.windows, self.backoffs = nil, nil, nil, nil
+        for _, m := range self.pendingReads {
+            self.msger.Client503(m.UID)
+        }
+        self.leaderReady, self.pendingReads = false, nil
+        self.failHeartbeats()
+        self.failCommitReads()
+        self.failSnapWaits()
+        self.failBulkLoad()
+        self.setCaughtUp(false)
+        self.emit(&SteppedDown { term })
+        self.timerReset() // the timer was running at heartbeat interval
+    }
+}
+
+// Before msg overwrites the log, report the entries of older terms it drops,
+// and answer the requests pending in them (from when this node was leader)
+// with a 503. Only entries from the first conflict on are stale; entries past
+// the end of msg without a conflict may just be truncated early (and sent
+// again).
+func (self *RaftNode) reportStaleEntries(msg *AppendEntries) {
+    lastIdx, _ := self.logTail()
+    conflictIdx, conflict := msg.PrevLogIdx + 1, false
+    for _, entry := range msg.Entries {
+        if conflictIdx > lastIdx {
+            break
+        } else if self.log(conflictIdx).Term != entry.Term {
+            conflict = true
+            break
+        }
+        conflictIdx += 1
+    }
+    if !conflict {
+        return
+    }
+    dropped := StaleEntriesDropped { LeaderTerm: msg.Term }
+    for idx := conflictIdx; idx <= lastIdx; idx += 1 {
+        entry := self.log(idx)
+        if entry.Term < msg.Term {
+            dropped.Count += 1
+            dropped.UIDs = append(dropped.UIDs, entry.clientUids()...)
+        }
+        for _, uid := range entry.clientUids() {
+            if pendingIdx, ok := self.idxOfUid[uid]; ok && pendingIdx == idx {
+                delete(self.idxOfUid, uid)
+                self.msger.Client503(uid)
+            }
+        }
+    }
+    if dropped.Count > 0 {
+        uids := dropped.UIDs // all of them are in the event
+        more := ""
+        if len(uids) > maxLoggedUids {
+            uids, more = uids[:maxLoggedUids], fmt.Sprintf(" and %v more", len(uids) - maxLoggedUids)
+        }
+        self.err.Printf("stale-leader write ignored: %v entries (%v uids: %v%v) overwritten in term %v",
+                        dropped.Count, len(dropped.UIDs), uids, more, msg.Term)
+        self.emit(&dropped)
+    }
+}
+
+// UIDs listed in the log line of reportStaleEntries
+const maxLoggedUids = 8
+
+// Write the entries of msg that are not in the log yet. The entries already
+// in the log with the same term are left as they are, so that a retransmitted
+// (or reordered) AppendEntries cannot truncate the log; it is overwritten only
+// from the first conflict on, which must be past the commit index. Returns
+// false (after calling fatal) if it is not.
+func (self *RaftNode) followerLogUpdate(msg *AppendEntries) bool {
+    lastIdx, _ := self.logTail()
+    idx, entries := msg.PrevLogIdx + 1, msg.Entries
+    for len(entries) > 0 && idx <= lastIdx && self.log(idx).Term == entries[0].Term {
+        idx, entries = idx + 1, entries[1:]
+    }
+    if len(entries) == 0 {
+        return true
+    } else if idx <= self.commitIdx {
+        self.fatal(fmt.Sprintf("committed entry %v of term %v overwritten by one of term %v (leader %v)",
+                               idx, self.log(idx).Term, entries[0].Term, msg.LeaderId))
+        return false
+    }
+    self.reportStaleEntries(msg)
+    self.logUpdate(idx, entries)
+    return true
+}
+
+// Every AppendReply also reports the commit index and the end of the log,
+// which let the leader skip the probing otherwise needed to find matchIdx
+func (self *RaftNode) appendReply(msg *AppendEntries, success bool, lastModIdx uint64) *AppendReply { // {{{1
+    lastIdx, _ := self.logTail()
+    return &AppendReply {
+        Term: self.term, Success: success,
+        NodeId: self.id, LastModIdx: lastModIdx,
+        CommitIdx: self.commitIdx, LastLogIdx: lastIdx,
+        ReqID: msg.ReqID,
     }
 }
 
@@ -264,41 +1122,50 @@ func (self *RaftNode) followerHandler(m Message) { // {{{1
     switch msg := m.(type) {
     case *AppendEntries:
         if msg.Term < self.term {
-            self.msger.Send(msg.LeaderId, &AppendReply {
-                Term: self.term, Success: false,
-                NodeId: self.id, LastModIdx: 0,
-            })
+            self.msger.Send(msg.LeaderId, self.appendReply(msg, false, 0))
         } else {
             if msg.Term > self.term {
                 self.setTermAndVote(msg.Term, msg.LeaderId) // to track leaderId
             }
+            if reply := self.seenAppend(msg); reply != nil { // retransmitted
+                self.msger.Send(msg.LeaderId, reply)
+                self.timerReset()
+                return
+            }
 
             lastIdx, _ := self.logTail()
             prevIdx := msg.PrevLogIdx
             if prevIdx <= lastIdx && self.log(prevIdx).Term == msg.PrevLogTerm {
                 var lastModIdx uint64 = 0 // should be non-zero only for non-heartbeat
+                endIdx := prevIdx + uint64(len(msg.Entries))
                 if len(msg.Entries) > 0 { // not heartbeat!
-                    self.logUpdate(prevIdx + 1, msg.Entries)
-                    lastModIdx, _ = self.logTail()
-                }
-                self.msger.Send(msg.LeaderId, &AppendReply {
-                    Term: self.term, Success: true,
-                    NodeId: self.id, LastModIdx: lastModIdx,
-                })
-                if self.commitIdx < msg.CommitIdx {
-                    lastIdx, _ := self.logTail()
-                    pracCommitIdx := msg.CommitIdx
-                    if pracCommitIdx > lastIdx {
-                        pracCommitIdx = lastIdx
+                    if !self.followerLogUpdate(msg) {
+                        self.timerReset()
+                        return // nothing is acked (see fatal)
                     }
-                    self.commitIdx = pracCommitIdx
-                    self.applyCommitted()
+                    // entries past endIdx (if any) are not known to match
+                    lastModIdx = endIdx
+                }
+                lastIdx, _ = self.logTail()
+                self.setCaughtUp(lastIdx == endIdx && lastIdx >= msg.CommitIdx)
+                // only the entries up to endIdx are known to match the
+                // leader's; the rest may be stale writes of an old leader
+                pracCommitIdx := msg.CommitIdx
+                if pracCommitIdx > endIdx {
+                    pracCommitIdx = endIdx
+                }
+                // a delayed AppendEntries may end before the commit index
+                committed := self.commitIdx < pracCommitIdx
+                if committed {
+                    self.setCommitIdx(pracCommitIdx)
                 } // else don't panic!
+                self.replyAppend(msg, self.appendReply(msg, true, lastModIdx))
+                if committed {
+                    self.applyCommitted()
+                }
             } else {
-                self.msger.Send(msg.LeaderId, &AppendReply {
-                    Term: self.term, Success: false,
-                    NodeId: self.id, LastModIdx: 0,
-                })
+                self.setCaughtUp(false)
+                self.replyAppend(msg, self.appendReply(msg, false, 0))
             }
             self.timerReset()
         }
@@ -308,10 +1175,12 @@ func (self *RaftNode) followerHandler(m Message) { // {{{1
             self.msger.Send(msg.CandidId, &VoteReply { self.term, false, self.id })
         } else {
             if msg.Term > self.term {
-                self.setTermAndVote(msg.Term, NilNode)
+                self.setTerm(msg.Term)
             }
 
-            if !self.isUpToDate(msg) || self.votedFor != NilNode {
+            // a resend (the reply may have been lost) is granted again
+            if !self.isUpToDate(msg) || msg.Priority < self.cfg.ElectionPriority ||
+               (self.hasVoted && self.votedFor != msg.CandidId) {
                 self.msger.Send(msg.CandidId, &VoteReply { self.term, false, self.id })
             } else {
                 self.setVote(msg.CandidId)
@@ -324,14 +1193,27 @@ func (self *RaftNode) followerHandler(m Message) { // {{{1
 
     case *VoteReply:
 
+    case *TimeoutNow:
+        if msg.Term == self.term && !self.cfg.WitnessMode && !self.quiesced {
+            self.state = Candidate
+            self.candidateHandler(&timeout { 0 })
+        }
+
     case *ClientEntry:
-        if self.votedFor != NilNode {
+        self.redirectEntry(msg.UID)
+
+    case *LeaderRead:
+        if self.hasVoted {
             self.msger.Client301(msg.UID, self.votedFor)
         } else {
             self.msger.Client503(msg.UID)
         }
 
     case *timeout:
+        if self.cfg.WitnessMode || self.quiesced {
+            self.timerReset()
+            break
+        }
         self.state = Candidate
         self.candidateHandler(msg)
 
@@ -344,13 +1226,10 @@ func (self *RaftNode) candidateHandler(m Message) { // {{{1
     switch msg := m.(type) {
     case *AppendEntries:
         if msg.Term < self.term {
-            self.msger.Send(msg.LeaderId, &AppendReply {
-                Term: self.term, Success: false,
-                NodeId: self.id, LastModIdx: 0,
-            })
+            self.msger.Send(msg.LeaderId, self.appendReply(msg, false, 0))
         } else {
-            self.setVote(msg.LeaderId) // just needs to be non-zero
-            self.state = Follower
+            self.setVote(msg.LeaderId) // just needs to be set
+            self.becomeFollower(msg.Term)
             self.followerHandler(msg)
         }
 
@@ -358,72 +1237,130 @@ func (self *RaftNode) candidateHandler(m Message) { // {{{1
         if msg.Term <= self.term {
             self.msger.Send(msg.CandidId, &VoteReply { self.term, false, self.id })
         } else {
-            self.state = Follower
+            self.becomeFollower(msg.Term)
             self.followerHandler(msg)
-            //reset timer?
         }
 
     case *AppendReply:
 
     case *VoteReply:
         if msg.Term == self.term && msg.Granted {
+            self.emit(&VoteGranted { msg.NodeId })
             self.voteSet[msg.NodeId] = true
-            // voteSet contains self vote too, but peerIds doesn't contain self id
-            if len(self.voteSet) > (len(self.peerIds) + 1) / 2 {
-                lastIdx, _ := self.logTail()
-                self.idxOfUid = make(map[uint64]uint64)
-                for idx := self.lastAppld + 1; idx <= lastIdx; idx += 1 {
-                    // fill idxOfUid with unapplied requests
-                    // FIXME since commitIdx is volatile, the first leader
-                    //       after a whole-cluster failure will have to read
-                    //       the entire log to make this map
-                    entry := self.log(idx)
-                    if entry.CEntry != nil {
-                        self.idxOfUid[entry.CEntry.UID] = idx
-                    }
-                }
-                self.matchIdx = make(map[uint32]uint64)
-                self.nextIdx = make(map[uint32]uint64)
-                for _, nodeId := range self.peerIds {
-                    self.matchIdx[nodeId] = 0
-                    self.nextIdx[nodeId] = lastIdx + 1
-                }
-                self.state = Leader
-                self.leaderHandler(&timeout { 0 })
-                // optimize by replicating an empty log entry of current term?
-            }
+            self.tryBecomeLeader()
         } else if msg.Term > self.term {
-            self.setTermAndVote(msg.Term, NilNode)
-            self.state = Follower
+            self.setTerm(msg.Term)
+            self.becomeFollower(msg.Term)
         }
 
+    case *TimeoutNow:
+
     case *ClientEntry:
+        self.redirectEntry(msg.UID)
+
+    case *LeaderRead:
         self.msger.Client503(msg.UID)
 
     case *timeout:
+        if self.voteSet != nil { // still campaigning (it is nil on followers)
+            self.stats.Lost += 1
+        }
+        self.stats.Started += 1
+        self.setCaughtUp(false)
         self.voteSet = make(map[uint32]bool)
         self.voteSet[self.id] = true
         self.setTermAndVote(self.term + 1, self.id)
+        self.emit(&ElectionStarted { self.term })
         lastIdx, lastEntry := self.logTail()
         self.msger.BroadcastVoteRequest(&VoteRequest {
             self.term,
             self.id,
             lastIdx,
             lastEntry.Term,
+            self.cfg.ElectionPriority,
         })
         self.timerReset()
+        self.tryBecomeLeader() // in case of a single-node cluster
 
     default:
         self.err.Print("bad type: ", m)
     }
 }
 
+func (self *RaftNode) tryBecomeLeader() {
+    var acks []uint32 // voteSet contains self vote too
+    for nodeId := range self.voteSet {
+        acks = append(acks, nodeId)
+    }
+    if self.isQuorum(acks) {
+        lastIdx, _ := self.logTail()
+        oldIdxOfUid := self.idxOfUid
+        self.idxOfUid = make(map[uint64]uint64)
+        for idx := self.lastAppld + 1; idx <= lastIdx; idx += 1 {
+            // fill idxOfUid with unapplied requests
+            // FIXME since commitIdx is volatile, the first leader
+            //       after a whole-cluster failure will have to read
+            //       the entire log to make this map
+            entry := self.log(idx)
+            for _, uid := range entry.clientUids() {
+                self.idxOfUid[uid] = idx
+            }
+        }
+        for uid := range oldIdxOfUid {
+            if _, ok := self.idxOfUid[uid]; !ok { // overwritten while not leader
+                self.msger.Client503(uid)
+            }
+        }
+        self.matchIdx = make(map[uint32]uint64)
+        self.nextIdx = make(map[uint32]uint64)
+        self.windows = make(map[uint32]*sendWindow)
+        self.backoffs = make(map[uint32]*replBackoff)
+        for _, nodeId := range self.peerIds {
+            self.matchIdx[nodeId] = 0
+            self.nextIdx[nodeId] = lastIdx + 1
+            self.windows[nodeId] = &sendWindow { }
+            self.backoffs[nodeId] = &replBackoff { }
+        }
+        self.leaderReady, self.pendingReads = false, nil
+        self.state = Leader
+        self.stats.Won += 1
+        self.ledTerms[self.term] = true
+        self.setCaughtUp(true)
+        self.emit(&BecameLeader { self.term })
+        self.leaderHandler(&timeout { 0 })
+        if self.cfg.LogicalClock {
+            clock := &ClockEntry { self.term, lastIdx + 1 }
+            self.leaderLogAppend(RaftEntry { self.term, &ClientEntry { 0, clock } })
+        }
+    }
+}
+
+// Entries committed on a peer are in the leader's log too, so its commitIdx
+// is a lower bound of its matchIdx
+func (self *RaftNode) ackCommitted(nodeId uint32, commitIdx uint64) { // {{{1
+    lastIdx, _ := self.logTail()
+    if commitIdx > lastIdx {
+        commitIdx = lastIdx
+    }
+    if commitIdx <= self.matchIdx[nodeId] {
+        return
+    }
+    self.matchIdx[nodeId] = commitIdx
+    if self.nextIdx[nodeId] <= commitIdx {
+        self.nextIdx[nodeId] = commitIdx + 1
+    }
+    self.windows[nodeId].ack(commitIdx)
+    self.updateCommitIdx()
+    self.applyCommitted()
+}
+
 func (self *RaftNode) leaderHandler(m Message) { // {{{1
     // FIXME too many AppendEntries! coordinate heartbeats with non-heartbeats
     switch msg := m.(type) {
     case *AppendEntries:
-        if self.term == msg.Term {
-            self.err.Print("fatal: two leaders of same term; ignoring!!!")
+        if self.term == msg.Term { // votes were double-counted, or a vote was lost
+            self.halt("invariant violated", fmt.Sprintf("two leaders (%v and %v) in term %v",
+                                                        self.id, msg.LeaderId, msg.Term))
         }
         self.candidateHandler(msg)
 
@@ -432,48 +1369,73 @@ func (self *RaftNode) leaderHandler(m Message) { // {{{1
 
     case *AppendReply:
         nodeId := msg.NodeId
+        if msg.Term == self.term {
+            self.ackHeartbeats(nodeId, msg.ReqID)
+            self.resetBackoff(nodeId)
+            self.ackCommitted(nodeId, msg.CommitIdx)
+        }
         if msg.Success == true {
             lastIdx, _ := self.logTail()
             if msg.LastModIdx > 0 {
+                self.windows[nodeId].ack(msg.LastModIdx)
                 // ignore duplicate/out-of-order messages
                 if msg.LastModIdx > self.matchIdx[nodeId] {
                     self.matchIdx[nodeId] = msg.LastModIdx
                     self.updateCommitIdx()
                     self.applyCommitted()
                 }
+            } else { // heartbeat succeeded, so nothing else is in flight
+                self.windows[nodeId].reset()
             }
             if self.nextIdx[nodeId] <= lastIdx {
                 self.sendAppendEntries(nodeId, 8)
+            } else {
+                self.maybeTransferLeadership(nodeId)
             }
         } else if msg.Term == self.term { // log mismatch
+            self.windows[nodeId].reset() // entries will be resent
             if self.nextIdx[nodeId] > self.matchIdx[nodeId] + 1 {
                 self.nextIdx[nodeId] -= 1
+                // skip past the end of a shorter log at once
+                if msg.LastLogIdx > 0 && self.nextIdx[nodeId] > msg.LastLogIdx + 1 {
+                    self.nextIdx[nodeId] = msg.LastLogIdx + 1
+                }
+                if self.nextIdx[nodeId] <= self.matchIdx[nodeId] {
+                    self.nextIdx[nodeId] = self.matchIdx[nodeId] + 1
+                }
             }
             self.sendAppendEntries(nodeId, 0)
         } else if msg.Term > self.term {
-            self.setTermAndVote(msg.Term, NilNode)
-            self.state = Follower
-            self.timerReset()
+            self.setTerm(msg.Term)
+            self.becomeFollower(msg.Term)
         } // else outdated message?
 
     case *VoteReply:
 
+    case *TimeoutNow:
+
     case *ClientEntry:
-        if self.machn.TryRespond(msg.UID) {
-            break
-        } else if logIdx, ok := self.idxOfUid[msg.UID]; ok {
-            if self.log(logIdx).CEntry.UID != msg.UID {
-                // this can only happen if a log entry was rewritten,
-                // but idxOfUid is reset when a candidate becomes leader
-                self.err.Print("fatal: idxOfUid mismatch; ignoring!!!")
-            }
+        if self.quiesced {
+            self.redirectEntry(msg.UID)
+        } else {
+            self.leaderAppendCoalesced(msg)
+        }
+
+    case *LeaderRead:
+        if self.readsReady() {
+            self.msger.ClientReadReply(msg.UID, self.machn.Read(msg.Key), self.lastAppld)
             break
         }
-        self.leaderLogAppend(RaftEntry { self.term, msg })
+        self.pendingReads = append(self.pendingReads, msg)
+        if _, lastEntry := self.logTail(); lastEntry.Term != self.term {
+            self.leaderLogAppend(RaftEntry { self.term, nil }) // no-op
+        }
 
     case *timeout:
         for _, nodeId := range self.peerIds {
-            self.sendAppendEntries(nodeId, 0)
+            if self.heartbeatDue(nodeId) {
+                self.sendAppendEntries(nodeId, 0)
+            }
         }
         self.timerReset()
 
@@ -484,5 +1446,127 @@ func (self *RaftNode) leaderHandler(m Message) { // {{{1
 
 // ---- internal Message-s {{{1
 type timeout struct { version uint64 }
-type exitLoop struct { }
+type exitLoop struct { done chan struct{} }
 type testEcho struct { }
+type applied struct { task *applyTask }
+type pingPeer struct {
+    peerId uint32
+    ping *Ping
+}
+type snapshotAt struct {
+    idx uint64
+    reply chan<- snapshotAtReply
+}
+type snapshotAtReply struct {
+    idx uint64
+    err error
+}
+type snapshotNow struct {
+    reply chan<- snapshotAtReply
+}
+type proposeBatch struct {
+    entries []ClientEntry
+    reply chan<- proposeBatchReply
+}
+type proposeBatchReply struct {
+    idx uint64
+    err error
+}
+type bulkLoad struct {
+    entries []ClientEntry
+    first, last bool // chunk of the load
+    reply chan<- error
+}
+type propose struct {
+    data interface{}
+    reply chan<- proposeReply
+}
+type proposeReply struct {
+    uid uint64
+    idx uint64
+    err error
+}
+type resetConfig struct {
+    cfg NodeConfig
+    reply chan<- error
+}
+type restartLoop struct {
+    cfg NodeConfig
+    reply chan<- error
+}
+type dumpState struct {
+    reply chan<- *stateDump
+}
+type inspectState struct {
+    fn func(*RaftNodeSnapshot)
+    done chan struct{}
+}
+type nodeStatus struct {
+    reply chan<- NodeStatus
+}
+type replaySlice struct {
+    startIdx, endIdx uint64
+    reply chan<- replaySliceReply
+}
+type replaySliceReply struct {
+    entries []RaftEntry
+    ok bool
+}
+type commitHook struct {
+    fn func(uint64, []ClientEntry) // nil clears the hook
+    reply chan<- error
+}
+type setLogger struct {
+    errlog *golog.Logger
+    done chan struct{}
+}
+type runDone struct {
+    reply chan<- (<-chan struct{})
+}
+type backupLog struct {
+    reply chan<- backupLogReply
+}
+type backupLogReply struct {
+    data []byte
+    err error
+}
+type logStats struct {
+    reply chan<- LogStatistics
+}
+type electionStats struct {
+    reset bool
+    reply chan<- ElectionStats
+}
+type validateConfig struct {
+    nodeIds []uint32
+    reply chan<- error
+}
+type heartbeat struct {
+    round *heartbeatRound
+}
+type readCommitted struct {
+    uid uint64
+    cmd interface{}
+    reply chan<- readCommittedReply
+}
+type readCommittedReply struct {
+    data []byte
+    err error
+}
+type quiesce struct {
+    on bool
+    done chan struct{}
+}
+type pauseLoop struct {
+    on bool
+    done chan struct{}
+}
+type pauseReplication struct {
+    nodeId uint32
+    pause bool
+    reply chan<- error
+}
+type rpcCall struct {
+    msg Message
+    reply chan<- Message
+}
@@ -1,9 +1,16 @@
 package raft
 
 import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "hash/crc32"
     golog "log"
+    "math/rand"
     "os"
     "reflect"
+    "strings"
     "testing"
     "time"
 )
@@ -13,13 +20,44 @@ import (
 type DummyMsger struct { // {{{1
     raftch chan<- Message
     testch chan interface{}
+    n503 map[uint64]int // Client503-s per uid; read only after syncWait
+    hints bool // keep the indices in AppendReply-s (see stripHints)
 }
 
 func (self *DummyMsger) Register(notifch chan<- Message)       { self.raftch = notifch }
-func (self *DummyMsger) Send(node uint32, msg Message)         { self.testch <- msg }
+func (self *DummyMsger) Send(node uint32, msg Message)         { self.testch <- stripHints(msg, self.hints) }
 func (self *DummyMsger) BroadcastVoteRequest(msg *VoteRequest) { self.testch <- msg }
 func (self *DummyMsger) Client301(uid uint64, node uint32)     { } // TODO test!
-func (self *DummyMsger) Client503(uid uint64)                  { }
+func (self *DummyMsger) Client503(uid uint64)                  { self.n503[uid] += 1 }
+func (self *DummyMsger) ClientReadReply(uid uint64, data []byte, appliedIdx uint64) {
+    self.testch <- &testReadReply { uid, data, appliedIdx }
+}
+func (self *DummyMsger) Latency(node uint32) time.Duration      { return NoLatencyEstimate }
+func (self *DummyMsger) Disconnect(node uint32)                 { }
+func (self *DummyMsger) Connect(node uint32)                    { }
+
+// ReqID-s are checked only in TestAppendDedup, and the commit/log indices of
+// AppendReply-s only in TestAppendReplyHints, so the others can compare the
+// messages as they are
+func stripHints(msg Message, hints bool) Message {
+    if ae, ok := msg.(*AppendEntries); ok && ae.ReqID != 0 {
+        copy := *ae
+        copy.ReqID = 0
+        return &copy
+    }
+    if ap, ok := msg.(*AppendReply); ok && !hints {
+        copy := *ap
+        copy.CommitIdx, copy.LastLogIdx = 0, 0
+        return &copy
+    }
+    return msg
+}
+
+type testReadReply struct {
+    uid uint64
+    data []byte
+    appliedIdx uint64
+}
 
 func (self *DummyMsger) syncWait(t *testing.T) {
     self.raftch <- &testEcho{}
@@ -59,6 +97,15 @@ func (self *DummyPster) LogUpdate(startIdx uint64, slice []RaftEntry) bool {
     }
     return true
 }
+func (self *DummyPster) CRC32() uint32 { // recomputed; fine for tests
+    var crc uint32
+    for i := range self.log {
+        blob, _ := json.Marshal(&self.log[i])
+        crc = crc32.Update(crc, crc32.IEEETable, blob)
+    }
+    return crc
+}
+func (self *DummyPster) Fsync() error { return nil }
 func (self *DummyPster) GetFields() *RaftFields { return nil }
 func (self *DummyPster) SetFields(RaftFields) bool { return true }
 
@@ -74,6 +121,12 @@ func (self *DummyMachn) Execute(entries []ClientEntry) {
 func (self *DummyMachn) TryRespond(uid uint64) bool {
     return self.hasUID(uid)
 }
+func (self *DummyMachn) Read(key string) []byte {
+    return []byte(key)
+}
+func (self *DummyMachn) ReadResult(uid uint64) ([]byte, bool) {
+    return nil, self.hasUID(uid)
+}
 func (self *DummyMachn) hasUID(uid uint64) bool {
     _, ok := self.uidSet[uid]
     return ok
@@ -90,12 +143,20 @@ func assert_eq(t *testing.T, x, y interface{}, args ...interface{}) {
 }
 
 func initTest() (*RaftNode, *DummyMsger, *DummyPster, *DummyMachn) {
+    return initTestEx(NodeConfig {
+        SelfId: 0,
+        NodeIds: []uint32 { 0, 1, 2, 3, 4 },
+        NotifBuf: 0, // unbuffered channel
+        MinNodes: 3,
+    })
+}
+
+func initTestEx(cfg NodeConfig) (*RaftNode, *DummyMsger, *DummyPster, *DummyMachn) {
     // Note: Deadlocking due to unbuffered channels is considered a bug!
-    msger := &DummyMsger{ nil, make(chan interface{}) } // unbuffered channel
+    msger := &DummyMsger{ nil, make(chan interface{}), make(map[uint64]int), false } // unbuffered channel
     pster, machn := &DummyPster{}, &DummyMachn{ make(map[uint64]bool) }
     errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
-    raft, err := NewNode(0, []uint32 { 0, 1, 2, 3, 4 }, 0, // unbuffered channel
-                         msger, pster, machn, errlog)
+    raft, err := NewNodeEx(cfg, msger, pster, machn, errlog)
     if err != nil { panic(err) }
     go raft.RunEx(func(rs RaftState) time.Duration {
         return time.Duration(400) * time.Millisecond
@@ -121,7 +182,7 @@ func TestFollower(t *testing.T) { // {{{1
         CommitIdx: 0,
     }
     m = <-msger.testch
-    assert_eq(t, m, &AppendReply { 1, true, 0, 1 }, "Bad append 1", m)
+    assert_eq(t, m, &AppendReply { 1, true, 0, 1, 0, 0, 0 }, "Bad append 1", m)
 
     msger.raftch <- &AppendEntries {
         Term: 3,
@@ -135,7 +196,7 @@ func TestFollower(t *testing.T) { // {{{1
     }
     assert(t, !machn.hasUID(1234), "Applied too early")
     m = <-msger.testch
-    assert_eq(t, m, &AppendReply { 3, true, 0, 2 }, "Bad append 3t.2", m)
+    assert_eq(t, m, &AppendReply { 3, true, 0, 2, 0, 0, 0 }, "Bad append 3t.2", m)
     msger.syncWait(t)
     assert(t, machn.hasUID(1234), "Failed to apply 1234")
 
@@ -148,7 +209,7 @@ func TestFollower(t *testing.T) { // {{{1
         CommitIdx: 1,
     }
     m = <-msger.testch
-    assert_eq(t, m, &AppendReply { 3, false, 0, 0 }, "Bad append 3f", m)
+    assert_eq(t, m, &AppendReply { 3, false, 0, 0, 0, 0, 0 }, "Bad append 3f", m)
 
     msger.raftch <- &AppendEntries {
         Term: 3,
@@ -161,7 +222,7 @@ func TestFollower(t *testing.T) { // {{{1
         CommitIdx: 2,
     }
     m = <-msger.testch
-    assert_eq(t, m, &AppendReply { 3, true, 0, 3 }, "Bad append 3t.3", m)
+    assert_eq(t, m, &AppendReply { 3, true, 0, 3, 0, 0, 0 }, "Bad append 3t.3", m)
     assert(t, raft.log(3).Term == 3, "Bad log 3")
 
     msger.raftch <- &AppendEntries { // overwrite previous entry
@@ -175,7 +236,7 @@ func TestFollower(t *testing.T) { // {{{1
         CommitIdx: 2,
     }
     m = <-msger.testch
-    assert_eq(t, m, &AppendReply { 4, true, 0, 3 }, "Bad append 4.1", m)
+    assert_eq(t, m, &AppendReply { 4, true, 0, 3, 0, 0, 0 }, "Bad append 4.1", m)
     assert(t, raft.log(3).Term == 4, "Bad log 4")
 
     msger.raftch <- &AppendEntries { // a lot happened!!
@@ -187,7 +248,7 @@ func TestFollower(t *testing.T) { // {{{1
         CommitIdx: 10,
     }
     m = <-msger.testch
-    assert_eq(t, m, &AppendReply { 8, false, 0, 0 }, "Bad append 8.1", m)
+    assert_eq(t, m, &AppendReply { 8, false, 0, 0, 0, 0, 0 }, "Bad append 8.1", m)
 
     msger.raftch <- &AppendEntries {
         Term: 8,
@@ -203,36 +264,503 @@ func TestFollower(t *testing.T) { // {{{1
         CommitIdx: 10,
     }
     m = <-msger.testch
-    assert_eq(t, m, &AppendReply { 8, true, 0, 7 }, "Bad append 8.2", m)
+    assert_eq(t, m, &AppendReply { 8, true, 0, 7, 0, 0, 0 }, "Bad append 8.2", m)
     msger.syncWait(t)
     assert(t, machn.hasUID(1235), "Failed to apply 1235")
     assert(t, machn.hasUID(1238), "Failed to apply 1238")
     assert(t, raft.votedFor == 2, "Bad votedFor 8.2", raft)
 
-    msger.raftch <- &VoteRequest { 7, 1, 8, 7 } // stale term
+    msger.raftch <- &VoteRequest { 7, 1, 8, 7, 0 } // stale term
     m = <-msger.testch
     assert_eq(t, m, &VoteReply { 8, false, 0 }, "Bad votereply 8.1", m)
 
-    msger.raftch <- &VoteRequest { 8, 1, 7, 6 }
+    msger.raftch <- &VoteRequest { 8, 1, 7, 6, 0 }
     m = <-msger.testch
     assert_eq(t, m, &VoteReply { 8, false, 0 }, "Bad votereply 8.2", m)
 
-    msger.raftch <- &VoteRequest { 9, 1, 6, 6 } // not up to date
+    msger.raftch <- &VoteRequest { 9, 1, 6, 6, 0 } // not up to date
     m = <-msger.testch
     assert_eq(t, m, &VoteReply { 9, false, 0 }, "Bad votereply 9.1", m)
 
-    msger.raftch <- &VoteRequest { 9, 3, 7, 6 }
+    msger.raftch <- &VoteRequest { 9, 3, 7, 6, 0 }
     m = <-msger.testch
     assert_eq(t, m, &VoteReply { 9, true, 0 }, "Bad votereply 9.2", m)
     assert(t, raft.votedFor == 3, "Bad votedFor 9.3", raft)
 
-    msger.raftch <- &VoteRequest { 9, 4, 7, 6 } // already voted
+    msger.raftch <- &VoteRequest { 9, 3, 7, 6, 0 } // resent; reply was lost
+    m = <-msger.testch
+    assert_eq(t, m, &VoteReply { 9, true, 0 }, "Bad votereply 9.2 (resend)", m)
+    assert(t, raft.votedFor == 3, "Bad votedFor 9.3 (resend)", raft)
+
+    msger.raftch <- &VoteRequest { 9, 4, 7, 6, 0 } // already voted
     m = <-msger.testch
     assert_eq(t, m, &VoteReply { 9, false, 0 }, "Bad votereply 9.3", m)
 
     raft.Exit()
 }
 
+func TestElectionPriority(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTestEx(NodeConfig {
+        SelfId: 0,
+        NodeIds: []uint32 { 0, 1, 2 },
+        MinNodes: 3,
+        ElectionPriority: 2,
+    })
+
+    msger.raftch <- &VoteRequest { 1, 1, 0, 0, 1 } // lower priority
+    m := <-msger.testch
+    assert_eq(t, m, &VoteReply { 1, false, 0 }, "Bad votereply 1", m)
+    assert(t, !raft.hasVoted, "Bad votedFor 1", raft)
+
+    msger.raftch <- &VoteRequest { 2, 2, 0, 0, 2 }
+    m = <-msger.testch
+    assert_eq(t, m, &VoteReply { 2, true, 0 }, "Bad votereply 2", m)
+
+    m = <-msger.testch // wait for timeout
+    assert_eq(t, m, &VoteRequest { 3, 0, 0, 0, 2 }, "Bad votereq 3", m)
+
+    raft.Exit()
+}
+
+func TestNilNodeId(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTestEx(NodeConfig {
+        SelfId: 0,
+        NodeIds: []uint32 { 0, 1, NilNode },
+        NotifBuf: 0,
+        MinNodes: 3,
+    })
+
+    msger.raftch <- &VoteRequest { 1, NilNode, 0, 0, 0 }
+    m := <-msger.testch
+    assert_eq(t, m, &VoteReply { 1, true, 0 }, "Bad votereply 1.1", m)
+    assert(t, raft.hasVoted && raft.votedFor == NilNode, "Bad votedFor 1", raft)
+
+    msger.raftch <- &VoteRequest { 1, 1, 0, 0, 0 } // already voted
+    m = <-msger.testch
+    assert_eq(t, m, &VoteReply { 1, false, 0 }, "Bad votereply 1.2", m)
+
+    msger.raftch <- &VoteRequest { 1, NilNode, 0, 0, 0 } // resent
+    m = <-msger.testch
+    assert_eq(t, m, &VoteReply { 1, true, 0 }, "Bad votereply 1.3", m)
+
+    raft.Exit()
+}
+
+func TestUnknownLeader(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTest()
+    var errbuf bytes.Buffer
+    raft.SetLogger(golog.New(&errbuf, "", 0))
+
+    entries := []RaftEntry { { 5, &ClientEntry { 1231, nil } } }
+    msger.raftch <- &AppendEntries { 5, 7, 0, 0, entries, 1, 0 } // node 7 is not in NodeIds
+    m, err := raft.RPC(&AppendEntries { 5, 7, 0, 0, entries, 1, 0 })
+    assert(t, err == nil && m == nil, "Replied to an unknown node", m, err)
+    msger.syncWait(t)
+    lastIdx, _ := raft.logTail()
+    assert(t, lastIdx == 0 && raft.Term() == 0, "Unknown node changed the log or term", lastIdx, raft.Term())
+    assert(t, strings.Contains(errbuf.String(), "unknown node 7"), "Not logged", errbuf.String())
+
+    msger.raftch <- &AppendEntries { 5, 2, 0, 0, entries, 0, 0 }
+    m = <-msger.testch
+    assert_eq(t, m, &AppendReply { 5, true, 0, 1, 0, 0, 0 }, "Bad append from a known node", m)
+    raft.Exit()
+}
+
+func TestHeartbeatStaleReplies(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTest()
+    <-msger.testch // wait for timeout; VoteRequest
+    msger.raftch <- &VoteReply { 1, true, 1 }
+    msger.raftch <- &VoteReply { 1, true, 2 } // gets majority; broadcasts heartbeats 1 to 4
+    for i := 0; i < 4; i += 1 { <-msger.testch }
+
+    done := make(chan error, 1)
+    go func() { done <- raft.VerifyLeadership(context.Background()) }()
+    for i := 0; i < 4; i += 1 { <-msger.testch } // heartbeats 5 to 8
+    // replies to the heartbeats sent before the round started
+    msger.raftch <- &AppendReply { 1, true, 1, 0, 0, 0, 3 }
+    msger.raftch <- &AppendReply { 1, true, 2, 0, 0, 0, 4 }
+    msger.syncWait(t)
+    select {
+    case err := <-done:
+        t.Fatal("Leadership confirmed by stale replies", err)
+    default:
+    }
+    msger.raftch <- &AppendReply { 1, true, 1, 0, 0, 0, 5 }
+    msger.raftch <- &AppendReply { 1, true, 2, 0, 0, 0, 6 }
+    assert(t, <-done == nil, "Leadership not confirmed")
+    raft.Exit()
+}
+
+func TestUnknownFollower(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTestEx(NodeConfig { SelfId: 0, NodeIds: []uint32 { 0, 1, 2 }, NotifBuf: 0, MinNodes: 3 })
+    var errbuf bytes.Buffer
+    raft.SetLogger(golog.New(&errbuf, "", 0))
+    <-msger.testch // wait for timeout; VoteRequest
+    msger.raftch <- &VoteReply { 1, true, 7 } // node 7 is not in NodeIds
+    msger.syncWait(t)
+    assert(t, raft.state == Candidate, "Unknown node's vote counted", raft.state)
+    msger.raftch <- &VoteReply { 1, true, 1 } // gets majority; broadcasts heartbeats
+    <-msger.testch
+    <-msger.testch
+
+    msger.raftch <- &ClientEntry { 1234, nil }
+    <-msger.testch
+    <-msger.testch
+    msger.raftch <- &AppendReply { 1, true, 7, 1, 0, 1, 0 }
+    msger.raftch <- &Ping { 9, 7, 100 }
+    msger.syncWait(t)
+    assert(t, raft.commitIdx == 0, "Unknown node's ack counted", raft.commitIdx)
+    assert(t, strings.Contains(errbuf.String(), "unknown node 7"), "Not logged", errbuf.String())
+    msger.raftch <- &AppendReply { 1, true, 1, 1, 0, 1, 0 }
+    msger.syncWait(t)
+    assert(t, raft.commitIdx == 1, "Known node's ack not counted", raft.commitIdx)
+    raft.Exit()
+}
+
+func TestHeartbeatPausedPeer(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTestEx(NodeConfig {
+        SelfId: 0,
+        NodeIds: []uint32 { 0, 1, 2 },
+        NotifBuf: 0,
+        MinNodes: 3,
+        ReplicationFailureThreshold: 1, // every heartbeat unanswered backs off
+    })
+    <-msger.testch // wait for timeout; VoteRequest
+    msger.raftch <- &VoteReply { 1, true, 1 } // gets majority; broadcasts heartbeats 1 and 2
+    <-msger.testch
+    <-msger.testch
+    assert(t, raft.PauseReplication(2) == nil, "PauseReplication failed")
+
+    type heartbeatReply struct {
+        res HeartbeatResult
+        err error
+    }
+    done := make(chan heartbeatReply, 1)
+    go func() {
+        ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+        defer cancel()
+        res, err := raft.Heartbeat(ctx)
+        done <- heartbeatReply { res, err }
+    }()
+    hb := &AppendEntries { 1, 0, 0, 0, nil, 0, 0 }
+    assert_eq(t, <-msger.testch, hb, "Bad heartbeat 3") // to 1 alone, though backed off from
+    msger.syncWait(t)
+    assert(t, raft.backoffs[1].fails == 1, "Forced heartbeat counted as a failure", raft.backoffs[1])
+    msger.raftch <- &AppendReply { 1, true, 1, 0, 0, 0, 3 }
+    r := <-done
+    assert(t, r.err == nil && r.res == HeartbeatResult { 1, 1 }, "Bad heartbeat round", r.res, r.err)
+    raft.Exit()
+}
+
+func TestAppendDedup(t *testing.T) { // {{{1
+    raft, msger, pster, _ := initTest()
+
+    ae1 := &AppendEntries { 1, 2, 0, 0, []RaftEntry { { 1, &ClientEntry { 1234, nil } } }, 0, 1 }
+    ae2 := &AppendEntries { 1, 2, 1, 1, []RaftEntry { { 1, &ClientEntry { 1235, nil } } }, 0, 2 }
+    msger.raftch <- ae1
+    assert_eq(t, <-msger.testch, &AppendReply { 1, true, 0, 1, 0, 0, 1 }, "Bad append 1")
+    msger.raftch <- ae2
+    assert_eq(t, <-msger.testch, &AppendReply { 1, true, 0, 2, 0, 0, 2 }, "Bad append 2")
+    for _, ae := range []*AppendEntries { ae2, ae1 } { // the latest reply is resent
+        msger.raftch <- ae
+        assert_eq(t, <-msger.testch, &AppendReply { 1, true, 0, 2, 0, 0, 2 }, "Bad reply to a resend", ae.ReqID)
+    }
+    msger.syncWait(t)
+    slice, _ := pster.LogSlice(1, 9)
+    assert_eq(t, slice, append(ae1.Entries, ae2.Entries...), "Bad log after resends", slice)
+
+    ae1.Term, ae1.ReqID = 2, 1 // numbered afresh in a new term
+    msger.raftch <- ae1
+    assert_eq(t, <-msger.testch, &AppendReply { 2, true, 0, 1, 0, 0, 1 }, "Bad append in a new term")
+
+    m := <-msger.testch // wait for timeout
+    assert_eq(t, m, &VoteRequest { 3, 0, 2, 1, 0 }, "Bad votereq 3", m)
+    msger.raftch <- &VoteReply { 3, true, 1 }
+    msger.raftch <- &VoteReply { 3, true, 3 } // gets majority; broadcasts heartbeats
+    for i := 0; i < 4; i += 1 {
+        <-msger.testch
+    }
+    msger.syncWait(t)
+    assert(t, raft.lastReqId == 4, "Heartbeats not numbered", raft.lastReqId)
+
+    raft.Exit()
+}
+
+func TestAppendReplyHints(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTestEx(NodeConfig {
+        SelfId: 0,
+        NodeIds: []uint32 { 0, 1, 2 },
+        NotifBuf: 0,
+        MinNodes: 3,
+    })
+    msger.hints = true
+
+    entries := []RaftEntry {
+        { 1, &ClientEntry { 1231, nil } }, { 1, &ClientEntry { 1232, nil } },
+        { 1, &ClientEntry { 1233, nil } }, { 1, &ClientEntry { 1234, nil } },
+    }
+    msger.raftch <- &AppendEntries { 1, 1, 0, 0, entries, 2, 0 }
+    m := <-msger.testch
+    assert_eq(t, m, &AppendReply { 1, true, 0, 4, 2, 4, 0 }, "Bad append", m)
+    msger.raftch <- &AppendEntries { 1, 1, 7, 1, nil, 2, 0 }
+    m = <-msger.testch // reported even on failure
+    assert_eq(t, m, &AppendReply { 1, false, 0, 0, 2, 4, 0 }, "Bad append mismatch", m)
+
+    m = <-msger.testch // wait for timeout
+    assert_eq(t, m, &VoteRequest { 2, 0, 4, 1, 0 }, "Bad votereq", m)
+    msger.raftch <- &VoteReply { 2, true, 1 } // gets majority; broadcasts heartbeats
+    <-msger.testch
+    <-msger.testch
+
+    // the heartbeat reply of 1 is enough to advance its matchIdx
+    msger.raftch <- &AppendReply { 2, true, 1, 0, 2, 4, 0 }
+    msger.syncWait(t) // nothing is sent to find it
+    lag := raft.ReplicationLag()
+    assert_eq(t, lag, map[uint32]uint64 { 1: 2, 2: 4 }, "Bad replication lag", lag)
+
+    // the shorter log of 2 is skipped past at once
+    msger.raftch <- &AppendReply { 2, false, 2, 0, 0, 1, 0 }
+    ae, ok := (<-msger.testch).(*AppendEntries)
+    assert(t, ok && ae.PrevLogIdx == 1, "Bad AppendEntries after a hint", ae)
+    msger.raftch <- &AppendReply { 2, false, 2, 0, 0, 0, 0 } // no hints
+    ae, ok = (<-msger.testch).(*AppendEntries)
+    assert(t, ok && ae.PrevLogIdx == 0, "Bad AppendEntries without hints", ae)
+
+    raft.Exit()
+}
+
+func TestElectionStats(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTest()
+
+    m := <-msger.testch // wait for timeout
+    assert_eq(t, m, &VoteRequest { 1, 0, 0, 0, 0 }, "Bad votereq 1", m)
+    m = <-msger.testch // no votes; times out again
+    assert_eq(t, m, &VoteRequest { 2, 0, 0, 0, 0 }, "Bad votereq 2", m)
+    msger.raftch <- &VoteReply { 2, true, 1 }
+    msger.raftch <- &VoteReply { 2, true, 2 } // gets majority; broadcasts heartbeats
+    for i := 0; i < 4; i += 1 {
+        <-msger.testch
+    }
+    stats := raft.ElectionStats()
+    assert_eq(t, stats, ElectionStats { 2, 1, 1, 0 }, "Bad stats as leader", stats)
+
+    msger.raftch <- &AppendReply { 3, false, 1, 0, 0, 0, 0 } // higher term
+    stats = raft.ElectionStats()
+    assert_eq(t, stats, ElectionStats { 2, 1, 1, 1 }, "Bad stats after stepping down", stats)
+
+    raft.ResetStats()
+    stats = raft.ElectionStats()
+    assert_eq(t, stats, ElectionStats { }, "Stats not reset", stats)
+
+    raft.Exit()
+}
+
+func TestTermAccessor(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTest()
+    assert(t, raft.Term() == 0, "Bad initial term", raft.Term())
+
+    // the term is stored before the messages of the new term are sent
+    m := <-msger.testch // wait for timeout
+    assert_eq(t, m, &VoteRequest { 1, 0, 0, 0, 0 }, "Bad votereq", m)
+    assert(t, raft.Term() == 1, "Term not updated on campaigning", raft.Term())
+    msger.raftch <- &AppendEntries { 3, 1, 0, 0, nil, 0, 0 }
+    m = <-msger.testch
+    assert_eq(t, m, &AppendReply { 3, true, 0, 0, 0, 0, 0 }, "Bad append", m)
+    assert(t, raft.Term() == 3, "Term not updated on a higher term", raft.Term())
+
+    raft.Exit()
+}
+
+func TestSetLogger(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTest()
+    var errbuf bytes.Buffer
+    raft.SetLogger(golog.New(&errbuf, "", 0))
+    msger.raftch <- 42 // logged as a bad type
+    msger.syncWait(t)
+    assert(t, strings.Contains(errbuf.String(), "bad type: 42"), "Not logged to the new logger", errbuf.String())
+    raft.Exit()
+}
+
+func TestCommitHook(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTest()
+    var idxs, uids []uint64
+    hook := func(idx uint64, entries []ClientEntry) {
+        idxs = append(idxs, idx)
+        for _, e := range entries {
+            uids = append(uids, e.UID)
+        }
+    }
+    assert(t, raft.CommitHook(nil) == ErrNilHook, "Registered a nil hook")
+    assert(t, raft.CommitHook(hook) == nil, "Failed to register the hook")
+    assert(t, raft.CommitHook(hook) == ErrHookAlreadyRegistered, "Registered a second hook")
+
+    batch := &BatchClientEntry { []ClientEntry { { 1233, nil }, { 1234, nil } } }
+    entries := []RaftEntry {
+        { 1, &ClientEntry { 1231, nil } }, { 1, &ClientEntry { 1232, nil } },
+        { 1, &ClientEntry { 0, batch } }, { 1, &ClientEntry { 1235, nil } },
+    }
+    msger.raftch <- &AppendEntries { 1, 1, 0, 0, entries[:3], 1, 0 }
+    assert_eq(t, <-msger.testch, &AppendReply { 1, true, 0, 3, 0, 0, 0 }, "Bad append")
+    msger.raftch <- &AppendEntries { 1, 1, 3, 1, entries[3:], 4, 0 }
+    assert_eq(t, <-msger.testch, &AppendReply { 1, true, 0, 4, 0, 0, 0 }, "Bad append")
+    msger.syncWait(t)
+    assert_eq(t, idxs, []uint64 { 1, 2, 3, 4 }, "Bad hook indices", idxs)
+    assert_eq(t, uids, []uint64 { 1231, 1232, 1233, 1234, 1235 }, "Entries missed or out of order", uids)
+
+    raft.ClearCommitHook()
+    assert(t, raft.CommitHook(func(uint64, []ClientEntry) { }) == nil, "Hook not cleared")
+    raft.Exit()
+}
+
+func TestPauseResume(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTest()
+    raft.Pause()
+    time.Sleep(600 * time.Millisecond) // the election timeout fires meanwhile
+    var state RaftState
+    raft.Inspect(func(s *RaftNodeSnapshot) { state = s.State }) // not held back
+    assert(t, state == Follower, "Bad state while paused", state)
+    raft.Resume()
+    msger.syncWait(t) // the held timeout is stale
+
+    start := time.Now()
+    assert_eq(t, <-msger.testch, &VoteRequest { 1, 0, 0, 0, 0 }, "Bad votereq")
+    assert(t, time.Since(start) > 300 * time.Millisecond, "Campaigned before a fresh timeout")
+    msger.syncWait(t)
+    assert(t, raft.term == 1 && raft.state == Candidate, "Campaigned more than once", raft.term)
+    raft.Exit()
+}
+
+func TestRPC(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTest()
+
+    m, err := raft.RPC(&AppendEntries { 1, 1, 0, 0, []RaftEntry { { 1, &ClientEntry { 1231, nil } } }, 0, 0 })
+    assert(t, err == nil, "RPC failed", err)
+    assert_eq(t, m, &AppendReply { 1, true, 0, 1, 0, 1, 0 }, "Bad append", m)
+    m, _ = raft.RPC(&VoteRequest { 2, 2, 0, 0, 0 }) // log not up-to-date
+    assert_eq(t, m, &VoteReply { 2, false, 0 }, "Bad vote", m)
+    m, _ = raft.RPC(&VoteRequest { 2, 2, 1, 1, 0 })
+    assert_eq(t, m, &VoteReply { 2, true, 0 }, "Bad vote", m)
+    m, _ = raft.RPC(&Ping { 7, 2, 100 })
+    assert_eq(t, m, &Pong { 7, 0, 100 }, "Bad pong", m)
+    m, _ = raft.RPC(&AppendReply { 2, true, 2, 0, 0, 0, 0 })
+    assert(t, m == nil, "Reply to an AppendReply", m)
+    _, err = raft.RPC(&ClientEntry { 1232, nil })
+    assert(t, err != nil, "RPC delivered a ClientEntry")
+    msger.syncWait(t) // nothing else was sent
+    raft.Exit()
+}
+
+func TestCommitIdxRegression(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTest()
+
+    entries := []RaftEntry {
+        { 1, &ClientEntry { 1231, nil } }, { 1, &ClientEntry { 1232, nil } }, { 1, &ClientEntry { 1233, nil } },
+    }
+    msger.raftch <- &AppendEntries { 1, 1, 0, 0, entries, 2, 0 }
+    assert_eq(t, <-msger.testch, &AppendReply { 1, true, 0, 3, 0, 0, 0 }, "Bad append")
+    // delayed heartbeat: commits up to 3, but is known to match only up to 1
+    msger.raftch <- &AppendEntries { 1, 1, 1, 1, nil, 3, 0 }
+    assert_eq(t, <-msger.testch, &AppendReply { 1, true, 0, 0, 0, 0, 0 }, "Bad heartbeat")
+    msger.syncWait(t)
+    assert(t, raft.CommitIndex() == 2, "Commit index regressed", raft.CommitIndex())
+    raft.Exit()
+
+    // a regression below lastApplied is clamped (and logged)
+    var errbuf bytes.Buffer
+    cfg := NodeConfig { SelfId: 0, NodeIds: []uint32 { 0, 1, 2 }, MinNodes: 3 }
+    log := append([]RaftEntry { { 0, nil } }, entries...)
+    pster := &commitPster { DummyPster { log }, 2 }
+    raft, err := NewNodeEx(cfg, &NopMessenger { }, pster, &DummyMachn { make(map[uint64]bool) },
+                           golog.New(&errbuf, "", 0))
+    if err != nil { t.Fatal(err) }
+    raft.setCommitIdx(1)
+    assert(t, raft.CommitIndex() == 2 && raft.LastApplied() == 2, "Commit index not clamped", raft.CommitIndex())
+    assert(t, strings.Contains(errbuf.String(), "below lastApplied"), "Regression not logged", errbuf.String())
+}
+
+func TestQuiesce(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTestEx(NodeConfig {
+        SelfId: 0,
+        NodeIds: []uint32 { 0, 1, 2 },
+        NotifBuf: 0,
+        MinNodes: 3,
+    })
+
+    <-msger.testch // wait for timeout; VoteRequest
+    msger.raftch <- &VoteReply { 1, true, 1 } // gets majority; broadcasts heartbeats
+    <-msger.testch
+    <-msger.testch
+
+    go raft.Quiesce() // the peers are caught up (the log is empty)
+    m := <-msger.testch
+    assert_eq(t, m, &TimeoutNow { 1, 0 }, "Leadership not handed over", m)
+    msger.syncWait(t)
+    _, err := raft.ProposeBatch([]ClientEntry { { 1234, nil } })
+    assert(t, err == ErrQuiesced, "Batch accepted while quiesced", err)
+    msger.raftch <- &ClientEntry { 1235, nil }
+    msger.syncWait(t)
+    assert(t, msger.n503[1235] == 1, "Write not turned away while quiesced", msger.n503)
+
+    msger.raftch <- &AppendEntries { 2, 1, 0, 0, nil, 0, 0 } // 1 took over
+    assert_eq(t, <-msger.testch, &AppendReply { 2, true, 0, 0, 0, 0, 0 }, "Bad append")
+    select {
+    case m := <-msger.testch:
+        t.Fatal("Quiesced node campaigned", m)
+    case <-time.After(time.Second):
+    }
+
+    raft.Unquiesce()
+    m = <-msger.testch // campaigns on the next timeout
+    assert_eq(t, m, &VoteRequest { 3, 0, 0, 0, 0 }, "Bad votereq after Unquiesce", m)
+
+    raft.Exit()
+}
+
+func TestPauseReplication(t *testing.T) { // {{{1
+    raft, msger, _, machn := initTestEx(NodeConfig {
+        SelfId: 0,
+        NodeIds: []uint32 { 0, 1, 2 },
+        NotifBuf: 0,
+        MinNodes: 3,
+    })
+
+    <-msger.testch // wait for timeout; VoteRequest
+    msger.raftch <- &VoteReply { 1, true, 1 } // gets majority; broadcasts heartbeats
+    <-msger.testch
+    <-msger.testch
+
+    assert(t, raft.PauseReplication(3) != nil, "Paused an unknown node")
+    assert(t, raft.PauseReplication(2) == nil, "PauseReplication failed")
+    clens := []*ClientEntry { { 1234, nil }, { 1235, nil } }
+    for i, clen := range clens { // only sent to 1
+        msger.raftch <- clen
+        apen := &AppendEntries { 1, 0, uint64(i), uint64(i), []RaftEntry { { 1, clen } }, uint64(i), 0 }
+        assert_eq(t, <-msger.testch, apen, "Bad AppendEntries", i)
+        msger.syncWait(t)
+        msger.raftch <- &AppendReply { 1, true, 1, uint64(i + 1), 0, 0, 0 }
+        lag := raft.ReplicationLag() // grows only for the paused peer
+        assert_eq(t, lag, map[uint32]uint64 { 1: 0, 2: uint64(i + 1) }, "Bad replication lag", i, lag)
+    }
+    msger.syncWait(t)
+    assert(t, machn.hasUID(1235), "Failed to apply 1235 without the paused peer")
+
+    msger.raftch <- &AppendReply { 1, true, 2, 0, 0, 0, 0 } // late reply of the paused peer
+    msger.syncWait(t)
+
+    errch := make(chan error, 1)
+    go func() { errch <- raft.ResumeReplication(2) }()
+    apen := &AppendEntries { 1, 0, 0, 0, []RaftEntry { { 1, clens[0] }, { 1, clens[1] } }, 2, 0 }
+    assert_eq(t, <-msger.testch, apen, "Bad catchup on resume")
+    assert(t, <-errch == nil, "ResumeReplication failed")
+    msger.raftch <- &AppendReply { 1, true, 2, 2, 0, 0, 0 }
+    msger.syncWait(t)
+    assert(t, raft.matchIdx[2] == 2, "Resumed peer did not catch up", raft.matchIdx)
+    lag := raft.ReplicationLag()
+    assert_eq(t, lag, map[uint32]uint64 { 1: 0, 2: 0 }, "Bad replication lag after resume", lag)
+
+    raft.Exit()
+}
+
 func TestCandidate(t *testing.T) { // {{{1
     raft, msger, _, _ := initTest()
     var m interface{}
@@ -250,7 +778,7 @@ func TestCandidate(t *testing.T) { // {{{1
         CommitIdx: 3,
     }
     m = <-msger.testch
-    assert_eq(t, m, &AppendReply { 4, true, 0, 3 }, "Bad append 4", m)
+    assert_eq(t, m, &AppendReply { 4, true, 0, 3, 0, 0, 0 }, "Bad append 4", m)
     assert(t, raft.state == Follower, "Bad state 4", raft)
 
     m = <-msger.testch // wait for timeout
@@ -262,22 +790,22 @@ func TestCandidate(t *testing.T) { // {{{1
     }, "Bad votereq 5", m)
     assert(t, raft.state == Candidate, "Bad state 5", raft)
 
-    msger.raftch <- &AppendEntries { 4, 2, 3, 4, nil, 3 }
+    msger.raftch <- &AppendEntries { 4, 2, 3, 4, nil, 3, 0 }
     m = <-msger.testch
-    assert_eq(t, m, &AppendReply { 5, false, 0, 0 }, "Bad append 5", m)
+    assert_eq(t, m, &AppendReply { 5, false, 0, 0, 0, 0, 0 }, "Bad append 5", m)
 
     m = <-msger.testch // wait for timeout again
-    assert_eq(t, m, &VoteRequest { 6, 0, 3, 4 }, "Bad votereq 6", m)
+    assert_eq(t, m, &VoteRequest { 6, 0, 3, 4, 0 }, "Bad votereq 6", m)
 
-    msger.raftch <- &AppendEntries { 6, 3, 3, 4, nil, 1 }
+    msger.raftch <- &AppendEntries { 6, 3, 3, 4, nil, 1, 0 }
     m = <-msger.testch
-    assert_eq(t, m, &AppendReply { 6, true, 0, 0 }, "Bad append 6", m)
+    assert_eq(t, m, &AppendReply { 6, true, 0, 0, 0, 0, 0 }, "Bad append 6", m)
     assert(t, raft.state == Follower, "Bad state 6", raft)
 
     m = <-msger.testch // wait for timeout one last time!
-    assert_eq(t, m, &VoteRequest { 7, 0, 3, 4 }, "Bad votereq 7", m)
+    assert_eq(t, m, &VoteRequest { 7, 0, 3, 4, 0 }, "Bad votereq 7", m)
 
-    msger.raftch <- &VoteRequest { 7, 1, 3, 4 }
+    msger.raftch <- &VoteRequest { 7, 1, 3, 4, 0 }
     m = <-msger.testch
     assert_eq(t, m, &VoteReply { 7, false, 0 }, "Bad votereply 7", m)
 
@@ -292,7 +820,7 @@ func TestCandidate(t *testing.T) { // {{{1
     msger.syncWait(t)
     assert(t, raft.state == Candidate, "Bad state 7", raft)
 
-    msger.raftch <- &VoteRequest { 8, 1, 3, 4 }
+    msger.raftch <- &VoteRequest { 8, 1, 3, 4, 0 }
     m = <-msger.testch
     assert_eq(t, m, &VoteReply { 8, true, 0 }, "Bad votereply 7", m)
     assert(t, raft.state == Follower, "Bad state 8", raft)
@@ -305,14 +833,14 @@ func TestLeader(t *testing.T) { // {{{1
     var m interface{}
 
     m = <-msger.testch // wait for timeout
-    assert_eq(t, m, &VoteRequest { 1, 0, 0, 0 }, "Bad votereq 1", m)
+    assert_eq(t, m, &VoteRequest { 1, 0, 0, 0, 0 }, "Bad votereq 1", m)
 
     msger.raftch <- &VoteReply { 1, true, 1 }
     msger.syncWait(t)
     assert(t, raft.state == Candidate, "Bad state 1.1", raft)
 
     msger.raftch <- &VoteReply { 1, true, 2 } // gets majority; broadcasts heartbeats
-    hb := &AppendEntries { 1, 0, 0, 0, nil, 0 } // term, id, prevIdx, prevTerm, entries, commitIdx
+    hb := &AppendEntries { 1, 0, 0, 0, nil, 0, 0 } // term, id, prevIdx, prevTerm, entries, commitIdx, reqId
     assert_eq(t, <-msger.testch, hb, "Bad heartbeat 1.1")
     assert_eq(t, <-msger.testch, hb, "Bad heartbeat 1.2")
     assert_eq(t, <-msger.testch, hb, "Bad heartbeat 1.3")
@@ -321,7 +849,7 @@ func TestLeader(t *testing.T) { // {{{1
 
     clen := &ClientEntry { 1234, nil }
     msger.raftch <- clen
-    apen := &AppendEntries { 1, 0, 0, 0, []RaftEntry { RaftEntry { 1, clen } }, 0 }
+    apen := &AppendEntries { 1, 0, 0, 0, []RaftEntry { RaftEntry { 1, clen } }, 0, 0 }
     assert_eq(t, <-msger.testch, apen, "Bad AppendEntries 1.1")
     assert_eq(t, <-msger.testch, apen, "Bad AppendEntries 1.2")
     assert_eq(t, <-msger.testch, apen, "Bad AppendEntries 1.3")
@@ -330,12 +858,12 @@ func TestLeader(t *testing.T) { // {{{1
     msger.raftch <- clen // duplicate -- before apply; should ignore
     msger.syncWait(t)
 
-    msger.raftch <- &AppendReply { 1, true, 1, 1 }
-    msger.raftch <- &AppendReply { 1, true, 1, 1 } // duplicate
+    msger.raftch <- &AppendReply { 1, true, 1, 1, 0, 0, 0 }
+    msger.raftch <- &AppendReply { 1, true, 1, 1, 0, 0, 0 } // duplicate
     msger.syncWait(t)
     assert(t, !machn.hasUID(1234), "Applied before reaching majority")
 
-    msger.raftch <- &AppendReply { 1, true, 2, 1 }
+    msger.raftch <- &AppendReply { 1, true, 2, 1, 0, 0, 0 }
     msger.syncWait(t)
     assert(t, machn.hasUID(1234), "Failed to apply 1234")
 
@@ -349,18 +877,18 @@ func TestLeader(t *testing.T) { // {{{1
             RaftEntry { 3, nil }, // 3
             RaftEntry { 3, nil }, // 4
             RaftEntry { 3, clen }, // 5
-        }, 4,
+        }, 4, 0,
     }
     m = <-msger.testch
-    assert_eq(t, m, &AppendReply { 3, true, 0, 5 }, "Bad append 3", m)
+    assert_eq(t, m, &AppendReply { 3, true, 0, 5, 0, 0, 0 }, "Bad append 3", m)
     assert(t, raft.state == Follower, "Bad state 3", raft)
 
     m = <-msger.testch // wait for timeout
-    assert_eq(t, m, &VoteRequest { 4, 0, 5, 3 }, "Bad votereq 1", m)
+    assert_eq(t, m, &VoteRequest { 4, 0, 5, 3, 0 }, "Bad votereq 1", m)
 
     msger.raftch <- &VoteReply { 4, true, 1 }
     msger.raftch <- &VoteReply { 4, true, 2 } // gets majority
-    hb = &AppendEntries { 4, 0, 5, 3, nil, 4 }
+    hb = &AppendEntries { 4, 0, 5, 3, nil, 4, 0 }
     assert_eq(t, <-msger.testch, hb, "Bad heartbeat 4.1")
     assert_eq(t, <-msger.testch, hb, "Bad heartbeat 4.2")
     assert_eq(t, <-msger.testch, hb, "Bad heartbeat 4.3")
@@ -369,26 +897,1234 @@ func TestLeader(t *testing.T) { // {{{1
     msger.raftch <- clen // duplicate; should ignore
     msger.syncWait(t)
 
-    msger.raftch <- &AppendReply { 4, false, 1, 0 }
-    assert_eq(t, <-msger.testch, &AppendEntries { 4, 0, 4, 3, nil, 4 }, "Bad append 4.1")
-    msger.raftch <- &AppendReply { 4, false, 1, 0 }
-    assert_eq(t, <-msger.testch, &AppendEntries { 4, 0, 3, 3, nil, 4 }, "Bad append 4.2")
-    msger.raftch <- &AppendReply { 4, false, 1, 0 }
-    assert_eq(t, <-msger.testch, &AppendEntries { 4, 0, 2, 2, nil, 4 }, "Bad append 4.3")
-    msger.raftch <- &AppendReply { 4, true, 1, 0 }
+    msger.raftch <- &AppendReply { 4, false, 1, 0, 0, 0, 0 }
+    assert_eq(t, <-msger.testch, &AppendEntries { 4, 0, 4, 3, nil, 4, 0 }, "Bad append 4.1")
+    msger.raftch <- &AppendReply { 4, false, 1, 0, 0, 0, 0 }
+    assert_eq(t, <-msger.testch, &AppendEntries { 4, 0, 3, 3, nil, 4, 0 }, "Bad append 4.2")
+    msger.raftch <- &AppendReply { 4, false, 1, 0, 0, 0, 0 }
+    assert_eq(t, <-msger.testch, &AppendEntries { 4, 0, 2, 2, nil, 4, 0 }, "Bad append 4.3")
+    msger.raftch <- &AppendReply { 4, true, 1, 0, 0, 0, 0 }
     assert_eq(t, <-msger.testch, &AppendEntries {
         4, 0, 2, 2,
         []RaftEntry {
             RaftEntry { 3, nil }, // 3
             RaftEntry { 3, nil }, // 4
             RaftEntry { 3, clen }, // 5
-        }, 4,
+        }, 4, 0,
     }, "Bad append 4.4")
 
-    msger.raftch <- &AppendReply { 5, false, 2, 0 }
+    msger.raftch <- &AppendReply { 5, false, 2, 0, 0, 0, 0 }
     msger.syncWait(t)
     assert(t, raft.term == 5, "Bad term 5", raft)
     assert(t, raft.state == Follower, "Bad state 5")
 
     raft.Exit()
 }
+
+func TestLeaderStepDown(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTest()
+
+    <-msger.testch // wait for timeout
+    msger.raftch <- &VoteReply { 1, true, 1 }
+    msger.raftch <- &VoteReply { 1, true, 2 } // gets majority
+    for i := 0; i < 4; i += 1 { <-msger.testch } // heartbeats
+
+    clen := &ClientEntry { 1234, nil }
+    msger.raftch <- clen
+    for i := 0; i < 4; i += 1 { <-msger.testch } // AppendEntries
+    msger.syncWait(t)
+    assert(t, raft.state == Leader, "Bad state 1", raft)
+
+    msger.raftch <- &VoteRequest { 2, 3, 1, 1, 0 } // higher term, up-to-date log
+    m := <-msger.testch
+    assert_eq(t, m, &VoteReply { 2, true, 0 }, "Bad votereply 2", m)
+    msger.syncWait(t)
+    assert(t, raft.state == Follower, "Bad state 2", raft)
+    assert(t, raft.votedFor == 3, "Bad vote 2", raft)
+    assert(t, raft.nextIdx == nil && raft.matchIdx == nil && raft.windows == nil,
+           "Leader state not cleared", raft)
+    assert_eq(t, raft.idxOfUid, map[uint64]uint64 { 1234: 1 }, "In-flight request forgotten", raft)
+
+    msger.raftch <- clen // no longer the leader; redirect
+    msger.syncWait(t)
+
+    m = <-msger.testch // wait for timeout
+    assert_eq(t, m, &VoteRequest { 3, 0, 1, 1, 0 }, "Bad votereq 3", m)
+    msger.raftch <- &VoteReply { 3, true, 1 }
+    msger.raftch <- &VoteReply { 3, true, 2 } // gets majority
+    hb := &AppendEntries { 3, 0, 1, 1, nil, 0, 0 }
+    for i := 0; i < 4; i += 1 {
+        assert_eq(t, <-msger.testch, hb, "Bad heartbeat 3", i)
+    }
+    assert(t, raft.state == Leader, "Bad state 3", raft)
+    assert(t, raft.idxOfUid[1234] == 1, "Unapplied entry not tracked", raft.idxOfUid)
+
+    raft.Exit()
+}
+
+func TestEvents(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTest()
+
+    <-msger.testch // wait for timeout; VoteRequest
+    msger.raftch <- &VoteReply { 1, true, 1 }
+    msger.raftch <- &VoteReply { 1, true, 2 } // gets majority; broadcasts heartbeats
+    for i := 0; i < 4; i += 1 { <-msger.testch }
+
+    msger.raftch <- &ClientEntry { 1234, nil }
+    for i := 0; i < 4; i += 1 { <-msger.testch }
+    msger.raftch <- &AppendReply { 1, true, 1, 1, 0, 0, 0 }
+    msger.raftch <- &AppendReply { 1, true, 2, 1, 0, 0, 0 }
+    msger.raftch <- &AppendReply { 2, false, 3, 0, 0, 0, 0 } // higher term
+    msger.syncWait(t)
+
+    expected := []RaftEvent {
+        &ElectionStarted { 1 },
+        &VoteGranted { 1 },
+        &VoteGranted { 2 },
+        &BecameLeader { 1 },
+        &CommitAdvanced { 1 },
+        &SteppedDown { 2 },
+    }
+    for _, ev := range expected {
+        select {
+        case e := <-raft.Events():
+            assert_eq(t, e, ev, "Bad event", e, ev)
+        default:
+            t.Fatal("Missing event", ev)
+        }
+    }
+
+    raft.Exit()
+}
+
+func TestLeaderWindow(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTestEx(NodeConfig {
+        SelfId: 0,
+        NodeIds: []uint32 { 0, 1, 2 },
+        NotifBuf: 0,
+        MinNodes: 3,
+        LeaderWindowSize: 20,
+        EntrySize: func(*RaftEntry) uint64 { return 10 },
+    })
+
+    <-msger.testch // wait for timeout; VoteRequest
+    msger.raftch <- &VoteReply { 1, true, 1 } // gets majority; broadcasts heartbeats
+    <-msger.testch
+    <-msger.testch
+
+    clens := []*ClientEntry { { 1234, nil }, { 1235, nil }, { 1236, nil } }
+    for i, clen := range clens[:2] {
+        msger.raftch <- clen
+        apen := &AppendEntries { 1, 0, uint64(i), uint64(i), []RaftEntry { { 1, clen } }, 0, 0 }
+        assert_eq(t, <-msger.testch, apen, "Bad AppendEntries", i)
+        assert_eq(t, <-msger.testch, apen, "Bad AppendEntries", i)
+    }
+    msger.raftch <- clens[2] // window is full
+    msger.syncWait(t)
+
+    msger.raftch <- &AppendReply { 1, true, 1, 1, 0, 0, 0 } // window opens up
+    apen := &AppendEntries { 1, 0, 2, 1, []RaftEntry { { 1, clens[2] } }, 1, 0 }
+    assert_eq(t, <-msger.testch, apen, "Bad AppendEntries after ack")
+
+    raft.Exit()
+}
+
+func TestStaleRead(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTest()
+    var m interface{}
+
+    msger.raftch <- &AppendEntries { 1, 2, 0, 0, []RaftEntry {
+        { 1, &ClientEntry { 1234, nil } },
+        { 1, &ClientEntry { 1235, nil } },
+    }, 1, 0 } // committed only till 1
+    m = <-msger.testch
+    assert_eq(t, m, &AppendReply { 1, true, 0, 2, 0, 0, 0 }, "Bad append 1", m)
+
+    msger.raftch <- &StaleRead { 77, "f" }
+    m = <-msger.testch
+    assert_eq(t, m, &testReadReply { 77, []byte("f"), 1 }, "Bad read reply 1", m)
+
+    msger.raftch <- &AppendEntries { 1, 2, 2, 1, nil, 2, 0 }
+    m = <-msger.testch
+    assert_eq(t, m, &AppendReply { 1, true, 0, 0, 0, 0, 0 }, "Bad append 2", m)
+
+    msger.raftch <- &StaleRead { 78, "f" }
+    m = <-msger.testch
+    assert_eq(t, m, &testReadReply { 78, []byte("f"), 2 }, "Bad read reply 2", m)
+
+    raft.Exit()
+}
+
+func TestReset(t *testing.T) { // {{{1
+    cfg := NodeConfig {
+        SelfId: 0,
+        NodeIds: []uint32 { 0, 1, 2 },
+        NotifBuf: 0,
+        MinNodes: 3,
+        LeaderWindowSize: 20,
+        EntrySize: func(*RaftEntry) uint64 { return 10 },
+    }
+    raft, msger, _, _ := initTestEx(cfg)
+
+    <-msger.testch // wait for timeout; VoteRequest
+    msger.raftch <- &VoteReply { 1, true, 1 } // gets majority; broadcasts heartbeats
+    <-msger.testch
+    <-msger.testch
+
+    clens := []*ClientEntry { { 1234, nil }, { 1235, nil }, { 1236, nil } }
+    for _, clen := range clens[:2] {
+        msger.raftch <- clen
+        <-msger.testch
+        <-msger.testch
+    }
+    msger.raftch <- clens[2] // window is full
+    msger.syncWait(t)
+
+    badCfg := cfg
+    badCfg.SelfId = 1
+    assert(t, raft.Reset(badCfg) == ErrImmutableField, "SelfId changed")
+    badCfg = cfg
+    badCfg.NodeIds = []uint32 { 0, 1, 3 }
+    assert(t, raft.Reset(badCfg) == ErrImmutableField, "NodeIds changed")
+    msger.syncWait(t) // nothing was sent
+
+    cfg.NodeIds = []uint32 { 2, 1, 0 } // same set
+    cfg.LeaderWindowSize = 30
+    go func() {
+        if err := raft.Reset(cfg); err != nil { t.Error("Reset failed", err) }
+    }()
+    apen := &AppendEntries { 1, 0, 2, 1, []RaftEntry { { 1, clens[2] } }, 0, 0 }
+    assert_eq(t, <-msger.testch, apen, "Bad AppendEntries after reset")
+    assert_eq(t, <-msger.testch, apen, "Bad AppendEntries after reset")
+
+    raft.Exit()
+}
+
+func TestQuorumFunc(t *testing.T) { // {{{1
+    raft, msger, _, machn := initTestEx(NodeConfig {
+        SelfId: 0,
+        NodeIds: []uint32 { 0, 1, 2 },
+        NotifBuf: 0,
+        MinNodes: 3,
+        Quorum: func(acks []uint32, nodeIds []uint32) bool {
+            return len(acks) == len(nodeIds)
+        },
+    })
+
+    <-msger.testch // wait for timeout; VoteRequest
+    msger.raftch <- &VoteReply { 1, true, 1 } // a majority, but not all
+    msger.syncWait(t)
+    assert(t, raft.state == Candidate, "Became leader without all votes", raft)
+    msger.raftch <- &VoteReply { 1, true, 2 } // broadcasts heartbeats
+    <-msger.testch
+    <-msger.testch
+    assert(t, raft.state == Leader, "Not leader with all votes", raft)
+
+    clen := &ClientEntry { 1234, nil }
+    msger.raftch <- clen
+    <-msger.testch
+    <-msger.testch
+    msger.raftch <- &AppendReply { 1, true, 1, 1, 0, 0, 0 }
+    msger.syncWait(t)
+    assert(t, !machn.hasUID(1234), "Applied before reaching all nodes")
+    assert(t, raft.CommitIndex() == 0, "Committed before reaching all nodes")
+    msger.raftch <- &AppendReply { 1, true, 2, 1, 0, 0, 0 }
+    msger.syncWait(t)
+    assert(t, machn.hasUID(1234), "Failed to apply 1234")
+    assert(t, raft.CommitIndex() == 1, "Failed to commit 1234")
+
+    raft.Exit()
+}
+
+func TestDumpState(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTestEx(NodeConfig {
+        SelfId: 0,
+        NodeIds: []uint32 { 0, 1, 2 },
+        NotifBuf: 0,
+        MinNodes: 3,
+    })
+
+    <-msger.testch // wait for timeout; VoteRequest
+    msger.raftch <- &VoteReply { 1, true, 1 } // gets majority; broadcasts heartbeats
+    <-msger.testch
+    <-msger.testch
+    msger.raftch <- &ClientEntry { 1234, nil }
+    <-msger.testch
+    <-msger.testch
+
+    var buf bytes.Buffer
+    if err := raft.DumpState(&buf); err != nil { t.Fatal(err) }
+    var dump stateDump
+    if err := json.Unmarshal(buf.Bytes(), &dump); err != nil { t.Fatal(err, buf.String()) }
+    assert(t, dump.Term == 1 && dump.State == "Leader" && dump.VotedFor == 0, "Bad state", dump)
+    assert(t, dump.LastLogIdx == 1, "Bad last log index", dump)
+    assert_eq(t, dump.LogTail, []entryDump { { 0, 0, 0, "" }, { 1, 1, 1234, "<nil>" } }, "Bad log tail", dump)
+    assert_eq(t, dump.NextIdx, map[uint32]uint64 { 1: 2, 2: 2 }, "Bad nextIdx", dump)
+    assert_eq(t, dump.IdxOfUid, map[uint64]uint64 { 1234: 1 }, "Bad idxOfUid", dump)
+
+    raft.Exit()
+}
+
+func TestInspect(t *testing.T) { // {{{1
+    raft, msger, pster, _ := initTestEx(NodeConfig {
+        SelfId: 0,
+        NodeIds: []uint32 { 0, 1, 2 },
+        NotifBuf: 0,
+        MinNodes: 3,
+    })
+
+    <-msger.testch // wait for timeout; VoteRequest
+    msger.raftch <- &VoteReply { 1, true, 1 } // gets majority; broadcasts heartbeats
+    <-msger.testch
+    <-msger.testch
+    msger.raftch <- &ClientEntry { 1234, nil }
+    <-msger.testch
+    <-msger.testch
+
+    var snap *RaftNodeSnapshot
+    raft.Inspect(func(s *RaftNodeSnapshot) { snap = s })
+    assert(t, snap.Id == 0 && snap.Term == 1 && snap.State == Leader && !snap.LeaderReady, "Bad state", snap)
+    assert_eq(t, snap.Log, []RaftEntry { { 0, nil }, { 1, &ClientEntry { 1234, nil } } }, "Bad log", snap.Log)
+    assert_eq(t, snap.NextIdx, map[uint32]uint64 { 1: 2, 2: 2 }, "Bad nextIdx", snap)
+    assert_eq(t, snap.IdxOfUid, map[uint64]uint64 { 1234: 1 }, "Bad idxOfUid", snap)
+
+    snap.Log[1].CEntry.UID = 4321 // a copy
+    snap.NextIdx[1] = 1
+    assert(t, pster.Entry(1).CEntry.UID == 1234, "Log shared with the snapshot")
+    raft.Inspect(func(s *RaftNodeSnapshot) { snap = s })
+    assert(t, snap.NextIdx[1] == 2, "nextIdx shared with the snapshot")
+
+    raft.Exit()
+}
+
+func TestTwoLeaders(t *testing.T) { // {{{1
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    raft, err := NewNodeEx(NodeConfig {
+        SelfId: 0,
+        NodeIds: []uint32 { 0, 1, 2 },
+        MinNodes: 3,
+    }, &DummyMsger { }, &DummyPster { }, &DummyMachn { make(map[uint64]bool) }, errlog)
+    if err != nil { t.Fatal(err) }
+    // not running, so that the handler can be called from here
+    raft.term, raft.state = 1, Leader
+
+    defer func() {
+        r := recover()
+        msg, ok := r.(string)
+        assert(t, ok && strings.Contains(msg, "two leaders (0 and 1) in term 1"), "Bad panic", r)
+    }()
+    raft.leaderHandler(&AppendEntries { 1, 1, 0, 0, nil, 0, 0 })
+    t.Fatal("Two leaders of the same term went unnoticed")
+}
+
+func TestConfigHistory(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTestEx(NodeConfig {
+        SelfId: 2,
+        NodeIds: []uint32 { 3, 2, 1 },
+        MinNodes: 3,
+    })
+    <-msger.testch // wait for timeout; VoteRequest
+    msger.raftch <- &VoteReply { 1, true, 1 } // gets majority; broadcasts heartbeats
+    <-msger.testch
+    <-msger.testch
+
+    want := []ConfigEntry { { 0, 0, []uint32 { 1, 2, 3 } } }
+    assert_eq(t, raft.ConfigHistory(), want, "Bad history")
+    raft.Exit()
+}
+
+func TestMaxLogEntriesNoSnapshotter(t *testing.T) { // {{{1
+    raft, msger, pster, _ := initTestEx(NodeConfig {
+        SelfId: 0,
+        NodeIds: []uint32 { 0, 1, 2 },
+        NotifBuf: 0,
+        MinNodes: 3,
+        MaxLogEntries: 2,
+    })
+
+    <-msger.testch // wait for timeout; VoteRequest
+    msger.raftch <- &VoteReply { 1, true, 1 } // gets majority; broadcasts heartbeats
+    <-msger.testch
+    <-msger.testch
+    for uid := uint64(1001); uid <= 1003; uid += 1 {
+        msger.raftch <- &ClientEntry { uid, nil }
+        <-msger.testch
+        <-msger.testch
+    }
+
+    status := raft.Status()
+    assert(t, status.State == Leader && status.LogEntryCount == 3, "Bad status", status)
+    for idx, entry := range pster.log {
+        if entry.CEntry != nil {
+            _, isMarker := entry.CEntry.Data.(*SnapshotMarker)
+            assert(t, !isMarker, "Snapshot scheduled without a Snapshotter", idx)
+        }
+    }
+
+    raft.Exit()
+}
+
+func TestInFlightEntry(t *testing.T) { // {{{1
+    raft, msger, pster, machn := initTestEx(NodeConfig {
+        SelfId: 0,
+        NodeIds: []uint32 { 0, 1, 2 },
+        NotifBuf: 0,
+        MinNodes: 3,
+    })
+
+    <-msger.testch // wait for timeout; VoteRequest
+    msger.raftch <- &VoteReply { 1, true, 1 } // gets majority; broadcasts heartbeats
+    <-msger.testch
+    <-msger.testch
+    for _, uid := range []uint64 { 1234, 5678 } { // appended at 1 and 2
+        msger.raftch <- &ClientEntry { uid, nil }
+        <-msger.testch
+        <-msger.testch
+    }
+
+    // step down on a VoteRequest (rejected), so no leader is known
+    msger.raftch <- &VoteRequest { Term: 2, CandidId: 1, LastLogIdx: 0, LastLogTerm: 0 }
+    assert_eq(t, <-msger.testch, &VoteReply { 2, false, 0 }, "Bad vote reply")
+    msger.raftch <- &ClientEntry { 1234, nil } // retry of an in-flight request
+    msger.raftch <- &ClientEntry { 4321, nil }
+    msger.syncWait(t)
+    assert_eq(t, msger.n503, map[uint64]int { 4321: 1 }, "503 for an in-flight request")
+
+    // the new leader commits 1 and overwrites 2
+    msger.raftch <- &AppendEntries {
+        Term: 2, LeaderId: 1,
+        PrevLogIdx: 1, PrevLogTerm: 1,
+        Entries: []RaftEntry { RaftEntry { 2, &ClientEntry { 9999, nil } } },
+        CommitIdx: 1,
+    }
+    <-msger.testch // AppendReply
+    msger.syncWait(t)
+    assert(t, machn.hasUID(1234), "In-flight request not applied")
+
+    // becoming leader again reveals that 5678 was lost
+    <-msger.testch // wait for timeout; VoteRequest
+    msger.raftch <- &VoteReply { 3, true, 1 }
+    <-msger.testch
+    <-msger.testch
+    msger.raftch <- &ClientEntry { 1234, nil } // already applied; not appended again
+    msger.syncWait(t)
+    assert_eq(t, msger.n503, map[uint64]int { 4321: 1, 5678: 1 }, "Bad 503-s")
+    lastIdx, _ := pster.LastEntry()
+    assert(t, lastIdx == 2, "Applied request was appended again", lastIdx)
+
+    raft.Exit()
+}
+
+func TestIsCaughtUp(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTest()
+    entry := func(uid uint64) RaftEntry { return RaftEntry { 1, &ClientEntry { uid, nil } } }
+    appendEntries := func(prevIdx uint64, entries []RaftEntry, commitIdx uint64) {
+        var prevTerm uint64 = 1
+        if prevIdx == 0 { prevTerm = 0 }
+        msger.raftch <- &AppendEntries {
+            Term: 1, LeaderId: 2,
+            PrevLogIdx: prevIdx, PrevLogTerm: prevTerm,
+            Entries: entries, CommitIdx: commitIdx,
+        }
+        <-msger.testch // AppendReply
+    }
+    assert(t, !raft.IsCaughtUp(), "New follower is caught up")
+
+    appendEntries(0, []RaftEntry { entry(1001) }, 0)
+    assert(t, raft.IsCaughtUp(), "Not caught up after the only entry")
+    appendEntries(3, nil, 3) // heartbeat from a leader 2 entries ahead
+    assert(t, !raft.IsCaughtUp(), "Caught up despite a log mismatch")
+    appendEntries(1, []RaftEntry { entry(1002) }, 3)
+    assert(t, !raft.IsCaughtUp(), "Caught up while behind the commit index")
+    appendEntries(2, []RaftEntry { entry(1003) }, 3)
+    assert(t, raft.IsCaughtUp(), "Not caught up after replication completed")
+
+    raft.Exit()
+}
+
+func TestOverlappingAppend(t *testing.T) { // {{{1
+    raft, msger, pster, _ := initTest()
+    entry := func(term, uid uint64) RaftEntry { return RaftEntry { term, &ClientEntry { uid, nil } } }
+    appendEntries := func(term, prevIdx, prevTerm uint64, entries []RaftEntry, commitIdx uint64) {
+        msger.raftch <- &AppendEntries {
+            Term: term, LeaderId: uint32(term),
+            PrevLogIdx: prevIdx, PrevLogTerm: prevTerm,
+            Entries: entries, CommitIdx: commitIdx,
+        }
+    }
+    uids := func() []uint64 {
+        var uids []uint64
+        for _, entry := range pster.log[1:] { uids = append(uids, entry.CEntry.UID) }
+        return uids
+    }
+
+    appendEntries(1, 0, 0, []RaftEntry { entry(1, 1001), entry(1, 1002), entry(1, 1003) }, 2)
+    assert_eq(t, <-msger.testch, &AppendReply { 1, true, 0, 3, 0, 0, 0 }, "Bad reply")
+
+    // a retransmission of an older message does not truncate the log
+    appendEntries(1, 0, 0, []RaftEntry { entry(1, 1001) }, 1)
+    assert_eq(t, <-msger.testch, &AppendReply { 1, true, 0, 1, 0, 0, 0 }, "Bad reply to the overlap")
+    assert_eq(t, uids(), []uint64 { 1001, 1002, 1003 }, "Log truncated by the overlap")
+
+    // committed entries are never overwritten
+    appendEntries(2, 1, 1, []RaftEntry { entry(2, 2002) }, 2)
+    msger.syncWait(t) // no reply
+    assert_eq(t, uids(), []uint64 { 1001, 1002, 1003 }, "Committed entry overwritten")
+    assert(t, raft.CommitIndex() == 2, "Commit index changed", raft.CommitIndex())
+
+    // but the ones past the commit index are
+    appendEntries(2, 2, 1, []RaftEntry { entry(2, 2003) }, 2)
+    assert_eq(t, <-msger.testch, &AppendReply { 2, true, 0, 3, 0, 0, 0 }, "Bad reply to the conflict")
+    assert_eq(t, uids(), []uint64 { 1001, 1002, 2003 }, "Uncommitted entry not overwritten")
+
+    raft.Exit()
+}
+
+type snapPster struct {
+    DummyPster
+    snaps map[[2]uint64][]byte
+}
+
+func (self *snapPster) SaveSnapshot(term, idx uint64, data []byte) bool {
+    self.snaps[[2]uint64 { term, idx }] = data
+    return true
+}
+func (self *snapPster) LoadSnapshot(term, idx uint64) ([]byte, bool) {
+    data, ok := self.snaps[[2]uint64 { term, idx }]
+    return data, ok
+}
+func (self *snapPster) DropSnapshot(term, idx uint64) bool {
+    delete(self.snaps, [2]uint64 { term, idx })
+    return true
+}
+
+type restoreMachn struct {
+    DummyMachn
+    restored string
+}
+
+func (self *restoreMachn) RestoreSnapshot(idx uint64, data []byte) error {
+    self.restored = string(data)
+    return nil
+}
+
+func TestRestore(t *testing.T) { // {{{1
+    msger := &DummyMsger{ nil, make(chan interface{}), make(map[uint64]int), false }
+    pster := &snapPster { DummyPster { }, make(map[[2]uint64][]byte) }
+    machn := &restoreMachn { DummyMachn { make(map[uint64]bool) }, "" }
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    raft, err := NewNodeEx(NodeConfig {
+        SelfId: 0, NodeIds: []uint32 { 0, 1, 2 }, MinNodes: 3,
+    }, msger, pster, machn, errlog)
+    if err != nil { t.Fatal(err) }
+    run := func() {
+        go raft.RunEx(func(rs RaftState) time.Duration { return 400 * time.Millisecond })
+        msger.syncWait(t)
+    }
+    run()
+
+    msger.raftch <- &AppendEntries {
+        Term: 1, LeaderId: 2, PrevLogIdx: 0, PrevLogTerm: 0,
+        Entries: []RaftEntry { { 1, &ClientEntry { 1001, nil } }, { 1, &ClientEntry { 1002, nil } },
+                               { 1, &ClientEntry { 1003, nil } } },
+        CommitIdx: 1,
+    }
+    <-msger.testch // AppendReply
+    assert(t, raft.Restore(2, 1, []byte("backup")) == ErrRunning, "Restored a running node")
+
+    raft.Exit()
+    assert(t, raft.Restore(4, 1, []byte("backup")) != nil, "Restored beyond the log")
+    assert(t, raft.Restore(2, 2, []byte("backup")) != nil, "Restored a snapshot of another term")
+    if err := raft.Restore(2, 1, []byte("backup")); err != nil { t.Fatal("Restore failed", err) }
+    assert(t, len(pster.log) == 4, "Log truncated after the snapshot", pster.log)
+    data, ok := pster.LoadSnapshot(1, 2)
+    assert(t, ok && string(data) == "backup", "Snapshot not saved", pster.snaps)
+    assert(t, machn.restored == "backup", "Snapshot not loaded into the machine")
+    assert(t, raft.CommitIndex() == 2 && raft.LastApplied() == 2, "Bad indices after restore",
+           raft.CommitIndex(), raft.LastApplied())
+
+    run() // rejoins as a follower, from the snapshot onwards
+    msger.raftch <- &AppendEntries {
+        Term: 2, LeaderId: 1, PrevLogIdx: 2, PrevLogTerm: 1,
+        Entries: []RaftEntry { { 2, &ClientEntry { 1004, nil } } },
+        CommitIdx: 3,
+    }
+    assert_eq(t, <-msger.testch, &AppendReply { 2, true, 0, 3, 0, 0, 0 }, "Bad reply after restore")
+    msger.syncWait(t)
+    assert(t, machn.hasUID(1004) && !machn.hasUID(1002), "Bad entries applied after restore")
+    raft.Exit()
+}
+
+func TestLeaderRead(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTestEx(NodeConfig {
+        SelfId: 0,
+        NodeIds: []uint32 { 0, 1, 2 },
+        NotifBuf: 0,
+        MinNodes: 3,
+    })
+
+    <-msger.testch // wait for timeout; VoteRequest
+    msger.raftch <- &VoteReply { 1, true, 1 } // gets majority; broadcasts heartbeats
+    <-msger.testch
+    <-msger.testch
+
+    msger.raftch <- &LeaderRead { 77, "f" } // deferred; appends a no-op
+    noop := &AppendEntries { 1, 0, 0, 0, []RaftEntry { { 1, nil } }, 0, 0 }
+    assert_eq(t, <-msger.testch, noop, "Bad no-op")
+    assert_eq(t, <-msger.testch, noop, "Bad no-op")
+    msger.raftch <- &LeaderRead { 78, "g" } // deferred; no more no-ops
+    msger.syncWait(t)
+
+    msger.raftch <- &AppendReply { 1, true, 1, 1, 0, 0, 0 } // no-op commits
+    m := <-msger.testch
+    assert_eq(t, m, &testReadReply { 77, []byte("f"), 1 }, "Bad read reply 1", m)
+    m = <-msger.testch
+    assert_eq(t, m, &testReadReply { 78, []byte("g"), 1 }, "Bad read reply 2", m)
+
+    msger.raftch <- &LeaderRead { 79, "h" } // served right away
+    m = <-msger.testch
+    assert_eq(t, m, &testReadReply { 79, []byte("h"), 1 }, "Bad read reply 3", m)
+
+    raft.Exit()
+}
+
+// Executes an entry only when the test lets it through gate
+type gatedMachn struct {
+    DummyMachn
+    gate chan struct{}
+}
+
+func (self *gatedMachn) Execute(entries []ClientEntry) { <-self.gate }
+func (self *gatedMachn) TryRespond(uid uint64) bool    { return false }
+
+func TestLeaderReadAsyncApply(t *testing.T) { // {{{1
+    msger := &DummyMsger{ nil, make(chan interface{}), make(map[uint64]int), false }
+    machn := &gatedMachn { DummyMachn { make(map[uint64]bool) }, make(chan struct{}) }
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    cfg := NodeConfig { SelfId: 0, NodeIds: []uint32 { 0, 1, 2 }, MinNodes: 3, AsyncApply: true }
+    raft, err := NewNodeEx(cfg, msger, &DummyPster{}, machn, errlog)
+    if err != nil { t.Fatal(err) }
+    go raft.RunEx(func(rs RaftState) time.Duration {
+        return time.Duration(400) * time.Millisecond
+    })
+
+    // a write acknowledged by the leader of term 1, which this node has yet
+    // to apply when it becomes the leader of term 2
+    entry := RaftEntry { 1, &ClientEntry { 1001, []byte("write") } }
+    msger.raftch <- &AppendEntries { 1, 1, 0, 0, []RaftEntry { entry }, 1, 0 }
+    assert_eq(t, <-msger.testch, &AppendReply { 1, true, 0, 1, 0, 0, 0 }, "Bad append")
+    m := <-msger.testch // wait for timeout
+    assert_eq(t, m, &VoteRequest { 2, 0, 1, 1, 0 }, "Bad votereq", m)
+    msger.raftch <- &VoteReply { 2, true, 1 } // gets majority; broadcasts heartbeats
+    <-msger.testch
+    <-msger.testch
+
+    msger.raftch <- &LeaderRead { 77, "f" } // deferred; appends a no-op
+    <-msger.testch
+    <-msger.testch
+    msger.raftch <- &AppendReply { 2, true, 1, 2, 0, 0, 0 } // no-op commits
+    msger.raftch <- &LeaderRead { 78, "g" } // deferred too; 1001 is not applied
+    select {
+    case m := <-msger.testch:
+        t.Fatal("Read served before the old leader's write was applied", m)
+    case <-time.After(100 * time.Millisecond):
+    }
+    assert(t, raft.CommitIndex() == 2 && raft.LastApplied() == 0, "Bad indices",
+           raft.CommitIndex(), raft.LastApplied())
+
+    machn.gate <- struct{}{} // 1001 (the no-op is not passed to Execute)
+    m = <-msger.testch
+    assert_eq(t, m, &testReadReply { 77, []byte("f"), 2 }, "Bad read reply 1", m)
+    m = <-msger.testch
+    assert_eq(t, m, &testReadReply { 78, []byte("g"), 2 }, "Bad read reply 2", m)
+
+    raft.Exit()
+}
+
+type latencyMsger struct {
+    NopMessenger
+    latency map[uint32]time.Duration
+}
+
+func (self *latencyMsger) Latency(node uint32) time.Duration { return self.latency[node] }
+
+func TestScaleTimeout(t *testing.T) { // {{{1
+    msger := &latencyMsger { latency: map[uint32]time.Duration { 1: 40 * time.Millisecond } }
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    cfg := NodeConfig { SelfId: 0, NodeIds: []uint32 { 0, 1, 2 }, MinNodes: 3 }
+    raft, err := NewNodeEx(cfg, msger, &DummyPster{}, &DummyMachn{}, errlog)
+    if err != nil { t.Fatal(err) }
+    base := 50 * time.Millisecond
+
+    assert(t, raft.scaleTimeout(base) == base, "Scaled without a multiplier")
+    raft.cfg.LatencyMultiplier = 2
+    assert(t, raft.scaleTimeout(base) == 80 * time.Millisecond, "Not scaled to latency")
+    msger.latency[1] = 10 * time.Millisecond
+    assert(t, raft.scaleTimeout(base) == base, "Scaled below timeoutBase")
+    msger.latency[1] = NoLatencyEstimate
+    assert(t, raft.scaleTimeout(base) == base, "Scaled without an estimate")
+}
+
+func TestSeededTimeouts(t *testing.T) { // {{{1
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    newNode := func(id uint32, rng *rand.Rand) *RaftNode {
+        cfg := NodeConfig { SelfId: id, NodeIds: []uint32 { 0, 1, 2 }, MinNodes: 3, Rand: rng }
+        raft, err := NewNodeEx(cfg, &DummyMsger{}, &DummyPster{}, &DummyMachn{}, errlog)
+        if err != nil { t.Fatal(err) }
+        return raft
+    }
+    sample := func(raft *RaftNode) []time.Duration {
+        var tos []time.Duration
+        for i := 0; i < 16; i += 1 {
+            tos = append(tos, raft.sampleTimeout(50 * time.Millisecond, RaftState(i % 2)))
+        }
+        return tos
+    }
+    seq0 := sample(newNode(0, rand.New(rand.NewSource(42))))
+    seq1 := sample(newNode(1, rand.New(rand.NewSource(42))))
+    assert_eq(t, seq0, seq1, "Same seed, different timeouts", seq0, seq1)
+    seq2 := sample(newNode(2, rand.New(rand.NewSource(43))))
+    assert(t, !reflect.DeepEqual(seq0, seq2), "Different seeds, same timeouts", seq0)
+    seq3, seq4 := sample(newNode(0, nil)), sample(newNode(1, nil))
+    assert(t, !reflect.DeepEqual(seq3, seq4), "Unseeded nodes drew the same timeouts", seq3)
+}
+
+func TestOversleptTimeout(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTest()
+
+    msger.raftch <- &AppendEntries { 1, 1, 0, 0, nil, 0, 0 }
+    assert_eq(t, <-msger.testch, &AppendReply { 1, true, 0, 0, 0, 0, 0 }, "Bad append")
+    // "pause" the loop until the timeout is a whole timeout overdue
+    msger.raftch <- &testEcho{}
+    time.Sleep(1000 * time.Millisecond)
+    assert_eq(t, <-msger.testch, &testEcho{}, "Bad echo!")
+    // the leader gets its heartbeat in before the next timeout
+    msger.raftch <- &AppendEntries { 1, 1, 0, 0, nil, 0, 0 }
+    m := <-msger.testch
+    assert_eq(t, m, &AppendReply { 1, true, 0, 0, 0, 0, 0 }, "Election after a pause", m)
+    assert(t, raft.Term() == 1, "Term inflated after a pause", raft.Term())
+
+    // a timeout on time is not excused
+    m = <-msger.testch
+    assert_eq(t, m, &VoteRequest { 2, 0, 0, 0, 0 }, "Bad votereq", m)
+    raft.Exit()
+}
+
+// Reports the time of every message sent to node
+type timedMsger struct {
+    DummyMsger
+    node uint32
+    sent chan time.Time
+}
+
+func (self *timedMsger) Send(node uint32, msg Message) {
+    if node == self.node {
+        self.sent <- time.Now()
+    }
+}
+
+func TestReplicationBackoff(t *testing.T) { // {{{1
+    msger := &timedMsger { DummyMsger { nil, make(chan interface{}), nil, false }, 2, make(chan time.Time, 256) }
+    cfg := NodeConfig {
+        SelfId: 0,
+        NodeIds: []uint32 { 0, 1, 2 },
+        MinNodes: 3,
+        ReplicationFailureThreshold: 2,
+        MaxReplicationBackoff: 80 * time.Millisecond,
+    }
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    raft, err := NewNodeEx(cfg, msger, &DummyPster { }, &DummyMachn { make(map[uint64]bool) }, errlog)
+    if err != nil { t.Fatal(err) }
+    const interval = 5 * time.Millisecond
+    go raft.RunEx(func(rs RaftState) time.Duration {
+        switch rs {
+        case Follower: return 2 * interval
+        case Leader: return interval
+        }
+        return time.Hour
+    })
+    defer raft.Exit()
+
+    <-msger.testch // wait for timeout; VoteRequest
+    msger.raftch <- &VoteReply { 1, true, 1 } // gets majority; no one replies
+    time.Sleep(400 * time.Millisecond)
+    var sent []time.Time
+    for len(msger.sent) > 0 {
+        sent = append(sent, <-msger.sent)
+    }
+    // doubled from the 2nd failure on (starting at twice the interval)
+    delays := []time.Duration { 5, 10, 20, 40, 80, 80, 80 }
+    assert(t, len(sent) > len(delays), "Too few heartbeats", len(sent))
+    for i, delay := range delays {
+        delay *= time.Millisecond
+        gap := sent[i + 1].Sub(sent[i])
+        assert(t, gap >= delay && gap < 2 * delay + interval, "Bad heartbeat interval", i, gap, delay)
+    }
+
+    msger.raftch <- &AppendReply { 1, true, 2, 0, 0, 0, 0 } // back to every interval
+    for len(msger.sent) > 0 {
+        <-msger.sent
+    }
+    t0 := <-msger.sent
+    t1 := <-msger.sent
+    assert(t, t1.Sub(t0) < 4 * interval, "Backoff not reset by a reply", t1.Sub(t0))
+}
+
+type fsyncPster struct {
+    DummyPster
+    fsyncs int
+}
+
+func (self *fsyncPster) Fsync() error { self.fsyncs += 1; return nil }
+
+func TestSyncOptions(t *testing.T) { // {{{1
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    entries := []RaftEntry { RaftEntry { 1, &ClientEntry { 1234, nil } } }
+    for _, cfg := range []NodeConfig {
+        { SyncOnVote: false, SyncBeforeReply: false },
+        { SyncOnVote: true, SyncBeforeReply: false },
+        { SyncOnVote: false, SyncBeforeReply: true },
+    } {
+        pster := &fsyncPster { }
+        cfg.SelfId, cfg.NodeIds, cfg.MinNodes = 0, []uint32 { 0, 1, 2 }, 3
+        raft, err := NewNodeEx(cfg, &NopMessenger { }, pster, &DummyMachn { }, errlog)
+        if err != nil { t.Fatal(err) }
+
+        raft.setTermAndVote(1, 2)
+        want := 0
+        if cfg.SyncOnVote { want = 1 }
+        assert(t, pster.fsyncs == want, "Bad fsyncs on vote", cfg, pster.fsyncs)
+
+        raft.logUpdate(1, entries)
+        if cfg.SyncBeforeReply { want += 1 }
+        assert(t, pster.fsyncs == want, "Bad fsyncs on log update", cfg, pster.fsyncs)
+
+        go raft.RunEx(func(RaftState) time.Duration { return time.Hour })
+        raft.Exit()
+        want += 1
+        assert(t, pster.fsyncs == want, "Not synced on exit", cfg, pster.fsyncs)
+        _, err = NewNodeEx(cfg, &NopMessenger { }, pster, &DummyMachn { }, errlog)
+        if err != nil { t.Fatal(err) }
+        slice, _ := pster.LogSlice(1, 2)
+        assert_eq(t, slice, entries, "Entries lost after exit", cfg, slice)
+    }
+}
+
+// Sizes each entry by the length of its (string) data
+type sizedPster struct {
+    DummyPster
+}
+
+func (self *sizedPster) EntrySize(idx uint64) uint64 {
+    if idx >= uint64(len(self.log)) || self.log[idx].CEntry == nil {
+        return 0
+    }
+    data, _ := self.log[idx].CEntry.Data.(string)
+    return uint64(len(data))
+}
+
+func TestLogStats(t *testing.T) { // {{{1
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    cfg := NodeConfig { SelfId: 0, NodeIds: []uint32 { 0, 1, 2 }, MinNodes: 3 }
+    pster := &sizedPster { }
+    raft, err := NewNodeEx(cfg, &NopMessenger { }, pster, &DummyMachn { }, errlog)
+    if err != nil { t.Fatal(err) }
+    go raft.RunEx(func(RaftState) time.Duration { return time.Hour })
+    assert_eq(t, raft.LogStats(), LogStatistics { }, "Bad stats of an empty log")
+
+    raft.Exit()
+    raft.setTermAndVote(1, 0)
+    raft.logUpdate(1, []RaftEntry {
+        { 1, &ClientEntry { 1231, "a" } }, { 1, &ClientEntry { 1232, "bbbbb" } }, { 1, &ClientEntry { 1233, "ccc" } },
+    })
+    go raft.RunEx(func(RaftState) time.Duration { return time.Hour })
+    s := raft.LogStats()
+    assert_eq(t, s, LogStatistics { 3, 9, 5, 3, 1 }, "Bad stats", s)
+    raft.Exit()
+}
+
+func BenchmarkLogStats(b *testing.B) {
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    cfg := NodeConfig { SelfId: 0, NodeIds: []uint32 { 0, 1, 2 }, MinNodes: 3 }
+    pster := &sizedPster { }
+    entries := make([]RaftEntry, 1000000)
+    for i := range entries {
+        entries[i] = RaftEntry { 1, &ClientEntry { uint64(i + 1), "Yo!" } }
+    }
+    pster.LogUpdate(0, append([]RaftEntry { { 0, nil } }, entries...))
+    raft, err := NewNodeEx(cfg, &NopMessenger { }, pster, &DummyMachn { }, errlog)
+    if err != nil { b.Fatal(err) }
+    b.ResetTimer()
+    for i := 0; i < b.N; i += 1 {
+        raft.logStats()
+    }
+}
+
+// Backs up the log as JSON
+type backupPster struct {
+    DummyPster
+}
+
+func (self *backupPster) Snapshot() ([]byte, error) {
+    return json.Marshal(self.log)
+}
+
+func TestBackupLog(t *testing.T) { // {{{1
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    cfg := NodeConfig { SelfId: 0, NodeIds: []uint32 { 0, 1, 2 }, MinNodes: 3 }
+    raft, err := NewNodeEx(cfg, &NopMessenger { }, &DummyPster { }, &DummyMachn { }, errlog)
+    if err != nil { t.Fatal(err) }
+    go raft.RunEx(func(RaftState) time.Duration { return time.Hour })
+    var buf bytes.Buffer
+    assert(t, raft.BackupLog(context.Background(), &buf) != nil, "Backed up without a BackupPersister")
+    raft.Exit()
+
+    pster := &backupPster { }
+    raft, err = NewNodeEx(cfg, &NopMessenger { }, pster, &DummyMachn { }, errlog)
+    if err != nil { t.Fatal(err) }
+    raft.setTermAndVote(1, 0)
+    raft.logUpdate(1, []RaftEntry { { 1, &ClientEntry { 1231, "a" } } })
+    go raft.RunEx(func(RaftState) time.Duration { return time.Hour })
+    err = raft.BackupLog(context.Background(), &buf)
+    assert(t, err == nil, "Backup failed", err)
+    var log []RaftEntry
+    assert(t, json.Unmarshal(buf.Bytes(), &log) == nil && len(log) == 2, "Bad backup", buf.String())
+    raft.Exit()
+}
+
+type invalidMachn struct {
+    DummyMachn
+}
+
+func (self *invalidMachn) Validate() error { return errors.New("bad state") }
+
+func TestPreflightCheck(t *testing.T) { // {{{1
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    cfg := NodeConfig { SelfId: 0, NodeIds: []uint32 { 0, 1, 2 }, MinNodes: 3 }
+    newNode := func(log []RaftEntry, machn Machine) *RaftNode {
+        raft, err := NewNodeEx(cfg, &NopMessenger { }, &DummyPster { log }, machn, errlog)
+        if err != nil { t.Fatal(err) }
+        return raft
+    }
+    log := []RaftEntry { { 0, nil }, { 1, nil }, { 2, nil } }
+
+    raft := newNode(log, &DummyMachn { })
+    raft.setTermAndVote(2, 1)
+    assert(t, raft.PreflightCheck() == nil, "Valid state rejected", raft.PreflightCheck())
+    go raft.RunEx(func(RaftState) time.Duration { return time.Hour })
+    raft.Status() // the loop is running once it answers
+    assert(t, raft.PreflightCheck() == ErrRunning, "Checked while running")
+    raft.Exit()
+
+    raft.setTermAndVote(2, 9)
+    assert(t, raft.PreflightCheck() != nil, "Vote for an unknown node accepted")
+    raft.setTermAndVote(1, 1)
+    assert(t, raft.PreflightCheck() != nil, "Log term beyond the term accepted")
+
+    raft = newNode([]RaftEntry { { 0, nil }, { 2, nil }, { 1, nil } }, &DummyMachn { })
+    raft.setTermAndVote(2, 1)
+    assert(t, raft.PreflightCheck() != nil, "Decreasing log terms accepted")
+
+    raft = newNode(log, &invalidMachn { })
+    raft.setTermAndVote(2, 1)
+    err := raft.PreflightCheck()
+    assert(t, err != nil && strings.Contains(err.Error(), "bad state"), "Machine not validated", err)
+}
+
+// Fails the next fails writes
+type flakyPster struct {
+    DummyPster
+    fails int
+    fields *RaftFields
+}
+
+func (self *flakyPster) fail() bool {
+    if self.fails > 0 {
+        self.fails -= 1
+        return true
+    }
+    return false
+}
+func (self *flakyPster) GetFields() *RaftFields { return self.fields }
+func (self *flakyPster) SetFields(f RaftFields) bool {
+    if self.fail() { return false }
+    self.fields = &f
+    return true
+}
+func (self *flakyPster) LogUpdate(startIdx uint64, slice []RaftEntry) bool {
+    return !self.fail() && self.DummyPster.LogUpdate(startIdx, slice)
+}
+
+func TestPersistRetries(t *testing.T) { // {{{1
+    var errbuf bytes.Buffer
+    pster := &flakyPster { }
+    cfg := NodeConfig { SelfId: 0, NodeIds: []uint32 { 0, 1, 2 }, MinNodes: 3, PersistRetries: 2 }
+    raft, err := NewNodeEx(cfg, &NopMessenger { }, pster, &DummyMachn { }, golog.New(&errbuf, "", 0))
+    if err != nil { t.Fatal(err) }
+
+    pster.fails = 2
+    raft.setTermAndVote(1, 2)
+    assert_eq(t, pster.GetFields(), &RaftFields { 1, 2, true }, "Fields not persisted", pster.GetFields())
+    pster.fails = 2
+    entries := []RaftEntry { RaftEntry { 1, &ClientEntry { 1234, nil } } }
+    raft.logUpdate(1, entries)
+    slice, _ := pster.LogSlice(1, 2)
+    assert_eq(t, slice, entries, "Log not updated", slice)
+    assert(t, strings.Count(errbuf.String(), "retrying") == 4, "Retries not logged", errbuf.String())
+
+    pster.fails = 3
+    func() {
+        defer func() {
+            assert(t, recover() != nil, "Not halted after the retries")
+        }()
+        raft.setTermAndVote(2, 0)
+    }()
+}
+
+func TestNewNodeErrors(t *testing.T) { // {{{1
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    cases := []struct {
+        cfg NodeConfig
+        pster Persister
+        err error
+    } {
+        { NodeConfig { SelfId: 0, NodeIds: []uint32 { 0, 1 }, MinNodes: 3 }, &DummyPster { }, ErrTooFewNodes },
+        { NodeConfig { SelfId: 0, NodeIds: []uint32 { }, MinNodes: 0 }, &DummyPster { }, ErrTooFewNodes },
+        { NodeConfig { SelfId: 3, NodeIds: []uint32 { 0, 1, 2 } }, &DummyPster { }, ErrSelfNotInSet },
+        { NodeConfig { SelfId: 0, NodeIds: []uint32 { 0, 1, 1 } }, &DummyPster { }, ErrDuplicateNodeId },
+        { NodeConfig { SelfId: 0, NodeIds: []uint32 { 0, 1, 2 } }, &flakyPster { fails: 1 }, ErrInitialLogUpdateFailed },
+        { NodeConfig { SelfId: 0, NodeIds: []uint32 { 0 }, GroupCommitInterval: time.Millisecond }, &DummyPster { }, ErrGroupCommitUnsupported },
+    }
+    for i, c := range cases {
+        _, err := NewNodeEx(c.cfg, &NopMessenger { }, c.pster, &DummyMachn { }, errlog)
+        assert(t, errors.Is(err, c.err), "Bad error", i, err)
+    }
+}
+
+type groupPster struct {
+    DummyPster
+    interval time.Duration // as set when the log was first written to
+}
+
+func (self *groupPster) SetGroupCommit(interval time.Duration) {
+    self.interval = interval
+}
+func (self *groupPster) LogUpdate(startIdx uint64, slice []RaftEntry) bool {
+    if self.interval == 0 { return false }
+    return self.DummyPster.LogUpdate(startIdx, slice)
+}
+
+func TestGroupCommitInterval(t *testing.T) { // {{{1
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    cfg := NodeConfig { SelfId: 0, NodeIds: []uint32 { 0 }, GroupCommitInterval: time.Millisecond }
+    pster := &groupPster { }
+    _, err := NewNodeEx(cfg, &NopMessenger { }, pster, &DummyMachn { }, errlog)
+    assert(t, err == nil, "Group commit not started before the first write", err)
+    assert_eq(t, pster.interval, time.Millisecond, "Bad group commit interval")
+}
+
+type countMachn struct {
+    DummyMachn
+    executed map[uint64]int
+}
+
+func (self *countMachn) Execute(entries []ClientEntry) {
+    for _, cEntry := range entries {
+        self.executed[cEntry.UID] += 1
+    }
+    self.DummyMachn.Execute(entries)
+}
+
+func TestPendingOverwritten(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTest()
+
+    <-msger.testch // wait for timeout; VoteRequest
+    msger.raftch <- &VoteReply { 1, true, 1 }
+    msger.raftch <- &VoteReply { 1, true, 2 } // gets majority; broadcasts heartbeats
+    for i := 0; i < 4; i += 1 { <-msger.testch }
+    msger.raftch <- &ClientEntry { 1234, nil }
+    for i := 0; i < 4; i += 1 { <-msger.testch }
+
+    msger.raftch <- &AppendEntries { 2, 1, 0, 0, []RaftEntry { { 2, nil } }, 0, 0 } // overwrites 1234
+    assert_eq(t, <-msger.testch, &AppendReply { 2, true, 0, 1, 0, 0, 0 }, "Bad append")
+    msger.syncWait(t)
+    assert(t, msger.n503[1234] == 1, "Overwritten request not answered", msger.n503)
+    assert(t, len(raft.idxOfUid) == 0, "Overwritten request still pending", raft.idxOfUid)
+
+    m := <-msger.testch // wait for timeout
+    assert_eq(t, m, &VoteRequest { 3, 0, 1, 2, 0 }, "Bad votereq", m)
+    msger.raftch <- &ClientEntry { 1234, nil } // retried while a candidate
+    msger.syncWait(t)
+    assert(t, msger.n503[1234] == 2, "Retried request not answered", msger.n503)
+}
+
+func TestBulkLoadOverwritten(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTestEx(NodeConfig {
+        SelfId: 0,
+        NodeIds: []uint32 { 0, 1, 2 },
+        NotifBuf: 0,
+        MinNodes: 3,
+    })
+
+    <-msger.testch // wait for timeout; VoteRequest
+    msger.raftch <- &VoteReply { 1, true, 1 } // gets majority; broadcasts heartbeats
+    <-msger.testch
+    <-msger.testch
+
+    loaded := make(chan error, 1)
+    go func() {
+        ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+        defer cancel()
+        loaded <- raft.BulkLoad(ctx, []ClientEntry { { 1001, nil }, { 1002, nil } })
+    }()
+    <-msger.testch
+    <-msger.testch
+    select {
+    case err := <-loaded:
+        t.Fatal("Bulk load returned before it was committed", err)
+    case <-time.After(50 * time.Millisecond):
+    }
+
+    msger.raftch <- &AppendEntries { 2, 1, 0, 0, []RaftEntry { { 2, nil } }, 0, 0 } // overwrites the load
+    assert_eq(t, <-msger.testch, &AppendReply { 2, true, 0, 1, 0, 0, 0 }, "Bad append")
+    assert(t, <-loaded == ErrNotLeader, "Dropped bulk load not reported")
+    msger.syncWait(t)
+    assert(t, !raft.hasClientEntries(), "Overwritten client entries still tracked", raft.firstClientIdx)
+    raft.Exit()
+}
+
+// A DummyPster that stores the commit index too
+type commitPster struct {
+    DummyPster
+    commitIdx uint64
+}
+
+func (self *commitPster) GetCommitIdx() uint64 { return self.commitIdx }
+func (self *commitPster) SetCommitIdx(idx uint64) bool { self.commitIdx = idx; return true }
+
+func TestReplayWhileRunning(t *testing.T) { // {{{1
+    raft, msger, _, _ := initTest()
+
+    entries := []RaftEntry {
+        RaftEntry { 1, &ClientEntry { 1001, nil } },
+        RaftEntry { 1, &ClientEntry { 1002, nil } },
+        RaftEntry { 1, &ClientEntry { 1003, nil } },
+    }
+    msger.raftch <- &AppendEntries { 1, 1, 0, 0, entries, 3, 0 }
+    assert_eq(t, <-msger.testch, &AppendReply { 1, true, 0, 3, 0, 0, 0 }, "Bad append")
+
+    // the loop keeps writing to the (unsynchronized) DummyPster meanwhile
+    replayed := make(chan []uint64, 1)
+    go func() {
+        var uids []uint64
+        err := raft.Replay(3, func(e ClientEntry) error {
+            uids = append(uids, e.UID)
+            return nil
+        })
+        if err != nil { t.Error("Replay failed", err) }
+        replayed <- uids
+    }()
+    for idx := uint64(4); idx < 4 + 2 * replayChunk; idx += 1 {
+        entry := RaftEntry { 1, &ClientEntry { 1000 + idx, nil } }
+        msger.raftch <- &AppendEntries { 1, 1, idx - 1, 1, []RaftEntry { entry }, 3, 0 }
+        assert_eq(t, <-msger.testch, &AppendReply { 1, true, 0, idx, 0, 0, 0 }, "Bad append", idx)
+    }
+    assert_eq(t, <-replayed, []uint64 { 1001, 1002, 1003 }, "Bad replay")
+    raft.Exit()
+}
+
+func TestApplyEntries(t *testing.T) { // {{{1
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    log := []RaftEntry {
+        RaftEntry { 0, nil },
+        RaftEntry { 1, &ClientEntry { 1001, nil } },
+        RaftEntry { 1, &ClientEntry { 0, &BatchClientEntry { []ClientEntry { { 1002, nil }, { 1003, nil } } } } },
+        RaftEntry { 2, nil },
+        RaftEntry { 2, &ClientEntry { 1004, nil } },
+    }
+    newNode := func(commitIdx uint64) (*RaftNode, *countMachn, error) {
+        machn := &countMachn { DummyMachn { make(map[uint64]bool) }, make(map[uint64]int) }
+        cfg := NodeConfig { SelfId: 0, NodeIds: []uint32 { 0, 1, 2 }, MinNodes: 3 }
+        pster := &commitPster { DummyPster { append([]RaftEntry(nil), log...) }, commitIdx }
+        raft, err := NewNodeEx(cfg, &NopMessenger { }, pster, machn, errlog)
+        return raft, machn, err
+    }
+
+    raft, machn, err := newNode(0)
+    if err != nil { t.Fatal(err) }
+    assert(t, len(machn.executed) == 0, "Executed without a commit index", machn.executed)
+    assert(t, raft.ApplyEntries(log[1:3]) != nil, "Applied entries not known to be committed")
+    raft.commitIdx = 4 // as if committed before an Exit with AsyncApply
+    assert(t, raft.ApplyEntries(log[3:]) != nil, "Applied entries after a gap")
+    assert(t, raft.ApplyEntries([]RaftEntry { { 3, nil } }) != nil, "Applied entries not in the log")
+    waited := make(chan error, 1)
+    go func() {
+        ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+        defer cancel()
+        waited <- raft.ReadBarrier(ctx, 2)
+    }()
+    time.Sleep(10 * time.Millisecond) // let it block
+    assert(t, raft.ApplyEntries(log[1:3]) == nil, "ApplyEntries failed")
+    select {
+    case err := <-waited:
+        assert(t, err == nil, "ReadBarrier failed", err)
+    case <-time.After(time.Second):
+        t.Fatal("ReadBarrier not woken up by ApplyEntries")
+    }
+    assert_eq(t, machn.executed, map[uint64]int { 1001: 1, 1002: 1, 1003: 1 }, "Bad execution", machn.executed)
+    assert(t, raft.LastApplied() == 2, "Bad LastApplied", raft.LastApplied())
+
+    machn.uidSet[1004] = true // already executed before the crash
+    assert(t, raft.ApplyEntries(log[3:]) == nil, "ApplyEntries failed")
+    assert(t, machn.executed[1004] == 0, "Executed 1004 again", machn.executed)
+    assert(t, raft.LastApplied() == 4, "Bad LastApplied", raft.LastApplied())
+
+    raft, machn, err = newNode(2) // replayed by NewNodeEx
+    if err != nil { t.Fatal(err) }
+    assert_eq(t, machn.executed, map[uint64]int { 1001: 1, 1002: 1, 1003: 1 }, "Bad replay", machn.executed)
+    assert(t, raft.LastApplied() == 2 && raft.CommitIndex() == 2, "Bad indices after replay", raft.LastApplied())
+    raft.setCommitIdx(4)
+    assert(t, raft.pster.(*commitPster).commitIdx == 4, "Commit index not persisted")
+
+    raft, machn, err = newNode(9) // the log lost its tail in a crash
+    if err != nil { t.Fatal(err) }
+    assert(t, raft.LastApplied() == 4 && raft.CommitIndex() == 4, "Bad indices after replay", raft.LastApplied())
+}
+
+// Labels commands by their (string) data; "slow" ones take 20ms
+type labeledMachn struct {
+    DummyMachn
+}
+
+func (self *labeledMachn) Label(cEntry ClientEntry) string {
+    label, _ := cEntry.Data.(string)
+    return label
+}
+func (self *labeledMachn) Execute(entries []ClientEntry) {
+    if self.Label(entries[0]) == "slow" {
+        time.Sleep(20 * time.Millisecond)
+    }
+    self.DummyMachn.Execute(entries)
+}
+
+func TestApplyObserver(t *testing.T) { // {{{1
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    hist := NewApplyHistogram(10 * time.Millisecond, time.Second)
+    cfg := NodeConfig { SelfId: 0, NodeIds: []uint32 { 0 }, MinNodes: 1, ApplyObserver: hist, AssignUIDs: true }
+    raft, err := NewNodeEx(cfg, &NopMessenger { }, &DummyPster { }, &labeledMachn { DummyMachn { make(map[uint64]bool) } }, errlog)
+    if err != nil { t.Fatal(err) }
+    go raft.RunEx(func(RaftState) time.Duration { return time.Hour })
+    defer raft.Exit()
+
+    for _, label := range []string { "fast", "slow", "fast", "slow" } {
+        _, idx, err := raft.Propose(label)
+        assert(t, err == nil, "Propose failed", err)
+        ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+        err = raft.ReadBarrier(ctx, idx) // one at a time, so that none waits behind another
+        cancel()
+        assert(t, err == nil, "Not applied", err)
+    }
+    assert_eq(t, hist.Counts("fast"), []uint64 { 2, 0, 0 }, "Bad fast counts", hist.Counts("fast"))
+    assert_eq(t, hist.Counts("slow"), []uint64 { 0, 2, 0 }, "Bad slow counts", hist.Counts("slow"))
+    assert_eq(t, hist.Counts("none"), []uint64 { 0, 0, 0 }, "Counts of an unseen label")
+}
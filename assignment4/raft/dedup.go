@@ -0,0 +1,39 @@
+package raft
+
+// A leader numbers its AppendEntries (see AppendEntries.ReqID), so that a
+// follower can answer a retransmitted one with the reply it sent before,
+// instead of processing it again. Since a restarted node has to win a new term
+// to lead again, numbers are only compared within a term.
+
+// The last AppendEntries processed from a leader, and the reply to it
+type appendSeen struct {
+    term uint64
+    reqId uint64
+    reply *AppendReply
+}
+
+func (self *RaftNode) nextReqId() uint64 {
+    self.lastReqId += 1
+    return self.lastReqId
+}
+
+// The reply to msg if it was already processed (or is older than one that
+// was), or else nil
+func (self *RaftNode) seenAppend(msg *AppendEntries) *AppendReply {
+    seen, ok := self.appendSeen[msg.LeaderId]
+    if msg.ReqID == 0 || !ok || seen.term != msg.Term || msg.ReqID > seen.reqId {
+        return nil
+    }
+    return seen.reply
+}
+
+// Send the reply to msg, and remember it for seenAppend
+func (self *RaftNode) replyAppend(msg *AppendEntries, reply *AppendReply) {
+    if msg.ReqID != 0 {
+        if self.appendSeen == nil {
+            self.appendSeen = make(map[uint32]appendSeen)
+        }
+        self.appendSeen[msg.LeaderId] = appendSeen { msg.Term, msg.ReqID, reply }
+    }
+    self.msger.Send(msg.LeaderId, reply)
+}
@@ -0,0 +1,255 @@
+package raft
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    golog "log"
+)
+
+// Number of entries at the end of the log included in a state dump
+const dumpTailLen = 8
+
+type stateDump struct {
+    Id uint32
+    Term uint64
+    VotedFor uint32
+    HasVoted bool
+    State string
+    CommitIdx uint64
+    LastApplied uint64
+    LastLogIdx uint64
+    LogEntryCount uint64
+    LogTail []entryDump
+    NextIdx map[uint32]uint64 `json:",omitempty"`
+    MatchIdx map[uint32]uint64 `json:",omitempty"`
+    IdxOfUid map[uint64]uint64 `json:",omitempty"`
+}
+
+type entryDump struct {
+    Idx uint64
+    Term uint64
+    UID uint64 `json:",omitempty"`
+    Data string `json:",omitempty"` // only the type; payloads may be huge
+}
+
+func (self RaftState) String() string {
+    switch self {
+    case Follower:
+        return "Follower"
+    case Candidate:
+        return "Candidate"
+    case Leader:
+        return "Leader"
+    }
+    return fmt.Sprintf("RaftState(%d)", int(self))
+}
+
+type NodeStatus struct {
+    State RaftState
+    Term uint64
+    CommitIdx uint64
+    LastApplied uint64
+    LastLogIdx uint64
+    LogEntryCount uint64 // entries since the latest snapshot (see MaxLogEntries)
+    // leader: number of entries each peer is known to be missing (the last
+    // log index minus its matchIdx); nil otherwise
+    ReplicationLag map[uint32]uint64
+}
+
+// A summary of the state of the node, read from within the event loop
+func (self *RaftNode) Status() NodeStatus { // {{{1
+    reply := make(chan NodeStatus, 1)
+    self.notifch <- &nodeStatus { reply }
+    return <-reply
+}
+
+// Status().ReplicationLag, for monitoring followers that fall behind
+func (self *RaftNode) ReplicationLag() map[uint32]uint64 {
+    return self.Status().ReplicationLag
+}
+
+func (self *RaftNode) status() NodeStatus {
+    lastIdx, _ := self.logTail()
+    s := NodeStatus {
+        State: self.state,
+        Term: self.term,
+        CommitIdx: self.commitIdx,
+        LastApplied: self.lastAppld,
+        LastLogIdx: lastIdx,
+        LogEntryCount: self.logEntryCount(),
+    }
+    if self.state == Leader {
+        s.ReplicationLag = make(map[uint32]uint64)
+        for nodeId, idx := range self.matchIdx {
+            s.ReplicationLag[nodeId] = lastIdx - idx
+        }
+    }
+    return s
+}
+
+func (self *RaftNode) logEntryCount() uint64 {
+    lastIdx, _ := self.logTail()
+    if lastIdx < self.lastSnapIdx {
+        return 0
+    }
+    return lastIdx - self.lastSnapIdx
+}
+
+// Write the state of the node as JSON to w, for diagnostics. The state is
+// read from within the event loop, so this blocks until the loop gets to it.
+// It is encoded outside the loop, so that a slow w does not hold it up.
+func (self *RaftNode) DumpState(w io.Writer) error { // {{{1
+    reply := make(chan *stateDump, 1)
+    self.notifch <- &dumpState { reply }
+    return json.NewEncoder(w).Encode(<-reply)
+}
+
+// A copy of the state of a node (see RaftNode.Inspect); maps and slices are
+// copies too, so they may be kept and modified by the caller
+type RaftNodeSnapshot struct {
+    Id uint32
+    PeerIds []uint32
+    Config NodeConfig
+    Term uint64
+    VotedFor uint32 // only if HasVoted
+    HasVoted bool
+    State RaftState
+    CommitIdx uint64
+    LastApplied uint64
+    VoteSet map[uint32]bool // candidate
+    NextIdx map[uint32]uint64 // leader
+    MatchIdx map[uint32]uint64 // leader
+    LeaderReady bool // leader
+    IdxOfUid map[uint64]uint64
+    LastSnapIdx uint64
+    MaxLogEntries uint64
+    Log []RaftEntry // Log[idx] is the entry at idx (ClientEntry.Data is shared)
+}
+
+// Call fn with a copy of the state of the node, including the whole log. fn
+// is called from within the event loop, so it must not block (nor call other
+// methods of the node); Inspect returns once fn does.
+func (self *RaftNode) Inspect(fn func(s *RaftNodeSnapshot)) { // {{{1
+    done := make(chan struct{})
+    self.notifch <- &inspectState { fn, done }
+    <-done
+}
+
+func (self *RaftNode) inspect() *RaftNodeSnapshot {
+    s := &RaftNodeSnapshot {
+        Id: self.id,
+        PeerIds: append([]uint32(nil), self.peerIds...),
+        Config: self.cfg,
+        Term: self.term,
+        VotedFor: self.votedFor,
+        HasVoted: self.hasVoted,
+        State: self.state,
+        CommitIdx: self.commitIdx,
+        LastApplied: self.lastAppld,
+        LeaderReady: self.leaderReady,
+        LastSnapIdx: self.lastSnapIdx,
+        MaxLogEntries: self.maxLogEntries,
+    }
+    s.Config.NodeIds = append([]uint32(nil), self.cfg.NodeIds...)
+    s.Config.Witnesses = append([]uint32(nil), self.cfg.Witnesses...)
+    if self.voteSet != nil {
+        s.VoteSet = make(map[uint32]bool)
+        for nodeId, v := range self.voteSet { s.VoteSet[nodeId] = v }
+    }
+    if self.nextIdx != nil {
+        s.NextIdx, s.MatchIdx = make(map[uint32]uint64), make(map[uint32]uint64)
+        for nodeId, idx := range self.nextIdx { s.NextIdx[nodeId] = idx }
+        for nodeId, idx := range self.matchIdx { s.MatchIdx[nodeId] = idx }
+    }
+    if self.idxOfUid != nil {
+        s.IdxOfUid = make(map[uint64]uint64)
+        for uid, idx := range self.idxOfUid { s.IdxOfUid[uid] = idx }
+    }
+    lastIdx, _ := self.logTail()
+    entries, _ := self.pster.LogSlice(0, lastIdx + 1)
+    s.Log = make([]RaftEntry, len(entries))
+    for i, entry := range entries {
+        s.Log[i] = entry
+        if entry.CEntry != nil {
+            cEntry := *entry.CEntry
+            s.Log[i].CEntry = &cEntry
+        }
+    }
+    return s
+}
+
+func (self *RaftNode) dumpState(w io.Writer) error {
+    return json.NewEncoder(w).Encode(self.dump())
+}
+
+// The maps are copied, so the dump may be encoded outside the loop
+func (self *RaftNode) dump() *stateDump {
+    lastIdx, lastEntry := self.logTail()
+    dump := &stateDump {
+        Id: self.id,
+        Term: self.term,
+        VotedFor: self.votedFor,
+        HasVoted: self.hasVoted,
+        State: self.state.String(),
+        CommitIdx: self.commitIdx,
+        LastApplied: self.lastAppld,
+        LastLogIdx: lastIdx,
+        LogEntryCount: self.logEntryCount(),
+    }
+    if self.nextIdx != nil {
+        dump.NextIdx, dump.MatchIdx = make(map[uint32]uint64), make(map[uint32]uint64)
+        for nodeId, idx := range self.nextIdx { dump.NextIdx[nodeId] = idx }
+        for nodeId, idx := range self.matchIdx { dump.MatchIdx[nodeId] = idx }
+    }
+    if self.idxOfUid != nil {
+        dump.IdxOfUid = make(map[uint64]uint64)
+        for uid, idx := range self.idxOfUid { dump.IdxOfUid[uid] = idx }
+    }
+    if lastEntry != nil {
+        var startIdx uint64 = 0
+        if lastIdx >= dumpTailLen {
+            startIdx = lastIdx - dumpTailLen + 1
+        }
+        for idx := startIdx; idx <= lastIdx; idx += 1 {
+            entry := self.log(idx)
+            if entry == nil { continue } // may have been compacted
+            ed := entryDump { Idx: idx, Term: entry.Term }
+            if entry.CEntry != nil {
+                ed.UID, ed.Data = entry.CEntry.UID, fmt.Sprintf("%T", entry.CEntry.Data)
+            }
+            dump.LogTail = append(dump.LogTail, ed)
+        }
+    }
+    return dump
+}
+
+// Replace the logger given to NewNodeEx; everything the loop logs from the
+// next message on goes to errlog
+func (self *RaftNode) SetLogger(errlog *golog.Logger) { // {{{1
+    done := make(chan struct{})
+    self.notifch <- &setLogger { errlog, done }
+    <-done
+}
+
+// Log a violated invariant along with a dump of the state, and carry on
+func (self *RaftNode) fatal(msg string) {
+    self.err.Print("fatal: ", msg, "; ignoring!!!")
+    self.logState()
+}
+
+// Like fatal, but for an error that cannot be ignored: prefix is "fatal" for
+// one that the node cannot recover from (see PersistRetries), or "invariant
+// violated" for a violation of the safety invariants of Raft, where going on
+// may lose committed entries; dumps the state and panics
+func (self *RaftNode) halt(prefix string, msg string) {
+    self.err.Print(prefix, ": ", msg, "; halting!!!")
+    self.logState()
+    panic("raft: " + prefix + ": " + msg)
+}
+
+func (self *RaftNode) logState() {
+    if err := self.dumpState(self.err.Writer()); err != nil {
+        self.err.Print("state dump failed: ", err)
+    }
+}
@@ -0,0 +1,54 @@
+package raft
+
+// Events are emitted from the state transition points of the event loop, and
+// can be received from RaftNode.Events(). The channel is buffered, and the
+// oldest events are dropped if the receiver does not keep up.
+type RaftEvent interface {}
+
+type ElectionStarted struct {
+    Term uint64
+}
+
+type VoteGranted struct {
+    From uint32
+}
+
+type BecameLeader struct {
+    Term uint64
+}
+
+type SteppedDown struct {
+    NewTerm uint64
+}
+
+type CommitAdvanced struct {
+    Idx uint64
+}
+
+// Uncommitted entries of an older term (from a stale leader) overwritten by
+// the current leader; their requests never got a success response
+type StaleEntriesDropped struct {
+    LeaderTerm uint64 // of the current leader
+    UIDs []uint64 // of the client requests dropped
+    Count int // number of entries dropped
+}
+
+const eventBuf = 64
+
+func (self *RaftNode) Events() <-chan RaftEvent {
+    return self.events
+}
+
+func (self *RaftNode) emit(ev RaftEvent) {
+    for {
+        select {
+        case self.events <- ev:
+            return
+        default: // drop the oldest event, never stall the loop
+            select {
+            case <-self.events:
+            default:
+            }
+        }
+    }
+}
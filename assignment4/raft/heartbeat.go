@@ -0,0 +1,154 @@
+package raft
+
+import (
+    "context"
+    "sync/atomic"
+)
+
+type HeartbeatResult struct {
+    Replies int // peers that acknowledged the heartbeat
+    Peers int // peers the heartbeat was sent to
+}
+
+// A heartbeat round waiting for AppendReply-s (see RaftNode.Heartbeat)
+type heartbeatRound struct {
+    replies int32 // atomic, read from outside the loop
+    peers int32 // atomic, read from outside the loop
+    minReqId uint64 // of the first AppendEntries sent for the round
+    acked map[uint32]bool
+    quorum bool // done once a quorum (rather than every peer) replies
+    ctxDone <-chan struct{}
+    done chan error
+}
+
+func (self *heartbeatRound) result() HeartbeatResult {
+    return HeartbeatResult {
+        Replies: int(atomic.LoadInt32(&self.replies)),
+        Peers: int(atomic.LoadInt32(&self.peers)),
+    }
+}
+
+// Force a heartbeat round (rather than waiting for the timer) and block until
+// all the peers reply, or ctx is done. Only a leader can do this; ErrNotLeader
+// is returned otherwise, or if the node steps down before all the replies
+// arrive. The result is valid (possibly partial) even if an error is returned.
+//
+// Only replies to AppendEntries sent after the round starts count (see
+// AppendReply.ReqID), so a reply already in flight cannot ack the round.
+func (self *RaftNode) Heartbeat(ctx context.Context) (HeartbeatResult, error) { // {{{1
+    round := &heartbeatRound {
+        acked: make(map[uint32]bool),
+        ctxDone: ctx.Done(),
+        done: make(chan error, 1),
+    }
+    select {
+    case self.notifch <- &heartbeat { round }:
+    case <-ctx.Done():
+        return round.result(), ctx.Err()
+    }
+    select {
+    case err := <-round.done:
+        return round.result(), err
+    case <-ctx.Done():
+        return round.result(), ctx.Err()
+    }
+}
+
+// Confirm that this node is still the leader, by a heartbeat round that a
+// quorum of the nodes reply to (with an AppendReply of the current term, which
+// no node sends once it knows of a newer term), so that a leader cut off from
+// the cluster finds out before serving a read. Replies to heartbeats sent
+// before the call do not count, since a newer leader may have been elected
+// since they were sent. ErrNotLeader is returned if the
+// node is not the leader to start with, and ErrLeadershipLost if it steps
+// down, or no quorum replies before ctx is done.
+func (self *RaftNode) VerifyLeadership(ctx context.Context) error { // {{{1
+    round := &heartbeatRound {
+        acked: make(map[uint32]bool),
+        quorum: true,
+        ctxDone: ctx.Done(),
+        done: make(chan error, 1),
+    }
+    select {
+    case self.notifch <- &heartbeat { round }:
+    case <-ctx.Done():
+        return ErrLeadershipLost
+    }
+    select {
+    case err := <-round.done:
+        if err == ErrNotLeader && atomic.LoadInt32(&round.peers) > 0 {
+            return ErrLeadershipLost // stepped down after the round started
+        }
+        return err
+    case <-ctx.Done():
+        return ErrLeadershipLost
+    }
+}
+
+func (self *heartbeatRound) ackIds(selfId uint32) []uint32 {
+    acks := []uint32 { selfId }
+    for nodeId := range self.acked {
+        acks = append(acks, nodeId)
+    }
+    return acks
+}
+
+func (self *RaftNode) startHeartbeat(round *heartbeatRound) {
+    if self.state != Leader {
+        round.done <- ErrNotLeader
+        return
+    }
+    // sent to every peer but the paused ones, backed off from or not (unlike
+    // the heartbeats on timeout, which are not counted as failures either)
+    round.minReqId = self.lastReqId + 1
+    var sent int32
+    for _, nodeId := range self.peerIds {
+        if !self.paused[nodeId] {
+            self.sendAppendEntries(nodeId, 0)
+            sent += 1
+        }
+    }
+    atomic.StoreInt32(&round.peers, sent)
+    if sent == 0 && (!round.quorum || self.isQuorum(round.ackIds(self.id))) {
+        round.done <- nil
+        return
+    }
+    self.heartbeats = append(self.heartbeats, round)
+}
+
+// Count an AppendReply of the current term from nodeId, replying to the
+// AppendEntries numbered reqId, towards the rounds started before it was sent
+func (self *RaftNode) ackHeartbeats(nodeId uint32, reqId uint64) {
+    pending := self.heartbeats[:0]
+    for _, round := range self.heartbeats {
+        select {
+        case <-round.ctxDone: // the caller gave up
+            continue
+        default:
+        }
+        if reqId < round.minReqId {
+            pending = append(pending, round)
+            continue
+        }
+        if !round.acked[nodeId] {
+            round.acked[nodeId] = true
+            atomic.AddInt32(&round.replies, 1)
+        }
+        if round.quorum && self.isQuorum(round.ackIds(self.id)) {
+            round.done <- nil
+        } else if int32(len(round.acked)) >= atomic.LoadInt32(&round.peers) {
+            round.done <- nil
+        } else {
+            pending = append(pending, round)
+        }
+    }
+    self.heartbeats = pending
+}
+
+// Fail all the pending rounds (when stepping down)
+func (self *RaftNode) failHeartbeats() {
+    for _, round := range self.heartbeats {
+        round.done <- ErrNotLeader
+    }
+    self.heartbeats = nil
+}
@@ -0,0 +1,39 @@
+package raft
+
+import (
+    "sort"
+    "sync"
+    "time"
+)
+
+// An ApplyObserver counting the latencies of each label into buckets: the
+// i-th bucket counts those up to Bounds[i] (and above Bounds[i - 1]), and the
+// last one, those above every bound
+type ApplyHistogram struct {
+    sync.Mutex
+    Bounds []time.Duration // ascending
+    counts map[string][]uint64
+}
+
+func NewApplyHistogram(bounds ...time.Duration) *ApplyHistogram {
+    return &ApplyHistogram { Bounds: bounds, counts: make(map[string][]uint64) }
+}
+
+func (self *ApplyHistogram) ObserveApply(label string, latency time.Duration) {
+    i := sort.Search(len(self.Bounds), func(i int) bool { return latency <= self.Bounds[i] })
+    self.Lock(); defer self.Unlock()
+    counts, ok := self.counts[label]
+    if !ok {
+        counts = make([]uint64, len(self.Bounds) + 1)
+        self.counts[label] = counts
+    }
+    counts[i] += 1
+}
+
+// The counts of the buckets of label (all zero if there is none yet)
+func (self *ApplyHistogram) Counts(label string) []uint64 {
+    self.Lock(); defer self.Unlock()
+    counts := make([]uint64, len(self.Bounds) + 1)
+    copy(counts, self.counts[label])
+    return counts
+}
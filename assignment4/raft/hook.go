@@ -0,0 +1,32 @@
+package raft
+
+// Register fn to be called with the entries handed to Machine.Execute right
+// after each call, along with the index of the log entry of the last of them;
+// it runs synchronously on the goroutine applying the entries (see
+// NodeConfig.AsyncApply), so it must not block or call back into the node.
+// Only one hook may be registered at a time; ErrNilHook is returned for a nil
+// fn (use ClearCommitHook to unregister).
+func (self *RaftNode) CommitHook(fn func(idx uint64, entries []ClientEntry)) error { // {{{1
+    if fn == nil {
+        return ErrNilHook
+    }
+    reply := make(chan error, 1)
+    self.notifch <- &commitHook { fn, reply }
+    return <-reply
+}
+
+// Unregister the hook given to CommitHook, if any; entries already handed
+// over to the applier may still reach it
+func (self *RaftNode) ClearCommitHook() { // {{{1
+    reply := make(chan error, 1)
+    self.notifch <- &commitHook { nil, reply }
+    <-reply
+}
+
+func (self *RaftNode) setCommitHook(fn func(uint64, []ClientEntry)) error {
+    if fn != nil && self.commitHook != nil {
+        return ErrHookAlreadyRegistered
+    }
+    self.commitHook = fn
+    return nil
+}
@@ -0,0 +1,99 @@
+package raft
+
+import "fmt"
+
+// Check the safety properties of Raft across a set of in-process nodes (all
+// running, and typically all the nodes of a cluster), and return the first
+// violation found, or nil. Meant for tests; all the nodes are paused while
+// their states are read (see Pause), so that the states are of a single point
+// in time, and resumed afterwards (even those paused before the call); the
+// messages in flight are not taken into account. The properties checked are:
+//  - every node has lastApplied <= commitIdx <= last log index
+//  - the terms in each log never decrease, nor exceed the node's term
+//  - there is at most one leader per term (Election Safety)
+//  - the entries committed by any two nodes agree (State Machine Safety)
+//  - a leader has all the entries committed by the nodes in the same or
+//    earlier terms (Leader Completeness)
+func CheckInvariants(nodes []*RaftNode) error { // {{{1
+    for _, node := range nodes {
+        node.Pause()
+    }
+    snaps := make([]*RaftNodeSnapshot, len(nodes))
+    for i, node := range nodes {
+        node.Inspect(func(s *RaftNodeSnapshot) { snaps[i] = s })
+    }
+    for _, node := range nodes {
+        node.Resume()
+    }
+    return checkInvariants(snaps)
+}
+
+func checkInvariants(snaps []*RaftNodeSnapshot) error {
+    for _, s := range snaps {
+        lastIdx := uint64(len(s.Log)) - 1 // there is always the entry at 0
+        if s.CommitIdx > lastIdx || s.LastApplied > s.CommitIdx {
+            return fmt.Errorf("node %v: lastApplied %v, commitIdx %v, last log index %v",
+                s.Id, s.LastApplied, s.CommitIdx, lastIdx)
+        }
+        var prevTerm uint64
+        for idx, entry := range s.Log {
+            if entry.Term < prevTerm || entry.Term > s.Term {
+                return fmt.Errorf("node %v: term %v at %v (after term %v, node term %v)",
+                    s.Id, entry.Term, idx, prevTerm, s.Term)
+            }
+            prevTerm = entry.Term
+        }
+    }
+    leaders := make(map[uint64]uint32) // term -> leader
+    for _, s := range snaps {
+        if s.State != Leader {
+            continue
+        }
+        if id, ok := leaders[s.Term]; ok {
+            return fmt.Errorf("two leaders (%v and %v) in term %v", id, s.Id, s.Term)
+        }
+        leaders[s.Term] = s.Id
+    }
+    for i, a := range snaps {
+        for _, b := range snaps[i + 1:] {
+            commitIdx := a.CommitIdx
+            if b.CommitIdx < commitIdx {
+                commitIdx = b.CommitIdx
+            }
+            if idx, ok := firstMismatch(a.Log, b.Log, commitIdx); !ok {
+                return fmt.Errorf("nodes %v and %v differ at committed index %v", a.Id, b.Id, idx)
+            }
+        }
+    }
+    for _, l := range snaps {
+        if l.State != Leader {
+            continue
+        }
+        for _, s := range snaps {
+            if s.Term > l.Term {
+                continue // may have learnt of commits after l's term
+            }
+            if idx, ok := firstMismatch(l.Log, s.Log, s.CommitIdx); !ok {
+                return fmt.Errorf("leader %v (term %v) lacks the entry at %v committed by %v",
+                    l.Id, l.Term, idx, s.Id)
+            }
+        }
+    }
+    return nil
+}
+
+// Compare the entries of two logs up to upto (by term and UID, since the
+// payloads may be stripped, see witnessEntries); a missing entry is a mismatch
+func firstMismatch(a, b []RaftEntry, upto uint64) (uint64, bool) {
+    for idx := uint64(0); idx <= upto; idx += 1 {
+        if idx >= uint64(len(a)) || idx >= uint64(len(b)) {
+            return idx, false
+        }
+        ea, eb := a[idx], b[idx]
+        if ea.Term != eb.Term || (ea.CEntry == nil) != (eb.CEntry == nil) ||
+            (ea.CEntry != nil && ea.CEntry.UID != eb.CEntry.UID) {
+            return idx, false
+        }
+    }
+    return 0, true
+}
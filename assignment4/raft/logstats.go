@@ -0,0 +1,43 @@
+package raft
+
+// The size of the log, for capacity planning. Entries carry no timestamps, so
+// their age is not known; and since the log is never truncated (see
+// SnapshotRestorer), the oldest entry is always the first one.
+type LogStatistics struct {
+    TotalEntries uint64 // not counting the empty entry at index 0
+    // Sizes as stored, if the Persister is an EntrySizer (or else 0)
+    TotalBytes uint64
+    MaxEntryBytes uint64
+    AvgEntryBytes float64
+    OldestEntryIdx uint64 // 0 if the log is empty
+}
+
+// Read from within the event loop, like Status; since this goes through the
+// whole log (given an EntrySizer), it holds up the loop for as long
+func (self *RaftNode) LogStats() LogStatistics { // {{{1
+    reply := make(chan LogStatistics, 1)
+    self.notifch <- &logStats { reply }
+    return <-reply
+}
+
+func (self *RaftNode) logStats() LogStatistics {
+    var s LogStatistics
+    lastIdx, _ := self.logTail()
+    if lastIdx == 0 {
+        return s
+    }
+    s.TotalEntries, s.OldestEntryIdx = lastIdx, 1
+    sizer, ok := self.pster.(EntrySizer)
+    if !ok {
+        return s
+    }
+    for idx := uint64(1); idx <= lastIdx; idx += 1 {
+        size := sizer.EntrySize(idx)
+        s.TotalBytes += size
+        if size > s.MaxEntryBytes {
+            s.MaxEntryBytes = size
+        }
+    }
+    s.AvgEntryBytes = float64(s.TotalBytes) / float64(s.TotalEntries)
+    return s
+}
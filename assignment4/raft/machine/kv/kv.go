@@ -0,0 +1,153 @@
+// Package kv is a reference implementation of raft.Machine: a map of string
+// keys to []byte values, driven by text commands.
+package kv
+
+import (
+    "bytes"
+    "encoding/gob"
+    "strings"
+    "sync"
+    "github.com/critiqjo/cs733/assignment4/raft"
+)
+
+// Results of the commands (besides the value returned by GET)
+var (
+    ResultOK = []byte("OK")
+    ResultNotFound = []byte("ERR_NOT_FOUND")
+    ResultBadCmd = []byte("ERR_CMD_ERR")
+)
+
+// A raft.Machine whose ClientEntry.Data is one of the commands (as a string
+// or []byte):
+//      SET key value   (the value is the rest of the line, spaces included)
+//      DEL key
+//      GET key
+// The result of every executed request is cached (for TryRespond and
+// ReadResult) and passed on to respond.
+type KVMachine struct {
+    sync.Mutex // Execute may run alongside the rest (see NodeConfig.AsyncApply)
+    kvMap map[string][]byte
+    results map[uint64][]byte // uid -> result
+    respond func(uid uint64, result []byte)
+}
+
+// respond may be nil, if the results are only needed through ReadResult
+func NewKVMachine(respond func(uid uint64, result []byte)) *KVMachine {
+    return &KVMachine {
+        kvMap: make(map[string][]byte),
+        results: make(map[uint64][]byte),
+        respond: respond,
+    }
+}
+
+// ---- quack like a raft.Machine {{{1
+func (self *KVMachine) Execute(entries []raft.ClientEntry) {
+    for _, cEntry := range entries {
+        self.Lock()
+        result := self.execute(cEntry.Data)
+        self.results[cEntry.UID] = result
+        self.Unlock()
+        if self.respond != nil {
+            self.respond(cEntry.UID, result)
+        }
+    }
+}
+
+func (self *KVMachine) TryRespond(uid uint64) bool {
+    self.Lock()
+    result, ok := self.results[uid]
+    self.Unlock()
+    if ok && self.respond != nil {
+        self.respond(uid, result)
+    }
+    return ok
+}
+
+func (self *KVMachine) Read(key string) []byte {
+    self.Lock(); defer self.Unlock()
+    return self.kvMap[key]
+}
+
+func (self *KVMachine) ReadResult(uid uint64) ([]byte, bool) {
+    self.Lock(); defer self.Unlock()
+    result, ok := self.results[uid]
+    return result, ok
+}
+
+// Must be called with the lock held
+func (self *KVMachine) execute(data interface{}) []byte {
+    var cmd string
+    switch d := data.(type) {
+    case nil: // read-only request
+        return ResultOK
+    case string:
+        cmd = d
+    case []byte:
+        cmd = string(d)
+    default:
+        return ResultBadCmd
+    }
+    fields := strings.SplitN(cmd, " ", 3)
+    switch {
+    case fields[0] == "SET" && len(fields) == 3:
+        self.kvMap[fields[1]] = []byte(fields[2])
+        return ResultOK
+    case fields[0] == "DEL" && len(fields) == 2:
+        if _, ok := self.kvMap[fields[1]]; !ok {
+            return ResultNotFound
+        }
+        delete(self.kvMap, fields[1])
+        return ResultOK
+    case fields[0] == "GET" && len(fields) == 2:
+        if value, ok := self.kvMap[fields[1]]; ok {
+            return value
+        }
+        return ResultNotFound
+    }
+    return ResultBadCmd
+}
+
+// ---- snapshots {{{1
+
+// What Snapshot encodes: the result cache is included, so that requests
+// executed before the snapshot are still answered from it after a restore,
+// instead of being executed again
+type kvSnapshot struct {
+    KVMap map[string][]byte
+    Results map[uint64][]byte
+}
+
+// A gob-encoded copy of the map and of the result cache (to be passed to
+// RaftNode.Restore, say). Note that this is not raft.Snapshotter, which takes
+// the index instead.
+func (self *KVMachine) Snapshot() []byte {
+    self.Lock(); defer self.Unlock()
+    var buf bytes.Buffer
+    if err := gob.NewEncoder(&buf).Encode(&kvSnapshot { self.kvMap, self.results }); err != nil {
+        panic(err) // maps of strings and ints to bytes are always encodable
+    }
+    return buf.Bytes()
+}
+
+// The same as Snapshot (see raft.SnapshotSerializer)
+func (self *KVMachine) SerializeSnapshot(idx uint64) ([]byte, error) {
+    return self.Snapshot(), nil
+}
+
+// Replace the map and the result cache with those from Snapshot (see
+// raft.SnapshotRestorer)
+func (self *KVMachine) RestoreSnapshot(idx uint64, data []byte) error {
+    var snap kvSnapshot
+    if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snap); err != nil {
+        return err
+    }
+    if snap.KVMap == nil { // gob leaves out empty maps
+        snap.KVMap = make(map[string][]byte)
+    }
+    if snap.Results == nil {
+        snap.Results = make(map[uint64][]byte)
+    }
+    self.Lock(); defer self.Unlock()
+    self.kvMap, self.results = snap.KVMap, snap.Results
+    return nil
+}
@@ -0,0 +1,223 @@
+package kv
+
+import (
+    "encoding/json"
+    "hash/crc32"
+    golog "log"
+    "os"
+    "sync"
+    "testing"
+    "time"
+    "github.com/critiqjo/cs733/assignment4/raft"
+)
+
+type memNet struct { // {{{1
+    sync.Mutex
+    notifchs map[uint32]chan<- raft.Message
+}
+
+type memMsger struct {
+    raft.NopMessenger
+    id uint32
+    peerIds []uint32
+    net *memNet
+}
+
+func (self *memMsger) Register(notifch chan<- raft.Message) {
+    self.net.Lock()
+    self.net.notifchs[self.id] = notifch
+    self.net.Unlock()
+}
+
+func (self *memMsger) Send(node uint32, msg raft.Message) {
+    if ae, ok := msg.(*raft.AppendEntries); ok { // the sender may overwrite its log
+        copy := *ae
+        copy.Entries = append([]raft.RaftEntry(nil), ae.Entries...)
+        msg = &copy
+    }
+    self.net.Lock()
+    notifch, ok := self.net.notifchs[node]
+    self.net.Unlock()
+    if ok {
+        select {
+        case notifch <- msg:
+        default: // dropped, as in a real network
+        }
+    }
+}
+
+func (self *memMsger) BroadcastVoteRequest(msg *raft.VoteRequest) {
+    for _, nodeId := range self.peerIds {
+        self.Send(nodeId, msg)
+    }
+}
+
+type memPster struct { // {{{1
+    sync.Mutex
+    log []raft.RaftEntry
+    fields *raft.RaftFields
+}
+
+func (self *memPster) Entry(idx uint64) *raft.RaftEntry {
+    self.Lock(); defer self.Unlock()
+    if idx >= uint64(len(self.log)) { return nil }
+    entry := self.log[idx]
+    return &entry
+}
+func (self *memPster) LastEntry() (uint64, *raft.RaftEntry) {
+    self.Lock(); defer self.Unlock()
+    if len(self.log) == 0 { return 0, nil }
+    entry := self.log[len(self.log) - 1]
+    return uint64(len(self.log) - 1), &entry
+}
+func (self *memPster) LogSlice(startIdx uint64, endIdx uint64) ([]raft.RaftEntry, bool) {
+    self.Lock(); defer self.Unlock()
+    if startIdx > endIdx || startIdx > uint64(len(self.log)) {
+        return nil, false
+    } else if endIdx > uint64(len(self.log)) {
+        endIdx = uint64(len(self.log))
+    }
+    if startIdx == endIdx {
+        return nil, true
+    }
+    return append([]raft.RaftEntry(nil), self.log[startIdx:endIdx]...), true
+}
+func (self *memPster) LogUpdate(startIdx uint64, slice []raft.RaftEntry) bool {
+    self.Lock(); defer self.Unlock()
+    if startIdx > uint64(len(self.log)) { return false }
+    self.log = append(self.log[:startIdx:startIdx], slice...)
+    return true
+}
+func (self *memPster) Fsync() error { return nil }
+func (self *memPster) CRC32() uint32 {
+    self.Lock(); defer self.Unlock()
+    var crc uint32
+    for i := range self.log {
+        blob, _ := json.Marshal(&self.log[i])
+        crc = crc32.Update(crc, crc32.IEEETable, blob)
+    }
+    return crc
+}
+func (self *memPster) GetFields() *raft.RaftFields {
+    self.Lock(); defer self.Unlock()
+    return self.fields
+}
+func (self *memPster) SetFields(rf raft.RaftFields) bool {
+    self.Lock(); defer self.Unlock()
+    self.fields = &rf
+    return true
+}
+
+// ---- tests {{{1
+func TestCommands(t *testing.T) {
+    m := NewKVMachine(nil)
+    m.Execute([]raft.ClientEntry {
+        { UID: 1, Data: "SET a hello world" },
+        { UID: 2, Data: []byte("GET a") },
+        { UID: 3, Data: "DEL a" },
+        { UID: 4, Data: "GET a" },
+        { UID: 5, Data: "DEL a" },
+        { UID: 6, Data: "PUT a b" },
+        { UID: 7, Data: "SET a" },
+        { UID: 8, Data: 42 },
+        { UID: 9, Data: nil },
+    })
+    expected := []string {
+        "OK", "hello world", "OK", "ERR_NOT_FOUND", "ERR_NOT_FOUND",
+        "ERR_CMD_ERR", "ERR_CMD_ERR", "ERR_CMD_ERR", "OK",
+    }
+    for i, exp := range expected {
+        uid := uint64(i + 1)
+        if result, ok := m.ReadResult(uid); !ok || string(result) != exp {
+            t.Fatal("Unexpected result of", uid, string(result), ok)
+        }
+    }
+    if m.TryRespond(10) || !m.TryRespond(1) {
+        t.Fatal("TryRespond does not follow the result cache")
+    }
+}
+
+func TestSnapshot(t *testing.T) {
+    m := NewKVMachine(nil)
+    m.Execute([]raft.ClientEntry { { UID: 1, Data: "SET a 1" }, { UID: 2, Data: "SET b 2" } })
+    data := m.Snapshot()
+    m.Execute([]raft.ClientEntry { { UID: 3, Data: "SET a 3" }, { UID: 4, Data: "DEL b" } })
+
+    restored := NewKVMachine(nil)
+    if err := restored.RestoreSnapshot(2, data); err != nil {
+        t.Fatal(err)
+    }
+    if string(restored.Read("a")) != "1" || string(restored.Read("b")) != "2" {
+        t.Fatal("Snapshot not restored")
+    }
+    if string(m.Read("a")) != "3" || m.Read("b") != nil {
+        t.Fatal("Snapshot shares the map")
+    }
+    if result, ok := restored.ReadResult(2); !ok || string(result) != "OK" {
+        t.Fatal("Result cache not restored")
+    }
+    if !restored.TryRespond(1) || restored.TryRespond(3) {
+        t.Fatal("Restored result cache does not follow the snapshot")
+    }
+    if restored.RestoreSnapshot(0, []byte("junk")) == nil {
+        t.Fatal("Restored a corrupt snapshot")
+    }
+}
+
+func TestCluster(t *testing.T) {
+    nodeIds := []uint32 { 1, 2, 3 }
+    net := &memNet { notifchs: make(map[uint32]chan<- raft.Message) }
+    errlog := golog.New(os.Stderr, "-- ", golog.Lshortfile)
+    nodes := make(map[uint32]*raft.RaftNode)
+    machns := make(map[uint32]*KVMachine)
+    for _, id := range nodeIds {
+        var peerIds []uint32
+        for _, peerId := range nodeIds {
+            if peerId != id { peerIds = append(peerIds, peerId) }
+        }
+        machns[id] = NewKVMachine(nil)
+        node, err := raft.NewNode(id, nodeIds, 256,
+            &memMsger { id: id, peerIds: peerIds, net: net }, &memPster { }, machns[id], errlog)
+        if err != nil { t.Fatal(err) }
+        nodes[id] = node
+        go node.Run(50 * time.Millisecond)
+    }
+    defer func() {
+        for _, node := range nodes { node.Exit() }
+    }()
+
+    cmds := []string { "SET x 1", "SET y 2", "DEL x", "SET y 3 4" }
+    for i, cmd := range cmds {
+        uid := uint64(i + 1)
+        // only the leader appends it; it is submitted again until applied,
+        // in case there was no leader to accept it (duplicates are ignored)
+        if !waitFor(func() bool {
+            net.Lock()
+            for _, notifch := range net.notifchs {
+                notifch <- &raft.ClientEntry { UID: uid, Data: cmd }
+            }
+            net.Unlock()
+            for _, m := range machns {
+                if _, ok := m.ReadResult(uid); !ok { return false }
+            }
+            return true
+        }) {
+            t.Fatal("Command not applied on all the nodes:", cmd)
+        }
+    }
+    for id, m := range machns {
+        if m.Read("x") != nil || string(m.Read("y")) != "3 4" {
+            t.Fatal("Unexpected state of", id, string(m.Read("x")), string(m.Read("y")))
+        }
+    }
+}
+
+// Poll cond every 10ms until it returns true, or give up after 5s
+func waitFor(cond func() bool) bool {
+    deadline := time.Now().Add(5 * time.Second)
+    for !cond() {
+        if time.Now().After(deadline) { return false }
+        time.Sleep(10 * time.Millisecond)
+    }
+    return true
+}
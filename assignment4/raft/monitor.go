@@ -0,0 +1,36 @@
+package raft
+
+import "time"
+
+// Call cb with the number of entries in the log not known to be committed
+// (Status().LastLogIdx - CommitIdx) every interval, from a goroutine of its
+// own, until the event loop exits; a lag that keeps growing on a leader means
+// that replication has stalled. Must be called while the loop is running.
+func (self *RaftNode) MonitorCommitLag(interval time.Duration, cb func(lag uint64)) { // {{{1
+    reply := make(chan (<-chan struct{}), 1)
+    self.notifch <- &runDone { reply }
+    done := <-reply
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ticker.C:
+            case <-done:
+                return
+            }
+            status := make(chan NodeStatus, 1)
+            select {
+            case self.notifch <- &nodeStatus { status }:
+            case <-done:
+                return
+            }
+            select {
+            case s := <-status:
+                cb(s.LastLogIdx - s.CommitIdx)
+            case <-done: // exited before getting to it
+                return
+            }
+        }
+    }()
+}
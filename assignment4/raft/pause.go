@@ -0,0 +1,69 @@
+package raft
+
+import "errors"
+
+// Stop sending AppendEntries (heartbeats included) to a peer, e.g. while it
+// is being upgraded; replies already in flight are still processed. This only
+// has an effect while the node is the leader, but it is kept across terms
+// until ResumeReplication. A paused peer that is up will time out and start an
+// election, so pause only the ones that are down (or about to be).
+func (self *RaftNode) PauseReplication(nodeId uint32) error { // {{{1
+    reply := make(chan error, 1)
+    self.notifch <- &pauseReplication { nodeId, true, reply }
+    return <-reply
+}
+
+// Undo PauseReplication, and (if leader) send the peer what it missed right
+// away, instead of waiting for the next heartbeat
+func (self *RaftNode) ResumeReplication(nodeId uint32) error { // {{{1
+    reply := make(chan error, 1)
+    self.notifch <- &pauseReplication { nodeId, false, reply }
+    return <-reply
+}
+
+func (self *RaftNode) pauseReplication(nodeId uint32, pause bool) error {
+    known := false
+    for _, id := range self.peerIds {
+        known = known || id == nodeId
+    }
+    if !known {
+        return errors.New("Unknown peer")
+    }
+    if pause {
+        self.paused[nodeId] = true
+    } else if self.paused[nodeId] {
+        delete(self.paused, nodeId)
+        if self.state == Leader {
+            self.sendAppendEntries(nodeId, 8)
+        }
+    }
+    return nil
+}
+
+// Stop the event loop from handling messages until Resume (for debugging);
+// whatever arrives meanwhile, timeouts included, is held back in order, so
+// calls that wait on the loop (other than Inspect, Resume and Exit) block
+// until then
+func (self *RaftNode) Pause() { // {{{1
+    done := make(chan struct{})
+    self.notifch <- &pauseLoop { true, done }
+    <-done
+}
+
+// Undo Pause; the timer is reset first, so a timeout held back while paused
+// is stale by the time the held messages are handled
+func (self *RaftNode) Resume() { // {{{1
+    done := make(chan struct{})
+    self.notifch <- &pauseLoop { false, done }
+    <-done
+}
+
+func (self *RaftNode) pause(on bool) {
+    if on == self.halted {
+        return
+    }
+    self.halted = on
+    if !on {
+        self.timerReset()
+    }
+}
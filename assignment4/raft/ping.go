@@ -0,0 +1,76 @@
+package raft
+
+import (
+    "errors"
+    "sync"
+    "time"
+)
+
+// Pings waiting for their Pong-s (see RaftNode.Ping)
+type pingTracker struct {
+    sync.Mutex
+    lastId uint64
+    replies map[uint64]chan<- time.Duration
+}
+
+func (self *pingTracker) add() (uint64, <-chan time.Duration) {
+    self.Lock(); defer self.Unlock()
+    if self.replies == nil {
+        self.replies = make(map[uint64]chan<- time.Duration)
+    }
+    self.lastId += 1
+    reply := make(chan time.Duration, 1)
+    self.replies[self.lastId] = reply
+    return self.lastId, reply
+}
+
+func (self *pingTracker) remove(id uint64) (chan<- time.Duration, bool) {
+    self.Lock(); defer self.Unlock()
+    reply, ok := self.replies[id]
+    delete(self.replies, id)
+    return reply, ok
+}
+
+// Measure the round-trip time to peerId, through the event loops of both the
+// nodes (so a busy loop shows up as latency). Ping-ing self is allowed.
+func (self *RaftNode) Ping(peerId uint32) (time.Duration, error) { // {{{1
+    known := peerId == self.id
+    for _, id := range self.peerIds {
+        known = known || id == peerId
+    }
+    if !known {
+        return 0, errors.New("Unknown node")
+    }
+    return self.ping(peerId)
+}
+
+// Ping any node, even one that is not in the current config
+func (self *RaftNode) ping(peerId uint32) (time.Duration, error) {
+    id, reply := self.pings.add()
+    self.notifch <- &pingPeer { peerId, &Ping { id, self.id, time.Now().UnixNano() } }
+    select {
+    case rtt := <-reply:
+        return rtt, nil
+    case <-time.After(pingTimeout):
+        self.pings.remove(id)
+        return 0, ErrPingTimeout
+    }
+}
+
+const pingTimeout = time.Second
+
+func (self *RaftNode) handlePing(m Message) {
+    if self.fromStranger(m) {
+        return
+    }
+    switch msg := m.(type) {
+    case *pingPeer:
+        self.msger.Send(msg.peerId, msg.ping)
+    case *Ping:
+        self.msger.Send(msg.NodeId, &Pong { msg.Id, self.id, msg.SentAt })
+    case *Pong:
+        if reply, ok := self.pings.remove(msg.Id); ok {
+            reply <- time.Since(time.Unix(0, msg.SentAt))
+        }
+    }
+}
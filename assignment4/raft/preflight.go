@@ -0,0 +1,42 @@
+package raft
+
+import (
+    "fmt"
+    "sync/atomic"
+)
+
+// Check the persisted state and the machine more deeply than NewNodeEx does,
+// before the event loop runs (RunEx calls this, and panics on an error): the
+// terms in the log never decrease, nor exceed the persisted term, the vote (if
+// any) is for a node in NodeIds, and the Machine validates itself if it is a
+// MachineValidator. This reads the whole log. Returns ErrRunning while the
+// event loop is running.
+func (self *RaftNode) PreflightCheck() error { // {{{1
+    if atomic.LoadInt32(&self.running) != 0 {
+        return ErrRunning
+    }
+    lastIdx, _ := self.logTail()
+    entries, ok := self.pster.LogSlice(0, lastIdx + 1)
+    if !ok {
+        return fmt.Errorf("Unable to read the log up to %v", lastIdx)
+    }
+    var prevTerm uint64
+    for idx, entry := range entries {
+        if entry.Term < prevTerm {
+            return fmt.Errorf("Term %v at %v after term %v", entry.Term, idx, prevTerm)
+        }
+        prevTerm = entry.Term
+    }
+    if prevTerm > self.term {
+        return fmt.Errorf("Log has term %v, beyond the persisted term %v", prevTerm, self.term)
+    }
+    if self.hasVoted && self.votedFor != self.id && !self.isPeer(self.votedFor) {
+        return fmt.Errorf("Voted for node %v, which is not in NodeIds", self.votedFor)
+    }
+    if validator, ok := self.machn.(MachineValidator); ok {
+        if err := validator.Validate(); err != nil {
+            return fmt.Errorf("Machine: %w", err)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,60 @@
+package raft
+
+import "time"
+
+// Leadership is biased towards nodes of higher priority (NodeConfig.Priorities)
+// in two ways: a node delays its campaign by PriorityDelay for every node of
+// higher priority, and a leader hands off leadership (see TimeoutNow) to a
+// caught-up peer of higher priority. Elections themselves are unchanged (unlike
+// with NodeConfig.ElectionPriority), so a node of any priority can still win
+// when the preferred ones are down.
+
+func (self *RaftNode) priority(nodeId uint32) int {
+    return self.cfg.Priorities[nodeId]
+}
+
+// Number of nodes (witnesses excluded) with a higher priority than self
+func (self *RaftNode) priorityRank() int {
+    rank := 0
+    for _, nodeId := range self.peerIds {
+        if !self.isWitness(nodeId) && self.priority(nodeId) > self.priority(self.id) {
+            rank += 1
+        }
+    }
+    return rank
+}
+
+// Add the priority delay to election timeouts sampled by sampler
+func (self *RaftNode) prioritySampler(sampler func(RaftState) time.Duration) func(RaftState) time.Duration {
+    return func(state RaftState) time.Duration {
+        dur := sampler(state)
+        if state == Leader {
+            return dur
+        }
+        delay := self.cfg.PriorityDelay
+        if delay == 0 {
+            delay = 2 * sampler(Leader)
+        }
+        return dur + time.Duration(self.priorityRank()) * delay
+    }
+}
+
+// Ask nodeId (which just acked an AppendEntries) to campaign right away, if
+// it is caught up and of a higher priority than self; done at most once per
+// term. Leadership may thus pass through a few nodes before it settles on the
+// reachable node of the highest priority. A quiesced leader asks any caught-up
+// peer, every time (see Quiesce). Returns whether nodeId was asked.
+func (self *RaftNode) maybeTransferLeadership(nodeId uint32) bool {
+    if self.isWitness(nodeId) || self.paused[nodeId] {
+        return false
+    } else if !self.quiesced && (self.transferTerm == self.term ||
+                                 self.priority(nodeId) <= self.priority(self.id)) {
+        return false
+    }
+    if lastIdx, _ := self.logTail(); self.matchIdx[nodeId] == lastIdx {
+        self.transferTerm = self.term
+        self.msger.Send(nodeId, &TimeoutNow { self.term, self.id })
+        return true
+    }
+    return false
+}
@@ -0,0 +1,37 @@
+package raft
+
+// Drain the node for a rolling restart: a leader hands leadership over to a
+// caught-up peer (retrying on every ack until one takes it), and until
+// Unquiesce, the node never campaigns and turns away new writes (with
+// Client503 while still the leader, and Client301 once a follower, while
+// Propose, ProposeBatch and BulkLoad return ErrQuiesced). It still votes,
+// and replicates as a follower.
+func (self *RaftNode) Quiesce() { // {{{1
+    done := make(chan struct{})
+    self.notifch <- &quiesce { true, done }
+    <-done
+}
+
+// Undo Quiesce; the node may campaign again on its next timeout
+func (self *RaftNode) Unquiesce() { // {{{1
+    done := make(chan struct{})
+    self.notifch <- &quiesce { false, done }
+    <-done
+}
+
+func (self *RaftNode) quiesce(on bool) {
+    self.quiesced = on
+    if !on {
+        return
+    }
+    switch self.state {
+    case Candidate:
+        self.becomeFollower(self.term)
+    case Leader:
+        for _, nodeId := range self.peerIds {
+            if self.maybeTransferLeadership(nodeId) {
+                break
+            }
+        }
+    }
+}
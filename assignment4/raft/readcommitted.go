@@ -0,0 +1,81 @@
+package raft
+
+import "context"
+
+// A ReadCommitted call waiting for the entry at idx to be applied
+type commitRead struct {
+    uid uint64
+    idx uint64
+    reply chan<- readCommittedReply
+}
+
+// Submit the read command cmd with uid (as a ClientEntry with cmd as Data,
+// unless the request is already in the log or executed, when cmd is ignored),
+// and block until it is committed and applied by this node, then return
+// Machine.ReadResult(uid), i.e. the result of executing cmd. As with a
+// LeaderRead, the result is returned only once an entry of the current term is
+// committed and applied, so a write acknowledged before the call is always
+// visible. The Machine must execute cmd without changing its state.
+//
+// Only a leader can do this; ErrNotLeader is returned otherwise, or if the
+// node steps down before the entry is applied.
+func (self *RaftNode) ReadCommitted(ctx context.Context, uid uint64, cmd interface{}) ([]byte, error) { // {{{1
+    reply := make(chan readCommittedReply, 1)
+    select {
+    case self.notifch <- &readCommitted { uid, cmd, reply }:
+    case <-ctx.Done():
+        return nil, ctx.Err()
+    }
+    select {
+    case r := <-reply:
+        return r.data, r.err
+    case <-ctx.Done():
+        return nil, ctx.Err() // the reply is dropped into the buffer
+    }
+}
+
+func (self *RaftNode) startCommitRead(uid uint64, cmd interface{}, reply chan<- readCommittedReply) {
+    if self.state != Leader {
+        reply <- readCommittedReply { nil, ErrNotLeader }
+        return
+    }
+    idx, pending := self.idxOfUid[uid]
+    if !pending {
+        if _, executed := self.machn.ReadResult(uid); !executed {
+            self.leaderLogAppend(RaftEntry { self.term, &ClientEntry { uid, cmd } })
+            idx, _ = self.logTail()
+        } else {
+            idx = self.lastAppld
+        }
+    }
+    if _, lastEntry := self.logTail(); lastEntry.Term != self.term {
+        self.leaderLogAppend(RaftEntry { self.term, nil }) // no-op
+    }
+    self.commitReads = append(self.commitReads, &commitRead { uid, idx, reply })
+    self.serveCommitReads()
+}
+
+// Answer the ReadCommitted calls whose entries are applied
+func (self *RaftNode) serveCommitReads() {
+    if !self.readsReady() {
+        return
+    }
+    waiting := self.commitReads[:0]
+    for _, r := range self.commitReads {
+        if r.idx > self.lastAppld {
+            waiting = append(waiting, r)
+        } else if data, ok := self.machn.ReadResult(r.uid); ok {
+            r.reply <- readCommittedReply { data, nil }
+        } else {
+            r.reply <- readCommittedReply { nil, ErrNoResult }
+        }
+    }
+    self.commitReads = waiting
+}
+
+func (self *RaftNode) failCommitReads() {
+    for _, r := range self.commitReads {
+        r.reply <- readCommittedReply { nil, ErrNotLeader }
+    }
+    self.commitReads = nil
+}
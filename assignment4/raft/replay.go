@@ -0,0 +1,146 @@
+package raft
+
+import (
+    "errors"
+    "sync/atomic"
+)
+
+// Number of entries read from the Persister at a time while replaying
+const replayChunk = 64
+
+// Feed the committed client entries up to (and including) the log index upto
+// to apply, in the order in which they are executed by the node; entries of
+// a batch are fed one by one. Replay stops at the first error from apply and
+// returns it. It may be used to rebuild a Machine from scratch (say, at
+// startup); apply is called from the caller's goroutine, while the log is read
+// replayChunk entries at a time from within the event loop if it is running
+// (a Persister need not be safe for concurrent use). Otherwise, the loop must
+// not be started until Replay returns.
+func (self *RaftNode) Replay(upto uint64, apply func(ClientEntry) error) error { // {{{1
+    if upto > self.CommitIndex() {
+        return errors.New("Replay beyond the commit index")
+    } else if self.cfg.WitnessMode {
+        return errors.New("Witnesses do not store payloads")
+    }
+    for startIdx := uint64(1); startIdx <= upto; startIdx += replayChunk {
+        endIdx := startIdx + replayChunk
+        if endIdx > upto + 1 {
+            endIdx = upto + 1
+        }
+        entries, ok := self.replaySlice(startIdx, endIdx)
+        if !ok || uint64(len(entries)) != endIdx - startIdx {
+            return errors.New("Unable to read the log")
+        }
+        for _, entry := range entries {
+            if entry.CEntry == nil {
+                continue
+            }
+            var cEntries []ClientEntry
+            switch data := entry.CEntry.Data.(type) {
+            case *SnapshotMarker, *ClockEntry:
+            case *BatchClientEntry:
+                cEntries = data.Entries
+            default:
+                cEntries = []ClientEntry { *entry.CEntry }
+            }
+            for _, cEntry := range cEntries {
+                if err := apply(cEntry); err != nil {
+                    return err
+                }
+            }
+        }
+    }
+    return nil
+}
+
+func (self *RaftNode) replaySlice(startIdx, endIdx uint64) ([]RaftEntry, bool) {
+    if atomic.LoadInt32(&self.running) == 0 {
+        return self.pster.LogSlice(startIdx, endIdx)
+    }
+    reply := make(chan replaySliceReply, 1)
+    self.notifch <- &replaySlice { startIdx, endIdx, reply }
+    r := <-reply
+    return r.entries, r.ok
+}
+
+// Execute entries, which must follow (and match) those in the log after
+// LastApplied, and be committed (up to CommitIndex, as when the loop exited
+// with AsyncApply, or as restored from a CommitPersister); entries of UIDs for
+// which Machine.TryRespond returns true are taken as already executed (say, by
+// a Machine that persists its own state), and skipped. Snapshots are not taken
+// for the SnapshotMarker-s among them, since they would be taken at indices
+// already past. The node must not be running (see Exit); NewNodeEx calls this
+// with the entries up to the commit index stored in a CommitPersister.
+func (self *RaftNode) ApplyEntries(entries []RaftEntry) error { // {{{1
+    if atomic.LoadInt32(&self.running) != 0 {
+        return ErrRunning
+    }
+    startIdx := self.lastAppld + 1
+    if self.lastAppld + uint64(len(entries)) > self.commitIdx {
+        return errors.New("Entries beyond the commit index")
+    }
+    for i := range entries {
+        if logEntry := self.log(startIdx + uint64(i)); logEntry == nil || logEntry.Term != entries[i].Term {
+            return errors.New("Entries do not match the log")
+        }
+    }
+    lastIdx := self.lastAppld + uint64(len(entries))
+    var cEntries []ClientEntry
+    execute := func(cEntry ClientEntry) {
+        if !self.machn.TryRespond(cEntry.UID) {
+            cEntries = append(cEntries, cEntry)
+        }
+    }
+    for _, entry := range entries {
+        if entry.CEntry == nil {
+            continue
+        }
+        switch data := entry.CEntry.Data.(type) {
+        case *SnapshotMarker:
+            if data.Idx > lastIdx {
+                self.snapIdxs[data.Idx] = true
+            }
+            if data.Idx > self.lastSnapIdx {
+                self.lastSnapIdx = data.Idx
+            }
+        case *ClockEntry:
+            self.clockAtomic.Store(*data)
+        case *BatchClientEntry:
+            for _, cEntry := range data.Entries {
+                execute(cEntry)
+            }
+        default:
+            execute(*entry.CEntry)
+        }
+    }
+    if len(cEntries) > 0 {
+        self.machn.Execute(cEntries)
+    }
+    self.lastAppld, self.appldQueued = lastIdx, lastIdx
+    self.publishApplied()
+    return nil
+}
+
+// Apply the entries after LastApplied up to the commit index stored in a
+// CommitPersister (if any); it is not synced along with the log, so it may be
+// past the end of a log that lost its unsynced tail in a crash
+func (self *RaftNode) replayCommitted() error {
+    cpster, ok := self.pster.(CommitPersister)
+    if !ok {
+        return nil
+    }
+    commitIdx := cpster.GetCommitIdx()
+    if lastIdx, _ := self.pster.LastEntry(); commitIdx > lastIdx {
+        commitIdx = lastIdx
+    }
+    if commitIdx <= self.lastAppld {
+        return nil
+    }
+    entries, ok := self.pster.LogSlice(self.lastAppld + 1, commitIdx + 1)
+    if !ok || uint64(len(entries)) != commitIdx - self.lastAppld {
+        return errors.New("Unable to read the committed entries")
+    }
+    self.commitIdx = commitIdx
+    atomic.StoreUint64(&self.commitIdxAtomic, commitIdx)
+    return self.ApplyEntries(entries)
+}
@@ -0,0 +1,25 @@
+package raft
+
+// Like Reset, but AsyncApply may change too: the applier is drained (whatever
+// was handed over to it is executed and finished), cfg takes effect, and a new
+// applier is started if needed. This all happens while the loop handles a
+// single message, so nothing else is held up for longer than the drain, and
+// the persistent state and the timer are left alone. The other fields Reset
+// refuses to change still return ErrImmutableField.
+func (self *RaftNode) GracefulRestart(cfg NodeConfig) error { // {{{1
+    reply := make(chan error, 1)
+    self.notifch <- &restartLoop { cfg, reply }
+    return <-reply
+}
+
+func (self *RaftNode) restart(cfg NodeConfig) error {
+    asyncApply := cfg.AsyncApply
+    cfg.AsyncApply = self.cfg.AsyncApply
+    self.stopApplier()
+    err := self.reset(cfg)
+    if err == nil {
+        self.cfg.AsyncApply = asyncApply
+    }
+    self.startApplier()
+    return err
+}
@@ -0,0 +1,57 @@
+package raft
+
+import (
+    "errors"
+    "sync/atomic"
+)
+
+// Restore the node from an external snapshot (say, from a backup) taken at
+// snapshotIdx, whose entry is of snapshotTerm: the snapshot is saved (see
+// SnapshotPersister) and loaded into the machine (see SnapshotRestorer), and
+// snapshotIdx is taken as committed and applied. The node must be stopped
+// (see Exit); once Run again, it rejoins the cluster as a follower.
+//
+// The log is left as it is: the entries after snapshotIdx may be part of a
+// commit quorum, so they are applied again as they are (re)committed. Since
+// the log cannot start after index 0, snapshotIdx must be in the log, with
+// the same term, lest the snapshot be of another history.
+func (self *RaftNode) Restore(snapshotIdx, snapshotTerm uint64, data []byte) error { // {{{1
+    if atomic.LoadInt32(&self.running) != 0 {
+        return ErrRunning
+    }
+    spster, ok := self.pster.(SnapshotPersister)
+    if !ok {
+        return errors.New("Persister cannot store snapshots")
+    }
+    restorer, ok := self.machn.(SnapshotRestorer)
+    if !ok {
+        return errors.New("Machine cannot restore snapshots")
+    }
+    if lastIdx, _ := self.logTail(); snapshotIdx == 0 || snapshotIdx > lastIdx {
+        return errors.New("Snapshot index is not in the log")
+    } else if self.log(snapshotIdx).Term != snapshotTerm {
+        return errors.New("Snapshot term does not match the log")
+    }
+
+    if !spster.SaveSnapshot(snapshotTerm, snapshotIdx, data) {
+        return errors.New("Unable to save the snapshot")
+    }
+    if err := restorer.RestoreSnapshot(snapshotIdx, data); err != nil {
+        return err
+    }
+
+    self.state, self.voteSet = Follower, nil
+    self.nextIdx, self.matchIdx, self.windows, self.backoffs = nil, nil, nil, nil
+    self.leaderReady, self.pendingReads = false, nil
+    self.failCommitReads()
+    self.failSnapWaits()
+    self.failBulkLoad()
+    self.idxOfUid = nil // rebuilt if this node becomes the leader
+    self.snapIdxs = make(map[uint64]bool)
+    self.lastSnapIdx = snapshotIdx
+    self.lastAppld, self.appldQueued = snapshotIdx, snapshotIdx
+    self.publishApplied()
+    self.setCommitIdx(snapshotIdx) // possibly below the old lastAppld
+    self.setCaughtUp(false)
+    return nil
+}
@@ -0,0 +1,62 @@
+package raft
+
+import "fmt"
+
+// Hand msg to the node as if a peer had sent it, and return what the node
+// replied to that peer (or nil, if it did not reply, as to a stale message).
+// Only the messages which peers exchange are accepted: AppendEntries,
+// VoteRequest and Ping (which get a reply), and AppendReply, VoteReply,
+// TimeoutNow and Pong (which never do). Meant for tests and admin tools;
+// everything else the node sends meanwhile still goes through the Messenger.
+func (self *RaftNode) RPC(msg Message) (Message, error) { // {{{1
+    switch msg.(type) {
+    case *AppendEntries, *VoteRequest, *Ping, *AppendReply, *VoteReply, *TimeoutNow, *Pong:
+    default:
+        return nil, fmt.Errorf("RPC cannot deliver a %T", msg)
+    }
+    reply := make(chan Message, 1)
+    self.notifch <- &rpcCall { msg, reply }
+    return <-reply, nil
+}
+
+// Catches the reply to the sender of an RPC, and passes on the rest
+type rpcMsger struct {
+    Messenger
+    nodeId uint32
+    reply Message
+}
+
+func (self *rpcMsger) Send(nodeId uint32, msg Message) {
+    if nodeId == self.nodeId && self.reply == nil {
+        self.reply = msg
+    } else {
+        self.Messenger.Send(nodeId, msg)
+    }
+}
+
+func (self *RaftNode) rpc(msg Message) Message {
+    var sender uint32
+    switch m := msg.(type) {
+    case *AppendEntries:
+        sender = m.LeaderId
+    case *VoteRequest:
+        sender = m.CandidId
+    case *Ping:
+        sender = m.NodeId
+    case *Pong:
+        self.handlePing(msg)
+        return nil
+    default: // nothing is sent back to the sender of the rest
+        self.dispatch(msg)
+        return nil
+    }
+    msger := &rpcMsger { self.msger, sender, nil }
+    self.msger = msger
+    defer func() { self.msger = msger.Messenger }()
+    if _, ok := msg.(*Ping); ok {
+        self.handlePing(msg)
+    } else {
+        self.dispatch(msg)
+    }
+    return msger.reply
+}
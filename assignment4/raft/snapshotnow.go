@@ -0,0 +1,126 @@
+package raft
+
+import (
+    "context"
+    "errors"
+    "sort"
+    "sync/atomic"
+)
+
+// A SnapshotNow call waiting for its snapshot to be persisted
+type snapWait struct {
+    idx uint64
+    reply chan<- snapshotAtReply
+}
+
+// Take a snapshot on every node right away (as SnapshotAt(0) does), and block
+// until this node has persisted its own (see SnapshotSerializer); returns the
+// index of the snapshot. Only a leader can do this; ErrNotLeader is returned
+// otherwise, or if the node steps down before the snapshot is taken.
+//
+// Once persisted, the snapshot is loaded (instead of executing the entries up
+// to its index again) whenever the node is created with this persister.
+func (self *RaftNode) SnapshotNow(ctx context.Context) (uint64, error) { // {{{1
+    reply := make(chan snapshotAtReply, 1)
+    select {
+    case self.notifch <- &snapshotNow { reply }:
+    case <-ctx.Done():
+        return 0, ctx.Err()
+    }
+    select {
+    case r := <-reply:
+        return r.idx, r.err
+    case <-ctx.Done():
+        return 0, ctx.Err() // the reply is dropped into the buffer
+    }
+}
+
+func (self *RaftNode) startSnapshotNow(reply chan<- snapshotAtReply) {
+    if _, ok := self.pster.(SnapshotPersister); !ok {
+        reply <- snapshotAtReply { 0, errors.New("Persister cannot store snapshots") }
+        return
+    } else if _, ok := self.machn.(SnapshotSerializer); !ok {
+        reply <- snapshotAtReply { 0, errors.New("Machine cannot serialize snapshots") }
+        return
+    }
+    idx, err := self.snapshotAt(0)
+    if err != nil {
+        reply <- snapshotAtReply { 0, err }
+        return
+    }
+    self.snapWaits = append(self.snapWaits, &snapWait { idx, reply })
+}
+
+// Persist the snapshots serialized while executing ops, and answer the
+// SnapshotNow calls waiting for them
+func (self *RaftNode) saveSnapshots(ops []applyOp) {
+    spster, ok := self.pster.(SnapshotPersister)
+    if _, canSerialize := self.machn.(SnapshotSerializer); !ok || !canSerialize {
+        return // and so no one is waiting (see startSnapshotNow)
+    }
+    for _, op := range ops {
+        if len(op.entries) > 0 {
+            continue
+        }
+        err := op.snapErr
+        if err == nil && !spster.SaveSnapshot(op.snapTerm, op.snapIdx, op.snapData) {
+            err = errors.New("Unable to save the snapshot")
+        }
+        if err != nil {
+            self.err.Printf("snapshot at %v not saved: %v", op.snapIdx, err)
+        }
+        waiting := self.snapWaits[:0]
+        for _, w := range self.snapWaits {
+            if w.idx == op.snapIdx {
+                w.reply <- snapshotAtReply { w.idx, err }
+            } else {
+                waiting = append(waiting, w)
+            }
+        }
+        self.snapWaits = waiting
+    }
+}
+
+func (self *RaftNode) failSnapWaits() {
+    for _, w := range self.snapWaits {
+        w.reply <- snapshotAtReply { 0, ErrNotLeader }
+    }
+    self.snapWaits = nil
+}
+
+// Load the latest persisted snapshot of those marked in the log (see
+// SnapshotMarker) into the machine, and take it as committed and applied
+func (self *RaftNode) loadSnapshot() error {
+    spster, ok := self.pster.(SnapshotPersister)
+    restorer, canRestore := self.machn.(SnapshotRestorer)
+    if !ok || !canRestore {
+        return nil
+    }
+    lastIdx, _ := self.logTail()
+    var snapIdxs []uint64
+    for idx := lastIdx; idx > 0; idx -= 1 {
+        entry := self.log(idx)
+        if entry == nil || entry.CEntry == nil {
+            continue
+        }
+        if marker, ok := entry.CEntry.Data.(*SnapshotMarker); ok && marker.Idx <= lastIdx {
+            snapIdxs = append(snapIdxs, marker.Idx)
+        }
+    }
+    sort.Slice(snapIdxs, func(i, j int) bool { return snapIdxs[i] > snapIdxs[j] })
+    for _, snapIdx := range snapIdxs {
+        data, ok := spster.LoadSnapshot(self.log(snapIdx).Term, snapIdx)
+        if !ok {
+            continue // not taken before the crash, or dropped since
+        }
+        if err := restorer.RestoreSnapshot(snapIdx, data); err != nil {
+            return err
+        }
+        self.lastSnapIdx = snapIdx
+        self.commitIdx, self.lastAppld, self.appldQueued = snapIdx, snapIdx, snapIdx
+        atomic.StoreUint64(&self.commitIdxAtomic, snapIdx)
+        self.publishApplied()
+        return nil
+    }
+    return nil
+}
@@ -0,0 +1,26 @@
+package raft
+
+// Counts of the election outcomes of a node, since it was created or since
+// the last ResetStats
+type ElectionStats struct {
+    Started uint64 // elections started (one per term campaigned in)
+    Won uint64
+    // elections given up, on finding a leader or a higher term, or on timing
+    // out to start another one
+    Lost uint64
+    SteppedDown uint64 // times this node stopped being the leader
+}
+
+// Read from within the event loop, like Status
+func (self *RaftNode) ElectionStats() ElectionStats { // {{{1
+    reply := make(chan ElectionStats, 1)
+    self.notifch <- &electionStats { false, reply }
+    return <-reply
+}
+
+// Zero the counters of ElectionStats (say, between test cases)
+func (self *RaftNode) ResetStats() { // {{{1
+    reply := make(chan ElectionStats, 1)
+    self.notifch <- &electionStats { true, reply }
+    <-reply
+}
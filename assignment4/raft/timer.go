@@ -2,19 +2,29 @@ package raft
 
 import "time"
 
+// The timeouts are time.Timer-s, which run on the monotonic clock, so a step of
+// the wall clock (e.g. by NTP) does not move them
 type RaftTimer struct {
     version uint64
     funcGen func(uint64) func()
     sampler func(RaftState) time.Duration
     t *time.Timer
+    done chan struct{} // closed by Stop
+    deadline time.Time // when the pending timeout is due
+    dur time.Duration // the last sampled duration
+    excused bool // the last timeout was Overslept
 }
 
 func NewRaftTimer(ff func(uint64) func(), tf func(RaftState) time.Duration) *RaftTimer {
-    return &RaftTimer { 0, ff, tf, nil }
+    return &RaftTimer { version: 0, funcGen: ff, sampler: tf, t: nil, done: make(chan struct{}) }
 }
 
 func (self *RaftTimer) Reset(rs RaftState) {
+    if self.Stopped() {
+        return
+    }
     dur := self.sampler(rs)
+    self.deadline, self.dur = time.Now().Add(dur), dur
     if self.t == nil || !self.t.Reset(dur) {
         self.version += 1
         self.t = time.AfterFunc(dur, self.funcGen(self.version))
@@ -24,3 +34,39 @@ func (self *RaftTimer) Reset(rs RaftState) {
 func (self *RaftTimer) Match(v uint64) bool {
     return self.version == v
 }
+
+// Whether the due timeout (matched) arrived more than a whole duration late,
+// as after the process or VM was paused; everyone else was likely paused too,
+// or the leader's heartbeats are waiting right behind it. It is true at most
+// once in a row, so that a node which is just slow still times out.
+func (self *RaftTimer) Overslept() bool {
+    late := time.Since(self.deadline) > self.dur
+    self.excused = late && !self.excused
+    return self.excused
+}
+
+// Stop the timer for good; a callback that has already fired should give up
+// (instead of blocking) once Done is closed
+func (self *RaftTimer) Stop() {
+    if self.Stopped() {
+        return
+    }
+    if self.t != nil {
+        self.t.Stop()
+    }
+    self.version += 1 // no pending timeout matches anymore
+    close(self.done)
+}
+
+func (self *RaftTimer) Done() <-chan struct{} {
+    return self.done
+}
+
+func (self *RaftTimer) Stopped() bool {
+    select {
+    case <-self.done:
+        return true
+    default:
+        return false
+    }
+}
@@ -0,0 +1,56 @@
+package raft
+
+// Tracks the unacknowledged entries sent to a peer (see LeaderWindowSize)
+type sendWindow struct {
+    batches []sentBatch
+    size uint64 // total size of all the batches
+}
+
+type sentBatch struct {
+    lastIdx uint64
+    size uint64
+}
+
+func (self *sendWindow) add(lastIdx uint64, size uint64) {
+    self.batches = append(self.batches, sentBatch { lastIdx, size })
+    self.size += size
+}
+
+// Release all the batches up to (and including) idx
+func (self *sendWindow) ack(idx uint64) {
+    for len(self.batches) > 0 && self.batches[0].lastIdx <= idx {
+        self.size -= self.batches[0].size
+        self.batches = self.batches[1:]
+    }
+}
+
+func (self *sendWindow) reset() {
+    self.batches = nil
+    self.size = 0
+}
+
+// Trim entries (to be sent starting at startIdx) to fit in the window of
+// nodeId; an oversized entry is let through only if the window is empty
+func (self *RaftNode) fitWindow(nodeId uint32, startIdx uint64, entries []RaftEntry) []RaftEntry {
+    win := self.windows[nodeId]
+    var size uint64 = 0
+    for i := range entries {
+        esize := self.entrySize(&entries[i])
+        if win.size + size + esize > self.cfg.LeaderWindowSize && (i > 0 || win.size > 0) {
+            entries = entries[:i]
+            break
+        }
+        size += esize
+    }
+    if len(entries) > 0 {
+        win.add(startIdx + uint64(len(entries)) - 1, size)
+    }
+    return entries
+}
+
+func (self *RaftNode) entrySize(entry *RaftEntry) uint64 {
+    if self.cfg.EntrySize == nil {
+        return 1
+    }
+    return self.cfg.EntrySize(entry)
+}
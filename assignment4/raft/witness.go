@@ -0,0 +1,36 @@
+package raft
+
+// A witness stores log entries without their payload (ClientEntry.Data), so it
+// can take part in elections and commits without storing the whole state. It
+// never campaigns, since it could not replicate the entries it does not have.
+
+func (self *RaftNode) isWitness(nodeId uint32) bool {
+    for _, id := range self.cfg.Witnesses {
+        if id == nodeId { return true }
+    }
+    return false
+}
+
+// Copy entries with the payloads stripped out; UIDs and raft-internal
+// commands are kept as they are
+func witnessEntries(entries []RaftEntry) []RaftEntry {
+    stripped := make([]RaftEntry, len(entries))
+    for i, entry := range entries {
+        stripped[i] = entry
+        if entry.CEntry == nil {
+            continue
+        }
+        switch data := entry.CEntry.Data.(type) {
+        case *SnapshotMarker, *ClockEntry:
+        case *BatchClientEntry:
+            batch := &BatchClientEntry { make([]ClientEntry, len(data.Entries)) }
+            for j, e := range data.Entries {
+                batch.Entries[j] = ClientEntry { e.UID, nil }
+            }
+            stripped[i].CEntry = &ClientEntry { entry.CEntry.UID, batch }
+        default:
+            stripped[i].CEntry = &ClientEntry { entry.CEntry.UID, nil }
+        }
+    }
+    return stripped
+}
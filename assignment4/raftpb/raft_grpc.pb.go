@@ -0,0 +1,251 @@
+// Messages and services of the gRPC messenger (see GrpcMsger in package main)
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             v5.27.2
+// source: raft.proto
+
+package raftpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	Peer_Stream_FullMethodName = "/raftpb.Peer/Stream"
+)
+
+// PeerClient is the client API for Peer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Between the nodes of a cluster; every message goes one way (replies are
+// messages of their own), in order, over a stream per peer
+type PeerClient interface {
+	Stream(ctx context.Context, opts ...grpc.CallOption) (Peer_StreamClient, error)
+}
+
+type peerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPeerClient(cc grpc.ClientConnInterface) PeerClient {
+	return &peerClient{cc}
+}
+
+func (c *peerClient) Stream(ctx context.Context, opts ...grpc.CallOption) (Peer_StreamClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Peer_ServiceDesc.Streams[0], Peer_Stream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &peerStreamClient{ClientStream: stream}
+	return x, nil
+}
+
+type Peer_StreamClient interface {
+	Send(*PeerMessage) error
+	CloseAndRecv() (*StreamClose, error)
+	grpc.ClientStream
+}
+
+type peerStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *peerStreamClient) Send(m *PeerMessage) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *peerStreamClient) CloseAndRecv() (*StreamClose, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(StreamClose)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// PeerServer is the server API for Peer service.
+// All implementations must embed UnimplementedPeerServer
+// for forward compatibility
+//
+// Between the nodes of a cluster; every message goes one way (replies are
+// messages of their own), in order, over a stream per peer
+type PeerServer interface {
+	Stream(Peer_StreamServer) error
+	mustEmbedUnimplementedPeerServer()
+}
+
+// UnimplementedPeerServer must be embedded to have forward compatible implementations.
+type UnimplementedPeerServer struct {
+}
+
+func (UnimplementedPeerServer) Stream(Peer_StreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method Stream not implemented")
+}
+func (UnimplementedPeerServer) mustEmbedUnimplementedPeerServer() {}
+
+// UnsafePeerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PeerServer will
+// result in compilation errors.
+type UnsafePeerServer interface {
+	mustEmbedUnimplementedPeerServer()
+}
+
+func RegisterPeerServer(s grpc.ServiceRegistrar, srv PeerServer) {
+	s.RegisterService(&Peer_ServiceDesc, srv)
+}
+
+func _Peer_Stream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(PeerServer).Stream(&peerStreamServer{ServerStream: stream})
+}
+
+type Peer_StreamServer interface {
+	SendAndClose(*StreamClose) error
+	Recv() (*PeerMessage, error)
+	grpc.ServerStream
+}
+
+type peerStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *peerStreamServer) SendAndClose(m *StreamClose) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *peerStreamServer) Recv() (*PeerMessage, error) {
+	m := new(PeerMessage)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Peer_ServiceDesc is the grpc.ServiceDesc for Peer service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Peer_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "raftpb.Peer",
+	HandlerType: (*PeerServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Stream",
+			Handler:       _Peer_Stream_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "raft.proto",
+}
+
+const (
+	Client_Request_FullMethodName = "/raftpb.Client/Request"
+)
+
+// ClientClient is the client API for Client service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// For clients; a request is the same as on the TCP client port (like
+// "read 0x1 foo\r\n", see ParseRequest), and so is the response (without the
+// trailing "\r\n")
+type ClientClient interface {
+	Request(ctx context.Context, in *ClientRequest, opts ...grpc.CallOption) (*ClientResponse, error)
+}
+
+type clientClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewClientClient(cc grpc.ClientConnInterface) ClientClient {
+	return &clientClient{cc}
+}
+
+func (c *clientClient) Request(ctx context.Context, in *ClientRequest, opts ...grpc.CallOption) (*ClientResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ClientResponse)
+	err := c.cc.Invoke(ctx, Client_Request_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ClientServer is the server API for Client service.
+// All implementations must embed UnimplementedClientServer
+// for forward compatibility
+//
+// For clients; a request is the same as on the TCP client port (like
+// "read 0x1 foo\r\n", see ParseRequest), and so is the response (without the
+// trailing "\r\n")
+type ClientServer interface {
+	Request(context.Context, *ClientRequest) (*ClientResponse, error)
+	mustEmbedUnimplementedClientServer()
+}
+
+// UnimplementedClientServer must be embedded to have forward compatible implementations.
+type UnimplementedClientServer struct {
+}
+
+func (UnimplementedClientServer) Request(context.Context, *ClientRequest) (*ClientResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Request not implemented")
+}
+func (UnimplementedClientServer) mustEmbedUnimplementedClientServer() {}
+
+// UnsafeClientServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ClientServer will
+// result in compilation errors.
+type UnsafeClientServer interface {
+	mustEmbedUnimplementedClientServer()
+}
+
+func RegisterClientServer(s grpc.ServiceRegistrar, srv ClientServer) {
+	s.RegisterService(&Client_ServiceDesc, srv)
+}
+
+func _Client_Request_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClientRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClientServer).Request(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Client_Request_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClientServer).Request(ctx, req.(*ClientRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Client_ServiceDesc is the grpc.ServiceDesc for Client service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Client_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "raftpb.Client",
+	HandlerType: (*ClientServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Request",
+			Handler:    _Client_Request_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "raft.proto",
+}
@@ -0,0 +1,154 @@
+// Package testutil holds tests shared by the implementations of the
+// interfaces in package raft.
+package testutil
+
+import (
+	"github.com/critiqjo/cs733/assignment4/raft"
+	"reflect"
+	"testing"
+)
+
+func contractEntries(first, n uint64, term uint64) []raft.RaftEntry {
+	var entries []raft.RaftEntry
+	for idx := first; idx < first+n; idx += 1 {
+		entries = append(entries, raft.RaftEntry{
+			Term:   term,
+			CEntry: &raft.ClientEntry{UID: 1000 + idx, Data: "Yo!"},
+		})
+	}
+	return entries
+}
+
+// Check a Persister against the contract documented in raft.Persister.
+// factory must return a new, empty persister on every call (cleaning it up,
+// if needed, is up to the factory; e.g. via t.Cleanup).
+func PersisterContractTest(t *testing.T, factory func() raft.Persister) {
+	t.Run("Empty", func(t *testing.T) {
+		pster := factory()
+		if idx, entry := pster.LastEntry(); idx != 0 || entry != nil {
+			t.Fatal("LastEntry of an empty log:", idx, entry)
+		}
+		if entry := pster.Entry(0); entry != nil {
+			t.Fatal("Entry of an empty log:", entry)
+		}
+		if fields := pster.GetFields(); fields != nil {
+			t.Fatal("GetFields without SetFields:", fields)
+		}
+		if pster.LogUpdate(1, contractEntries(1, 1, 0)) {
+			t.Fatal("LogUpdate left a gap at the head")
+		}
+	})
+
+	t.Run("Append", func(t *testing.T) {
+		pster := factory()
+		entries := contractEntries(0, 4, 1)
+		if !pster.LogUpdate(0, entries[:1]) || !pster.LogUpdate(1, entries[1:]) {
+			t.Fatal("LogUpdate failed")
+		}
+		if err := pster.Fsync(); err != nil {
+			t.Fatal("Fsync failed:", err)
+		}
+		if idx, entry := pster.LastEntry(); idx != 3 || !reflect.DeepEqual(entry, &entries[3]) {
+			t.Fatal("Bad LastEntry:", idx, entry)
+		}
+		for idx := range entries {
+			if entry := pster.Entry(uint64(idx)); !reflect.DeepEqual(entry, &entries[idx]) {
+				t.Fatal("Bad Entry:", idx, entry)
+			}
+		}
+		if entry := pster.Entry(4); entry != nil {
+			t.Fatal("Entry beyond the tail:", entry)
+		}
+		if pster.LogUpdate(5, contractEntries(5, 1, 1)) {
+			t.Fatal("LogUpdate left a gap after the tail")
+		}
+		if !pster.LogUpdate(4, nil) {
+			t.Fatal("Empty LogUpdate at the tail failed")
+		}
+		if idx, _ := pster.LastEntry(); idx != 3 {
+			t.Fatal("Empty LogUpdate changed the tail:", idx)
+		}
+	})
+
+	t.Run("Truncate", func(t *testing.T) {
+		pster := factory()
+		entries := contractEntries(0, 6, 1)
+		if !pster.LogUpdate(0, entries) {
+			t.Fatal("LogUpdate failed")
+		}
+		rewrite := contractEntries(2, 2, 2)
+		if !pster.LogUpdate(2, rewrite) {
+			t.Fatal("Overwriting LogUpdate failed")
+		}
+		if idx, entry := pster.LastEntry(); idx != 3 || !reflect.DeepEqual(entry, &rewrite[1]) {
+			t.Fatal("Bad LastEntry after truncation:", idx, entry)
+		}
+		if entry := pster.Entry(4); entry != nil {
+			t.Fatal("Truncated entry is still there:", entry)
+		}
+		want := append(append([]raft.RaftEntry(nil), entries[:2]...), rewrite...)
+		if slice, ok := pster.LogSlice(0, 9); !ok || !reflect.DeepEqual(slice, want) {
+			t.Fatal("Bad log after truncation:", slice)
+		}
+	})
+
+	t.Run("LogSlice", func(t *testing.T) {
+		pster := factory()
+		entries := contractEntries(0, 4, 1)
+		if !pster.LogUpdate(0, entries) {
+			t.Fatal("LogUpdate failed")
+		}
+		if slice, ok := pster.LogSlice(1, 3); !ok || !reflect.DeepEqual(slice, entries[1:3]) {
+			t.Fatal("Bad slice:", slice)
+		}
+		if slice, ok := pster.LogSlice(2, 9); !ok || !reflect.DeepEqual(slice, entries[2:]) {
+			t.Fatal("Bad slice beyond the tail:", slice)
+		}
+		if slice, ok := pster.LogSlice(4, 9); !ok || slice != nil {
+			t.Fatal("Bad slice at the tail:", slice, ok)
+		}
+		if _, ok := pster.LogSlice(5, 9); ok {
+			t.Fatal("Slice after the tail")
+		}
+		if _, ok := pster.LogSlice(3, 2); ok {
+			t.Fatal("Slice with startIdx > endIdx")
+		}
+	})
+
+	t.Run("CRC32", func(t *testing.T) {
+		pster := factory()
+		if crc := pster.CRC32(); crc != 0 {
+			t.Fatal("CRC32 of an empty log:", crc)
+		}
+		entries := contractEntries(0, 4, 1)
+		if !pster.LogUpdate(0, entries) {
+			t.Fatal("LogUpdate failed")
+		}
+		crc := pster.CRC32()
+		if crc == 0 {
+			t.Fatal("CRC32 did not change on LogUpdate")
+		}
+		if !pster.LogUpdate(2, contractEntries(2, 1, 2)) || pster.CRC32() == crc {
+			t.Fatal("CRC32 did not change on an overwriting LogUpdate")
+		}
+		if !pster.LogUpdate(2, entries[2:]) || pster.CRC32() != crc {
+			t.Fatal("CRC32 differs for the same log:", pster.CRC32(), crc)
+		}
+	})
+
+	t.Run("Fields", func(t *testing.T) {
+		pster := factory()
+		for _, fields := range []raft.RaftFields{
+			{Term: 1, VotedFor: 2, HasVoted: true},
+			{Term: 3},
+			{Term: 4, VotedFor: raft.NilNode, HasVoted: true},
+		} {
+			if !pster.SetFields(fields) {
+				t.Fatal("SetFields failed")
+			}
+			if got := pster.GetFields(); !reflect.DeepEqual(got, &fields) {
+				t.Fatal("Bad fields:", got, fields)
+			}
+		}
+	})
+}
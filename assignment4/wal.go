@@ -0,0 +1,669 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/critiqjo/cs733/assignment4/raft"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Persister that keeps the log as a sequence of segment files (a write-ahead
+// log), each with a companion index file recording the offset, length and term
+// of every entry in it. The indices are loaded into memory on open, so that
+// looking up any entry, including the tail, does not need any scanning.
+// Segments are rotated once they grow beyond WalOpts.SegmentSize, which lets
+// a prefix of the log be dropped cheaply by deleting whole segments (see
+// TruncatePrefix).
+//
+// Every entry also has a rolling checksum (see CRC32), verified on open.
+//
+// With group commit (see SetGroupCommit), LogUpdate leaves the segments it
+// writes to unsynced, and waits for a flush that syncs the segments written by
+// every LogUpdate since the previous one.
+//
+// Directory layout:
+//
+//	<first-index>.wal  concatenated entry blobs (see LogValEncEx)
+//	<first-index>.idx  one walIdxRec per entry in the segment
+//	<first-index>.crc  rolling CRC32 of the blobs up to each entry (4 bytes each)
+//	fields             RaftFields (replaced atomically on every update)
+//	commit             commit index (see raft.CommitPersister)
+//	<term>-<index>.snap  machine snapshots (see raft.SnapshotPersister)
+type WalPster struct {
+	mutex   sync.Mutex
+	dir     string
+	segs    []*walSegment // in log order; the last one is being appended to
+	segSize int64
+	comp    Compressor // nil unless compression is enabled
+	group   *groupCommit
+	dirty   map[*walSegment]bool // segments to sync in the next group flush
+	err     *log.Logger
+}
+
+type WalOpts struct {
+	// Size (in bytes) beyond which a new segment is started (default 4 MB)
+	SegmentSize int64
+	// If not nil, log entries are compressed before writing (a log has to be
+	// always opened with the same Compressor)
+	Compressor Compressor
+}
+
+type walSegment struct {
+	first uint64 // log index of the first entry
+	data  *os.File
+	index *os.File
+	crc   *os.File
+	recs  []walIdxRec
+	crcs  []uint32 // rolling checksum up to (and including) each entry
+	size  int64    // bytes in use in data
+}
+
+type walIdxRec struct {
+	Off  uint64
+	Len  uint32
+	Term uint64
+}
+
+const walIdxRecSize = 20
+
+var errWalCorrupt = errors.New("Corrupted WAL!")
+
+func NewWalPster(dir string, opts WalOpts, errlog *log.Logger) (*WalPster, error) { // {{{1
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = 4 << 20
+	}
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if err != nil {
+		return nil, err
+	}
+	var firsts []uint64
+	for _, name := range names {
+		first, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".wal"), 10, 64)
+		if err != nil {
+			continue // not ours
+		}
+		firsts = append(firsts, first)
+	}
+	sort.Slice(firsts, func(i, j int) bool { return firsts[i] < firsts[j] })
+
+	pster := &WalPster{
+		dir:     dir,
+		segs:    nil,
+		segSize: opts.SegmentSize,
+		comp:    opts.Compressor,
+		group:   nil,
+		dirty:   make(map[*walSegment]bool),
+		err:     errlog,
+	}
+	for i, first := range firsts {
+		if i > 0 && first != pster.next() {
+			pster.Close()
+			return nil, errWalCorrupt
+		}
+		seg, err := pster.openSegment(first)
+		if err != nil {
+			pster.Close()
+			return nil, err
+		}
+		pster.segs = append(pster.segs, seg)
+	}
+	if err := pster.checkCRCs(true); err != nil {
+		pster.Close()
+		return nil, err
+	}
+	return pster, nil
+}
+
+func (self *WalPster) segPath(first uint64, ext string) string {
+	return filepath.Join(self.dir, fmt.Sprintf("%020d.%v", first, ext))
+}
+
+// Open (or create) a segment, and recover it to its last complete entry
+func (self *WalPster) openSegment(first uint64) (*walSegment, error) {
+	data, err := os.OpenFile(self.segPath(first, "wal"), os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, err
+	}
+	index, err := os.OpenFile(self.segPath(first, "idx"), os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	crc, err := os.OpenFile(self.segPath(first, "crc"), os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		data.Close()
+		index.Close()
+		return nil, err
+	}
+	seg := &walSegment{first: first, data: data, index: index, crc: crc}
+	blob, err := ioutil.ReadAll(index)
+	if err == nil {
+		var dataInfo os.FileInfo
+		dataInfo, err = data.Stat()
+		if err == nil {
+			seg.load(blob, dataInfo.Size())
+			blob, err = ioutil.ReadAll(crc)
+		}
+		if err == nil {
+			seg.loadCRCs(blob)
+			err = seg.truncate(uint64(len(seg.recs)))
+		}
+	}
+	if err != nil {
+		seg.close()
+		return nil, err
+	}
+	return seg, nil
+}
+
+// Load index records, stopping at the first one not backed by data (which
+// can only be the result of a crash in the middle of an append)
+func (self *walSegment) load(blob []byte, dataSize int64) {
+	buf := bytes.NewBuffer(blob)
+	for buf.Len() >= walIdxRecSize {
+		var rec walIdxRec
+		binaryMustDec(buf.Next(walIdxRecSize), &rec)
+		end := int64(rec.Off) + int64(rec.Len)
+		if int64(rec.Off) != self.size || end > dataSize {
+			break
+		}
+		self.recs = append(self.recs, rec)
+		self.size = end
+	}
+}
+
+// Load the checksums of the loaded entries; the ones missing (after a crash in
+// the middle of an append, or in a log written without them) are left to
+// checkCRCs
+func (self *walSegment) loadCRCs(blob []byte) {
+	for len(blob) >= 4 && len(self.crcs) < len(self.recs) {
+		self.crcs = append(self.crcs, binary.BigEndian.Uint32(blob))
+		blob = blob[4:]
+	}
+}
+
+func (self *walSegment) next() uint64 {
+	return self.first + uint64(len(self.recs))
+}
+
+func (self *walSegment) blob(idx uint64) ([]byte, error) {
+	rec := self.recs[idx-self.first]
+	blob := make([]byte, rec.Len)
+	_, err := self.data.ReadAt(blob, int64(rec.Off))
+	return blob, err
+}
+
+// Keep only the first n entries
+func (self *walSegment) truncate(n uint64) error {
+	if n < uint64(len(self.recs)) {
+		self.recs = self.recs[:n]
+		self.size = 0
+		if n > 0 {
+			self.size = int64(self.recs[n-1].Off) + int64(self.recs[n-1].Len)
+		}
+	}
+	if n < uint64(len(self.crcs)) {
+		self.crcs = self.crcs[:n]
+	}
+	if err := self.index.Truncate(int64(n) * walIdxRecSize); err != nil {
+		return err
+	}
+	if err := self.crc.Truncate(int64(len(self.crcs)) * 4); err != nil {
+		return err
+	}
+	return self.data.Truncate(self.size)
+}
+
+// prevCRC is the checksum up to the previous entry
+func (self *walSegment) append(term uint64, blob []byte, prevCRC uint32) error {
+	rec := walIdxRec{Off: uint64(self.size), Len: uint32(len(blob)), Term: term}
+	if _, err := self.data.WriteAt(blob, self.size); err != nil {
+		return err
+	}
+	recOff := int64(len(self.recs)) * walIdxRecSize
+	if _, err := self.index.WriteAt(binaryMustEnc(&rec, walIdxRecSize), recOff); err != nil {
+		return err
+	}
+	self.recs = append(self.recs, rec)
+	self.size += int64(len(blob))
+	return self.appendCRC(crc32.Update(prevCRC, crc32.IEEETable, blob))
+}
+
+func (self *walSegment) appendCRC(crc uint32) error {
+	var blob [4]byte
+	binary.BigEndian.PutUint32(blob[:], crc)
+	if _, err := self.crc.WriteAt(blob[:], int64(len(self.crcs))*4); err != nil {
+		return err
+	}
+	self.crcs = append(self.crcs, crc)
+	return nil
+}
+
+func (self *walSegment) sync() error {
+	if err := self.data.Sync(); err != nil {
+		return err
+	}
+	if err := self.index.Sync(); err != nil {
+		return err
+	}
+	return self.crc.Sync()
+}
+
+func (self *walSegment) close() {
+	self.data.Close()
+	self.index.Close()
+	self.crc.Close()
+}
+
+func (self *walSegment) remove() {
+	self.close()
+	os.Remove(self.data.Name())
+	os.Remove(self.index.Name())
+	os.Remove(self.crc.Name())
+}
+
+// ---- private utility methods {{{1
+// Index of the first entry (0 if the log is empty)
+func (self *WalPster) first() uint64 {
+	if len(self.segs) == 0 {
+		return 0
+	}
+	return self.segs[0].first
+}
+
+// Index that the next appended entry would get
+func (self *WalPster) next() uint64 {
+	if len(self.segs) == 0 {
+		return 0
+	}
+	return self.segs[len(self.segs)-1].next()
+}
+
+// Segment containing idx, or nil if out of bounds
+func (self *WalPster) segment(idx uint64) *walSegment {
+	if idx < self.first() || idx >= self.next() {
+		return nil
+	}
+	i := sort.Search(len(self.segs), func(i int) bool {
+		return self.segs[i].first > idx
+	})
+	return self.segs[i-1]
+}
+
+func (self *WalPster) entry(idx uint64) *raft.RaftEntry {
+	seg := self.segment(idx)
+	if seg == nil {
+		return nil
+	}
+	blob, err := seg.blob(idx)
+	if err != nil {
+		self.err.Print(err.Error())
+		return nil // panic?
+	}
+	entry, err := LogValDecEx(blob, self.comp)
+	if err != nil {
+		self.err.Print(err.Error())
+		return nil // panic?
+	}
+	return entry
+}
+
+// Checksum up to (and including) the entry at idx; 0 before the first entry
+// (which is also taken as the start after TruncatePrefix)
+func (self *WalPster) crcAt(idx uint64) uint32 {
+	seg := self.segment(idx)
+	if seg == nil {
+		return 0
+	}
+	return seg.crcs[idx-seg.first]
+}
+
+// Recompute the checksum of every entry from its blob, and compare it to the
+// stored one. If fill, missing checksums are computed and stored instead.
+// The first entry left by TruncatePrefix can only be checked against the ones
+// after it, since the checksum before it is gone.
+func (self *WalPster) checkCRCs(fill bool) error {
+	var prev uint32
+	for _, seg := range self.segs {
+		for i := range seg.recs {
+			idx := seg.first + uint64(i)
+			blob, err := seg.blob(idx)
+			if err != nil {
+				return err
+			}
+			crc := crc32.Update(prev, crc32.IEEETable, blob)
+			if i >= len(seg.crcs) {
+				if !fill {
+					return fmt.Errorf("Missing checksum of log entry %v", idx)
+				} else if err := seg.appendCRC(crc); err != nil {
+					return err
+				}
+			} else if seg.crcs[i] != crc && !(idx == self.first() && idx > 0) {
+				return fmt.Errorf("Checksum mismatch at log entry %v", idx)
+			}
+			prev = seg.crcs[i]
+		}
+		if fill {
+			if err := seg.crc.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Remove a segment, which the next group flush has nothing to sync in anymore
+func (self *WalPster) removeSegment(seg *walSegment) {
+	delete(self.dirty, seg)
+	seg.remove()
+}
+
+// Sync the segments written to since the previous group flush
+func (self *WalPster) syncDirty() error {
+	for seg := range self.dirty {
+		if err := seg.sync(); err != nil {
+			self.err.Print(err.Error())
+			return err
+		}
+		delete(self.dirty, seg)
+	}
+	return nil
+}
+
+func (self *WalPster) rotate(first uint64) error {
+	seg, err := self.openSegment(first)
+	if err != nil {
+		return err
+	}
+	if err = seg.truncate(0); err != nil { // leftovers of a crashed update
+		seg.remove()
+		return err
+	}
+	self.segs = append(self.segs, seg)
+	return nil
+}
+
+// ---- quack like a Persister {{{1
+func (self *WalPster) Entry(idx uint64) *raft.RaftEntry {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.entry(idx)
+}
+
+// The size of the stored (encoded, and maybe compressed) entry
+func (self *WalPster) EntrySize(idx uint64) uint64 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	seg := self.segment(idx)
+	if seg == nil {
+		return 0
+	}
+	return uint64(seg.recs[idx-seg.first].Len)
+}
+
+func (self *WalPster) LastEntry() (uint64, *raft.RaftEntry) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.next() == self.first() {
+		return 0, nil
+	}
+	lastIdx := self.next() - 1
+	entry := self.entry(lastIdx)
+	if entry == nil {
+		return 0, nil
+	}
+	return lastIdx, entry
+}
+
+func (self *WalPster) LogSlice(startIdx uint64, endIdx uint64) ([]raft.RaftEntry, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if startIdx < self.first() || startIdx > self.next() || startIdx > endIdx {
+		return nil, false
+	}
+	if endIdx > self.next() {
+		endIdx = self.next()
+	}
+	var entries []raft.RaftEntry
+	for idx := startIdx; idx < endIdx; idx += 1 {
+		entry := self.entry(idx)
+		if entry == nil {
+			panic("Corrupted log entry!")
+		}
+		entries = append(entries, *entry)
+	}
+	return entries, true
+}
+
+func (self *WalPster) LogUpdate(startIdx uint64, slice []raft.RaftEntry) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if startIdx < self.first() || startIdx > self.next() {
+		return false
+	}
+	if len(slice) == 0 {
+		return true // nothing to update
+	}
+
+	// truncate; segments starting at or after startIdx are dropped whole
+	for len(self.segs) > 0 && self.segs[len(self.segs)-1].first >= startIdx {
+		self.removeSegment(self.segs[len(self.segs)-1])
+		self.segs = self.segs[:len(self.segs)-1]
+	}
+	if len(self.segs) == 0 {
+		if err := self.rotate(startIdx); err != nil {
+			self.err.Print(err.Error())
+			return false
+		}
+	}
+	seg := self.segs[len(self.segs)-1]
+	if err := seg.truncate(startIdx - seg.first); err != nil {
+		self.err.Print(err.Error())
+		return false
+	}
+
+	dirty := []*walSegment{seg}
+	for i, entry := range slice { // append
+		blob, err := LogValEncEx(&entry, self.comp)
+		if err != nil {
+			panic("Impossible encode error!!")
+		}
+		if seg.size >= self.segSize {
+			if err := self.rotate(startIdx + uint64(i)); err != nil {
+				self.err.Print(err.Error())
+				return false
+			}
+			seg = self.segs[len(self.segs)-1]
+			dirty = append(dirty, seg)
+		}
+		if err := seg.append(entry.Term, blob, self.crcAt(startIdx+uint64(i)-1)); err != nil {
+			self.err.Print(err.Error())
+			return false
+		}
+	}
+	if self.group != nil {
+		for _, seg := range dirty {
+			self.dirty[seg] = true
+		}
+		return self.group.wait() == nil
+	}
+	for _, seg := range dirty {
+		if err := seg.sync(); err != nil {
+			self.err.Print(err.Error())
+			return false
+		}
+	}
+	return true
+}
+
+// LogUpdate already syncs the segments it writes to, and SetFields its file;
+// this syncs all the segments again, which is only needed if they were
+// written to by someone else
+func (self *WalPster) Fsync() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, seg := range self.segs {
+		for _, file := range []*os.File{seg.data, seg.index, seg.crc} {
+			if err := fdatasync(file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The rolling CRC32 (IEEE) of the stored blobs of all the entries, in order
+func (self *WalPster) CRC32() uint32 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.next() == self.first() {
+		return 0
+	}
+	return self.crcAt(self.next() - 1)
+}
+
+// Check the log against its checksums, to detect silent corruption (this
+// reads the whole log)
+func (self *WalPster) VerifyIntegrity() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.checkCRCs(false)
+}
+
+func (self *WalPster) GetFields() *raft.RaftFields {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	blob, err := ioutil.ReadFile(filepath.Join(self.dir, "fields"))
+	if err != nil {
+		return nil
+	}
+	return FieldsDec(blob)
+}
+
+func (self *WalPster) SetFields(fields raft.RaftFields) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return writeFileAtomic(filepath.Join(self.dir, "fields"), FieldsEnc(&fields)) == nil
+}
+
+// ---- quack like a CommitPersister {{{1
+
+func (self *WalPster) GetCommitIdx() uint64 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	blob, err := ioutil.ReadFile(filepath.Join(self.dir, "commit"))
+	if err != nil || len(blob) != 8 {
+		return 0
+	}
+	return U64Dec(blob)
+}
+
+// Not synced (it is written on every commit): a crash may leave an older index
+// in place, or an empty file (read as no index), both of which are safe
+func (self *WalPster) SetCommitIdx(idx uint64) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	path := filepath.Join(self.dir, "commit")
+	if err := ioutil.WriteFile(path+".tmp", U64Enc(idx), 0660); err != nil {
+		return false
+	}
+	return os.Rename(path+".tmp", path) == nil
+}
+
+// Replace the contents of path such that a crash leaves either the old or the
+// new contents in it
+func writeFileAtomic(path string, data []byte) error {
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	return err
+}
+
+// ---- quack like a SnapshotPersister {{{1
+func (self *WalPster) snapPath(term, idx uint64) string {
+	return filepath.Join(self.dir, fmt.Sprintf("%020d-%020d.snap", term, idx))
+}
+
+func (self *WalPster) SaveSnapshot(term, idx uint64, data []byte) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return writeFileAtomic(self.snapPath(term, idx), data) == nil
+}
+
+func (self *WalPster) LoadSnapshot(term, idx uint64) ([]byte, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	data, err := ioutil.ReadFile(self.snapPath(term, idx))
+	return data, err == nil
+}
+
+func (self *WalPster) DropSnapshot(term, idx uint64) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return os.Remove(self.snapPath(term, idx)) == nil
+}
+
+// Drop all the segments that lie entirely before idx. The segment holding the
+// last entry is always kept, so the log never becomes empty because of this.
+// Returns the index of the new first entry.
+func (self *WalPster) TruncatePrefix(idx uint64) uint64 { // {{{1
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	lastIdx := self.next() - 1
+	for len(self.segs) > 1 {
+		seg := self.segs[0]
+		if seg.next() > idx || seg.next() > lastIdx {
+			break
+		}
+		self.removeSegment(seg)
+		self.segs = self.segs[1:]
+	}
+	return self.first()
+}
+
+// ---- quack like a raft.GroupCommitter {{{1
+
+// Start group commit, unless it is on already: a LogUpdate then blocks until
+// the next group flush, which is done at most once in every interval
+func (self *WalPster) SetGroupCommit(interval time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.group == nil && interval > 0 {
+		self.group = newGroupCommit(&self.mutex, interval, self.syncDirty)
+	}
+}
+
+func (self *WalPster) Close() { // {{{1
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.group != nil {
+		self.group.stop()
+	}
+	for _, seg := range self.segs {
+		seg.close()
+	}
+	self.segs = nil
+}
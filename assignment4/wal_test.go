@@ -0,0 +1,393 @@
+package main
+
+import (
+	"compress/flate"
+	"github.com/critiqjo/cs733/assignment4/raft"
+	"github.com/critiqjo/cs733/assignment4/testutil"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func initWalPster(t *testing.T, dir string, segSize int64) *WalPster {
+	errlog := log.New(os.Stderr, "-- ", log.Lshortfile)
+	pster, err := NewWalPster(dir, WalOpts{SegmentSize: segSize}, errlog)
+	if err != nil {
+		t.Fatal("Creating persister failed:", err)
+	}
+	return pster
+}
+
+func walTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "testwal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func walSegments(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func walEntries(first, n uint64) []raft.RaftEntry {
+	var entries []raft.RaftEntry
+	for idx := first; idx < first+n; idx += 1 {
+		entries = append(entries, raft.RaftEntry{
+			Term:   idx / 4,
+			CEntry: &raft.ClientEntry{UID: 1000 + idx, Data: "Yo!"},
+		})
+	}
+	return entries
+}
+
+func TestWalPster(t *testing.T) { // {{{1
+	dir := walTestDir(t)
+	defer os.RemoveAll(dir)
+	pster := initWalPster(t, dir, 0)
+	defer pster.Close()
+
+	idx, entry := pster.LastEntry()
+	assert(t, idx == 0 && entry == nil, "Non-empty new log", idx, entry)
+	assert(t, pster.GetFields() == nil, "Fields in new log")
+	assert(t, !pster.LogUpdate(1, walEntries(1, 1)), "Appended beyond the tail")
+
+	entries := walEntries(0, 4)
+	assert(t, pster.LogUpdate(0, entries), "Failed to persist log entries")
+	fields := raft.RaftFields{Term: 20, VotedFor: 9, HasVoted: true}
+	assert(t, pster.SetFields(fields), "Failed to persist fields")
+	assert(t, pster.GetCommitIdx() == 0, "Commit index in new log")
+	assert(t, pster.SetCommitIdx(2), "Failed to persist commit index")
+
+	pster_dup := initWalPster(t, dir, 0)
+	idx, entry = pster_dup.LastEntry()
+	assert(t, idx == 3 && reflect.DeepEqual(entry, &entries[3]), "Bad tail", idx, entry)
+	slice, ok := pster_dup.LogSlice(1, 9)
+	assert(t, ok && reflect.DeepEqual(slice, entries[1:]), "Bad slice", slice)
+	slice, ok = pster_dup.LogSlice(4, 9)
+	assert(t, ok && slice == nil, "Bad slice at the tail", slice)
+	_, ok = pster_dup.LogSlice(5, 9)
+	assert(t, !ok, "Slice beyond the tail")
+	assert_eq(t, pster_dup.GetFields(), &fields, "Fields were not synced with disk!")
+	assert(t, pster_dup.GetCommitIdx() == 2, "Bad commit index", pster_dup.GetCommitIdx())
+	pster_dup.Close()
+
+	// truncate and overwrite
+	entries = walEntries(2, 3)
+	entries[0].Term = 7
+	assert(t, pster.LogUpdate(2, entries[:1]), "Failed to overwrite log entry")
+	idx, entry = pster.LastEntry()
+	assert(t, idx == 2 && reflect.DeepEqual(entry, &entries[0]), "Bad tail", idx, entry)
+	assert(t, pster.Entry(3) == nil, "Truncated entry is still there")
+	blob, _ := LogValEncEx(&entries[0], nil)
+	assert(t, pster.EntrySize(2) == uint64(len(blob)), "Bad entry size", pster.EntrySize(2))
+	assert(t, pster.EntrySize(3) == 0, "Size of a truncated entry", pster.EntrySize(3))
+}
+
+func TestWalContract(t *testing.T) { // {{{1
+	testutil.PersisterContractTest(t, func() raft.Persister {
+		dir := walTestDir(t)
+		pster := initWalPster(t, dir, 256) // small segments, to cross them
+		t.Cleanup(func() {
+			pster.Close()
+			os.RemoveAll(dir)
+		})
+		return pster
+	})
+}
+
+func TestWalRotation(t *testing.T) { // {{{1
+	dir := walTestDir(t)
+	defer os.RemoveAll(dir)
+	pster := initWalPster(t, dir, 256)
+
+	entries := walEntries(0, 40)
+	for idx := range entries {
+		assert(t, pster.LogUpdate(uint64(idx), entries[idx:idx+1]), "Failed to append", idx)
+	}
+	segs := walSegments(t, dir)
+	assert(t, len(segs) > 2, "Segments were not rotated", segs)
+	pster.Close()
+
+	pster = initWalPster(t, dir, 256)
+	defer pster.Close()
+	idx, entry := pster.LastEntry()
+	assert(t, idx == 39 && reflect.DeepEqual(entry, &entries[39]), "Bad tail after reopen", idx, entry)
+	for _, seg := range pster.segs {
+		e := pster.Entry(seg.first) // across segment boundaries
+		assert(t, reflect.DeepEqual(e, &entries[seg.first]), "Bad entry", seg.first, e)
+	}
+	slice, ok := pster.LogSlice(0, 40)
+	assert(t, ok && reflect.DeepEqual(slice, entries), "Bad slice after reopen")
+
+	// a batch larger than a segment is split into many
+	more := walEntries(40, 40)
+	assert(t, pster.LogUpdate(40, more), "Failed to append batch")
+	assert(t, len(walSegments(t, dir)) > len(segs)+2, "Batch did not rotate segments")
+	slice, ok = pster.LogSlice(35, 80)
+	assert(t, ok && reflect.DeepEqual(slice, append(entries[35:], more...)), "Bad slice")
+}
+
+func TestWalTruncation(t *testing.T) { // {{{1
+	dir := walTestDir(t)
+	defer os.RemoveAll(dir)
+	pster := initWalPster(t, dir, 256)
+	defer pster.Close()
+
+	entries := walEntries(0, 40)
+	for idx := range entries {
+		assert(t, pster.LogUpdate(uint64(idx), entries[idx:idx+1]), "Failed to append", idx)
+	}
+	nsegs := len(walSegments(t, dir))
+
+	// suffix truncation drops the later segments whole
+	second := pster.segs[1].first
+	assert(t, pster.LogUpdate(second, walEntries(second, 1)), "Failed to overwrite")
+	assert(t, len(walSegments(t, dir)) == 2, "Later segments not dropped", nsegs)
+	idx, _ := pster.LastEntry()
+	assert(t, idx == second, "Bad tail after truncation", idx)
+
+	for idx := second + 1; idx < 40; idx += 1 {
+		assert(t, pster.LogUpdate(idx, entries[idx:idx+1]), "Failed to append", idx)
+	}
+	nsegs = len(walSegments(t, dir))
+	third := pster.segs[2].first
+
+	// prefix truncation drops only the segments entirely before the index
+	first := pster.TruncatePrefix(third + 1)
+	assert(t, first == third, "Bad first index after prefix truncation", first)
+	assert(t, len(walSegments(t, dir)) == nsegs-2, "Earlier segments not dropped")
+	assert(t, pster.Entry(third-1) == nil, "Dropped entry is still there")
+	_, ok := pster.LogSlice(third-1, 40)
+	assert(t, !ok, "Slice of dropped entries")
+	slice, ok := pster.LogSlice(third, 40)
+	assert(t, ok && reflect.DeepEqual(slice, entries[third:]), "Bad slice after prefix truncation")
+	assert(t, !pster.LogUpdate(third-1, entries[third-1:third]), "Rewrote a dropped entry")
+
+	// the segment with the tail is always kept
+	first = pster.TruncatePrefix(100)
+	idx, entry := pster.LastEntry()
+	assert(t, first <= 39 && idx == 39 && reflect.DeepEqual(entry, &entries[39]),
+		"Tail was dropped", first, idx)
+
+	pster.Close()
+	pster = initWalPster(t, dir, 256)
+	assert(t, pster.first() == first, "Bad first index after reopen", pster.first())
+	pster.Close()
+}
+
+func TestWalRecovery(t *testing.T) { // {{{1
+	dir := walTestDir(t)
+	defer os.RemoveAll(dir)
+	pster := initWalPster(t, dir, 0)
+	entries := walEntries(0, 4)
+	assert(t, pster.LogUpdate(0, entries), "Failed to persist log entries")
+	pster.Close()
+
+	// simulate a crash in the middle of appending the last entry
+	seg := filepath.Join(dir, "00000000000000000000.wal")
+	info, err := os.Stat(seg)
+	assert(t, err == nil, err)
+	assert(t, os.Truncate(seg, info.Size()-1) == nil, "Truncate failed")
+
+	pster = initWalPster(t, dir, 0)
+	defer pster.Close()
+	idx, entry := pster.LastEntry()
+	assert(t, idx == 2 && reflect.DeepEqual(entry, &entries[2]), "Torn entry was not dropped", idx)
+	assert(t, pster.LogUpdate(3, entries[3:]), "Failed to append after recovery")
+	slice, ok := pster.LogSlice(0, 4)
+	assert(t, ok && reflect.DeepEqual(slice, entries), "Bad slice after recovery")
+}
+
+func TestWalChecksum(t *testing.T) { // {{{1
+	dir := walTestDir(t)
+	defer os.RemoveAll(dir)
+	pster := initWalPster(t, dir, 0)
+	assert(t, pster.LogUpdate(0, walEntries(0, 4)), "Failed to persist log entries")
+	crc := pster.CRC32()
+	assert(t, pster.VerifyIntegrity() == nil, "Fresh log failed verification")
+	pster.Close()
+
+	pster = initWalPster(t, dir, 0)
+	assert(t, pster.CRC32() == crc, "CRC32 changed on reopen", pster.CRC32(), crc)
+	pster.Close()
+
+	// a log without the checksums gets them on open
+	crcFile := filepath.Join(dir, "00000000000000000000.crc")
+	assert(t, os.Remove(crcFile) == nil, "Remove failed")
+	pster = initWalPster(t, dir, 0)
+	assert(t, pster.CRC32() == crc, "Bad CRC32 of a log without checksums", pster.CRC32(), crc)
+	pster.Close()
+
+	// flip a byte in the middle of the segment
+	seg := filepath.Join(dir, "00000000000000000000.wal")
+	blob, err := ioutil.ReadFile(seg)
+	assert(t, err == nil, err)
+	blob[len(blob)/2] ^= 0xff
+	assert(t, ioutil.WriteFile(seg, blob, 0660) == nil, "WriteFile failed")
+	errlog := log.New(os.Stderr, "-- ", log.Lshortfile)
+	_, err = NewWalPster(dir, WalOpts{}, errlog)
+	assert(t, err != nil && strings.Contains(err.Error(), "Checksum mismatch"), "Corruption not detected", err)
+}
+
+func TestWalSnapshots(t *testing.T) { // {{{1
+	dir := walTestDir(t)
+	defer os.RemoveAll(dir)
+	pster := initWalPster(t, dir, 0)
+
+	_, ok := pster.LoadSnapshot(1, 10)
+	assert(t, !ok, "Loaded a missing snapshot")
+	assert(t, pster.SaveSnapshot(1, 10, []byte("old")), "Failed to save snapshot")
+	assert(t, pster.SaveSnapshot(2, 20, []byte("new")), "Failed to save snapshot")
+	pster.Close()
+
+	pster = initWalPster(t, dir, 0)
+	defer pster.Close()
+	data, ok := pster.LoadSnapshot(1, 10)
+	assert(t, ok && string(data) == "old", "Older snapshot was lost", string(data))
+	data, ok = pster.LoadSnapshot(2, 20)
+	assert(t, ok && string(data) == "new", "Bad snapshot", string(data))
+	assert(t, pster.DropSnapshot(1, 10), "Failed to drop snapshot")
+	_, ok = pster.LoadSnapshot(1, 10)
+	assert(t, !ok, "Dropped snapshot is still there")
+	assert(t, !pster.DropSnapshot(1, 10), "Dropped a missing snapshot")
+}
+
+func TestWalCompression(t *testing.T) { // {{{1
+	var entries []raft.RaftEntry
+	for idx := uint64(0); idx < 8; idx += 1 {
+		entries = append(entries, raft.RaftEntry{
+			Term:   1,
+			CEntry: &raft.ClientEntry{UID: 1000 + idx, Data: strings.Repeat("compressible ", 100)},
+		})
+	}
+	walSize := func(comp Compressor) int64 {
+		dir := walTestDir(t)
+		defer os.RemoveAll(dir)
+		errlog := log.New(os.Stderr, "-- ", log.Lshortfile)
+		pster, err := NewWalPster(dir, WalOpts{Compressor: comp}, errlog)
+		assert(t, err == nil, err)
+		assert(t, pster.LogUpdate(0, entries), "Failed to persist log entries")
+		pster.Close()
+
+		pster, err = NewWalPster(dir, WalOpts{Compressor: comp}, errlog)
+		assert(t, err == nil, err)
+		defer pster.Close()
+		slice, ok := pster.LogSlice(0, 8)
+		assert(t, ok && reflect.DeepEqual(slice, entries), "Bad slice after reopen")
+		info, err := os.Stat(filepath.Join(dir, "00000000000000000000.wal"))
+		assert(t, err == nil, err)
+		return info.Size()
+	}
+	plain, compressed := walSize(nil), walSize(FlateCompressor{flate.BestSpeed})
+	assert(t, compressed < plain/4, "Not compressed enough", compressed, plain)
+}
+
+func TestWalGroupCommit(t *testing.T) { // {{{1
+	dir := walTestDir(t)
+	defer os.RemoveAll(dir)
+	pster := initWalPster(t, dir, 256) // so that a flush syncs several segments
+	pster.SetGroupCommit(time.Millisecond)
+	assert(t, pster.LogUpdate(0, walEntries(0, 1)), "Failed to persist log entry")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert(t, pster.LogUpdate(1, walEntries(1, 16)), "Failed to persist log entries")
+		}()
+	}
+	wg.Wait()
+	pster.mutex.Lock()
+	assert(t, len(pster.dirty) == 0, "Segments left unsynced", len(pster.dirty))
+	pster.mutex.Unlock()
+	pster.Close()
+
+	pster = initWalPster(t, dir, 256)
+	defer pster.Close()
+	slice, ok := pster.LogSlice(0, 17)
+	assert(t, ok && reflect.DeepEqual(slice, walEntries(0, 17)), "Bad slice after reopen")
+}
+
+// Appending one entry at a time, as a follower does (with SyncBeforeReply,
+// every append is followed by an Fsync). Runs in $WAL_BENCH_DIR if set, so
+// that disks can be compared (e.g. an NVMe and a rotational one).
+func benchWalAppend(b *testing.B, syncBeforeReply bool) {
+	dir, err := ioutil.TempDir(os.Getenv("WAL_BENCH_DIR"), "benchwal")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	errlog := log.New(os.Stderr, "-- ", log.Lshortfile)
+	pster, err := NewWalPster(dir, WalOpts{}, errlog)
+	if err != nil {
+		b.Fatal("Creating persister failed:", err)
+	}
+	defer pster.Close()
+	entries := walEntries(0, 1)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !pster.LogUpdate(uint64(i), entries) {
+			b.Fatal("Failed to persist log entry")
+		}
+		if syncBeforeReply {
+			if err := pster.Fsync(); err != nil {
+				b.Fatal("Fsync failed:", err)
+			}
+		}
+	}
+}
+
+func BenchmarkWalAppend(b *testing.B)                { benchWalAppend(b, false) }
+func BenchmarkWalAppendSyncBeforeReply(b *testing.B) { benchWalAppend(b, true) }
+
+// 1000 concurrent single-entry writers, each waiting for its entry to be
+// durable; with group commit, a single flush makes all of them durable
+func benchWalConcurrent(b *testing.B, groupCommit time.Duration) {
+	dir, err := ioutil.TempDir(os.Getenv("WAL_BENCH_DIR"), "benchwal")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	errlog := log.New(os.Stderr, "-- ", log.Lshortfile)
+	pster, err := NewWalPster(dir, WalOpts{}, errlog)
+	if err != nil {
+		b.Fatal("Creating persister failed:", err)
+	}
+	defer pster.Close()
+	pster.SetGroupCommit(groupCommit)
+	entries := walEntries(0, 1)
+	if !pster.LogUpdate(0, entries) {
+		b.Fatal("Failed to persist log entry")
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for j := 0; j < 1000; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if !pster.LogUpdate(1, entries) {
+					b.Error("Failed to persist log entry")
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func BenchmarkWalConcurrent(b *testing.B)            { benchWalConcurrent(b, 0) }
+func BenchmarkWalConcurrentGroupCommit(b *testing.B) { benchWalConcurrent(b, time.Millisecond) }
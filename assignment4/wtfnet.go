@@ -12,6 +12,7 @@ type WtfPush struct { // {{{1
 	addr   *net.TCPAddr
 	conn   *net.TCPConn
 	pushch chan []byte
+	quit   chan struct{} // closed by Close
 }
 
 func NewWtfPush(straddr string) (*WtfPush, error) {
@@ -23,6 +24,7 @@ func NewWtfPush(straddr string) (*WtfPush, error) {
 		addr:   addr,
 		conn:   nil,
 		pushch: make(chan []byte),
+		quit:   make(chan struct{}),
 	}, nil
 }
 
@@ -34,10 +36,25 @@ func (self *WtfPush) Push(blob []byte) {
 	}
 }
 
-// the push loop (forever and ever)
+// Stop the push loop once the blob being sent (if any) is sent, and close the
+// connection; later pushes are discarded
+func (self *WtfPush) Close() {
+	close(self.quit)
+}
+
+// the push loop (until Close)
 func (self *WtfPush) Run() {
 	for {
-		blob := <-self.pushch
+		var blob []byte
+		select {
+		case blob = <-self.pushch:
+		case <-self.quit:
+			if self.conn != nil {
+				_ = self.conn.Close()
+				self.conn = nil
+			}
+			return
+		}
 		if self.conn == nil {
 			conn, err := net.DialTCP("tcp", nil, self.addr)
 			if err == nil {